@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	deletedPlayerDisplayName = "Deleted player"
+	deletedOwnerReason       = "the organizer deleted their account"
+)
+
+// AccountExport is everything kept about a user, as returned by GET /me/export
+type AccountExport struct {
+	ExportedAt    time.Time      `json:"exportedAt"`
+	Profile       UserProfile    `json:"profile"`
+	OwnedGames    []Game         `json:"ownedGames"`
+	Registrations []Registration `json:"registrations"`
+	OwnedSeries   []Series       `json:"ownedSeries"`
+	// SeriesSubscriptions are the IDs of the series the user is subscribed to
+	SeriesSubscriptions []string `json:"seriesSubscriptions"`
+	// Payments are the user's charges, refunds and venue split shares on every game
+	Payments []LedgerEntry `json:"payments"`
+}
+
+// Registration is the user's place on a game they signed up for
+type Registration struct {
+	GameID     string      `json:"gameId"`
+	Name       string      `json:"name"`
+	Category   string      `json:"category"`
+	Location   string      `json:"location"`
+	StartTime  time.Time   `json:"startTime"`
+	GameStatus GameStatus  `json:"gameStatus"`
+	Role       GameRole    `json:"role"`
+	Entry      RosterEntry `json:"entry"`
+}
+
+// ExportAccount gathers the requester's profile, games, registrations, series and payments
+func (h *Handler) ExportAccount(ctx context.Context, requester string) (AccountExport, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "ExportAccount").Str("requester", requester).Logger()
+	logger.Info().Msg("exporting account")
+	profileRecord, err := h.getUserProfileRecord(ctx, requester)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export := AccountExport{
+		ExportedAt:          h.now().UTC().Truncate(time.Second),
+		Profile:             userProfileFromRecord(profileRecord),
+		Registrations:       []Registration{},
+		OwnedSeries:         []Series{},
+		SeriesSubscriptions: []string{},
+	}
+	ownedGames, err := h.allGamesByUser(ctx, requester, GameRoleOwner)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	if export.OwnedGames, err = h.presentGames(ctx, requester, ownedGames); err != nil {
+		return AccountExport{}, err
+	}
+	for _, role := range []GameRole{GameRolePlayer, GameRoleWaitList} {
+		gameRecords, err := h.allGamesByUser(ctx, requester, role)
+		if err != nil {
+			return AccountExport{}, err
+		}
+		for _, gameRecord := range gameRecords {
+			players := gameRecord.Roster
+			if role == GameRoleWaitList {
+				players = gameRecord.WaitList
+			}
+			entry := players[indexOfPlayer(players, requester)]
+			entry.PlayerID = h.PlayerIDs.PlayerID(requester)
+			export.Registrations = append(export.Registrations, Registration{
+				GameID:     gameRecord.GameID,
+				Name:       gameRecord.Name,
+				Category:   gameRecord.Category,
+				Location:   gameRecord.Location,
+				StartTime:  time.Unix(gameRecord.StartTime, 0).UTC(),
+				GameStatus: gameRecord.GameStatus(),
+				Role:       role,
+				Entry:      entry,
+			})
+		}
+	}
+	seriesRecords, err := h.SeriesStore.ListSeries(ctx)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	for _, seriesRecord := range seriesRecords {
+		if seriesRecord.Owner == requester {
+			series, err := h.presentSeries(ctx, requester, seriesRecord)
+			if err != nil {
+				return AccountExport{}, err
+			}
+			export.OwnedSeries = append(export.OwnedSeries, series)
+		}
+		if containsPlayer(seriesRecord.Subscribers, requester) {
+			export.SeriesSubscriptions = append(export.SeriesSubscriptions, seriesRecord.SeriesID)
+		}
+	}
+	if export.Payments, err = h.Payments.GetLedgerEntriesByUser(ctx, requester); err != nil {
+		return AccountExport{}, err
+	}
+	return export, nil
+}
+
+// DeleteAccount removes the requester. They're dropped from upcoming games, with the waitlist
+// promoted as for DropFromGame, and replaced by an anonymous ID wherever a game or payment still
+// records them.
+// Upcoming games they own are cancelled and their series ended. The identity provider user goes
+// last so that a request that fails part way can be retried with the same token.
+func (h *Handler) DeleteAccount(ctx context.Context, requester string) error {
+	logger := log.Ctx(ctx).With().Str("operation", "DeleteAccount").Str("requester", requester).Logger()
+	logger.Info().Msg("deleting account")
+	// one ID for all of the user's records keeps them consistent with each other without
+	// linking them to the email
+	anonymousID := "deleted-" + uuid.New().String()
+	now := h.now().Unix()
+	seriesRecords, err := h.SeriesStore.ListSeries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, seriesRecord := range seriesRecords {
+		if containsPlayer(seriesRecord.Subscribers, requester) {
+			if _, err := h.UnsubscribeFromSeries(ctx, seriesRecord.SeriesID, requester); err != nil {
+				return err
+			}
+		}
+		if seriesRecord.Owner == requester {
+			if err := h.endDeletedOwnersSeries(ctx, seriesRecord.SeriesID, requester, anonymousID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, role := range []GameRole{GameRoleOwner, GameRolePlayer, GameRoleWaitList} {
+		gameRecords, err := h.allGamesByUser(ctx, requester, role)
+		if err != nil {
+			return err
+		}
+		for _, gameRecord := range gameRecords {
+			upcoming := gameRecord.StartTime > now && gameRecord.GameStatus() != GameStatusCancelled
+			if upcoming && role != GameRoleOwner {
+				if _, err := h.DropFromGame(ctx, gameRecord.GameID, requester); err != nil {
+					return err
+				}
+				// the game's roster changes and promo redemptions still name them
+			}
+			if err := h.anonymizeGame(ctx, gameRecord.GameID, requester, anonymousID, now); err != nil {
+				return err
+			}
+		}
+	}
+	// after the games, so the refunds for the ones they dropped are anonymized too
+	if err := h.anonymizeLedgerEntries(ctx, requester, anonymousID); err != nil {
+		return err
+	}
+	if err := h.UserProfiles.DeleteUserProfile(ctx, requester); err != nil {
+		return err
+	}
+	if err := h.IdentityProvider.DeleteUser(ctx, requester); err != nil {
+		return err
+	}
+	logger.Info().Msg("deleted account")
+	return nil
+}
+
+// allGamesByUser returns every game, cancelled or not, that the user holds role in
+func (h *Handler) allGamesByUser(ctx context.Context, user string, role GameRole) ([]GameRecord, error) {
+	query := UserGameQuery{
+		User:             user,
+		Role:             role,
+		From:             0,
+		To:               math.MaxInt64,
+		Limit:            maxGamesPageSize,
+		IncludeCancelled: true,
+	}
+	gameRecords := []GameRecord{}
+	for {
+		gamePage, err := h.GameStore.GetGamesByUser(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		gameRecords = append(gameRecords, gamePage.Games...)
+		if gamePage.NextCursor == "" {
+			return gameRecords, nil
+		}
+		query.Cursor = gamePage.NextCursor
+	}
+}
+
+// anonymizeGame replaces the deleted user with anonymousID on the game. If they owned it and it
+// hasn't happened yet, it's cancelled and its players are told.
+func (h *Handler) anonymizeGame(ctx context.Context, gameID string, userID string, anonymousID string, now int64) error {
+	for attempt := 1; ; attempt++ {
+		gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+		if errors.Is(err, errGameNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		expectedVersion := gameRecord.Version
+		cancelled := false
+		if gameRecord.Owner == userID {
+			gameRecord.Owner = anonymousID
+			if gameRecord.StartTime > now && gameRecord.GameStatus() != GameStatusCancelled {
+				gameRecord.Status = GameStatusCancelled
+				gameRecord.CancellationReason = deletedOwnerReason
+				cancelled = true
+			}
+		}
+		for _, players := range [][]RosterEntry{gameRecord.Roster, gameRecord.WaitList} {
+			for i := range players {
+				if players[i].UserID == userID {
+					players[i].UserID = anonymousID
+					players[i].DisplayName = deletedPlayerDisplayName
+				}
+				if players[i].GuestOf == userID {
+					players[i].GuestOf = anonymousID
+				}
+			}
+		}
+		for i := range gameRecord.PromoRedemptions {
+			if gameRecord.PromoRedemptions[i].UserID == userID {
+				gameRecord.PromoRedemptions[i].UserID = anonymousID
+			}
+		}
+		for i := range gameRecord.RosterChanges {
+			if gameRecord.RosterChanges[i].Actor == userID {
+				gameRecord.RosterChanges[i].Actor = anonymousID
+			}
+			if gameRecord.RosterChanges[i].Player == userID {
+				gameRecord.RosterChanges[i].Player = anonymousID
+			}
+		}
+		updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
+		if errors.Is(err, errConditionFailed) && attempt < maxGameUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update game: %w", err)
+		}
+		if cancelled {
+			h.notifyGameCancelled(ctx, updatedGame)
+			if err := h.refundCancelledGame(ctx, updatedGame); err != nil {
+				log.Ctx(ctx).Error().Err(err).Str("gameID", gameID).Msg("failed to refund cancelled game")
+			}
+		}
+		return nil
+	}
+}
+
+// anonymizeLedgerEntries replaces the deleted user with anonymousID on their payments. Amounts
+// and statuses are kept, the owners' books still have to add up.
+func (h *Handler) anonymizeLedgerEntries(ctx context.Context, userID string, anonymousID string) error {
+	entries, err := h.Payments.GetLedgerEntriesByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entry.UserID = anonymousID
+		if err := h.Payments.PutLedgerEntry(ctx, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endDeletedOwnersSeries stops the series creating more games and hands it to anonymousID. The
+// games it already created are cancelled along with the owner's other games.
+func (h *Handler) endDeletedOwnersSeries(ctx context.Context, seriesID string, userID string, anonymousID string) error {
+	for attempt := 1; ; attempt++ {
+		seriesRecord, err := h.SeriesStore.GetSeries(ctx, seriesID)
+		if err != nil {
+			return err
+		}
+		if seriesRecord.Owner != userID {
+			return nil
+		}
+		expectedVersion := seriesRecord.Version
+		seriesRecord.Owner = anonymousID
+		// Until is the last start time materialization may reach, and 0 would mean no end
+		seriesRecord.Until = seriesRecord.MaterializedThrough
+		if seriesRecord.Until == 0 {
+			seriesRecord.Until = 1
+		}
+		_, err = h.SeriesStore.ReplaceSeries(ctx, seriesRecord, expectedVersion)
+		if errors.Is(err, errSeriesConditionFailed) && attempt < maxOccurrenceUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update series: %w", err)
+		}
+		return nil
+	}
+}
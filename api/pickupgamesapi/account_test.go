@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (h *testHandler) exportAccount(t *testing.T, requester string) AccountExport {
+	t.Helper()
+	var export AccountExport
+	h.mustCall(t, testRequest{RouteKey: "GET /me/export", Requester: requester}, &export)
+	return export
+}
+
+func (h *testHandler) deleteAccount(t *testing.T, requester string) {
+	t.Helper()
+	h.mustCall(t, testRequest{RouteKey: "DELETE /me", Requester: requester}, nil)
+}
+
+// paidGame creates a game with a signup fee that player has registered for and paid
+func (h *testHandler) paidGame(t *testing.T, player string) Game {
+	t.Helper()
+	body := newTestGame("soccer", 72*time.Hour, 1, 5)
+	body["signupFeeCents"] = 1000
+	game := h.createGame(t, "owner@example.com", body)
+	h.register(t, game.GameID, player)
+	if response := h.pay(t, game.GameID, player, "pm_card_visa"); response.StatusCode != http.StatusOK {
+		t.Fatalf("paying returned %d: %s", response.StatusCode, response.Body)
+	}
+	return game
+}
+
+func TestExportAccountIncludesPayments(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	game := h.paidGame(t, "a@example.com")
+	h.paidGame(t, "b@example.com")
+
+	export := h.exportAccount(t, "a@example.com")
+	if len(export.Payments) != 1 {
+		t.Fatalf("expected the one charge, got %+v", export.Payments)
+	}
+	charge := export.Payments[0]
+	if charge.GameID != game.GameID || charge.UserID != "a@example.com" || charge.Kind != LedgerEntryCharge || charge.AmountCents != 1000 {
+		t.Errorf("got %+v", charge)
+	}
+}
+
+func TestDeleteAccountAnonymizesPayments(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	game := h.paidGame(t, "a@example.com")
+	h.paidGame(t, "b@example.com")
+
+	// dropping out of the upcoming game refunds the charge, and both are anonymized
+	h.deleteAccount(t, "a@example.com")
+	entries := h.ledger(t, game.GameID, "owner@example.com")
+	if len(entries) != 2 || refundsFor(entries) != 1 {
+		t.Fatalf("expected the charge and its refund, got %+v", entries)
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.UserID, "deleted-") || entry.UserID != entries[0].UserID {
+			t.Errorf("expected one anonymous ID on every entry, got %+v", entries)
+		}
+	}
+	if entries[0].AmountCents != 1000 || entries[1].AmountCents != 1000 {
+		t.Errorf("expected the amounts kept, got %+v", entries)
+	}
+	remaining, err := h.Payments.GetLedgerEntriesByUser(context.Background(), "a@example.com")
+	if err != nil || len(remaining) != 0 {
+		t.Errorf("expected no entries left under the email, got %+v %v", remaining, err)
+	}
+	if others, _ := h.Payments.GetLedgerEntriesByUser(context.Background(), "b@example.com"); len(others) != 1 {
+		t.Errorf("other players' payments were touched: %+v", others)
+	}
+}
+
+func TestDeleteAccountAnonymizesPromoRedemptions(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	var gameIDs []string
+	for _, startsIn := range []time.Duration{2 * time.Hour, 72 * time.Hour} {
+		body := newTestGame("soccer", startsIn, 1, 5)
+		body["signupFeeCents"] = 1000
+		body["promoCodes"] = []map[string]interface{}{{"code": "FRIENDS", "percentOff": 50}}
+		game := h.createGame(t, "owner@example.com", body)
+		response := h.call(t, testRequest{
+			RouteKey:       "POST /games/{gameID}/registrtation",
+			Requester:      "a@example.com",
+			PathParameters: map[string]string{"gameID": game.GameID},
+			Body:           RegistrationRequest{PromoCode: "friends"},
+		}, nil)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("registering with the promo code returned %d: %s", response.StatusCode, response.Body)
+		}
+		gameIDs = append(gameIDs, game.GameID)
+	}
+	// the first game has been played by the time they leave, the second is still to come
+	h.clock.Advance(3 * time.Hour)
+	h.deleteAccount(t, "a@example.com")
+
+	for _, gameID := range gameIDs {
+		gameRecord, err := h.GameStore.GetGame(context.Background(), gameID)
+		if err != nil {
+			t.Fatalf("failed to get game: %v", err)
+		}
+		if len(gameRecord.PromoRedemptions) != 1 || !strings.HasPrefix(gameRecord.PromoRedemptions[0].UserID, "deleted-") {
+			t.Errorf("expected the redemption anonymized, got %+v", gameRecord.PromoRedemptions)
+		}
+		for _, change := range gameRecord.RosterChanges {
+			if change.Actor == "a@example.com" || change.Player == "a@example.com" {
+				t.Errorf("roster change still names the user: %+v", change)
+			}
+		}
+	}
+}
+
+func TestExportAccountListsGamesAndRegistrations(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	h.createUser(t, "b@example.com")
+	owned := h.createGame(t, "a@example.com", newTestGame("soccer", 96*time.Hour, 1, 5))
+	played := h.createGame(t, "owner@example.com", newTestGame("soccer", time.Hour, 1, 5))
+	playing := h.createGame(t, "owner@example.com", newTestGame("soccer", 24*time.Hour, 1, 5))
+	full := h.createGame(t, "owner@example.com", newTestGame("basketball", 48*time.Hour, 1, 1))
+	h.register(t, played.GameID, "a@example.com")
+	h.register(t, playing.GameID, "a@example.com")
+	h.register(t, full.GameID, "b@example.com")
+	h.register(t, full.GameID, "a@example.com")
+	h.clock.Advance(2 * time.Hour)
+
+	export := h.exportAccount(t, "a@example.com")
+	if export.Profile.UserID != "a@example.com" || export.Profile.FirstName != "Test" || !export.ExportedAt.Equal(h.clock.Now()) {
+		t.Errorf("got profile %+v exported at %v", export.Profile, export.ExportedAt)
+	}
+	if len(export.OwnedGames) != 1 || export.OwnedGames[0].GameID != owned.GameID || export.OwnedGames[0].Owner != "a@example.com" {
+		t.Errorf("expected the owned game, got %+v", export.OwnedGames)
+	}
+	var registrations []string
+	for _, registration := range export.Registrations {
+		registrations = append(registrations, registration.GameID+" "+string(registration.Role))
+		if registration.Entry.UserID != "a@example.com" || registration.Entry.PlayerID != h.PlayerIDs.PlayerID("a@example.com") {
+			t.Errorf("expected the user's own entry, got %+v", registration.Entry)
+		}
+	}
+	want := []string{played.GameID + " player", playing.GameID + " player", full.GameID + " waitlist"}
+	if !equalStrings(registrations, want) {
+		t.Errorf("expected the past and upcoming registrations %v, got %v", want, registrations)
+	}
+	if export := h.exportAccount(t, "b@example.com"); len(export.OwnedGames) != 0 || len(export.Registrations) != 1 {
+		t.Errorf("expected only b's registration, got %+v", export)
+	}
+}
+
+func TestDeleteAccountDropsUpcomingAndAnonymizesPast(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	played := h.createGame(t, "owner@example.com", newTestGame("soccer", time.Hour, 1, 5))
+	upcoming := h.createGame(t, "owner@example.com", newTestGame("soccer", 24*time.Hour, 1, 1))
+	ownedPlayed := h.createGame(t, "a@example.com", newTestGame("soccer", time.Hour, 1, 5))
+	ownedUpcoming := h.createGame(t, "a@example.com", newTestGame("soccer", 48*time.Hour, 1, 5))
+	h.register(t, played.GameID, "a@example.com")
+	h.register(t, upcoming.GameID, "a@example.com")
+	h.register(t, upcoming.GameID, "b@example.com")
+	h.register(t, ownedUpcoming.GameID, "c@example.com")
+	h.clock.Advance(2 * time.Hour)
+	h.deleteAccount(t, "a@example.com")
+
+	// the upcoming spot goes to the waitlist as if they'd dropped out
+	if got := h.getGame(t, upcoming.GameID, "owner@example.com"); !equalStrings(userIDs(got.Roster), []string{"b@example.com"}) || len(got.WaitList) != 0 {
+		t.Errorf("expected b promoted, got roster %v and waitlist %v", userIDs(got.Roster), userIDs(got.WaitList))
+	}
+	got := h.getGame(t, played.GameID, "owner@example.com")
+	if len(got.Roster) != 1 || !strings.HasPrefix(got.Roster[0].UserID, "deleted-") || got.Roster[0].DisplayName != deletedPlayerDisplayName {
+		t.Errorf("expected the played game's entry anonymized, got %+v", got.Roster)
+	}
+	anonymousID := got.Roster[0].UserID
+	for _, test := range []struct {
+		game          Game
+		wantCancelled bool
+	}{{ownedPlayed, false}, {ownedUpcoming, true}} {
+		gameRecord, err := h.GameStore.GetGame(context.Background(), test.game.GameID)
+		if err != nil {
+			t.Fatalf("failed to get game: %v", err)
+		}
+		if gameRecord.Owner != anonymousID || (gameRecord.GameStatus() == GameStatusCancelled) != test.wantCancelled {
+			t.Errorf("expected the owned game handed to %s, cancelled %v, got owner %s and status %s", anonymousID, test.wantCancelled, gameRecord.Owner, gameRecord.GameStatus())
+		}
+	}
+	if kinds := h.notifier.kinds("c@example.com"); len(kinds) != 1 || kinds[0] != NotificationKindGameCancelled {
+		t.Errorf("expected c told the owned game was cancelled, got %v", kinds)
+	}
+
+	for _, role := range []GameRole{GameRoleOwner, GameRolePlayer, GameRoleWaitList} {
+		if gameRecords, err := h.allGamesByUser(context.Background(), "a@example.com", role); err != nil || len(gameRecords) != 0 {
+			t.Errorf("expected no games left as %s, got %d %v", role, len(gameRecords), err)
+		}
+	}
+	if _, err := h.UserProfiles.GetUserProfile(context.Background(), "a@example.com"); !errors.Is(err, errUserProfileNotFound) {
+		t.Errorf("expected the profile deleted, got %v", err)
+	}
+	if _, err := h.identity.GetUser(context.Background(), "a@example.com"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("expected the identity provider user deleted, got %v", err)
+	}
+}
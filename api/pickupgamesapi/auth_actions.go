@@ -2,21 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"pickupgamesapi/types"
+	"strconv"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
-	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
 	"github.com/rs/zerolog/log"
 )
 
 type User struct {
-	Email       string `json:"email"`
-	FirstName   string `json:"firstName"`
-	LastName    string `json:"lastName"`
-	PhoneNumber string `json:"phoneNumber"`
+	Email               string `json:"email"`
+	FirstName           string `json:"firstName"`
+	LastName            string `json:"lastName"`
+	PhoneNumber         string `json:"phoneNumber"`
+	EmailVerified       bool   `json:"emailVerified"`
+	PhoneNumberVerified bool   `json:"phoneNumberVerified"`
 }
 
 type SignInRequest struct {
@@ -24,6 +25,35 @@ type SignInRequest struct {
 	Password string `json:"password"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ConfirmForgotPasswordRequest struct {
+	Email       string `json:"email"`
+	Code        string `json:"code"`
+	NewPassword string `json:"newPassword"`
+}
+
+func (r *ConfirmForgotPasswordRequest) MissingFields() bool {
+	return r.Email == "" || r.Code == "" || r.NewPassword == ""
+}
+
+// VerifyRequest confirms an email or phone number. Without a code, a new code is sent instead.
+type VerifyRequest struct {
+	Email     string              `json:"email"`
+	Attribute VerificationPurpose `json:"attribute"`
+	Code      string              `json:"code"`
+}
+
+func (r *VerifyRequest) MissingFields() bool {
+	return r.Email == "" || (r.Attribute != VerificationPurposeEmail && r.Attribute != VerificationPurposePhoneNumber)
+}
+
 type SignInResponse struct {
 	AccessToken     string    `json:"accessToken"`
 	RefreshToken    string    `json:"refreshToken"`
@@ -33,79 +63,213 @@ type SignInResponse struct {
 
 func (h *Handler) SignUpUser(ctx context.Context, newUserRequest NewUserRequest) (User, error) {
 	log := log.Ctx(ctx).With().Str("operation", "SignUpUser").Logger()
-	// Use newUserRequest to AdminCreateUser in Cognito
-	adminCreateUserInput := &cognitoidentityprovider.AdminCreateUserInput{
-		UserPoolId: aws.String(h.userPoolID),
-		Username:   aws.String(newUserRequest.Email),
-		UserAttributes: []types.AttributeType{
-			{
-				Name:  aws.String("email"),
-				Value: aws.String(newUserRequest.Email),
-			},
-			{
-				Name:  aws.String("phone_number"),
-				Value: aws.String(newUserRequest.PhoneNumber),
-			},
-			{
-				Name:  aws.String("given_name"),
-				Value: aws.String(newUserRequest.FirstName),
-			},
-			{
-				Name:  aws.String("family_name"),
-				Value: aws.String(newUserRequest.LastName),
-			},
-		},
-		MessageAction: types.MessageActionTypeSuppress,
-	}
-	_, err := h.AWSCognitoClient.AdminCreateUser(ctx, adminCreateUserInput)
+	user, err := h.IdentityProvider.CreateUser(ctx, newUserRequest)
 	if err != nil {
-		return User{}, fmt.Errorf("error creating user: %w", err)
+		return User{}, err
 	}
 	log.Debug().Msg("successfully created user")
 	// set user's password
-	adminSetUserPasswordInput := &cognitoidentityprovider.AdminSetUserPasswordInput{
-		UserPoolId: aws.String(os.Getenv("USER_POOL_ID")),
-		Username:   aws.String(newUserRequest.Email),
-		Password:   aws.String(newUserRequest.Password),
-		Permanent:  true,
-	}
-	_, err = h.AWSCognitoClient.AdminSetUserPassword(ctx, adminSetUserPasswordInput)
+	err = h.IdentityProvider.SetPassword(ctx, newUserRequest.Email, newUserRequest.Password)
 	if err != nil {
-		return User{}, fmt.Errorf("error setting user password: %w", err)
+		return User{}, err
 	}
 	log.Debug().Msg("successfully set user password")
-	return User{
-		Email:       newUserRequest.Email,
-		FirstName:   newUserRequest.FirstName,
-		LastName:    newUserRequest.LastName,
-		PhoneNumber: newUserRequest.PhoneNumber,
-	}, nil
+	// the identity provider has the user's details too, so a profile that fails to save is
+	// rebuilt from there the first time it's read
+	if err := h.UserProfiles.PutUserProfile(ctx, h.newUserProfileRecord(user)); err != nil {
+		log.Error().Err(err).Msg("failed to save user profile")
+	}
+	// the account is usable without a verified email, so a failed send is left for /auth/verify to retry
+	if err := h.sendVerificationCode(ctx, user, VerificationPurposeEmail); err != nil {
+		log.Error().Err(err).Msg("failed to send email verification code")
+	}
+	return user, nil
 }
 
 func (h *Handler) SignInUser(ctx context.Context, signInRequest SignInRequest) (SignInResponse, error) {
 	log := log.Ctx(ctx).With().Str("operation", "SignInUser").Logger()
-	// Use signInRequest to initiate auth flow in Cognito
-	authFlow := types.AuthFlowTypeAdminNoSrpAuth
-	authParameters := map[string]string{
-		"USERNAME": signInRequest.Email,
-		"PASSWORD": signInRequest.Password,
-	}
-	adminInitiateAuthInput := &cognitoidentityprovider.AdminInitiateAuthInput{
-		UserPoolId:     aws.String(h.userPoolID),
-		ClientId:       aws.String(h.clientID),
-		AuthFlow:       authFlow,
-		AuthParameters: authParameters,
-	}
-	adminInitiateAuthOutput, err := h.AWSCognitoClient.AdminInitiateAuth(ctx, adminInitiateAuthInput)
+	signInResponse, err := h.IdentityProvider.Authenticate(ctx, signInRequest.Email, signInRequest.Password)
+	if err != nil {
+		return SignInResponse{}, err
+	}
+	log.Debug().Msg("successfully authenticated user")
+	return signInResponse, nil
+}
+
+func (h *Handler) RefreshTokens(ctx context.Context, refreshRequest RefreshRequest) (SignInResponse, error) {
+	log := log.Ctx(ctx).With().Str("operation", "RefreshTokens").Logger()
+	signInResponse, err := h.IdentityProvider.Refresh(ctx, refreshRequest.RefreshToken)
+	if err != nil {
+		return SignInResponse{}, err
+	}
+	log.Debug().Msg("successfully refreshed tokens")
+	return signInResponse, nil
+}
+
+func (h *Handler) SignOutUser(ctx context.Context, email string) error {
+	log := log.Ctx(ctx).With().Str("operation", "SignOutUser").Logger()
+	if err := h.IdentityProvider.SignOut(ctx, email); err != nil {
+		return err
+	}
+	if err := h.revokeIssuedTokens(ctx, email); err != nil {
+		return err
+	}
+	log.Debug().Msg("successfully signed out user")
+	return nil
+}
+
+// ForgotPassword sends a password reset code. Unknown emails are ignored so the response doesn't
+// reveal who has an account.
+func (h *Handler) ForgotPassword(ctx context.Context, forgotPasswordRequest ForgotPasswordRequest) error {
+	log := log.Ctx(ctx).With().Str("operation", "ForgotPassword").Logger()
+	user, err := h.IdentityProvider.GetUser(ctx, forgotPasswordRequest.Email)
+	if errors.Is(err, errUserNotFound) {
+		log.Debug().Msg("ignoring password reset for unknown user")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := h.sendVerificationCode(ctx, user, VerificationPurposePasswordReset); err != nil {
+		return err
+	}
+	log.Debug().Msg("sent password reset code")
+	return nil
+}
+
+// ConfirmForgotPassword sets a new password once the reset code checks out, then signs the user
+// out everywhere. Receiving the code also proves the user owns their email.
+func (h *Handler) ConfirmForgotPassword(ctx context.Context, confirmRequest ConfirmForgotPasswordRequest) error {
+	log := log.Ctx(ctx).With().Str("operation", "ConfirmForgotPassword").Logger()
+	err := checkVerificationCode(ctx, h.VerificationCodes, confirmRequest.Email, VerificationPurposePasswordReset, confirmRequest.Code, h.now())
 	if err != nil {
-		return SignInResponse{}, fmt.Errorf("error initiating auth flow: %w", err)
-	}
-	log.Debug().Msg("successfully initiated auth flow")
-	// return the tokens
-	return SignInResponse{
-		AccessToken:     *adminInitiateAuthOutput.AuthenticationResult.AccessToken,
-		RefreshToken:    *adminInitiateAuthOutput.AuthenticationResult.RefreshToken,
-		IDToken:         *adminInitiateAuthOutput.AuthenticationResult.IdToken,
-		TokenExpiration: time.Now().Add(time.Duration(adminInitiateAuthOutput.AuthenticationResult.ExpiresIn) * time.Second),
-	}, nil
+		return err
+	}
+	if err := h.IdentityProvider.SetPassword(ctx, confirmRequest.Email, confirmRequest.NewPassword); err != nil {
+		return err
+	}
+	if err := h.IdentityProvider.SignOut(ctx, confirmRequest.Email); err != nil {
+		return err
+	}
+	if err := h.revokeIssuedTokens(ctx, confirmRequest.Email); err != nil {
+		return err
+	}
+	if err := h.IdentityProvider.MarkVerified(ctx, confirmRequest.Email, VerificationPurposeEmail); err != nil {
+		log.Error().Err(err).Msg("failed to mark email verified")
+	}
+	log.Debug().Msg("reset user password")
+	return nil
+}
+
+// VerifyAttribute confirms the user's email or phone number, or sends a fresh code when the
+// request has none
+func (h *Handler) VerifyAttribute(ctx context.Context, verifyRequest VerifyRequest) error {
+	log := log.Ctx(ctx).With().Str("operation", "VerifyAttribute").Str("attribute", string(verifyRequest.Attribute)).Logger()
+	if verifyRequest.Code == "" {
+		user, err := h.IdentityProvider.GetUser(ctx, verifyRequest.Email)
+		if errors.Is(err, errUserNotFound) {
+			log.Debug().Msg("ignoring verification for unknown user")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return h.sendVerificationCode(ctx, user, verifyRequest.Attribute)
+	}
+	err := checkVerificationCode(ctx, h.VerificationCodes, verifyRequest.Email, verifyRequest.Attribute, verifyRequest.Code, h.now())
+	if err != nil {
+		return err
+	}
+	if err := h.IdentityProvider.MarkVerified(ctx, verifyRequest.Email, verifyRequest.Attribute); err != nil {
+		return err
+	}
+	log.Debug().Msg("verified user attribute")
+	return nil
+}
+
+// sendVerificationCode stores a new code for user and purpose and sends it by email, or by SMS
+// when verifying a phone number. Once the outstanding code is out of attempts or has been sent
+// maxVerificationSends times, nothing is sent until it expires. That isn't reported, as the
+// response would then reveal who has an account.
+func (h *Handler) sendVerificationCode(ctx context.Context, user User, purpose VerificationPurpose) error {
+	ttl := attributeCodeTTL
+	if purpose == VerificationPurposePasswordReset {
+		ttl = passwordResetCodeTTL
+	}
+	now := h.now()
+	code, verificationCode, err := newVerificationCode(user.Email, purpose, ttl, now)
+	if err != nil {
+		return err
+	}
+	previous, err := h.VerificationCodes.GetVerificationCode(ctx, user.Email, purpose)
+	if err != nil && !errors.Is(err, errVerificationCodeNotFound) {
+		return err
+	}
+	verificationCode, ok := verificationCode.reissue(previous, now)
+	if !ok {
+		log.Ctx(ctx).Warn().Str("purpose", string(purpose)).Msg("too many verification codes requested, not sending another")
+		return nil
+	}
+	if err := h.VerificationCodes.PutVerificationCode(ctx, verificationCode); err != nil {
+		return err
+	}
+	notification := Notification{
+		Kind:      NotificationKindVerification,
+		Channel:   NotificationChannelEmail,
+		Recipient: user.Email,
+		Subject:   "Verify your email",
+		Message:   fmt.Sprintf("Your Pick Up Games verification code is %s", code),
+		Data:      map[string]string{"code": code, "purpose": string(purpose)},
+	}
+	switch purpose {
+	case VerificationPurposePasswordReset:
+		notification.Kind = NotificationKindPasswordReset
+		notification.Subject = "Reset your password"
+		notification.Message = fmt.Sprintf("Your Pick Up Games password reset code is %s. It expires in %d minutes.", code, int(ttl.Minutes()))
+	case VerificationPurposePhoneNumber:
+		if user.PhoneNumber == "" {
+			return &types.InvalidRequestError{Message: "user has no phone number"}
+		}
+		notification.Channel = NotificationChannelSMS
+		notification.Recipient = user.PhoneNumber
+		notification.Subject = "Verify your phone number"
+	}
+	return h.Notifier.Notify(ctx, notification)
+}
+
+// revokeIssuedTokens records that the user signed out, revoking every token issued to them so far.
+// Identity providers only revoke refresh and access tokens, and API Gateway accepts an ID token on
+// its signature alone, so it's up to the handler to turn away the ones issued before this.
+func (h *Handler) revokeIssuedTokens(ctx context.Context, email string) error {
+	profileRecord, err := h.getUserProfileRecord(ctx, email)
+	if err != nil {
+		return err
+	}
+	profileRecord.SignedOutAt = h.now().Unix()
+	return h.UserProfiles.PutUserProfile(ctx, profileRecord)
+}
+
+// checkTokenNotRevoked refuses tokens issued before the user last signed out. Token times are in
+// whole seconds, so a token issued in the same second as the sign out is still accepted, which
+// lets the user sign straight back in.
+func (h *Handler) checkTokenNotRevoked(ctx context.Context, claims map[string]string) error {
+	email := claims["email"]
+	if email == "" {
+		return nil
+	}
+	issuedAt, err := strconv.ParseInt(claims["iat"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: token has no issue time", errInvalidToken)
+	}
+	profileRecord, err := h.UserProfiles.GetUserProfile(ctx, email)
+	if errors.Is(err, errUserProfileNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if issuedAt < profileRecord.SignedOutAt {
+		return fmt.Errorf("%w: token was issued before the user signed out", errInvalidToken)
+	}
+	return nil
 }
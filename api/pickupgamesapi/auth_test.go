@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// codesSent returns the verification codes sent to recipient, oldest first
+func (n *recordingNotifier) codesSent(recipient string) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	codes := []string{}
+	for _, notification := range n.notifications {
+		if code, ok := notification.Data["code"]; ok && notification.Recipient == recipient {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+func (h *testHandler) forgotPassword(t *testing.T, email string) {
+	t.Helper()
+	h.mustCall(t, testRequest{RouteKey: "POST /auth/forgot-password", Body: ForgotPasswordRequest{Email: email}}, nil)
+}
+
+func (h *testHandler) confirmForgotPassword(t *testing.T, email string, code string) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	return h.call(t, testRequest{
+		RouteKey: "POST /auth/confirm-forgot-password",
+		Body:     ConfirmForgotPasswordRequest{Email: email, Code: code, NewPassword: "NewPassword1!"},
+	}, nil)
+}
+
+// signIn gives the user created by createUser, who has no usable password yet, one and signs in
+func (h *testHandler) signIn(t *testing.T, email string) SignInResponse {
+	t.Helper()
+	if err := h.identity.SetPassword(context.Background(), email, "Password1!"); err != nil {
+		t.Fatalf("failed to set password: %v", err)
+	}
+	var signInResponse SignInResponse
+	h.mustCall(t, testRequest{RouteKey: "POST /auth/signin", Body: SignInRequest{Email: email, Password: "Password1!"}}, &signInResponse)
+	return signInResponse
+}
+
+func (h *testHandler) refresh(t *testing.T, refreshToken string) (SignInResponse, events.APIGatewayV2HTTPResponse) {
+	t.Helper()
+	var signInResponse SignInResponse
+	response := h.call(t, testRequest{RouteKey: "POST /auth/refresh", Body: RefreshRequest{RefreshToken: refreshToken}}, &signInResponse)
+	return signInResponse, response
+}
+
+// serveWithToken sends a request through serve mode, where the local provider verifies the bearer
+// token like API Gateway's authorizer, and returns the status code
+func (h *testHandler) serveWithToken(t *testing.T, method string, path string, token string) int {
+	t.Helper()
+	server := httptest.NewServer(&HTTPServer{Handler: h.Handler, TokenVerifier: h.identity})
+	defer server.Close()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// wrongCode is a code that isn't code
+func wrongCode(code string) string {
+	if code == "000000" {
+		return "000001"
+	}
+	return "000000"
+}
+
+func TestVerificationCodeLocksAfterMaxAttempts(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	h.forgotPassword(t, "a@example.com")
+	code := h.notifier.codesSent("a@example.com")[0]
+	for attempt := 1; attempt <= maxVerificationAttempts; attempt++ {
+		if response := h.confirmForgotPassword(t, "a@example.com", wrongCode(code)); response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("attempt %d returned %d: %s", attempt, response.StatusCode, response.Body)
+		}
+	}
+	if response := h.confirmForgotPassword(t, "a@example.com", code); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the right code refused once the attempts ran out, got %d", response.StatusCode)
+	}
+}
+
+func TestReissuedVerificationCodeKeepsAttempts(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	// a guess per code, reissuing in between, still runs out of attempts
+	for attempt := 1; attempt <= maxVerificationAttempts; attempt++ {
+		h.forgotPassword(t, "a@example.com")
+		codes := h.notifier.codesSent("a@example.com")
+		h.confirmForgotPassword(t, "a@example.com", wrongCode(codes[len(codes)-1]))
+	}
+	sent := len(h.notifier.codesSent("a@example.com"))
+	h.forgotPassword(t, "a@example.com")
+	if codes := h.notifier.codesSent("a@example.com"); len(codes) != sent {
+		t.Fatalf("expected no code sent while locked, got %d more", len(codes)-sent)
+	}
+	// the lock lasts until the last code expires
+	h.clock.Advance(passwordResetCodeTTL + time.Second)
+	h.forgotPassword(t, "a@example.com")
+	codes := h.notifier.codesSent("a@example.com")
+	if len(codes) != sent+1 {
+		t.Fatalf("expected a new code once the lock expired")
+	}
+	if response := h.confirmForgotPassword(t, "a@example.com", codes[len(codes)-1]); response.StatusCode != http.StatusOK {
+		t.Errorf("expected the new code accepted, got %d: %s", response.StatusCode, response.Body)
+	}
+}
+
+func TestVerificationCodeSendsAreLimited(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	for i := 0; i < maxVerificationSends+2; i++ {
+		h.forgotPassword(t, "a@example.com")
+	}
+	codes := h.notifier.codesSent("a@example.com")
+	if len(codes) != maxVerificationSends {
+		t.Fatalf("expected %d codes sent, got %d", maxVerificationSends, len(codes))
+	}
+	// the last code sent still works
+	if response := h.confirmForgotPassword(t, "a@example.com", codes[len(codes)-1]); response.StatusCode != http.StatusOK {
+		t.Errorf("expected the last code accepted, got %d: %s", response.StatusCode, response.Body)
+	}
+	// which resets the limit
+	h.forgotPassword(t, "a@example.com")
+	if len(h.notifier.codesSent("a@example.com")) != maxVerificationSends+1 {
+		t.Errorf("expected a code sent after the last one was used")
+	}
+}
+
+func TestForgotPasswordIgnoresUnknownEmail(t *testing.T) {
+	h := newTestHandler(t)
+	h.forgotPassword(t, "nobody@example.com")
+	if codes := h.notifier.codesSent("nobody@example.com"); len(codes) != 0 {
+		t.Errorf("expected nothing sent, got %v", codes)
+	}
+}
+
+func TestRefreshIssuesNewTokens(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	tokens := h.signIn(t, "a@example.com")
+	h.clock.Advance(localTokenLifetime + time.Minute)
+	if status := h.serveWithToken(t, http.MethodGet, "/me", tokens.IDToken); status != http.StatusUnauthorized {
+		t.Fatalf("expected the expired ID token refused, got %d", status)
+	}
+	refreshed, response := h.refresh(t, tokens.RefreshToken)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("refreshing returned %d: %s", response.StatusCode, response.Body)
+	}
+	if status := h.serveWithToken(t, http.MethodGet, "/me", refreshed.IDToken); status != http.StatusOK {
+		t.Errorf("expected the refreshed ID token accepted, got %d", status)
+	}
+	if _, response := h.refresh(t, "not-a-refresh-token"); response.StatusCode != http.StatusUnauthorized || errorCode(t, response) != "refresh_token_invalid" {
+		t.Errorf("expected an unknown refresh token refused, got %d: %s", response.StatusCode, response.Body)
+	}
+}
+
+func TestSignOutRevokesTokens(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	tokens := h.signIn(t, "a@example.com")
+	if status := h.serveWithToken(t, http.MethodPost, "/auth/signout", tokens.IDToken); status != http.StatusOK {
+		t.Fatalf("signing out returned %d", status)
+	}
+	if status := h.serveWithToken(t, http.MethodGet, "/me", tokens.IDToken); status != http.StatusUnauthorized {
+		t.Errorf("expected the ID token refused after signing out, got %d", status)
+	}
+	if _, response := h.refresh(t, tokens.RefreshToken); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the refresh token refused after signing out, got %d: %s", response.StatusCode, response.Body)
+	}
+	// signing straight back in works, even within the same second
+	tokens = h.signIn(t, "a@example.com")
+	if status := h.serveWithToken(t, http.MethodGet, "/me", tokens.IDToken); status != http.StatusOK {
+		t.Errorf("expected a new ID token accepted, got %d", status)
+	}
+}
+
+func TestSignOutRevokesTokensTheAuthorizerAccepts(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	// API Gateway only checks an ID token's signature, so it keeps passing on tokens issued
+	// before the user signed out until they expire
+	issuedAt := h.clock.Now()
+	h.clock.Advance(time.Minute)
+	h.mustCall(t, testRequest{RouteKey: "POST /auth/signout", Requester: "a@example.com", IssuedAt: issuedAt}, nil)
+	response := h.call(t, testRequest{RouteKey: "GET /me", Requester: "a@example.com", IssuedAt: issuedAt}, nil)
+	if response.StatusCode != http.StatusUnauthorized || errorCode(t, response) != "invalid_token" {
+		t.Errorf("expected a token issued before signing out refused, got %d: %s", response.StatusCode, response.Body)
+	}
+	h.clock.Advance(time.Second)
+	h.mustCall(t, testRequest{RouteKey: "GET /me", Requester: "a@example.com"}, nil)
+}
+
+func TestPasswordResetRevokesTokens(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	issuedAt := h.clock.Now()
+	h.clock.Advance(time.Minute)
+	h.forgotPassword(t, "a@example.com")
+	if response := h.confirmForgotPassword(t, "a@example.com", h.notifier.codesSent("a@example.com")[0]); response.StatusCode != http.StatusOK {
+		t.Fatalf("resetting the password returned %d: %s", response.StatusCode, response.Body)
+	}
+	if response := h.call(t, testRequest{RouteKey: "GET /me", Requester: "a@example.com", IssuedAt: issuedAt}, nil); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a token issued before the reset refused, got %d: %s", response.StatusCode, response.Body)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"pickupgamesapi/types"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// awsClient calls the AWS APIs the service only needs one action of, SES, SNS and Secrets
+// Manager, without pulling in a whole SDK module for each. Requests are signed with the
+// credentials cfg resolves, the Lambda's role when deployed.
+type awsClient struct {
+	cfg        aws.Config
+	signer     *v4.Signer
+	httpClient *http.Client
+	// endpoint is the base URL of the service, its regional endpoint unless a test replaces it
+	endpoint func(endpointPrefix string) string
+}
+
+func newAWSClient(cfg aws.Config) *awsClient {
+	return &awsClient{
+		cfg:        cfg,
+		signer:     v4.NewSigner(),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		endpoint: func(endpointPrefix string) string {
+			return fmt.Sprintf("https://%s.%s.amazonaws.com", endpointPrefix, cfg.Region)
+		},
+	}
+}
+
+// awsRequest is a call to one AWS API action
+type awsRequest struct {
+	// Service is the name requests are signed for, EndpointPrefix the host they're sent to
+	Service        string
+	EndpointPrefix string
+	Path           string
+	ContentType    string
+	// Target is the X-Amz-Target header of JSON protocol APIs
+	Target string
+	Body   []byte
+}
+
+// call sends the signed request and decodes a JSON response into out, when it's set
+func (c *awsClient) call(ctx context.Context, request awsRequest, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint(request.EndpointPrefix)+request.Path, bytes.NewReader(request.Body))
+	if err != nil {
+		return fmt.Errorf("failed to build %s request: %w", request.Service, err)
+	}
+	req.Header.Set("Content-Type", request.ContentType)
+	if request.Target != "" {
+		req.Header.Set("X-Amz-Target", request.Target)
+	}
+	credentials, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(request.Body)
+	err = c.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), request.Service, c.cfg.Region, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to sign %s request: %w", request.Service, err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &types.UpstreamUnavailableError{Service: request.Service, Err: err}
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return &types.UpstreamUnavailableError{Service: request.Service, Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("%s returned %d: %s", request.Service, resp.StatusCode, responseBody)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return &types.UpstreamUnavailableError{Service: request.Service, Err: err}
+		}
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(responseBody, out); err != nil {
+		return fmt.Errorf("failed to unmarshal %s response: %w", request.Service, err)
+	}
+	return nil
+}
+
+// getSecretValue reads the current value of the Secrets Manager secret with secretID, its ARN or name
+func (c *awsClient) getSecretValue(ctx context.Context, secretID string) (string, error) {
+	body, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal secret request: %w", err)
+	}
+	var secret struct {
+		SecretString string
+	}
+	err = c.call(ctx, awsRequest{
+		Service:        "secretsmanager",
+		EndpointPrefix: "secretsmanager",
+		Path:           "/",
+		ContentType:    "application/x-amz-json-1.1",
+		Target:         "secretsmanager.GetSecretValue",
+		Body:           body,
+	}, &secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %s: %w", secretID, err)
+	}
+	return secret.SecretString, nil
+}
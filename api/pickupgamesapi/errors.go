@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"pickupgamesapi/types"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// upstreamError marks err as an UpstreamUnavailableError when it is the kind of failure the AWS
+// SDK would retry (throttling, timeouts, connection errors and 5xx responses), so the client is
+// told to try again rather than receiving an opaque 500
+func upstreamError(service string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) ||
+		retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary {
+		return &types.UpstreamUnavailableError{Service: service, Err: err}
+	}
+	return err
+}
@@ -2,33 +2,35 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-type ErrorMessages string
-
-const (
-	ErrGameNotFound ErrorMessages = "game not found"
-)
-
 func (h *Handler) CreateGame(ctx context.Context, newGameRequest NewGameRequest) (Game, error) {
 	log := log.Ctx(ctx).With().Str("operation", "CreateGame").Logger()
 	log.Info().Interface("newGameRequest", newGameRequest).Msg("creating game")
 	// Use newGameRequest to create a new gameRecord
 	if newGameRequest.Roster == nil {
-		newGameRequest.Roster = []string{}
+		newGameRequest.Roster = []RosterEntry{}
 	}
 	if newGameRequest.WaitList == nil {
-		newGameRequest.WaitList = []string{}
+		newGameRequest.WaitList = []RosterEntry{}
+	}
+	// players the owner lists join as the game is created
+	now := h.now().UTC().Truncate(time.Second)
+	for _, players := range [][]RosterEntry{newGameRequest.Roster, newGameRequest.WaitList} {
+		for i := range players {
+			if players[i].JoinedAt == nil {
+				players[i].JoinedAt = &now
+			}
+			players[i].PlayerID, players[i].Hidden = "", false
+		}
 	}
 	gameRecord := GameRecord{
 		// set GameID to UUID
@@ -36,220 +38,451 @@ func (h *Handler) CreateGame(ctx context.Context, newGameRequest NewGameRequest)
 		GameID:    uuid.New().String(),
 		Owner:     newGameRequest.Requester,
 		StartTime: newGameRequest.StartTime.Unix(),
+		Status:    GameStatusScheduled,
 	}
-	// save game to DynamoDB
-	gameAttributeValue, err := attributevalue.MarshalMap(gameRecord)
-	if err != nil {
-		return Game{}, fmt.Errorf("failed to marshal game to attribute value: %w", err)
-	}
-	putItemInput := dynamodb.PutItemInput{
-		TableName: &h.pickupGamesTableName,
-		Item:      gameAttributeValue,
-	}
-	_, err = h.AWSDynamoDBClient.PutItem(ctx, &putItemInput)
+	// save game to the game store
+	err := h.GameStore.PutGame(ctx, gameRecord)
 	if err != nil {
-		return Game{}, fmt.Errorf("failed to put game to DynamoDB: %w", err)
+		return Game{}, err
 	}
-	return GameFromGameRecord(gameRecord), nil
+	return h.presentGame(ctx, newGameRequest.Requester, gameRecord)
 }
 
-func (h *Handler) GetGame(ctx context.Context, gameID string) (Game, error) {
+func (h *Handler) GetGame(ctx context.Context, gameID string, requester string) (Game, error) {
 	log := log.Ctx(ctx).With().Str("operation", "GetGame").Logger()
 	log.Info().Str("gameID", gameID).Msg("getting game")
-	getItemInput := dynamodb.GetItemInput{
-		TableName: &h.pickupGamesTableName,
-		Key:       map[string]ddbtypes.AttributeValue{"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID}},
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+	if err != nil {
+		return Game{}, err
+	}
+	return h.presentGame(ctx, requester, gameRecord)
+}
+
+// GetGames returns a page of the category's games. Cancelled games are left out unless the query
+// includes them.
+func (h *Handler) GetGames(ctx context.Context, query GameQuery, requester string) (GameList, error) {
+	log := log.Ctx(ctx).With().Str("operation", "GetGames").Logger()
+	log.Info().Interface("query", query).Msg("getting games")
+	gamePage, err := h.GameStore.GetGamesByCategory(ctx, query)
+	if err != nil {
+		return GameList{Games: []Game{}}, err
 	}
-	getItemOutput, err := h.AWSDynamoDBClient.GetItem(ctx, &getItemInput)
+	return h.presentGamePage(ctx, requester, gamePage)
+}
+
+// GetMyGames returns a page of the games the requester plays in, is waitlisted for or owns
+func (h *Handler) GetMyGames(ctx context.Context, query UserGameQuery) (GameList, error) {
+	log := log.Ctx(ctx).With().Str("operation", "GetMyGames").Logger()
+	log.Info().Str("role", string(query.Role)).Msg("getting the requester's games")
+	gamePage, err := h.GameStore.GetGamesByUser(ctx, query)
 	if err != nil {
-		return Game{}, fmt.Errorf("failed to get game from DynamoDB: %w", err)
+		return GameList{Games: []Game{}}, err
 	}
-	var gameRecord GameRecord
-	err = attributevalue.UnmarshalMap(getItemOutput.Item, &gameRecord)
+	return h.presentGamePage(ctx, query.User, gamePage)
+}
+
+func (h *Handler) presentGamePage(ctx context.Context, requester string, gamePage GamePage) (GameList, error) {
+	games, err := h.presentGames(ctx, requester, gamePage.Games)
 	if err != nil {
-		return Game{}, fmt.Errorf("failed to unmarshal game record: %w", err)
+		return GameList{Games: []Game{}}, err
 	}
-	return GameFromGameRecord(gameRecord), nil
+	return GameList{Games: games, NextCursor: gamePage.NextCursor}, nil
 }
 
-func (h *Handler) GetGames(ctx context.Context, category string) (GameList, error) {
-	log := log.Ctx(ctx).With().Str("operation", "GetGames").Logger()
-	log.Info().Str("category", category).Msg("getting games")
-	gameList := GameList{Games: []Game{}}
-	oneMonthFromNow := time.Now().Add(30 * 24 * time.Hour).Unix()
-	queryInput := dynamodb.QueryInput{
-		TableName:              &h.pickupGamesTableName,
-		IndexName:              aws.String("SortedCategoryIndex"),
-		KeyConditionExpression: aws.String("Category = :category AND StartTime BETWEEN :now AND :oneMonthFromNow"),
-		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
-			":category":        &ddbtypes.AttributeValueMemberS{Value: category},
-			":now":             &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
-			":oneMonthFromNow": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", oneMonthFromNow)},
-		},
-	}
-	getItemOutput, err := h.AWSDynamoDBClient.Query(ctx, &queryInput)
+// GetNearbyGames returns the scheduled games within the search radius, closest first. Only games
+// with a GeoLocation can be found.
+func (h *Handler) GetNearbyGames(ctx context.Context, request NearbyGamesRequest, requester string) (NearbyGameList, error) {
+	log := log.Ctx(ctx).With().Str("operation", "GetNearbyGames").Logger()
+	log.Info().Interface("request", request).Msg("getting nearby games")
+	gameRecords, err := h.GameStore.GetGamesInGeohashCells(ctx, GeoQuery{
+		Cells:    geohashCellsCovering(request.Lat, request.Lng, request.RadiusKm, geohashCellPrecision),
+		Category: request.Category,
+		From:     request.From,
+		To:       request.To,
+	})
 	if err != nil {
-		return gameList, fmt.Errorf("failed to get games from DynamoDB: %w", err)
+		return NearbyGameList{}, err
 	}
-	for _, item := range getItemOutput.Items {
-		var gameRecord GameRecord
-		err := attributevalue.UnmarshalMap(item, &gameRecord)
-		if err != nil {
-			return gameList, fmt.Errorf("failed to unmarshal game record: %w", err)
+	nearbyRecords := []GameRecord{}
+	distances := map[string]float64{}
+	for _, gameRecord := range gameRecords {
+		if gameRecord.GeoLocation == nil {
+			continue
 		}
-		gameList.Games = append(gameList.Games, GameFromGameRecord(gameRecord))
+		distance := distanceKm(request.Lat, request.Lng, gameRecord.GeoLocation.Lat, gameRecord.GeoLocation.Lng)
+		if distance <= request.RadiusKm {
+			nearbyRecords = append(nearbyRecords, gameRecord)
+			distances[gameRecord.GameID] = distance
+		}
+	}
+	sort.SliceStable(nearbyRecords, func(i, j int) bool {
+		if distances[nearbyRecords[i].GameID] != distances[nearbyRecords[j].GameID] {
+			return distances[nearbyRecords[i].GameID] < distances[nearbyRecords[j].GameID]
+		}
+		return nearbyRecords[i].StartTime < nearbyRecords[j].StartTime
+	})
+	if len(nearbyRecords) > request.Limit {
+		nearbyRecords = nearbyRecords[:request.Limit]
 	}
-	return gameList, nil
+	games, err := h.presentGames(ctx, requester, nearbyRecords)
+	if err != nil {
+		return NearbyGameList{}, err
+	}
+	nearbyGames := make([]NearbyGame, len(games))
+	for i, game := range games {
+		nearbyGames[i] = NearbyGame{Game: game, DistanceKm: distances[game.GameID]}
+	}
+	return NearbyGameList{Games: nearbyGames}, nil
 }
 
+// DropFromGame takes the requester off the game, promoting the front of the waitlist into their
+// spot, and refunds their signup fee under the game's refund policy
 func (h *Handler) DropFromGame(ctx context.Context, gameID string, requester string) (Game, error) {
 	logger := log.Ctx(ctx).With().Str("operation", "DropFromGame").Str("gameID", gameID).Str("requester", requester).Logger()
-	game, err := h.GetGame(ctx, gameID)
-	if err != nil {
-		if err.Error() == string(ErrGameNotFound) {
+	for attempt := 1; ; attempt++ {
+		game, err := h.GameStore.GetGame(ctx, gameID)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to get game")
 			return Game{}, err
 		}
-		logger.Error().Err(err).Msg("failed to get game")
-		return Game{}, fmt.Errorf("failed to get game: %w", err)
-	}
-	// remember original roster and waitlist size for condition check later
-	originalRosterSize := len(game.Roster)
-	originalWaitListSize := len(game.WaitList)
-	logger.Debug().Int("originalRosterSize", originalRosterSize).Int("originalWaitListSize", originalWaitListSize).Msg("original roster and waitlist size")
-	waitListLogArr := zerolog.Arr()
-	rosterLogArr := zerolog.Arr()
-	for _, player := range game.WaitList {
-		waitListLogArr.Str(player)
-	}
-	for _, player := range game.Roster {
-		rosterLogArr.Str(player)
-	}
-	logger.Debug().Array("roster", rosterLogArr).Array("waitlist", waitListLogArr).Msg("current roster and waitlist")
-	// check if requester is in waitlist
-	playerInWaitList := false
-	for i, player := range game.WaitList {
-		if player == requester {
+		if _, err := h.lockSplitIfDue(ctx, game); err != nil {
+			logger.Error().Err(err).Msg("failed to lock venue split")
+			return Game{}, err
+		}
+		// remember original version for condition check later
+		previousRoster := copyRosterEntries(game.Roster)
+		expectedVersion := game.Version
+		logger.Debug().Int("expectedVersion", expectedVersion).Msg("original version")
+		waitListLogArr := zerolog.Arr()
+		rosterLogArr := zerolog.Arr()
+		for _, player := range game.WaitList {
+			waitListLogArr.Str(player.UserID)
+		}
+		for _, player := range game.Roster {
+			rosterLogArr.Str(player.UserID)
+		}
+		logger.Debug().Array("roster", rosterLogArr).Array("waitlist", waitListLogArr).Msg("current roster and waitlist")
+		// check if requester is in waitlist
+		playerInWaitList := false
+		paid := false
+		if i := indexOfPlayer(game.WaitList, requester); i >= 0 {
 			// remove requester from waitlist
 			playerInWaitList = true
+			paid = game.WaitList[i].Paid
 			game.WaitList = append(game.WaitList[:i], game.WaitList[i+1:]...)
-			break
 		}
-	}
-	playerInRoster := false
-	// check if requester is in roster
-	for i, player := range game.Roster {
-		if player == requester {
+		playerInRoster := false
+		spotFilled := false
+		// check if requester is in roster
+		if i := indexOfPlayer(game.Roster, requester); i >= 0 {
 			// remove requester from roster
 			playerInRoster = true
+			paid = game.Roster[i].Paid
 			game.Roster = append(game.Roster[:i], game.Roster[i+1:]...)
 			// if there are players in waitlist, move the first one to roster
 			if len(game.WaitList) > 0 {
-				game.Roster = append(game.Roster, game.WaitList[0])
+				game.Roster = append(game.Roster, game.promotedEntry(game.WaitList[0], h.now()))
 				game.WaitList = game.WaitList[1:]
+				spotFilled = true
 			}
-			break
 		}
+		if !playerInWaitList && !playerInRoster {
+			return h.presentGame(ctx, requester, game)
+		}
+		// update roster and waitlist
+		updatedGame, err := h.GameStore.SetPlayerLists(ctx, gameID, game.Roster, game.WaitList, expectedVersion)
+		if errors.Is(err, errConditionFailed) && attempt < maxGameUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to update game")
+			return Game{}, fmt.Errorf("failed to update game: %w", err)
+		}
+		h.notifyNewHolds(ctx, previousRoster, updatedGame)
+		if paid {
+			// the player is off the game either way, so a refund that fails is left for the owner
+			if err := h.refundDroppedPlayer(ctx, updatedGame, requester, !playerInRoster, spotFilled); err != nil {
+				logger.Error().Err(err).Msg("failed to refund dropped player")
+			}
+		}
+		return h.presentGame(ctx, requester, updatedGame)
 	}
-	if !playerInWaitList && !playerInRoster {
-		return game, nil
+}
+
+// RegisterForGame adds the requester to the roster, or to the waitlist once the roster is full.
+// displayName is shown to other players. The player's price is fixed when they register, from the
+// game's price tiers and promoCode if they gave one. A spot on a game with a price to pay is held
+// for paymentHoldDuration, until the player pays with POST /games/{gameID}/registration/payment.
+func (h *Handler) RegisterForGame(ctx context.Context, gameID string, requester string, displayName string, promoCode string) (Game, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "RegisterForGame").Logger()
+	logger.Info().Str("gameID", gameID).Str("requester", requester).Str("promoCode", promoCode).Msg("registering for game")
+	for attempt := 1; ; attempt++ {
+		// get game
+		game, err := h.GameStore.GetGame(ctx, gameID)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to get game")
+			return Game{}, err
+		}
+		if game.GameStatus() == GameStatusCancelled {
+			return Game{}, errGameCancelled
+		}
+		// check if requester is already in roster or waitlist
+		if indexOfPlayer(game.Roster, requester) >= 0 || indexOfPlayer(game.WaitList, requester) >= 0 {
+			return h.presentGame(ctx, requester, game)
+		}
+		if _, err := h.lockSplitIfDue(ctx, game); err != nil {
+			logger.Error().Err(err).Msg("failed to lock venue split")
+			return Game{}, err
+		}
+		// add requester to roster or waitlist
+		relevantList := PlayerListRoster
+		if len(game.Roster) >= game.NumTeams*game.TeamSize {
+			relevantList = PlayerListWaitList
+		}
+		now := h.now()
+		entry := newRosterEntry(requester, displayName, now)
+		var redemption *PromoRedemption
+		if game.SignupFeeCents > 0 {
+			priceCents := game.currentPriceCents(now)
+			if promoCode != "" {
+				discountedCents, promoRedemption, err := game.redeemPromoCode(promoCode, requester, priceCents, now)
+				if err != nil {
+					return Game{}, err
+				}
+				priceCents = discountedCents
+				redemption = &promoRedemption
+				entry.PromoCode = promoRedemption.Code
+			}
+			entry.PriceCents = &priceCents
+		} else if promoCode != "" {
+			return Game{}, errNoSignupFeeToCut
+		}
+		if relevantList == PlayerListRoster && game.feeFor(entry) > 0 {
+			entry.Status = RegistrationStatusPendingPayment
+			entry.PaymentDueAt = game.holdUntil(now, paymentHoldDuration)
+		}
+		// the version check keeps the game from being overfilled, or joined once it's been
+		// cancelled, by requests racing this one
+		expectedVersion := game.Version
+		var updatedGame GameRecord
+		if redemption != nil {
+			// the redemption is recorded in the same write, which keeps it within the code's limits
+			if relevantList == PlayerListRoster {
+				game.Roster = append(game.Roster, entry)
+			} else {
+				game.WaitList = append(game.WaitList, entry)
+			}
+			game.PromoRedemptions = append(game.PromoRedemptions, *redemption)
+			updatedGame, err = h.GameStore.ReplaceGame(ctx, game, expectedVersion)
+		} else {
+			updatedGame, err = h.GameStore.AppendPlayer(ctx, gameID, relevantList, entry, expectedVersion)
+		}
+		if errors.Is(err, errConditionFailed) && attempt < maxGameUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			logger.Error().Err(err).Msgf("failed to update game")
+			return Game{}, fmt.Errorf("failed to update game: %w", err)
+		}
+		return h.presentGame(ctx, requester, updatedGame)
 	}
-	// update roster and waitlist
-	rosterList, err := attributevalue.MarshalList(game.Roster)
+}
+
+func (h *Handler) UpdateGame(ctx context.Context, gameID string, requester string, updateGameRequest UpdateGameRequest) (Game, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "UpdateGame").Str("gameID", gameID).Str("requester", requester).Logger()
+	logger.Info().Interface("updateGameRequest", updateGameRequest).Msg("updating game")
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
 	if err != nil {
-		logger.Error().Err(err).Msg("failed to marshal roster")
-		return Game{}, fmt.Errorf("failed to marshal roster: %w", err)
+		logger.Error().Err(err).Msg("failed to get game")
+		return Game{}, err
 	}
-	waitList, err := attributevalue.MarshalList(game.WaitList)
+	if gameRecord.Owner != requester {
+		return Game{}, errNotGameOwner
+	}
+	if gameRecord.GameStatus() == GameStatusCancelled {
+		return Game{}, errGameCancelled
+	}
+	if updateGameRequest.Version != nil && *updateGameRequest.Version != gameRecord.Version {
+		return Game{}, errConditionFailed
+	}
+	lockedShares, err := h.lockSplitIfDue(ctx, gameRecord)
 	if err != nil {
-		logger.Error().Err(err).Msg("failed to marshal waitlist")
-		return Game{}, fmt.Errorf("failed to marshal waitlist: %w", err)
-	}
-	updateItemInput := dynamodb.UpdateItemInput{
-		TableName: &h.pickupGamesTableName,
-		Key: map[string]ddbtypes.AttributeValue{
-			"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID},
-		},
-		UpdateExpression: aws.String("SET Roster = :roster, WaitList = :waitlist"),
-		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
-			":roster":              &ddbtypes.AttributeValueMemberL{Value: rosterList},
-			":waitlist":            &ddbtypes.AttributeValueMemberL{Value: waitList},
-			":currentRosterSize":   &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", originalRosterSize)},
-			":currentWaitListSize": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", originalWaitListSize)},
-		},
-		ReturnValues: "ALL_NEW",
-		// condition check on roster and waitlist length
-		ConditionExpression: aws.String("size(Roster) = :currentRosterSize AND size(WaitList) = :currentWaitListSize"),
-	}
-	returnValues, err := h.AWSDynamoDBClient.UpdateItem(ctx, &updateItemInput)
+		logger.Error().Err(err).Msg("failed to lock venue split")
+		return Game{}, err
+	}
+	if lockedShares != nil && (updateGameRequest.SplitFeeCents != nil || updateGameRequest.SplitLockHours != nil) {
+		return Game{}, errSplitLocked
+	}
+	expectedVersion := gameRecord.Version
+	previousRoster := copyRosterEntries(gameRecord.Roster)
+	applyGameUpdate(&gameRecord, updateGameRequest, h.now())
+	updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
 	if err != nil {
 		logger.Error().Err(err).Msg("failed to update game")
-		return Game{}, fmt.Errorf("failed to put game to DynamoDB: %w", err)
+		return Game{}, fmt.Errorf("failed to update game: %w", err)
+	}
+	h.notifyNewHolds(ctx, previousRoster, updatedGame)
+	return h.presentGame(ctx, requester, updatedGame)
+}
+
+// CancelGame marks the game cancelled, keeping the record and its players, lets everyone on the
+// roster and waitlist know and refunds their signup fees in full. Cancelling an already cancelled
+// game changes nothing.
+func (h *Handler) CancelGame(ctx context.Context, gameID string, requester string, reason string) (Game, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "CancelGame").Str("gameID", gameID).Str("requester", requester).Logger()
+	logger.Info().Str("reason", reason).Msg("cancelling game")
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get game")
+		return Game{}, err
+	}
+	if gameRecord.Owner != requester {
+		return Game{}, errNotGameOwner
 	}
-	var updatedGame GameRecord
-	err = attributevalue.UnmarshalMap(returnValues.Attributes, &updatedGame)
+	if gameRecord.GameStatus() == GameStatusCancelled {
+		return h.presentGame(ctx, requester, gameRecord)
+	}
+	expectedVersion := gameRecord.Version
+	gameRecord.Status = GameStatusCancelled
+	gameRecord.CancellationReason = reason
+	updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
 	if err != nil {
-		logger.Error().Err(err).Msg("failed to unmarshal game record")
-		return Game{}, fmt.Errorf("failed to unmarshal game record: %w", err)
+		logger.Error().Err(err).Msg("failed to update game")
+		return Game{}, fmt.Errorf("failed to update game: %w", err)
+	}
+	h.notifyGameCancelled(ctx, updatedGame)
+	if err := h.refundCancelledGame(ctx, updatedGame); err != nil {
+		logger.Error().Err(err).Msg("failed to refund cancelled game")
 	}
-	return GameFromGameRecord(updatedGame), nil
+	return h.presentGame(ctx, requester, updatedGame)
 }
 
-func (h *Handler) RegisterForGame(ctx context.Context, gameID string, requester string) (Game, error) {
-	logger := log.Ctx(ctx).With().Str("operation", "RegisterForGame").Logger()
-	logger.Info().Str("gameID", gameID).Str("requester", requester).Msg("registering for game")
-	// get game
-	game, err := h.GetGame(ctx, gameID)
+// DeleteGame removes the game entirely. If it hadn't started players are notified and refunded as
+// for a cancellation, unless the game had already been cancelled, in which case they've been told.
+// Deleting a game that's been played is only tidying up, so nobody hears about it.
+func (h *Handler) DeleteGame(ctx context.Context, gameID string, requester string) error {
+	logger := log.Ctx(ctx).With().Str("operation", "DeleteGame").Str("gameID", gameID).Str("requester", requester).Logger()
+	logger.Info().Msg("deleting game")
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
 	if err != nil {
-		if err.Error() == string(ErrGameNotFound) {
-			return Game{}, err
+		logger.Error().Err(err).Msg("failed to get game")
+		return err
+	}
+	if gameRecord.Owner != requester {
+		return errNotGameOwner
+	}
+	if err := h.GameStore.DeleteGame(ctx, gameID); err != nil {
+		logger.Error().Err(err).Msg("failed to delete game")
+		return fmt.Errorf("failed to delete game: %w", err)
+	}
+	if gameRecord.GameStatus() != GameStatusCancelled && gameRecord.StartTime > h.now().Unix() {
+		h.notifyGameCancelled(ctx, gameRecord)
+		if err := h.refundCancelledGame(ctx, gameRecord); err != nil {
+			logger.Error().Err(err).Msg("failed to refund deleted game")
 		}
-		log.Error().Err(err).Msg("failed to get game")
-		return Game{}, fmt.Errorf("failed to get game: %w", err)
-	}
-	// check if requester is already in roster
-	for _, player := range game.Roster {
-		if player == requester {
-			return game, nil
-		}
-	}
-	// check if requester is already in waitlist
-	for _, player := range game.WaitList {
-		if player == requester {
-			return game, nil
-		}
-	}
-	// add requester to roster or waitlist
-	relevantList := "Roster"
-	if len(game.Roster) >= game.NumTeams*game.TeamSize {
-		relevantList = "WaitList"
-	}
-	updateItemInput := dynamodb.UpdateItemInput{
-		TableName: &h.pickupGamesTableName,
-		Key: map[string]ddbtypes.AttributeValue{
-			"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID},
-		},
-		UpdateExpression:    aws.String("SET #RelevantList = list_append(#RelevantList, :registration)"),
-		ConditionExpression: aws.String("size(#RosterList) = :currentRosterSize"),
-		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
-			":registration":      &ddbtypes.AttributeValueMemberL{Value: []ddbtypes.AttributeValue{&ddbtypes.AttributeValueMemberS{Value: requester}}},
-			":currentRosterSize": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", len(game.Roster))},
-		},
-		ExpressionAttributeNames: map[string]string{
-			"#RosterList":   "Roster",
-			"#RelevantList": relevantList,
-		},
-		ReturnValues: "ALL_NEW",
-	}
-	returnValues, err := h.AWSDynamoDBClient.UpdateItem(ctx, &updateItemInput)
-	if err != nil {
-		logger.Error().Err(err).Msgf("failed to update game")
-		return Game{}, fmt.Errorf("failed to put game to DynamoDB: %w", err)
 	}
-	var updatedGame GameRecord
-	err = attributevalue.UnmarshalMap(returnValues.Attributes, &updatedGame)
-	if err != nil {
-		logger.Error().Err(err).Msgf("failed to unmarshal game record")
-		return Game{}, fmt.Errorf("failed to unmarshal game record: %w", err)
+	return nil
+}
+
+// notifyGameCancelled sends a cancellation notice to every player on the roster and waitlist.
+// Delivery failures are logged rather than returned as the cancellation has already happened.
+func (h *Handler) notifyGameCancelled(ctx context.Context, gameRecord GameRecord) {
+	logger := log.Ctx(ctx).With().Str("operation", "notifyGameCancelled").Str("gameID", gameRecord.GameID).Logger()
+	message := describeGame(gameRecord) + " has been cancelled."
+	if gameRecord.CancellationReason != "" {
+		message += " Reason: " + gameRecord.CancellationReason
+	}
+	players := append(append([]RosterEntry{}, gameRecord.Roster...), gameRecord.WaitList...)
+	for _, player := range players {
+		err := h.Notifier.Notify(ctx, Notification{
+			Kind:      NotificationKindGameCancelled,
+			Channel:   NotificationChannelEmail,
+			Recipient: player.UserID,
+			Subject:   "Game cancelled: " + gameRecord.Name,
+			Message:   message,
+			Data: map[string]string{
+				"gameId": gameRecord.GameID,
+				"reason": gameRecord.CancellationReason,
+			},
+		})
+		if err != nil {
+			logger.Error().Err(err).Str("recipient", player.UserID).Msg("failed to send cancellation notification")
+		}
+	}
+}
+
+// applyGameUpdate copies the requested changes onto gameRecord and, if the capacity changed,
+// promotes players from the front of the waitlist or demotes the most recent registrations back
+// to the front of it so the waitlist stays in registration order
+func applyGameUpdate(gameRecord *GameRecord, updateGameRequest UpdateGameRequest, now time.Time) {
+	if updateGameRequest.Category != nil {
+		gameRecord.Category = *updateGameRequest.Category
+	}
+	if updateGameRequest.DurationMins != nil {
+		gameRecord.DurationMins = *updateGameRequest.DurationMins
+	}
+	if updateGameRequest.Location != nil {
+		gameRecord.Location = *updateGameRequest.Location
+	}
+	if updateGameRequest.Name != nil {
+		gameRecord.Name = *updateGameRequest.Name
+	}
+	if updateGameRequest.NumTeams != nil {
+		gameRecord.NumTeams = *updateGameRequest.NumTeams
+	}
+	if updateGameRequest.SignupFeeCents != nil {
+		gameRecord.SignupFeeCents = *updateGameRequest.SignupFeeCents
+	}
+	if updateGameRequest.SplitFeeCents != nil {
+		gameRecord.SplitFeeCents = *updateGameRequest.SplitFeeCents
+	}
+	if updateGameRequest.TeamSize != nil {
+		gameRecord.TeamSize = *updateGameRequest.TeamSize
+	}
+	if updateGameRequest.StartTime != nil {
+		gameRecord.StartTime = updateGameRequest.StartTime.Unix()
+	}
+	if updateGameRequest.PromotionOfferHours != nil {
+		gameRecord.PromotionOfferHours = *updateGameRequest.PromotionOfferHours
+	}
+	if updateGameRequest.SplitLockHours != nil {
+		gameRecord.SplitLockHours = *updateGameRequest.SplitLockHours
+	}
+	if updateGameRequest.RefundPolicy != nil {
+		gameRecord.RefundPolicy = *updateGameRequest.RefundPolicy
+	}
+	if updateGameRequest.PriceTiers != nil {
+		gameRecord.PriceTiers = append([]PriceTier{}, *updateGameRequest.PriceTiers...)
+	}
+	if updateGameRequest.PromoCodes != nil {
+		gameRecord.PromoCodes = append([]PromoCode{}, *updateGameRequest.PromoCodes...)
+	}
+	if updateGameRequest.GeoLocation != nil {
+		geoLocation := *updateGameRequest.GeoLocation
+		gameRecord.GeoLocation = &geoLocation
+	}
+	balancePlayerLists(gameRecord, now)
+}
+
+// balancePlayerLists fills the roster from the front of the waitlist, or moves the most recent
+// registrations past the roster's capacity back to the front of the waitlist. Players moved back
+// lose any offer they held, and players promoted at now are offered their spots from then.
+func balancePlayerLists(gameRecord *GameRecord, now time.Time) {
+	capacity := gameRecord.NumTeams * gameRecord.TeamSize
+	roster := append([]RosterEntry{}, gameRecord.Roster...)
+	waitList := append([]RosterEntry{}, gameRecord.WaitList...)
+	if len(roster) > capacity {
+		demoted := make([]RosterEntry, 0, len(roster)-capacity)
+		for _, entry := range roster[capacity:] {
+			demoted = append(demoted, entry.withoutHold())
+		}
+		waitList = append(demoted, waitList...)
+		roster = roster[:capacity]
+	}
+	for len(roster) < capacity && len(waitList) > 0 {
+		roster = append(roster, gameRecord.promotedEntry(waitList[0], now))
+		waitList = waitList[1:]
 	}
-	return GameFromGameRecord(updatedGame), nil
+	gameRecord.Roster = roster
+	gameRecord.WaitList = waitList
 }
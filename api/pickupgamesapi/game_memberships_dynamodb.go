@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog/log"
+)
+
+// gameMembershipRecord says a player is on one of a game's lists. The memberships table is keyed
+// on Player and GameID with a PlayerStartTimeIndex (Player, StartTime) global secondary index.
+type gameMembershipRecord struct {
+	Player     string
+	GameID     string
+	PlayerList PlayerList
+	StartTime  int64
+}
+
+// gameMemberships maps every player on the game to the list they're on
+func gameMemberships(gameRecord GameRecord) map[string]PlayerList {
+	memberships := map[string]PlayerList{}
+	for _, player := range gameRecord.Roster {
+		memberships[player.UserID] = PlayerListRoster
+	}
+	for _, player := range gameRecord.WaitList {
+		memberships[player.UserID] = PlayerListWaitList
+	}
+	return memberships
+}
+
+// syncMemberships brings the memberships table from previousGame's players to updatedGame's. The
+// game write has already happened by now, so failures are logged rather than returned. Reads check
+// memberships against the game record, which makes a stale membership harmless, and a missing one
+// leaves the game out of the player's list until BackfillMemberships next runs.
+func (s *DynamoDBGameStore) syncMemberships(ctx context.Context, previousGame GameRecord, updatedGame GameRecord) {
+	previous := gameMemberships(previousGame)
+	updated := gameMemberships(updatedGame)
+	for player, list := range updated {
+		if previous[player] == list && previousGame.StartTime == updatedGame.StartTime {
+			continue
+		}
+		s.putMembership(ctx, gameMembershipRecord{Player: player, GameID: updatedGame.GameID, PlayerList: list, StartTime: updatedGame.StartTime})
+	}
+	for player := range previous {
+		if _, ok := updated[player]; !ok {
+			s.deleteMembership(ctx, player, updatedGame.GameID)
+		}
+	}
+}
+
+func (s *DynamoDBGameStore) putMembership(ctx context.Context, membership gameMembershipRecord) {
+	if err := s.writeMembership(ctx, membership); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("gameID", membership.GameID).Msg("failed to put game membership")
+	}
+}
+
+func (s *DynamoDBGameStore) writeMembership(ctx context.Context, membership gameMembershipRecord) error {
+	item, err := attributevalue.MarshalMap(membership)
+	if err != nil {
+		return fmt.Errorf("failed to marshal game membership: %w", err)
+	}
+	_, err = s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.MembershipsTableName,
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put game membership: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
+
+// membershipBackfiller is a GameStore that keeps memberships apart from its game records
+type membershipBackfiller interface {
+	BackfillMemberships(ctx context.Context) (int, error)
+}
+
+// BackfillMemberships writes the membership of every player on every game, returning how many it
+// wrote. It fills in games from before the memberships table existed and repairs memberships a
+// failed sync left out, and it's safe to run again. Stale memberships are left for reads to skip.
+func (s *DynamoDBGameStore) BackfillMemberships(ctx context.Context) (int, error) {
+	written := 0
+	paginator := dynamodb.NewScanPaginator(s.Client, &dynamodb.ScanInput{TableName: &s.TableName})
+	for paginator.HasMorePages() {
+		scanOutput, err := paginator.NextPage(ctx)
+		if err != nil {
+			return written, fmt.Errorf("failed to scan games in DynamoDB: %w", upstreamError("DynamoDB", err))
+		}
+		for _, item := range scanOutput.Items {
+			var gameRecord GameRecord
+			if err := attributevalue.UnmarshalMap(item, &gameRecord); err != nil {
+				return written, fmt.Errorf("failed to unmarshal game record: %w", err)
+			}
+			for player, list := range gameMemberships(gameRecord) {
+				membership := gameMembershipRecord{Player: player, GameID: gameRecord.GameID, PlayerList: list, StartTime: gameRecord.StartTime}
+				if err := s.writeMembership(ctx, membership); err != nil {
+					return written, err
+				}
+				written++
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *DynamoDBGameStore) deleteMembership(ctx context.Context, player string, gameID string) {
+	_, err := s.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &s.MembershipsTableName,
+		Key: map[string]ddbtypes.AttributeValue{
+			"Player": &ddbtypes.AttributeValueMemberS{Value: player},
+			"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID},
+		},
+	})
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("gameID", gameID).Msg("failed to delete game membership")
+	}
+}
+
+// getGamesByMembership pages through the player's memberships on the query's list and loads their
+// games, dropping any the game record no longer agrees with
+func (s *DynamoDBGameStore) getGamesByMembership(ctx context.Context, query UserGameQuery) (GamePage, error) {
+	cursor, err := decodeGameCursor(query.Cursor)
+	if err != nil {
+		return GamePage{}, err
+	}
+	queryInput := dynamodb.QueryInput{
+		TableName:              &s.MembershipsTableName,
+		IndexName:              aws.String("PlayerStartTimeIndex"),
+		KeyConditionExpression: aws.String("Player = :player AND StartTime BETWEEN :from AND :to"),
+		FilterExpression:       aws.String("PlayerList = :list"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":player": &ddbtypes.AttributeValueMemberS{Value: query.User},
+			":from":   &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", query.From)},
+			":to":     &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", query.To)},
+			":list":   &ddbtypes.AttributeValueMemberS{Value: string(query.Role.PlayerList())},
+		},
+	}
+	if cursor != nil {
+		queryInput.ExclusiveStartKey = map[string]ddbtypes.AttributeValue{
+			"Player":    &ddbtypes.AttributeValueMemberS{Value: query.User},
+			"GameID":    &ddbtypes.AttributeValueMemberS{Value: cursor.GameID},
+			"StartTime": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", cursor.StartTime)},
+		}
+	}
+	page := GamePage{Games: []GameRecord{}}
+	for {
+		queryInput.Limit = aws.Int32(int32(query.Limit - len(page.Games)))
+		queryOutput, err := s.Client.Query(ctx, &queryInput)
+		if err != nil {
+			return GamePage{}, fmt.Errorf("failed to get game memberships from DynamoDB: %w", upstreamError("DynamoDB", err))
+		}
+		var memberships []gameMembershipRecord
+		if err := attributevalue.UnmarshalListOfMaps(queryOutput.Items, &memberships); err != nil {
+			return GamePage{}, fmt.Errorf("failed to unmarshal game memberships: %w", err)
+		}
+		gameIDs := make([]string, len(memberships))
+		for i, membership := range memberships {
+			gameIDs[i] = membership.GameID
+		}
+		gameRecords, err := s.batchGetGames(ctx, gameIDs)
+		if err != nil {
+			return GamePage{}, err
+		}
+		for _, gameID := range gameIDs {
+			if gameRecord, ok := gameRecords[gameID]; ok && query.matches(gameRecord) {
+				page.Games = append(page.Games, gameRecord)
+			}
+		}
+		if queryOutput.LastEvaluatedKey == nil {
+			return page, nil
+		}
+		if len(page.Games) >= query.Limit {
+			var lastEvaluated gameMembershipRecord
+			if err := attributevalue.UnmarshalMap(queryOutput.LastEvaluatedKey, &lastEvaluated); err != nil {
+				return GamePage{}, fmt.Errorf("failed to unmarshal last evaluated key: %w", err)
+			}
+			page.NextCursor = encodeGameCursor(GameRecord{GameID: lastEvaluated.GameID, StartTime: lastEvaluated.StartTime})
+			return page, nil
+		}
+		queryInput.ExclusiveStartKey = queryOutput.LastEvaluatedKey
+	}
+}
+
+// batchGetGames loads up to 100 games by ID, leaving out any that don't exist
+func (s *DynamoDBGameStore) batchGetGames(ctx context.Context, gameIDs []string) (map[string]GameRecord, error) {
+	gameRecords := map[string]GameRecord{}
+	if len(gameIDs) == 0 {
+		return gameRecords, nil
+	}
+	keys := make([]map[string]ddbtypes.AttributeValue, len(gameIDs))
+	for i, gameID := range gameIDs {
+		keys[i] = map[string]ddbtypes.AttributeValue{"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID}}
+	}
+	requestItems := map[string]ddbtypes.KeysAndAttributes{s.TableName: {Keys: keys}}
+	for len(requestItems) > 0 {
+		batchGetItemOutput, err := s.Client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: requestItems})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get games from DynamoDB: %w", upstreamError("DynamoDB", err))
+		}
+		for _, item := range batchGetItemOutput.Responses[s.TableName] {
+			var gameRecord GameRecord
+			if err := attributevalue.UnmarshalMap(item, &gameRecord); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal game record: %w", err)
+			}
+			gameRecords[gameRecord.GameID] = gameRecord
+		}
+		requestItems = batchGetItemOutput.UnprocessedKeys
+	}
+	return gameRecords, nil
+}
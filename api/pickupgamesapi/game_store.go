@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"pickupgamesapi/types"
+)
+
+// PlayerList identifies one of the player lists held on a game record
+type PlayerList string
+
+const (
+	PlayerListRoster   PlayerList = "Roster"
+	PlayerListWaitList PlayerList = "WaitList"
+)
+
+// maxGameUpdateAttempts is how many times an update to a game record is tried when other requests
+// keep changing the game between reading and writing it
+const maxGameUpdateAttempts = 3
+
+var (
+	errGameNotFound    = types.NewNotFoundError("game_not_found", "game not found")
+	errConditionFailed = types.NewConflictError("concurrent_update", "game was modified by another request, please retry")
+	errNotGameOwner    = types.NewForbiddenError("not_game_owner", "only the game's owner can do that")
+	errGameCancelled   = types.NewConflictError("game_cancelled", "game has been cancelled")
+	errGameExists      = types.NewConflictError("game_exists", "game already exists")
+	errInvalidCursor   = types.NewValidationError("invalid_cursor", "cursor is invalid")
+)
+
+// GameStore persists game records. Implementations must apply the version conditions atomically so
+// that concurrent registrations can't overfill a game or join one that's just been cancelled. A
+// missing game is reported as errGameNotFound and a failed condition as errConditionFailed. Every
+// update increments the record's Version.
+type GameStore interface {
+	// PutGame saves a new game record, failing with errGameExists if the ID is taken
+	PutGame(ctx context.Context, gameRecord GameRecord) error
+	// GetGame returns the game record with the given ID
+	GetGame(ctx context.Context, gameID string) (GameRecord, error)
+	// GetGamesByCategory returns a page of the games matching query, ordered by start time
+	GetGamesByCategory(ctx context.Context, query GameQuery) (GamePage, error)
+	// GetGamesInGeohashCells returns the scheduled games indexed under any of the query's cells
+	GetGamesInGeohashCells(ctx context.Context, query GeoQuery) ([]GameRecord, error)
+	// GetGamesByUser returns a page of the games the user holds the query's role in, ordered by start time
+	GetGamesByUser(ctx context.Context, query UserGameQuery) (GamePage, error)
+	// GetGamesBySeries returns the series' games starting at or after from (Unix seconds), ordered by start time
+	GetGamesBySeries(ctx context.Context, seriesID string, from int64) ([]GameRecord, error)
+	// GetGamesWithExpiredHolds returns the games holding a spot for an offer or payment that expired
+	// at or before now (Unix seconds)
+	GetGamesWithExpiredHolds(ctx context.Context, now int64) ([]GameRecord, error)
+	// AppendPlayer appends player to list, provided the stored record is still at expectedVersion
+	AppendPlayer(ctx context.Context, gameID string, list PlayerList, player RosterEntry, expectedVersion int) (GameRecord, error)
+	// SetPlayerLists replaces the roster and waitlist, provided the stored record is still at expectedVersion
+	SetPlayerLists(ctx context.Context, gameID string, roster []RosterEntry, waitList []RosterEntry, expectedVersion int) (GameRecord, error)
+	// ReplaceGame overwrites the whole record, provided the stored record is still at expectedVersion
+	ReplaceGame(ctx context.Context, gameRecord GameRecord, expectedVersion int) (GameRecord, error)
+	// DeleteGame removes the game record and its players
+	DeleteGame(ctx context.Context, gameID string) error
+}
+
+// GameQuery selects a page of a category's games
+type GameQuery struct {
+	Category string
+	From     int64 // Unix seconds, inclusive
+	To       int64 // Unix seconds, inclusive
+	Limit    int
+	// Cursor continues from a previous page's NextCursor
+	Cursor           string
+	IncludeCancelled bool
+}
+
+// GameRole is how a user is involved in a game
+type GameRole string
+
+const (
+	GameRolePlayer   GameRole = "player"
+	GameRoleWaitList GameRole = "waitlist"
+	GameRoleOwner    GameRole = "owner"
+)
+
+// UserGameQuery selects a page of the games a user plays in, is waitlisted for or owns
+type UserGameQuery struct {
+	User             string
+	Role             GameRole
+	From             int64 // Unix seconds, inclusive
+	To               int64 // Unix seconds, inclusive
+	Limit            int
+	Cursor           string
+	IncludeCancelled bool
+}
+
+// matches reports whether gameRecord belongs in the query's results, ignoring the cursor
+func (q UserGameQuery) matches(gameRecord GameRecord) bool {
+	if gameRecord.StartTime < q.From || gameRecord.StartTime > q.To {
+		return false
+	}
+	if gameRecord.GameStatus() == GameStatusCancelled && !q.IncludeCancelled {
+		return false
+	}
+	switch q.Role {
+	case GameRoleOwner:
+		return gameRecord.Owner == q.User
+	case GameRolePlayer:
+		return indexOfPlayer(gameRecord.Roster, q.User) >= 0
+	case GameRoleWaitList:
+		return indexOfPlayer(gameRecord.WaitList, q.User) >= 0
+	}
+	return false
+}
+
+// PlayerList is the list a player holding the role is kept on
+func (r GameRole) PlayerList() PlayerList {
+	if r == GameRoleWaitList {
+		return PlayerListWaitList
+	}
+	return PlayerListRoster
+}
+
+// GamePage is one page of games. NextCursor is empty once there are no more games; a page may
+// hold fewer than Limit games even when it isn't the last.
+type GamePage struct {
+	Games      []GameRecord
+	NextCursor string
+}
+
+// gameCursor is the position after the last game of a page. Games are ordered by start time and
+// then ID, which is also enough to rebuild DynamoDB's LastEvaluatedKey on SortedCategoryIndex.
+type gameCursor struct {
+	StartTime int64  `json:"s"`
+	GameID    string `json:"g"`
+}
+
+func encodeGameCursor(gameRecord GameRecord) string {
+	cursorBytes, _ := json.Marshal(gameCursor{StartTime: gameRecord.StartTime, GameID: gameRecord.GameID})
+	return base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+// decodeGameCursor returns nil for an empty cursor and errInvalidCursor for one that wasn't issued by encodeGameCursor
+func decodeGameCursor(cursor string) (*gameCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var decoded gameCursor
+	if err := json.Unmarshal(cursorBytes, &decoded); err != nil || decoded.GameID == "" {
+		return nil, errInvalidCursor
+	}
+	return &decoded, nil
+}
+
+// after reports whether gameRecord comes after the cursor in page order
+func (c *gameCursor) after(gameRecord GameRecord) bool {
+	if c == nil {
+		return true
+	}
+	return gameRecord.StartTime > c.StartTime || (gameRecord.StartTime == c.StartTime && gameRecord.GameID > c.GameID)
+}
+
+// GeoQuery selects the scheduled games in a set of geohash cells starting between From and To
+// (Unix seconds, inclusive). Category is optional.
+type GeoQuery struct {
+	Cells    []string
+	Category string
+	From     int64
+	To       int64
+}
+
+func (q GeoQuery) matches(gameRecord GameRecord) bool {
+	if gameRecord.GameStatus() == GameStatusCancelled || gameRecord.StartTime < q.From || gameRecord.StartTime > q.To {
+		return false
+	}
+	if q.Category != "" && gameRecord.Category != q.Category {
+		return false
+	}
+	for _, cell := range q.Cells {
+		if gameRecord.GeohashCell == cell {
+			return true
+		}
+	}
+	return false
+}
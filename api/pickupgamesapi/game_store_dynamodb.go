@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBGameStore is a GameStore backed by a DynamoDB table keyed on GameID with
+// SortedCategoryIndex (Category, StartTime), SeriesIndex (SeriesID, StartTime), GeohashIndex
+// (GeohashCell, StartTime), OwnerIndex (Owner, StartTime) and HoldExpiryIndex (HoldIndexKey,
+// NextHoldExpiry) global secondary indexes. Players
+// can't be indexed inside the roster lists, so the store also keeps a memberships table in step
+// with every write; see game_memberships_dynamodb.go.
+type DynamoDBGameStore struct {
+	Client               *dynamodb.Client
+	TableName            string
+	MembershipsTableName string
+}
+
+func NewDynamoDBGameStore(client *dynamodb.Client, tableName string, membershipsTableName string) *DynamoDBGameStore {
+	return &DynamoDBGameStore{
+		Client:               client,
+		TableName:            tableName,
+		MembershipsTableName: membershipsTableName,
+	}
+}
+
+func (s *DynamoDBGameStore) PutGame(ctx context.Context, gameRecord GameRecord) error {
+	gameRecord.indexGeoLocation()
+	gameRecord.indexHolds()
+	gameAttributeValue, err := attributevalue.MarshalMap(gameRecord)
+	if err != nil {
+		return fmt.Errorf("failed to marshal game to attribute value: %w", err)
+	}
+	putItemInput := dynamodb.PutItemInput{
+		TableName:           &s.TableName,
+		Item:                gameAttributeValue,
+		ConditionExpression: aws.String("attribute_not_exists(GameID)"),
+	}
+	_, err = s.Client.PutItem(ctx, &putItemInput)
+	if err != nil {
+		var conditionalCheckFailed *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailed) {
+			return errGameExists
+		}
+		return fmt.Errorf("failed to put game to DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	s.syncMemberships(ctx, GameRecord{}, gameRecord)
+	return nil
+}
+
+func (s *DynamoDBGameStore) GetGame(ctx context.Context, gameID string) (GameRecord, error) {
+	getItemInput := dynamodb.GetItemInput{
+		TableName: &s.TableName,
+		Key:       map[string]ddbtypes.AttributeValue{"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID}},
+	}
+	getItemOutput, err := s.Client.GetItem(ctx, &getItemInput)
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("failed to get game from DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	if getItemOutput.Item == nil {
+		return GameRecord{}, errGameNotFound
+	}
+	var gameRecord GameRecord
+	err = attributevalue.UnmarshalMap(getItemOutput.Item, &gameRecord)
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("failed to unmarshal game record: %w", err)
+	}
+	return gameRecord, nil
+}
+
+func (s *DynamoDBGameStore) GetGamesByCategory(ctx context.Context, query GameQuery) (GamePage, error) {
+	cursor, err := decodeGameCursor(query.Cursor)
+	if err != nil {
+		return GamePage{}, err
+	}
+	queryInput := dynamodb.QueryInput{
+		TableName:                &s.TableName,
+		IndexName:                aws.String("SortedCategoryIndex"),
+		KeyConditionExpression:   aws.String("Category = :category AND StartTime BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]string{},
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":category": &ddbtypes.AttributeValueMemberS{Value: query.Category},
+			":from":     &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", query.From)},
+			":to":       &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", query.To)},
+		},
+	}
+	if cursor != nil {
+		queryInput.ExclusiveStartKey = map[string]ddbtypes.AttributeValue{
+			"GameID":    &ddbtypes.AttributeValueMemberS{Value: cursor.GameID},
+			"Category":  &ddbtypes.AttributeValueMemberS{Value: query.Category},
+			"StartTime": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", cursor.StartTime)},
+		}
+	}
+	return s.queryGamePage(ctx, &queryInput, query.IncludeCancelled, query.Limit)
+}
+
+// GetGamesByUser reads owned games from OwnerIndex and the others through the memberships table
+func (s *DynamoDBGameStore) GetGamesByUser(ctx context.Context, query UserGameQuery) (GamePage, error) {
+	if query.Role != GameRoleOwner {
+		return s.getGamesByMembership(ctx, query)
+	}
+	cursor, err := decodeGameCursor(query.Cursor)
+	if err != nil {
+		return GamePage{}, err
+	}
+	queryInput := dynamodb.QueryInput{
+		TableName:                &s.TableName,
+		IndexName:                aws.String("OwnerIndex"),
+		KeyConditionExpression:   aws.String("#Owner = :owner AND StartTime BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]string{"#Owner": "Owner"},
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":owner": &ddbtypes.AttributeValueMemberS{Value: query.User},
+			":from":  &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", query.From)},
+			":to":    &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", query.To)},
+		},
+	}
+	if cursor != nil {
+		queryInput.ExclusiveStartKey = map[string]ddbtypes.AttributeValue{
+			"GameID":    &ddbtypes.AttributeValueMemberS{Value: cursor.GameID},
+			"Owner":     &ddbtypes.AttributeValueMemberS{Value: query.User},
+			"StartTime": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", cursor.StartTime)},
+		}
+	}
+	return s.queryGamePage(ctx, &queryInput, query.IncludeCancelled, query.Limit)
+}
+
+// queryGamePage keeps querying an index sorted on StartTime until the page is full or the index
+// is exhausted, so neither DynamoDB's 1 MB response limit nor filtered out cancelled games end a
+// listing early
+func (s *DynamoDBGameStore) queryGamePage(ctx context.Context, queryInput *dynamodb.QueryInput, includeCancelled bool, limit int) (GamePage, error) {
+	if !includeCancelled {
+		queryInput.FilterExpression = aws.String("attribute_not_exists(#Status) OR #Status <> :cancelled")
+		queryInput.ExpressionAttributeNames["#Status"] = "Status"
+		queryInput.ExpressionAttributeValues[":cancelled"] = &ddbtypes.AttributeValueMemberS{Value: string(GameStatusCancelled)}
+	}
+	page := GamePage{Games: []GameRecord{}}
+	for {
+		queryInput.Limit = aws.Int32(int32(limit - len(page.Games)))
+		queryOutput, err := s.Client.Query(ctx, queryInput)
+		if err != nil {
+			return GamePage{}, fmt.Errorf("failed to get games from DynamoDB: %w", upstreamError("DynamoDB", err))
+		}
+		for _, item := range queryOutput.Items {
+			var gameRecord GameRecord
+			if err := attributevalue.UnmarshalMap(item, &gameRecord); err != nil {
+				return GamePage{}, fmt.Errorf("failed to unmarshal game record: %w", err)
+			}
+			page.Games = append(page.Games, gameRecord)
+		}
+		if queryOutput.LastEvaluatedKey == nil {
+			return page, nil
+		}
+		if len(page.Games) >= limit {
+			var lastEvaluated GameRecord
+			if err := attributevalue.UnmarshalMap(queryOutput.LastEvaluatedKey, &lastEvaluated); err != nil {
+				return GamePage{}, fmt.Errorf("failed to unmarshal last evaluated key: %w", err)
+			}
+			page.NextCursor = encodeGameCursor(lastEvaluated)
+			return page, nil
+		}
+		queryInput.ExclusiveStartKey = queryOutput.LastEvaluatedKey
+	}
+}
+
+func (s *DynamoDBGameStore) GetGamesInGeohashCells(ctx context.Context, query GeoQuery) ([]GameRecord, error) {
+	filterExpression := "attribute_not_exists(#Status) OR #Status <> :cancelled"
+	expressionAttributeValues := map[string]ddbtypes.AttributeValue{
+		":from":      &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", query.From)},
+		":to":        &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", query.To)},
+		":cancelled": &ddbtypes.AttributeValueMemberS{Value: string(GameStatusCancelled)},
+	}
+	if query.Category != "" {
+		filterExpression = "(" + filterExpression + ") AND Category = :category"
+		expressionAttributeValues[":category"] = &ddbtypes.AttributeValueMemberS{Value: query.Category}
+	}
+	gameRecords := []GameRecord{}
+	for _, cell := range query.Cells {
+		values := map[string]ddbtypes.AttributeValue{":cell": &ddbtypes.AttributeValueMemberS{Value: cell}}
+		for name, value := range expressionAttributeValues {
+			values[name] = value
+		}
+		queryInput := dynamodb.QueryInput{
+			TableName:                 &s.TableName,
+			IndexName:                 aws.String("GeohashIndex"),
+			KeyConditionExpression:    aws.String("GeohashCell = :cell AND StartTime BETWEEN :from AND :to"),
+			FilterExpression:          aws.String(filterExpression),
+			ExpressionAttributeNames:  map[string]string{"#Status": "Status"},
+			ExpressionAttributeValues: values,
+		}
+		paginator := dynamodb.NewQueryPaginator(s.Client, &queryInput)
+		for paginator.HasMorePages() {
+			queryOutput, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get games from DynamoDB: %w", upstreamError("DynamoDB", err))
+			}
+			for _, item := range queryOutput.Items {
+				var gameRecord GameRecord
+				if err := attributevalue.UnmarshalMap(item, &gameRecord); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal game record: %w", err)
+				}
+				gameRecords = append(gameRecords, gameRecord)
+			}
+		}
+	}
+	return gameRecords, nil
+}
+
+func (s *DynamoDBGameStore) GetGamesBySeries(ctx context.Context, seriesID string, from int64) ([]GameRecord, error) {
+	queryInput := dynamodb.QueryInput{
+		TableName:              &s.TableName,
+		IndexName:              aws.String("SeriesIndex"),
+		KeyConditionExpression: aws.String("SeriesID = :seriesID AND StartTime >= :from"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":seriesID": &ddbtypes.AttributeValueMemberS{Value: seriesID},
+			":from":     &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", from)},
+		},
+	}
+	gameRecords := []GameRecord{}
+	paginator := dynamodb.NewQueryPaginator(s.Client, &queryInput)
+	for paginator.HasMorePages() {
+		queryOutput, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get games from DynamoDB: %w", upstreamError("DynamoDB", err))
+		}
+		for _, item := range queryOutput.Items {
+			var gameRecord GameRecord
+			if err := attributevalue.UnmarshalMap(item, &gameRecord); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal game record: %w", err)
+			}
+			gameRecords = append(gameRecords, gameRecord)
+		}
+	}
+	return gameRecords, nil
+}
+
+func (s *DynamoDBGameStore) GetGamesWithExpiredHolds(ctx context.Context, now int64) ([]GameRecord, error) {
+	queryInput := dynamodb.QueryInput{
+		TableName:              &s.TableName,
+		IndexName:              aws.String("HoldExpiryIndex"),
+		KeyConditionExpression: aws.String("HoldIndexKey = :holdIndexKey AND NextHoldExpiry <= :now"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":holdIndexKey": &ddbtypes.AttributeValueMemberS{Value: holdIndexKey},
+			":now":          &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", now)},
+		},
+	}
+	gameRecords := []GameRecord{}
+	paginator := dynamodb.NewQueryPaginator(s.Client, &queryInput)
+	for paginator.HasMorePages() {
+		queryOutput, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get games from DynamoDB: %w", upstreamError("DynamoDB", err))
+		}
+		for _, item := range queryOutput.Items {
+			var gameRecord GameRecord
+			if err := attributevalue.UnmarshalMap(item, &gameRecord); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal game record: %w", err)
+			}
+			gameRecords = append(gameRecords, gameRecord)
+		}
+	}
+	return gameRecords, nil
+}
+
+func (s *DynamoDBGameStore) AppendPlayer(ctx context.Context, gameID string, list PlayerList, player RosterEntry, expectedVersion int) (GameRecord, error) {
+	registration, err := attributevalue.Marshal(player)
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("failed to marshal roster entry: %w", err)
+	}
+	expressionAttributeValues := map[string]ddbtypes.AttributeValue{
+		":registration":    &ddbtypes.AttributeValueMemberL{Value: []ddbtypes.AttributeValue{registration}},
+		":expectedVersion": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", expectedVersion)},
+		":one":             &ddbtypes.AttributeValueMemberN{Value: "1"},
+	}
+	appendInput := func(set string, condition string) *dynamodb.UpdateItemInput {
+		return &dynamodb.UpdateItemInput{
+			TableName: &s.TableName,
+			Key: map[string]ddbtypes.AttributeValue{
+				"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID},
+			},
+			UpdateExpression:          aws.String("SET #RelevantList = list_append(#RelevantList, :registration)" + set + " ADD Version :one"),
+			ConditionExpression:       aws.String(versionCondition(expectedVersion) + condition),
+			ExpressionAttributeValues: expressionAttributeValues,
+			ExpressionAttributeNames: map[string]string{
+				"#RelevantList": string(list),
+			},
+			ReturnValues: "ALL_NEW",
+		}
+	}
+	var updatedGame GameRecord
+	if expiresAt := player.holdExpiresAt(); expiresAt != nil && list == PlayerListRoster {
+		// the hold is indexed in the same write so ExpireHolds always finds it. NextHoldExpiry is
+		// only ever brought forward: when an earlier hold is already indexed the first condition
+		// fails and the second write keeps it. A version conflict fails both.
+		expressionAttributeValues[":holdIndexKey"] = &ddbtypes.AttributeValueMemberS{Value: holdIndexKey}
+		expressionAttributeValues[":expiresAt"] = &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", expiresAt.Unix())}
+		updatedGame, err = s.updateGame(ctx, appendInput(", HoldIndexKey = :holdIndexKey, NextHoldExpiry = :expiresAt",
+			" AND (attribute_not_exists(NextHoldExpiry) OR NextHoldExpiry > :expiresAt)"))
+		if errors.Is(err, errConditionFailed) {
+			updatedGame, err = s.updateGame(ctx, appendInput(", HoldIndexKey = :holdIndexKey", " AND NextHoldExpiry <= :expiresAt"))
+		}
+	} else {
+		updatedGame, err = s.updateGame(ctx, appendInput("", ""))
+	}
+	if err != nil {
+		return GameRecord{}, err
+	}
+	s.putMembership(ctx, gameMembershipRecord{Player: player.UserID, GameID: gameID, PlayerList: list, StartTime: updatedGame.StartTime})
+	return updatedGame, nil
+}
+
+func (s *DynamoDBGameStore) SetPlayerLists(ctx context.Context, gameID string, roster []RosterEntry, waitList []RosterEntry, expectedVersion int) (GameRecord, error) {
+	rosterList, err := attributevalue.MarshalList(roster)
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("failed to marshal roster: %w", err)
+	}
+	waitListList, err := attributevalue.MarshalList(waitList)
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("failed to marshal waitlist: %w", err)
+	}
+	expressionAttributeValues := map[string]ddbtypes.AttributeValue{
+		":roster":          &ddbtypes.AttributeValueMemberL{Value: rosterList},
+		":waitlist":        &ddbtypes.AttributeValueMemberL{Value: waitListList},
+		":expectedVersion": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", expectedVersion)},
+		":one":             &ddbtypes.AttributeValueMemberN{Value: "1"},
+	}
+	// the hold index follows the new roster
+	holds := GameRecord{GameBase: GameBase{Roster: roster}}
+	holds.indexHolds()
+	updateExpression := "SET Roster = :roster, WaitList = :waitlist REMOVE HoldIndexKey, NextHoldExpiry ADD Version :one"
+	if holds.HoldIndexKey != "" {
+		updateExpression = "SET Roster = :roster, WaitList = :waitlist, HoldIndexKey = :holdIndexKey, " +
+			"NextHoldExpiry = :nextHoldExpiry ADD Version :one"
+		expressionAttributeValues[":holdIndexKey"] = &ddbtypes.AttributeValueMemberS{Value: holds.HoldIndexKey}
+		expressionAttributeValues[":nextHoldExpiry"] = &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", holds.NextHoldExpiry)}
+	}
+	updateItemInput := dynamodb.UpdateItemInput{
+		TableName: &s.TableName,
+		Key: map[string]ddbtypes.AttributeValue{
+			"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ExpressionAttributeValues: expressionAttributeValues,
+		// the old lists tell us whose memberships to remove, and the new record follows from them
+		ReturnValues:        "ALL_OLD",
+		ConditionExpression: aws.String(versionCondition(expectedVersion)),
+	}
+	previousGame, err := s.updateGame(ctx, &updateItemInput)
+	if err != nil {
+		return GameRecord{}, err
+	}
+	updatedGame := previousGame
+	updatedGame.Roster = roster
+	updatedGame.WaitList = waitList
+	updatedGame.HoldIndexKey = holds.HoldIndexKey
+	updatedGame.NextHoldExpiry = holds.NextHoldExpiry
+	updatedGame.Version++
+	s.syncMemberships(ctx, previousGame, updatedGame)
+	return updatedGame, nil
+}
+
+func (s *DynamoDBGameStore) ReplaceGame(ctx context.Context, gameRecord GameRecord, expectedVersion int) (GameRecord, error) {
+	gameRecord.Version = expectedVersion + 1
+	gameRecord.indexGeoLocation()
+	gameRecord.indexHolds()
+	gameAttributeValue, err := attributevalue.MarshalMap(gameRecord)
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("failed to marshal game to attribute value: %w", err)
+	}
+	putItemInput := dynamodb.PutItemInput{
+		TableName:           &s.TableName,
+		Item:                gameAttributeValue,
+		ConditionExpression: aws.String(versionCondition(expectedVersion)),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":expectedVersion": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", expectedVersion)},
+		},
+		ReturnValues: "ALL_OLD",
+	}
+	putItemOutput, err := s.Client.PutItem(ctx, &putItemInput)
+	if err != nil {
+		var conditionalCheckFailed *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailed) {
+			return GameRecord{}, errConditionFailed
+		}
+		return GameRecord{}, fmt.Errorf("failed to put game to DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	var previousGame GameRecord
+	if err := attributevalue.UnmarshalMap(putItemOutput.Attributes, &previousGame); err != nil {
+		return GameRecord{}, fmt.Errorf("failed to unmarshal game record: %w", err)
+	}
+	s.syncMemberships(ctx, previousGame, gameRecord)
+	return gameRecord, nil
+}
+
+func (s *DynamoDBGameStore) DeleteGame(ctx context.Context, gameID string) error {
+	deleteItemInput := dynamodb.DeleteItemInput{
+		TableName:           &s.TableName,
+		Key:                 map[string]ddbtypes.AttributeValue{"GameID": &ddbtypes.AttributeValueMemberS{Value: gameID}},
+		ConditionExpression: aws.String("attribute_exists(GameID)"),
+		ReturnValues:        "ALL_OLD",
+	}
+	deleteItemOutput, err := s.Client.DeleteItem(ctx, &deleteItemInput)
+	if err != nil {
+		var conditionalCheckFailed *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailed) {
+			return errGameNotFound
+		}
+		return fmt.Errorf("failed to delete game from DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	var deletedGame GameRecord
+	if err := attributevalue.UnmarshalMap(deleteItemOutput.Attributes, &deletedGame); err != nil {
+		return fmt.Errorf("failed to unmarshal game record: %w", err)
+	}
+	s.syncMemberships(ctx, deletedGame, GameRecord{GameID: gameID})
+	return nil
+}
+
+// versionCondition requires the game to exist at expectedVersion, as the :expectedVersion value.
+// Games written before Version existed have no attribute, which reads as version 0.
+func versionCondition(expectedVersion int) string {
+	if expectedVersion == 0 {
+		return "attribute_exists(GameID) AND (attribute_not_exists(Version) OR Version = :expectedVersion)"
+	}
+	return "attribute_exists(GameID) AND Version = :expectedVersion"
+}
+
+// updateGame runs a conditional update and unmarshals the record it returns
+func (s *DynamoDBGameStore) updateGame(ctx context.Context, updateItemInput *dynamodb.UpdateItemInput) (GameRecord, error) {
+	returnValues, err := s.Client.UpdateItem(ctx, updateItemInput)
+	if err != nil {
+		var conditionalCheckFailed *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailed) {
+			return GameRecord{}, errConditionFailed
+		}
+		return GameRecord{}, fmt.Errorf("failed to put game to DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	var updatedGame GameRecord
+	err = attributevalue.UnmarshalMap(returnValues.Attributes, &updatedGame)
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("failed to unmarshal game record: %w", err)
+	}
+	return updatedGame, nil
+}
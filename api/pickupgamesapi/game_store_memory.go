@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryGameStore is a thread-safe, in-process GameStore. It applies the same version conditions
+// as the DynamoDB store, which makes it suitable for tests and for running the API locally.
+type MemoryGameStore struct {
+	mu    sync.RWMutex
+	games map[string]GameRecord
+}
+
+func NewMemoryGameStore() *MemoryGameStore {
+	return &MemoryGameStore{
+		games: map[string]GameRecord{},
+	}
+}
+
+// copyGameRecord returns a copy of gameRecord that shares nothing with the original
+func copyGameRecord(gameRecord GameRecord) GameRecord {
+	gameRecord.Roster = copyRosterEntries(gameRecord.Roster)
+	gameRecord.WaitList = copyRosterEntries(gameRecord.WaitList)
+	gameRecord.RosterChanges = append([]RosterChange{}, gameRecord.RosterChanges...)
+	gameRecord.PriceTiers = append([]PriceTier{}, gameRecord.PriceTiers...)
+	gameRecord.PromoCodes = append([]PromoCode{}, gameRecord.PromoCodes...)
+	gameRecord.PromoRedemptions = append([]PromoRedemption{}, gameRecord.PromoRedemptions...)
+	if gameRecord.GeoLocation != nil {
+		geoLocation := *gameRecord.GeoLocation
+		gameRecord.GeoLocation = &geoLocation
+	}
+	return gameRecord
+}
+
+func (s *MemoryGameStore) PutGame(ctx context.Context, gameRecord GameRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.games[gameRecord.GameID]; ok {
+		return errGameExists
+	}
+	gameRecord.indexGeoLocation()
+	s.games[gameRecord.GameID] = copyGameRecord(gameRecord)
+	return nil
+}
+
+func (s *MemoryGameStore) GetGame(ctx context.Context, gameID string) (GameRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gameRecord, ok := s.games[gameID]
+	if !ok {
+		return GameRecord{}, errGameNotFound
+	}
+	return copyGameRecord(gameRecord), nil
+}
+
+func (s *MemoryGameStore) GetGamesByCategory(ctx context.Context, query GameQuery) (GamePage, error) {
+	cursor, err := decodeGameCursor(query.Cursor)
+	if err != nil {
+		return GamePage{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gameRecords := []GameRecord{}
+	for _, gameRecord := range s.games {
+		if gameRecord.Category != query.Category || gameRecord.StartTime < query.From || gameRecord.StartTime > query.To {
+			continue
+		}
+		if gameRecord.GameStatus() == GameStatusCancelled && !query.IncludeCancelled {
+			continue
+		}
+		if cursor.after(gameRecord) {
+			gameRecords = append(gameRecords, copyGameRecord(gameRecord))
+		}
+	}
+	return pageGameRecords(gameRecords, query.Limit), nil
+}
+
+func (s *MemoryGameStore) GetGamesByUser(ctx context.Context, query UserGameQuery) (GamePage, error) {
+	cursor, err := decodeGameCursor(query.Cursor)
+	if err != nil {
+		return GamePage{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gameRecords := []GameRecord{}
+	for _, gameRecord := range s.games {
+		if query.matches(gameRecord) && cursor.after(gameRecord) {
+			gameRecords = append(gameRecords, copyGameRecord(gameRecord))
+		}
+	}
+	return pageGameRecords(gameRecords, query.Limit), nil
+}
+
+// pageGameRecords sorts the games past the cursor in the same order as the DynamoDB indexes and
+// returns the first limit of them
+func pageGameRecords(gameRecords []GameRecord, limit int) GamePage {
+	sort.Slice(gameRecords, func(i, j int) bool {
+		if gameRecords[i].StartTime != gameRecords[j].StartTime {
+			return gameRecords[i].StartTime < gameRecords[j].StartTime
+		}
+		return gameRecords[i].GameID < gameRecords[j].GameID
+	})
+	page := GamePage{Games: gameRecords}
+	if len(gameRecords) > limit {
+		page.Games = gameRecords[:limit]
+		page.NextCursor = encodeGameCursor(page.Games[limit-1])
+	}
+	return page
+}
+
+func (s *MemoryGameStore) GetGamesInGeohashCells(ctx context.Context, query GeoQuery) ([]GameRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gameRecords := []GameRecord{}
+	for _, gameRecord := range s.games {
+		if query.matches(gameRecord) {
+			gameRecords = append(gameRecords, copyGameRecord(gameRecord))
+		}
+	}
+	return gameRecords, nil
+}
+
+func (s *MemoryGameStore) GetGamesBySeries(ctx context.Context, seriesID string, from int64) ([]GameRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gameRecords := []GameRecord{}
+	for _, gameRecord := range s.games {
+		if gameRecord.SeriesID == seriesID && gameRecord.StartTime >= from {
+			gameRecords = append(gameRecords, copyGameRecord(gameRecord))
+		}
+	}
+	sort.Slice(gameRecords, func(i, j int) bool {
+		return gameRecords[i].StartTime < gameRecords[j].StartTime
+	})
+	return gameRecords, nil
+}
+
+func (s *MemoryGameStore) GetGamesWithExpiredHolds(ctx context.Context, now int64) ([]GameRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gameRecords := []GameRecord{}
+	for _, gameRecord := range s.games {
+		for _, entry := range gameRecord.Roster {
+			if entry.holdExpired(time.Unix(now, 0)) {
+				gameRecords = append(gameRecords, copyGameRecord(gameRecord))
+				break
+			}
+		}
+	}
+	return gameRecords, nil
+}
+
+func (s *MemoryGameStore) AppendPlayer(ctx context.Context, gameID string, list PlayerList, player RosterEntry, expectedVersion int) (GameRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gameRecord, ok := s.games[gameID]
+	if !ok {
+		return GameRecord{}, errGameNotFound
+	}
+	if gameRecord.Version != expectedVersion {
+		return GameRecord{}, errConditionFailed
+	}
+	gameRecord = copyGameRecord(gameRecord)
+	switch list {
+	case PlayerListRoster:
+		gameRecord.Roster = append(gameRecord.Roster, player)
+	case PlayerListWaitList:
+		gameRecord.WaitList = append(gameRecord.WaitList, player)
+	}
+	gameRecord.Version++
+	s.games[gameID] = gameRecord
+	return copyGameRecord(gameRecord), nil
+}
+
+func (s *MemoryGameStore) SetPlayerLists(ctx context.Context, gameID string, roster []RosterEntry, waitList []RosterEntry, expectedVersion int) (GameRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gameRecord, ok := s.games[gameID]
+	if !ok {
+		return GameRecord{}, errGameNotFound
+	}
+	if gameRecord.Version != expectedVersion {
+		return GameRecord{}, errConditionFailed
+	}
+	gameRecord.Roster = roster
+	gameRecord.WaitList = waitList
+	gameRecord.Version++
+	gameRecord = copyGameRecord(gameRecord)
+	s.games[gameID] = gameRecord
+	return copyGameRecord(gameRecord), nil
+}
+
+func (s *MemoryGameStore) ReplaceGame(ctx context.Context, gameRecord GameRecord, expectedVersion int) (GameRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	storedRecord, ok := s.games[gameRecord.GameID]
+	if !ok {
+		return GameRecord{}, errGameNotFound
+	}
+	if storedRecord.Version != expectedVersion {
+		return GameRecord{}, errConditionFailed
+	}
+	gameRecord = copyGameRecord(gameRecord)
+	gameRecord.Version = expectedVersion + 1
+	gameRecord.indexGeoLocation()
+	s.games[gameRecord.GameID] = gameRecord
+	return copyGameRecord(gameRecord), nil
+}
+
+func (s *MemoryGameStore) DeleteGame(ctx context.Context, gameID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.games[gameID]; !ok {
+		return errGameNotFound
+	}
+	delete(s.games, gameID)
+	return nil
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLGameStore is a GameStore backed by SQLite or Postgres. Players are kept in game_players in
+// list order, and roster changes run in a transaction holding the game row so the size
+// conditions behave like the DynamoDB condition expressions.
+type SQLGameStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+func NewSQLGameStore(db *sql.DB, dialect SQLDialect) *SQLGameStore {
+	return &SQLGameStore{
+		db:      db,
+		dialect: dialect,
+	}
+}
+
+// lockGame loads a game inside tx, taking a row lock on Postgres. SQLite needs no lock as the
+// store only ever has one connection.
+func (s *SQLGameStore) lockGame(ctx context.Context, tx *sql.Tx, gameID string) (GameRecord, error) {
+	lockClause := ""
+	if s.dialect == SQLDialectPostgres {
+		lockClause = " FOR UPDATE"
+	}
+	return s.loadGame(ctx, tx, gameID, lockClause)
+}
+
+func (s *SQLGameStore) loadGame(ctx context.Context, q sqlQueryer, gameID string, lockClause string) (GameRecord, error) {
+	row := q.QueryRowContext(ctx, `SELECT `+sqlGameColumns+`
+		FROM games WHERE game_id = $1`+lockClause, gameID)
+	gameRecord, err := scanGame(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return GameRecord{}, errGameNotFound
+	}
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("failed to get game: %w", err)
+	}
+	if err := s.loadPlayers(ctx, q, &gameRecord); err != nil {
+		return GameRecord{}, err
+	}
+	return gameRecord, nil
+}
+
+const sqlGameColumns = `game_id, owner, category, name, location, start_time, duration_mins,
+	num_teams, team_size, signup_fee_cents, split_fee_cents, version,
+	status, cancellation_reason, series_id, geo_lat, geo_lng, geo_address, geohash_cell, roster_changes,
+	promotion_offer_hours, split_lock_hours, refund_full_hours, refund_partial_percent, refund_none_hours,
+	refund_when_spot_filled, price_tiers, promo_codes, promo_redemptions`
+
+func scanGame(row sqlScanner) (GameRecord, error) {
+	var gameRecord GameRecord
+	var geoLocation sqlGeoLocation
+	var rosterChanges, priceTiers, promoCodes, promoRedemptions string
+	err := row.Scan(&gameRecord.GameID, &gameRecord.Owner, &gameRecord.Category, &gameRecord.Name, &gameRecord.Location,
+		&gameRecord.StartTime, &gameRecord.DurationMins, &gameRecord.NumTeams, &gameRecord.TeamSize,
+		&gameRecord.SignupFeeCents, &gameRecord.SplitFeeCents, &gameRecord.Version,
+		&gameRecord.Status, &gameRecord.CancellationReason, &gameRecord.SeriesID,
+		&geoLocation.Lat, &geoLocation.Lng, &geoLocation.Address, &gameRecord.GeohashCell, &rosterChanges,
+		&gameRecord.PromotionOfferHours, &gameRecord.SplitLockHours, &gameRecord.RefundPolicy.FullRefundHours,
+		&gameRecord.RefundPolicy.PartialRefundPercent, &gameRecord.RefundPolicy.NoRefundHours,
+		&gameRecord.RefundPolicy.RefundWhenSpotFilled, &priceTiers, &promoCodes, &promoRedemptions)
+	if err != nil {
+		return GameRecord{}, err
+	}
+	if err := json.Unmarshal([]byte(rosterChanges), &gameRecord.RosterChanges); err != nil {
+		return GameRecord{}, fmt.Errorf("failed to unmarshal roster changes: %w", err)
+	}
+	if err := scanPricingColumns(&gameRecord.GameBase, priceTiers, promoCodes); err != nil {
+		return GameRecord{}, err
+	}
+	if err := json.Unmarshal([]byte(promoRedemptions), &gameRecord.PromoRedemptions); err != nil {
+		return GameRecord{}, fmt.Errorf("failed to unmarshal promo redemptions: %w", err)
+	}
+	gameRecord.GeoLocation = geoLocation.GeoLocation()
+	return gameRecord, nil
+}
+
+// rosterChangesColumn encodes the game's roster changes
+func rosterChangesColumn(gameRecord GameRecord) (string, error) {
+	rosterChanges, err := json.Marshal(append([]RosterChange{}, gameRecord.RosterChanges...))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal roster changes: %w", err)
+	}
+	return string(rosterChanges), nil
+}
+
+// pricingColumns encodes the game or series' price tiers and promo codes
+func pricingColumns(gameBase GameBase) (string, string, error) {
+	priceTiers, err := json.Marshal(append([]PriceTier{}, gameBase.PriceTiers...))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal price tiers: %w", err)
+	}
+	promoCodes, err := json.Marshal(append([]PromoCode{}, gameBase.PromoCodes...))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal promo codes: %w", err)
+	}
+	return string(priceTiers), string(promoCodes), nil
+}
+
+// scanPricingColumns decodes the columns written by pricingColumns
+func scanPricingColumns(gameBase *GameBase, priceTiers string, promoCodes string) error {
+	if err := json.Unmarshal([]byte(priceTiers), &gameBase.PriceTiers); err != nil {
+		return fmt.Errorf("failed to unmarshal price tiers: %w", err)
+	}
+	if err := json.Unmarshal([]byte(promoCodes), &gameBase.PromoCodes); err != nil {
+		return fmt.Errorf("failed to unmarshal promo codes: %w", err)
+	}
+	return nil
+}
+
+// promoRedemptionsColumn encodes the game's promo redemptions
+func promoRedemptionsColumn(gameRecord GameRecord) (string, error) {
+	promoRedemptions, err := json.Marshal(append([]PromoRedemption{}, gameRecord.PromoRedemptions...))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal promo redemptions: %w", err)
+	}
+	return string(promoRedemptions), nil
+}
+
+func (s *SQLGameStore) loadPlayers(ctx context.Context, q sqlQueryer, gameRecord *GameRecord) error {
+	rows, err := q.QueryContext(ctx, `SELECT list, player, display_name, joined_at, status, offer_expires_at, payment_due_at,
+			paid, payment_status, price_cents, promo_code, guest_of
+		FROM game_players WHERE game_id = $1 ORDER BY list, position`, gameRecord.GameID)
+	if err != nil {
+		return fmt.Errorf("failed to get players: %w", err)
+	}
+	defer rows.Close()
+	gameRecord.Roster = []RosterEntry{}
+	gameRecord.WaitList = []RosterEntry{}
+	for rows.Next() {
+		var list PlayerList
+		var player RosterEntry
+		var joinedAt, offerExpiresAt, paymentDueAt, priceCents sql.NullInt64
+		err := rows.Scan(&list, &player.UserID, &player.DisplayName, &joinedAt, &player.Status, &offerExpiresAt, &paymentDueAt,
+			&player.Paid, &player.PaymentStatus, &priceCents, &player.PromoCode, &player.GuestOf)
+		if err != nil {
+			return fmt.Errorf("failed to scan player: %w", err)
+		}
+		if joinedAt.Valid {
+			joinedAtTime := time.Unix(joinedAt.Int64, 0).UTC()
+			player.JoinedAt = &joinedAtTime
+		}
+		if offerExpiresAt.Valid {
+			offerExpiresAtTime := time.Unix(offerExpiresAt.Int64, 0).UTC()
+			player.OfferExpiresAt = &offerExpiresAtTime
+		}
+		if paymentDueAt.Valid {
+			paymentDueAtTime := time.Unix(paymentDueAt.Int64, 0).UTC()
+			player.PaymentDueAt = &paymentDueAtTime
+		}
+		if priceCents.Valid {
+			priceCentsValue := int(priceCents.Int64)
+			player.PriceCents = &priceCentsValue
+		}
+		switch list {
+		case PlayerListRoster:
+			gameRecord.Roster = append(gameRecord.Roster, player)
+		case PlayerListWaitList:
+			gameRecord.WaitList = append(gameRecord.WaitList, player)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get players: %w", err)
+	}
+	return nil
+}
+
+// bumpVersion increments the game's version inside tx
+func bumpVersion(ctx context.Context, tx *sql.Tx, gameID string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE games SET version = version + 1 WHERE game_id = $1`, gameID); err != nil {
+		return fmt.Errorf("failed to update game version: %w", err)
+	}
+	return nil
+}
+
+// insertPlayers writes players to list starting at position offset
+func insertPlayers(ctx context.Context, tx *sql.Tx, gameID string, list PlayerList, players []RosterEntry, offset int) error {
+	for i, player := range players {
+		var joinedAt, offerExpiresAt, paymentDueAt, priceCents sql.NullInt64
+		if player.JoinedAt != nil {
+			joinedAt = sql.NullInt64{Int64: player.JoinedAt.Unix(), Valid: true}
+		}
+		if player.OfferExpiresAt != nil {
+			offerExpiresAt = sql.NullInt64{Int64: player.OfferExpiresAt.Unix(), Valid: true}
+		}
+		if player.PaymentDueAt != nil {
+			paymentDueAt = sql.NullInt64{Int64: player.PaymentDueAt.Unix(), Valid: true}
+		}
+		if player.PriceCents != nil {
+			priceCents = sql.NullInt64{Int64: int64(*player.PriceCents), Valid: true}
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO game_players (game_id, list, position, player, display_name, joined_at, status,
+				offer_expires_at, payment_due_at, paid, payment_status, price_cents, promo_code, guest_of)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+			gameID, list, offset+i, player.UserID, player.DisplayName, joinedAt, player.Status, offerExpiresAt, paymentDueAt,
+			player.Paid, string(player.PaymentStatus), priceCents, player.PromoCode, player.GuestOf)
+		if err != nil {
+			return fmt.Errorf("failed to insert player: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLGameStore) PutGame(ctx context.Context, gameRecord GameRecord) error {
+	return withSQLTx(ctx, s.db, func(tx *sql.Tx) error {
+		gameRecord.indexGeoLocation()
+		geoLat, geoLng, geoAddress := geoLocationColumns(gameRecord.GeoLocation)
+		rosterChanges, err := rosterChangesColumn(gameRecord)
+		if err != nil {
+			return err
+		}
+		priceTiers, promoCodes, err := pricingColumns(gameRecord.GameBase)
+		if err != nil {
+			return err
+		}
+		promoRedemptions, err := promoRedemptionsColumn(gameRecord)
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, `INSERT INTO games (`+sqlGameColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22,
+				$23, $24, $25, $26, $27, $28, $29)
+			ON CONFLICT (game_id) DO NOTHING`,
+			gameRecord.GameID, gameRecord.Owner, gameRecord.Category, gameRecord.Name, gameRecord.Location, gameRecord.StartTime,
+			gameRecord.DurationMins, gameRecord.NumTeams, gameRecord.TeamSize, gameRecord.SignupFeeCents, gameRecord.SplitFeeCents,
+			gameRecord.Version, gameRecord.GameStatus(), gameRecord.CancellationReason, gameRecord.SeriesID,
+			geoLat, geoLng, geoAddress, gameRecord.GeohashCell, rosterChanges, gameRecord.PromotionOfferHours,
+			gameRecord.SplitLockHours, gameRecord.RefundPolicy.FullRefundHours, gameRecord.RefundPolicy.PartialRefundPercent,
+			gameRecord.RefundPolicy.NoRefundHours, gameRecord.RefundPolicy.RefundWhenSpotFilled, priceTiers, promoCodes,
+			promoRedemptions)
+		if err != nil {
+			return fmt.Errorf("failed to insert game: %w", err)
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to insert game: %w", err)
+		}
+		if inserted == 0 {
+			return errGameExists
+		}
+		if err := insertPlayers(ctx, tx, gameRecord.GameID, PlayerListRoster, gameRecord.Roster, 0); err != nil {
+			return err
+		}
+		return insertPlayers(ctx, tx, gameRecord.GameID, PlayerListWaitList, gameRecord.WaitList, 0)
+	})
+}
+
+func (s *SQLGameStore) GetGame(ctx context.Context, gameID string) (GameRecord, error) {
+	return s.loadGame(ctx, s.db, gameID, "")
+}
+
+func (s *SQLGameStore) GetGamesByCategory(ctx context.Context, query GameQuery) (GamePage, error) {
+	return s.queryGamePage(ctx, `WHERE category = $1 AND start_time BETWEEN $2 AND $3`,
+		[]interface{}{query.Category, query.From, query.To}, query.Cursor, query.IncludeCancelled, query.Limit)
+}
+
+func (s *SQLGameStore) GetGamesByUser(ctx context.Context, query UserGameQuery) (GamePage, error) {
+	clause := `WHERE owner = $1 AND start_time BETWEEN $2 AND $3`
+	args := []interface{}{query.User, query.From, query.To}
+	if query.Role != GameRoleOwner {
+		clause = `WHERE game_id IN (SELECT game_id FROM game_players WHERE player = $1 AND list = $4)
+			AND start_time BETWEEN $2 AND $3`
+		args = append(args, query.Role.PlayerList())
+	}
+	return s.queryGamePage(ctx, clause, args, query.Cursor, query.IncludeCancelled, query.Limit)
+}
+
+// queryGamePage loads a page of the games matched by the WHERE clause, ordered by start time and ID
+func (s *SQLGameStore) queryGamePage(ctx context.Context, clause string, args []interface{}, encodedCursor string, includeCancelled bool, limit int) (GamePage, error) {
+	cursor, err := decodeGameCursor(encodedCursor)
+	if err != nil {
+		return GamePage{}, err
+	}
+	if !includeCancelled {
+		args = append(args, GameStatusCancelled)
+		clause += fmt.Sprintf(` AND status <> $%d`, len(args))
+	}
+	if cursor != nil {
+		args = append(args, cursor.StartTime, cursor.GameID)
+		clause += fmt.Sprintf(` AND (start_time > $%d OR (start_time = $%d AND game_id > $%d))`, len(args)-1, len(args)-1, len(args))
+	}
+	// one extra row tells us whether there's another page
+	args = append(args, limit+1)
+	clause += fmt.Sprintf(` ORDER BY start_time, game_id LIMIT $%d`, len(args))
+	gameRecords, err := s.queryGames(ctx, clause, args...)
+	if err != nil {
+		return GamePage{}, err
+	}
+	page := GamePage{Games: gameRecords}
+	if len(gameRecords) > limit {
+		page.Games = gameRecords[:limit]
+		page.NextCursor = encodeGameCursor(page.Games[limit-1])
+	}
+	return page, nil
+}
+
+func (s *SQLGameStore) GetGamesInGeohashCells(ctx context.Context, query GeoQuery) ([]GameRecord, error) {
+	if len(query.Cells) == 0 {
+		return []GameRecord{}, nil
+	}
+	args := []interface{}{query.From, query.To, GameStatusCancelled}
+	placeholders := make([]string, len(query.Cells))
+	for i, cell := range query.Cells {
+		args = append(args, cell)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+	clause := `WHERE geohash_cell IN (` + strings.Join(placeholders, ", ") + `) AND start_time BETWEEN $1 AND $2 AND status <> $3`
+	if query.Category != "" {
+		args = append(args, query.Category)
+		clause += fmt.Sprintf(` AND category = $%d`, len(args))
+	}
+	return s.queryGames(ctx, clause+` ORDER BY start_time`, args...)
+}
+
+func (s *SQLGameStore) GetGamesBySeries(ctx context.Context, seriesID string, from int64) ([]GameRecord, error) {
+	return s.queryGames(ctx, `WHERE series_id = $1 AND start_time >= $2 ORDER BY start_time`, seriesID, from)
+}
+
+func (s *SQLGameStore) GetGamesWithExpiredHolds(ctx context.Context, now int64) ([]GameRecord, error) {
+	return s.queryGames(ctx, `WHERE game_id IN (SELECT game_id FROM game_players
+			WHERE (status = $1 AND offer_expires_at <= $3) OR (status = $2 AND payment_due_at <= $3))
+		ORDER BY start_time`, RegistrationStatusOffered, RegistrationStatusPendingPayment, now)
+}
+
+// queryGames loads the games matched by the WHERE/ORDER BY clause along with their players
+func (s *SQLGameStore) queryGames(ctx context.Context, clause string, args ...interface{}) ([]GameRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqlGameColumns+`
+		FROM games `+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get games: %w", err)
+	}
+	gameRecords := []GameRecord{}
+	for rows.Next() {
+		gameRecord, err := scanGame(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan game: %w", err)
+		}
+		gameRecords = append(gameRecords, gameRecord)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get games: %w", err)
+	}
+	// players are loaded once the games cursor is closed, SQLite only has one connection
+	for i := range gameRecords {
+		if err := s.loadPlayers(ctx, s.db, &gameRecords[i]); err != nil {
+			return nil, err
+		}
+	}
+	return gameRecords, nil
+}
+
+func (s *SQLGameStore) AppendPlayer(ctx context.Context, gameID string, list PlayerList, player RosterEntry, expectedVersion int) (GameRecord, error) {
+	var updatedGame GameRecord
+	err := withSQLTx(ctx, s.db, func(tx *sql.Tx) error {
+		gameRecord, err := s.lockGame(ctx, tx, gameID)
+		if err != nil {
+			return err
+		}
+		if gameRecord.Version != expectedVersion {
+			return errConditionFailed
+		}
+		offset := len(gameRecord.Roster)
+		if list == PlayerListWaitList {
+			offset = len(gameRecord.WaitList)
+		}
+		if err := insertPlayers(ctx, tx, gameID, list, []RosterEntry{player}, offset); err != nil {
+			return err
+		}
+		if err := bumpVersion(ctx, tx, gameID); err != nil {
+			return err
+		}
+		updatedGame, err = s.loadGame(ctx, tx, gameID, "")
+		return err
+	})
+	return updatedGame, err
+}
+
+func (s *SQLGameStore) SetPlayerLists(ctx context.Context, gameID string, roster []RosterEntry, waitList []RosterEntry, expectedVersion int) (GameRecord, error) {
+	var updatedGame GameRecord
+	err := withSQLTx(ctx, s.db, func(tx *sql.Tx) error {
+		gameRecord, err := s.lockGame(ctx, tx, gameID)
+		if err != nil {
+			return err
+		}
+		if gameRecord.Version != expectedVersion {
+			return errConditionFailed
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM game_players WHERE game_id = $1`, gameID); err != nil {
+			return fmt.Errorf("failed to clear players: %w", err)
+		}
+		if err := insertPlayers(ctx, tx, gameID, PlayerListRoster, roster, 0); err != nil {
+			return err
+		}
+		if err := insertPlayers(ctx, tx, gameID, PlayerListWaitList, waitList, 0); err != nil {
+			return err
+		}
+		if err := bumpVersion(ctx, tx, gameID); err != nil {
+			return err
+		}
+		updatedGame, err = s.loadGame(ctx, tx, gameID, "")
+		return err
+	})
+	return updatedGame, err
+}
+
+func (s *SQLGameStore) ReplaceGame(ctx context.Context, gameRecord GameRecord, expectedVersion int) (GameRecord, error) {
+	var updatedGame GameRecord
+	err := withSQLTx(ctx, s.db, func(tx *sql.Tx) error {
+		storedRecord, err := s.lockGame(ctx, tx, gameRecord.GameID)
+		if err != nil {
+			return err
+		}
+		if storedRecord.Version != expectedVersion {
+			return errConditionFailed
+		}
+		gameRecord.indexGeoLocation()
+		geoLat, geoLng, geoAddress := geoLocationColumns(gameRecord.GeoLocation)
+		rosterChanges, err := rosterChangesColumn(gameRecord)
+		if err != nil {
+			return err
+		}
+		priceTiers, promoCodes, err := pricingColumns(gameRecord.GameBase)
+		if err != nil {
+			return err
+		}
+		promoRedemptions, err := promoRedemptionsColumn(gameRecord)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE games SET owner = $2, category = $3, name = $4, location = $5, start_time = $6,
+			duration_mins = $7, num_teams = $8, team_size = $9, signup_fee_cents = $10, split_fee_cents = $11, version = $12,
+			status = $13, cancellation_reason = $14, geo_lat = $15, geo_lng = $16, geo_address = $17, geohash_cell = $18,
+			roster_changes = $19, promotion_offer_hours = $20, split_lock_hours = $21,
+			refund_full_hours = $22, refund_partial_percent = $23, refund_none_hours = $24, refund_when_spot_filled = $25,
+			price_tiers = $26, promo_codes = $27, promo_redemptions = $28
+			WHERE game_id = $1`,
+			gameRecord.GameID, gameRecord.Owner, gameRecord.Category, gameRecord.Name, gameRecord.Location, gameRecord.StartTime,
+			gameRecord.DurationMins, gameRecord.NumTeams, gameRecord.TeamSize, gameRecord.SignupFeeCents, gameRecord.SplitFeeCents,
+			expectedVersion+1, gameRecord.GameStatus(), gameRecord.CancellationReason, geoLat, geoLng, geoAddress,
+			gameRecord.GeohashCell, rosterChanges, gameRecord.PromotionOfferHours, gameRecord.SplitLockHours,
+			gameRecord.RefundPolicy.FullRefundHours, gameRecord.RefundPolicy.PartialRefundPercent,
+			gameRecord.RefundPolicy.NoRefundHours, gameRecord.RefundPolicy.RefundWhenSpotFilled, priceTiers, promoCodes,
+			promoRedemptions)
+		if err != nil {
+			return fmt.Errorf("failed to update game: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM game_players WHERE game_id = $1`, gameRecord.GameID); err != nil {
+			return fmt.Errorf("failed to clear players: %w", err)
+		}
+		if err := insertPlayers(ctx, tx, gameRecord.GameID, PlayerListRoster, gameRecord.Roster, 0); err != nil {
+			return err
+		}
+		if err := insertPlayers(ctx, tx, gameRecord.GameID, PlayerListWaitList, gameRecord.WaitList, 0); err != nil {
+			return err
+		}
+		updatedGame, err = s.loadGame(ctx, tx, gameRecord.GameID, "")
+		return err
+	})
+	return updatedGame, err
+}
+
+func (s *SQLGameStore) DeleteGame(ctx context.Context, gameID string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM games WHERE game_id = $1`, gameID)
+	if err != nil {
+		return fmt.Errorf("failed to delete game: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete game: %w", err)
+	}
+	if deleted == 0 {
+		return errGameNotFound
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newSQLTestDatabase is a SQLite database migrated from empty, removed when the test ends
+func newSQLTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := OpenSQLDatabase(context.Background(), SQLDialectSQLite, filepath.Join(t.TempDir(), "pickupgames.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newSQLTestHandler is a test handler on the SQL stores
+func newSQLTestHandler(t *testing.T) *testHandler {
+	t.Helper()
+	h := newTestHandler(t)
+	db := newSQLTestDatabase(t)
+	h.GameStore = NewSQLGameStore(db, SQLDialectSQLite)
+	h.SeriesStore = NewSQLSeriesStore(db)
+	h.VerificationCodes = NewSQLVerificationCodeStore(db)
+	h.UserProfiles = NewSQLUserProfileStore(db)
+	h.Payments = NewSQLPaymentLedger(db)
+	return h
+}
+
+// sqlTestGame is a scheduled game record in category starting startsIn after the test clock's start
+func sqlTestGame(gameID string, category string, startsIn time.Duration) GameRecord {
+	return GameRecord{
+		GameBase: GameBase{
+			Category:     category,
+			DurationMins: 60,
+			Location:     "Main Park",
+			Name:         fmt.Sprintf("%s game", category),
+			NumTeams:     2,
+			TeamSize:     5,
+		},
+		GameID:    gameID,
+		Owner:     "owner@example.com",
+		StartTime: testStart.Add(startsIn).Unix(),
+		Status:    GameStatusScheduled,
+	}
+}
+
+func TestSQLMigrationsFromEmpty(t *testing.T) {
+	db := newSQLTestDatabase(t)
+	latest := sqlMigrations[len(sqlMigrations)-1].Version
+	var version, applied int
+	if err := db.QueryRow(`SELECT MAX(version), COUNT(*) FROM schema_migrations`).Scan(&version, &applied); err != nil {
+		t.Fatalf("failed to read schema version: %v", err)
+	}
+	if version != latest || applied != len(sqlMigrations) {
+		t.Fatalf("expected all %d migrations applied up to %d, got %d up to %d", len(sqlMigrations), latest, applied, version)
+	}
+	// migrating an up to date database does nothing
+	if err := migrateSQL(context.Background(), db, sqlMigrations); err != nil {
+		t.Fatalf("migrating again returned an error: %v", err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil || applied != len(sqlMigrations) {
+		t.Errorf("expected no migrations applied again, got %d %v", applied, err)
+	}
+}
+
+func TestSQLGameStoreDropPromotesWaitlist(t *testing.T) {
+	h := newSQLTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 1, 1))
+	for _, player := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if response := h.register(t, game.GameID, player); response.StatusCode != http.StatusOK {
+			t.Fatalf("registering %s returned %d: %s", player, response.StatusCode, response.Body)
+		}
+	}
+	h.drop(t, game.GameID, "a@example.com")
+
+	gameRecord, err := h.GameStore.GetGame(context.Background(), game.GameID)
+	if err != nil {
+		t.Fatalf("failed to get game: %v", err)
+	}
+	if !equalStrings(userIDs(gameRecord.Roster), []string{"b@example.com"}) || !equalStrings(userIDs(gameRecord.WaitList), []string{"c@example.com"}) {
+		t.Errorf("expected b promoted and c still waiting, got roster %v and waitlist %v", userIDs(gameRecord.Roster), userIDs(gameRecord.WaitList))
+	}
+	if gameRecord.Roster[0].Status != RegistrationStatusConfirmed {
+		t.Errorf("expected the promoted player confirmed, got %+v", gameRecord.Roster[0])
+	}
+}
+
+func TestSQLGameStoreRejectsStaleVersions(t *testing.T) {
+	ctx := context.Background()
+	store := NewSQLGameStore(newSQLTestDatabase(t), SQLDialectSQLite)
+	if err := store.PutGame(ctx, sqlTestGame("game-1", "soccer", 48*time.Hour)); err != nil {
+		t.Fatalf("failed to put game: %v", err)
+	}
+	if err := store.PutGame(ctx, sqlTestGame("game-1", "soccer", 48*time.Hour)); !errors.Is(err, errGameExists) {
+		t.Errorf("expected a second game with the ID refused, got %v", err)
+	}
+	stale, err := store.GetGame(ctx, "game-1")
+	if err != nil {
+		t.Fatalf("failed to get game: %v", err)
+	}
+	player := RosterEntry{UserID: "a@example.com", Status: RegistrationStatusConfirmed}
+	current, err := store.AppendPlayer(ctx, "game-1", PlayerListRoster, player, stale.Version)
+	if err != nil {
+		t.Fatalf("failed to append player: %v", err)
+	}
+	if current.Version != stale.Version+1 {
+		t.Errorf("expected the version bumped to %d, got %d", stale.Version+1, current.Version)
+	}
+
+	other := RosterEntry{UserID: "b@example.com", Status: RegistrationStatusConfirmed}
+	if _, err := store.AppendPlayer(ctx, "game-1", PlayerListRoster, other, stale.Version); !errors.Is(err, errConditionFailed) {
+		t.Errorf("AppendPlayer: expected errConditionFailed, got %v", err)
+	}
+	if _, err := store.SetPlayerLists(ctx, "game-1", []RosterEntry{other}, nil, stale.Version); !errors.Is(err, errConditionFailed) {
+		t.Errorf("SetPlayerLists: expected errConditionFailed, got %v", err)
+	}
+	renamed := stale
+	renamed.Name = "renamed"
+	if _, err := store.ReplaceGame(ctx, renamed, stale.Version); !errors.Is(err, errConditionFailed) {
+		t.Errorf("ReplaceGame: expected errConditionFailed, got %v", err)
+	}
+	if _, err := store.AppendPlayer(ctx, "missing", PlayerListRoster, other, 0); !errors.Is(err, errGameNotFound) {
+		t.Errorf("expected errGameNotFound for a missing game, got %v", err)
+	}
+
+	stored, err := store.GetGame(ctx, "game-1")
+	if err != nil {
+		t.Fatalf("failed to get game: %v", err)
+	}
+	if stored.Version != current.Version || stored.Name != "soccer game" || !equalStrings(userIDs(stored.Roster), []string{"a@example.com"}) {
+		t.Errorf("expected the stale writes to leave the game alone, got %+v", stored)
+	}
+}
+
+func TestSQLGameStorePagesByCategoryAndStartTime(t *testing.T) {
+	ctx := context.Background()
+	store := NewSQLGameStore(newSQLTestDatabase(t), SQLDialectSQLite)
+	cancelled := sqlTestGame("soccer-cancelled", "soccer", 3*time.Hour)
+	cancelled.Status = GameStatusCancelled
+	for _, gameRecord := range []GameRecord{
+		sqlTestGame("soccer-4", "soccer", 4*time.Hour),
+		sqlTestGame("soccer-1", "soccer", time.Hour),
+		// games starting together are ordered by ID
+		sqlTestGame("soccer-2b", "soccer", 2*time.Hour),
+		sqlTestGame("soccer-2a", "soccer", 2*time.Hour),
+		sqlTestGame("soccer-late", "soccer", 30*time.Hour),
+		sqlTestGame("basketball-1", "basketball", time.Hour),
+		cancelled,
+	} {
+		if err := store.PutGame(ctx, gameRecord); err != nil {
+			t.Fatalf("failed to put %s: %v", gameRecord.GameID, err)
+		}
+	}
+
+	query := GameQuery{
+		Category: "soccer",
+		From:     testStart.Unix(),
+		To:       testStart.Add(24 * time.Hour).Unix(),
+		Limit:    2,
+	}
+	var gameIDs []string
+	for pages := 0; ; pages++ {
+		if pages == 5 {
+			t.Fatalf("expected paging to end, got %v", gameIDs)
+		}
+		page, err := store.GetGamesByCategory(ctx, query)
+		if err != nil {
+			t.Fatalf("failed to get games: %v", err)
+		}
+		for _, gameRecord := range page.Games {
+			gameIDs = append(gameIDs, gameRecord.GameID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if !equalStrings(gameIDs, []string{"soccer-1", "soccer-2a", "soccer-2b", "soccer-4"}) {
+		t.Errorf("got %v", gameIDs)
+	}
+
+	page, err := store.GetGamesByCategory(ctx, GameQuery{
+		Category:         "soccer",
+		From:             testStart.Add(2 * time.Hour).Unix(),
+		To:               testStart.Add(3 * time.Hour).Unix(),
+		Limit:            10,
+		IncludeCancelled: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to get games: %v", err)
+	}
+	gameIDs = nil
+	for _, gameRecord := range page.Games {
+		gameIDs = append(gameIDs, gameRecord.GameID)
+	}
+	if !equalStrings(gameIDs, []string{"soccer-2a", "soccer-2b", "soccer-cancelled"}) || page.NextCursor != "" {
+		t.Errorf("expected the games between the times, cancelled included, got %v %q", gameIDs, page.NextCursor)
+	}
+	if _, err := store.GetGamesByCategory(ctx, GameQuery{Category: "soccer", Limit: 2, Cursor: "not-a-cursor"}); !errors.Is(err, errInvalidCursor) {
+		t.Errorf("expected errInvalidCursor, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"pickupgamesapi/types"
+)
+
+const (
+	// geohashCellPrecision is the geohash length games are indexed under. Four characters is a
+	// cell of roughly 39km by 20km, so a search touches a handful of cells.
+	geohashCellPrecision = 4
+	geohashAlphabet      = "0123456789bcdefghjkmnpqrstuvwxyz"
+	earthRadiusKm        = 6371.0
+)
+
+// GeoLocation pins a game to a point on the map. Location stays the free-form place name.
+type GeoLocation struct {
+	Lat     float64 `json:"lat" dynamodbav:"Lat"`
+	Lng     float64 `json:"lng" dynamodbav:"Lng"`
+	Address string  `json:"address" dynamodbav:"Address"`
+}
+
+func (l *GeoLocation) Validate() error {
+	if l.Lat < -90 || l.Lat > 90 || math.IsNaN(l.Lat) {
+		return types.NewValidationError("", "lat must be between -90 and 90")
+	}
+	if l.Lng < -180 || l.Lng > 180 || math.IsNaN(l.Lng) {
+		return types.NewValidationError("", "lng must be between -180 and 180")
+	}
+	return nil
+}
+
+// encodeGeohash returns the geohash of the point with the given number of characters
+func encodeGeohash(lat float64, lng float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	geohash := make([]byte, 0, precision)
+	bits, bit := 0, 0
+	evenBit := true
+	for len(geohash) < precision {
+		if evenBit {
+			mid := (lngRange[0] + lngRange[1]) / 2
+			if lng >= mid {
+				bits = bits<<1 | 1
+				lngRange[0] = mid
+			} else {
+				bits = bits << 1
+				lngRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if lat >= mid {
+				bits = bits<<1 | 1
+				latRange[0] = mid
+			} else {
+				bits = bits << 1
+				latRange[1] = mid
+			}
+		}
+		evenBit = !evenBit
+		bit++
+		if bit == 5 {
+			geohash = append(geohash, geohashAlphabet[bits])
+			bits, bit = 0, 0
+		}
+	}
+	return string(geohash)
+}
+
+// geohashCellSize returns the height and width in degrees of a geohash cell of the given precision
+func geohashCellSize(precision int) (float64, float64) {
+	totalBits := precision * 5
+	lngBits := (totalBits + 1) / 2
+	latBits := totalBits / 2
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lngBits))
+}
+
+// geohashCellsCovering returns the geohash cells overlapping the box around a circle, which is
+// every cell that can hold a point within radiusKm of the center
+func geohashCellsCovering(lat float64, lng float64, radiusKm float64, precision int) []string {
+	angularRadius := radiusKm / earthRadiusKm
+	latDelta := angularRadius * 180 / math.Pi
+	// the circle is widest where it's furthest from the equator, and spans every longitude once it
+	// reaches over a pole
+	lngDelta := 180.0
+	if sinRatio := math.Sin(angularRadius) / math.Cos(lat*math.Pi/180); sinRatio < 1 {
+		lngDelta = math.Asin(sinRatio) * 180 / math.Pi
+	}
+	minLat, maxLat := math.Max(-90, lat-latDelta), math.Min(90, lat+latDelta)
+	cellHeight, cellWidth := geohashCellSize(precision)
+	seen := map[string]bool{}
+	cells := []string{}
+	// stepping by half a cell and always including the far edge can't skip over a cell
+	for cellLat := minLat; ; cellLat += cellHeight / 2 {
+		cellLat = math.Min(cellLat, maxLat)
+		for cellLng := lng - lngDelta; ; cellLng += cellWidth / 2 {
+			cellLng = math.Min(cellLng, lng+lngDelta)
+			cell := encodeGeohash(cellLat, normalizeLongitude(cellLng), precision)
+			if !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+			if cellLng >= lng+lngDelta {
+				break
+			}
+		}
+		if cellLat >= maxLat {
+			break
+		}
+	}
+	return cells
+}
+
+// normalizeLongitude wraps lng into [-180, 180)
+func normalizeLongitude(lng float64) float64 {
+	lng = math.Mod(lng+180, 360)
+	if lng < 0 {
+		lng += 360
+	}
+	return lng - 180
+}
+
+// distanceKm is the great-circle distance between two points
+func distanceKm(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// geoLocationColumns splits a GeoLocation into nullable SQL columns
+func geoLocationColumns(geoLocation *GeoLocation) (sql.NullFloat64, sql.NullFloat64, sql.NullString) {
+	if geoLocation == nil {
+		return sql.NullFloat64{}, sql.NullFloat64{}, sql.NullString{}
+	}
+	return sql.NullFloat64{Float64: geoLocation.Lat, Valid: true},
+		sql.NullFloat64{Float64: geoLocation.Lng, Valid: true},
+		sql.NullString{String: geoLocation.Address, Valid: true}
+}
+
+// sqlGeoLocation scans the nullable columns written by geoLocationColumns
+type sqlGeoLocation struct {
+	Lat     sql.NullFloat64
+	Lng     sql.NullFloat64
+	Address sql.NullString
+}
+
+func (l sqlGeoLocation) GeoLocation() *GeoLocation {
+	if !l.Lat.Valid || !l.Lng.Valid {
+		return nil
+	}
+	return &GeoLocation{Lat: l.Lat.Float64, Lng: l.Lng.Float64, Address: l.Address.String}
+}
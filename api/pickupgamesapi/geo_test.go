@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEncodeGeohash(t *testing.T) {
+	for _, test := range []struct {
+		lat, lng  float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{42.6, -5.6, 5, "ezs42"},
+		{0, 0, 4, "s000"},
+		{-90, -180, 4, "0000"},
+		{90, 180, 4, "zzzz"},
+		{-33.8688, 151.2093, 4, "r3gx"},
+	} {
+		if got := encodeGeohash(test.lat, test.lng, test.precision); got != test.want {
+			t.Errorf("encodeGeohash(%v, %v, %d) = %q, want %q", test.lat, test.lng, test.precision, got, test.want)
+		}
+	}
+}
+
+func TestDistanceKm(t *testing.T) {
+	oneDegreeKm := 2 * math.Pi * earthRadiusKm / 360
+	for _, test := range []struct {
+		name                   string
+		lat1, lng1, lat2, lng2 float64
+		want                   float64
+	}{
+		{"same point", 52.52, 13.405, 52.52, 13.405, 0},
+		{"a degree along the equator", 0, 10, 0, 11, oneDegreeKm},
+		{"a degree across the antimeridian", 0, 179.5, 0, -179.5, oneDegreeKm},
+		{"pole to pole", 90, 0, -90, 0, math.Pi * earthRadiusKm},
+		{"Paris to London", 48.8566, 2.3522, 51.5074, -0.1278, 343.5},
+	} {
+		if got := distanceKm(test.lat1, test.lng1, test.lat2, test.lng2); math.Abs(got-test.want) > 0.5 {
+			t.Errorf("%s: got %.2fkm, want %.2fkm", test.name, got, test.want)
+		}
+	}
+}
+
+// destination is the point distanceKm from lat, lng heading bearing degrees clockwise from north
+func destination(lat float64, lng float64, bearing float64, distanceKm float64) (float64, float64) {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	toDegrees := func(radians float64) float64 { return radians * 180 / math.Pi }
+	angle := distanceKm / earthRadiusKm
+	lat1, lng1, theta := toRadians(lat), toRadians(lng), toRadians(bearing)
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(angle) + math.Cos(lat1)*math.Sin(angle)*math.Cos(theta))
+	lng2 := lng1 + math.Atan2(math.Sin(theta)*math.Sin(angle)*math.Cos(lat1), math.Cos(angle)-math.Sin(lat1)*math.Sin(lat2))
+	return toDegrees(lat2), normalizeLongitude(toDegrees(lng2))
+}
+
+func TestGeohashCellsCovering(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		lat, lng  float64
+		radiusKm  float64
+		wantCells []string
+	}{
+		{name: "city", lat: 52.52, lng: 13.405, radiusKm: 10},
+		{name: "on a cell corner", lat: 0, lng: 0, radiusKm: 5, wantCells: []string{"s000", "ebpb", "kpbp", "7zzz"}},
+		{
+			name: "across the antimeridian", lat: -17.7, lng: 179.95, radiusKm: 20,
+			wantCells: []string{encodeGeohash(-17.7, 179.95, 4), encodeGeohash(-17.7, -179.95, 4)},
+		},
+		{name: "far north", lat: 60, lng: 10, radiusKm: 50},
+		{name: "close to the north pole", lat: 89, lng: 0.17, radiusKm: 50},
+		{
+			name: "over the north pole", lat: 89.95, lng: 0, radiusKm: 20,
+			wantCells: []string{encodeGeohash(89.99, -179.99, 4), encodeGeohash(89.99, 179.99, 4), encodeGeohash(89.99, 90, 4)},
+		},
+		{name: "near the south pole", lat: -89.9, lng: 45, radiusKm: 50},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cells := geohashCellsCovering(test.lat, test.lng, test.radiusKm, geohashCellPrecision)
+			covered := map[string]bool{}
+			for _, cell := range cells {
+				if len(cell) != geohashCellPrecision {
+					t.Fatalf("got malformed cell %q", cell)
+				}
+				if covered[cell] {
+					t.Errorf("cell %s listed twice", cell)
+				}
+				covered[cell] = true
+			}
+			for _, cell := range test.wantCells {
+				if !covered[cell] {
+					t.Errorf("expected cell %s covered", cell)
+				}
+			}
+			// every point within the radius falls in a covered cell
+			for bearing := 0.0; bearing < 360; bearing++ {
+				for _, fraction := range []float64{0.25, 0.5, 0.9, 0.999} {
+					lat, lng := destination(test.lat, test.lng, bearing, test.radiusKm*fraction)
+					if cell := encodeGeohash(lat, lng, geohashCellPrecision); !covered[cell] {
+						t.Errorf("point %.4f, %.4f at bearing %v is in uncovered cell %s", lat, lng, bearing, cell)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNearbyGamesAcrossCellBoundary(t *testing.T) {
+	h := newTestHandler(t)
+	// cells are 0.3515625 degrees of longitude wide, so one edge runs along 13.359375
+	lat, lng := 52.52, 13.35
+	createAt := func(name string, gameLat float64, gameLng float64) Game {
+		body := newTestGame("soccer", 48*time.Hour, 2, 5)
+		body["name"] = name
+		body["geoLocation"] = GeoLocation{Lat: gameLat, Lng: gameLng, Address: name}
+		return h.createGame(t, "owner@example.com", body)
+	}
+	sameCell := createAt("same cell", 52.52, 13.34)
+	nextCell := createAt("next cell", 52.53, 13.37)
+	createAt("too far", 52.52, 13.8)
+	if encodeGeohash(lat, lng, geohashCellPrecision) == encodeGeohash(52.53, 13.37, geohashCellPrecision) {
+		t.Fatalf("expected the next game in a different cell")
+	}
+
+	var nearby NearbyGameList
+	h.mustCall(t, testRequest{
+		RouteKey:        "GET /games/nearby",
+		Requester:       "player@example.com",
+		QueryParameters: map[string]string{"lat": fmt.Sprint(lat), "lng": fmt.Sprint(lng), "radiusKm": "5"},
+	}, &nearby)
+	if len(nearby.Games) != 2 || nearby.Games[0].GameID != sameCell.GameID || nearby.Games[1].GameID != nextCell.GameID {
+		t.Fatalf("expected both nearby games, closest first, got %+v", nearby.Games)
+	}
+	if want := distanceKm(lat, lng, 52.53, 13.37); math.Abs(nearby.Games[1].DistanceKm-want) > 0.001 {
+		t.Errorf("expected the next cell's game %.3fkm away, got %.3f", want, nearby.Games[1].DistanceKm)
+	}
+}
@@ -0,0 +1,975 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// testSigningKey signs the local identity provider's tokens. It's generated once as RSA keys are
+// slow to make.
+var testSigningKey *rsa.PrivateKey
+
+func TestMain(m *testing.M) {
+	// handlers log every request, which would bury test failures
+	log.Logger = zerolog.Nop()
+	key, err := LoadOrGenerateSigningKey("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate signing key: %v\n", err)
+		os.Exit(1)
+	}
+	testSigningKey = key
+	os.Exit(m.Run())
+}
+
+// testStart is the fixed current time of test handlers, games are scheduled relative to it
+var testStart = time.Date(2030, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+// testClock is a handler clock tests can move forward
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// recordingNotifier keeps the notifications sent so tests can check them
+type recordingNotifier struct {
+	mu            sync.Mutex
+	notifications []Notification
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+func (n *recordingNotifier) kinds(recipient string) []NotificationKind {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	kinds := []NotificationKind{}
+	for _, notification := range n.notifications {
+		if notification.Recipient == recipient {
+			kinds = append(kinds, notification.Kind)
+		}
+	}
+	return kinds
+}
+
+// testHandler is a Handler on the in-memory stores and the fake payment provider, with a clock
+// tests control
+type testHandler struct {
+	*Handler
+	clock    *testClock
+	notifier *recordingNotifier
+	payments *FakePaymentProvider
+	identity *LocalIdentityProvider
+}
+
+func newTestHandler(t *testing.T) *testHandler {
+	t.Helper()
+	clock := &testClock{now: testStart}
+	notifier := &recordingNotifier{}
+	payments := NewFakePaymentProvider()
+	identity := NewLocalIdentityProvider("http://localhost:8080", "pickupgames", testSigningKey)
+	identity.Clock = clock.Now
+	return &testHandler{
+		Handler: &Handler{
+			IdentityProvider:     identity,
+			GameStore:            NewMemoryGameStore(),
+			SeriesStore:          NewMemorySeriesStore(),
+			VerificationCodes:    NewMemoryVerificationCodeStore(),
+			UserProfiles:         NewMemoryUserProfileStore(),
+			Notifier:             notifier,
+			PlayerIDs:            NewPlayerIDs([]byte("test player ID key")),
+			PaymentProvider:      payments,
+			Payments:             NewMemoryPaymentLedger(),
+			PaymentWebhookSecret: []byte("whsec_test"),
+			Clock:                clock.Now,
+		},
+		clock:    clock,
+		notifier: notifier,
+		payments: payments,
+		identity: identity,
+	}
+}
+
+// createUser adds a user with email to the identity provider
+func (h *testHandler) createUser(t *testing.T, email string) {
+	t.Helper()
+	_, err := h.identity.CreateUser(context.Background(), NewUserRequest{
+		FirstName:   "Test",
+		LastName:    "Player",
+		Email:       email,
+		Password:    "Password1!",
+		PhoneNumber: "+15555550100",
+	})
+	if err != nil {
+		t.Fatalf("failed to create user %s: %v", email, err)
+	}
+}
+
+// testRequest is an API Gateway request made by requester, unauthenticated when it's empty
+type testRequest struct {
+	RouteKey  string
+	Requester string
+	// IssuedAt is when the requester's token was issued, the test clock's time when it's zero
+	IssuedAt        time.Time
+	PathParameters  map[string]string
+	QueryParameters map[string]string
+	Headers         map[string]string
+	Body            interface{}
+}
+
+// call sends the request through the handler and decodes a successful response into out
+func (h *testHandler) call(t *testing.T, request testRequest, out interface{}) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	event := events.APIGatewayV2HTTPRequest{
+		RouteKey:              request.RouteKey,
+		PathParameters:        request.PathParameters,
+		QueryStringParameters: request.QueryParameters,
+		Headers:               request.Headers,
+	}
+	if request.Requester != "" {
+		issuedAt := request.IssuedAt
+		if issuedAt.IsZero() {
+			issuedAt = h.clock.Now()
+		}
+		event.RequestContext.Authorizer = &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+			JWT: &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+				Claims: map[string]string{
+					"email":      request.Requester,
+					"given_name": request.Requester,
+					"iat":        strconv.FormatInt(issuedAt.Unix(), 10),
+				},
+			},
+		}
+	}
+	switch body := request.Body.(type) {
+	case nil:
+	case string:
+		event.Body = body
+	default:
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+		event.Body = string(bodyBytes)
+	}
+	response, err := h.handler(context.Background(), event)
+	if err != nil {
+		t.Fatalf("%s returned an error: %v", request.RouteKey, err)
+	}
+	if out != nil && response.StatusCode == http.StatusOK {
+		if err := json.Unmarshal([]byte(response.Body), out); err != nil {
+			t.Fatalf("failed to unmarshal %s response %q: %v", request.RouteKey, response.Body, err)
+		}
+	}
+	return response
+}
+
+// mustCall is call for requests that have to succeed
+func (h *testHandler) mustCall(t *testing.T, request testRequest, out interface{}) {
+	t.Helper()
+	if response := h.call(t, request, out); response.StatusCode != http.StatusOK {
+		t.Fatalf("%s returned %d: %s", request.RouteKey, response.StatusCode, response.Body)
+	}
+}
+
+// errorCode returns the code of an error response
+func errorCode(t *testing.T, response events.APIGatewayV2HTTPResponse) string {
+	t.Helper()
+	var errorMessage ErrorMessage
+	if err := json.Unmarshal([]byte(response.Body), &errorMessage); err != nil {
+		t.Fatalf("failed to unmarshal error response %q: %v", response.Body, err)
+	}
+	return errorMessage.Code
+}
+
+// newTestGame is the body of a game created by tests, starting startsIn after the test clock's
+// current time
+func newTestGame(category string, startsIn time.Duration, numTeams int, teamSize int) map[string]interface{} {
+	return map[string]interface{}{
+		"category":     category,
+		"name":         fmt.Sprintf("%s game", category),
+		"location":     "Main Park",
+		"durationMins": 60,
+		"numTeams":     numTeams,
+		"teamSize":     teamSize,
+		"startTime":    testStart.Add(startsIn).Format(time.RFC3339),
+	}
+}
+
+func (h *testHandler) createGame(t *testing.T, owner string, body map[string]interface{}) Game {
+	t.Helper()
+	var game Game
+	h.mustCall(t, testRequest{RouteKey: "POST /games", Requester: owner, Body: body}, &game)
+	return game
+}
+
+func (h *testHandler) register(t *testing.T, gameID string, player string) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	return h.call(t, testRequest{
+		RouteKey:       "POST /games/{gameID}/registrtation",
+		Requester:      player,
+		PathParameters: map[string]string{"gameID": gameID},
+	}, nil)
+}
+
+func (h *testHandler) drop(t *testing.T, gameID string, player string) Game {
+	t.Helper()
+	var game Game
+	h.mustCall(t, testRequest{
+		RouteKey:       "DELETE /games/{gameID}/registration",
+		Requester:      player,
+		PathParameters: map[string]string{"gameID": gameID},
+	}, &game)
+	return game
+}
+
+// getGame returns the game as requester sees it
+func (h *testHandler) getGame(t *testing.T, gameID string, requester string) Game {
+	t.Helper()
+	var game Game
+	h.mustCall(t, testRequest{
+		RouteKey:       "GET /games/{gameID}",
+		Requester:      requester,
+		PathParameters: map[string]string{"gameID": gameID},
+	}, &game)
+	return game
+}
+
+// userIDs lists the players' user IDs in order
+func userIDs(players []RosterEntry) []string {
+	ids := make([]string, len(players))
+	for i, player := range players {
+		ids[i] = player.UserID
+	}
+	return ids
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCreateAndGetGame(t *testing.T) {
+	h := newTestHandler(t)
+	created := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 2, 5))
+	if created.GameID == "" || created.Status != GameStatusScheduled || created.Version != 0 {
+		t.Fatalf("unexpected created game %+v", created)
+	}
+	got := h.getGame(t, created.GameID, "owner@example.com")
+	if got.Name != "soccer game" || got.Owner != "owner@example.com" || !got.StartTime.Equal(testStart.Add(48*time.Hour)) {
+		t.Errorf("owner got %+v", got)
+	}
+	other := h.getGame(t, created.GameID, "player@example.com")
+	if other.Owner != "" || other.OwnerPlayerID != h.PlayerIDs.PlayerID("owner@example.com") {
+		t.Errorf("other players should see the owner's player ID only, got owner %q and player ID %q", other.Owner, other.OwnerPlayerID)
+	}
+}
+
+func TestGetGameNotFound(t *testing.T) {
+	h := newTestHandler(t)
+	response := h.call(t, testRequest{
+		RouteKey:       "GET /games/{gameID}",
+		Requester:      "player@example.com",
+		PathParameters: map[string]string{"gameID": "missing"},
+	}, nil)
+	if response.StatusCode != http.StatusNotFound || errorCode(t, response) != "game_not_found" {
+		t.Errorf("got %d %s", response.StatusCode, response.Body)
+	}
+}
+
+func TestCreateGameRejectsInvalidBody(t *testing.T) {
+	h := newTestHandler(t)
+	for name, body := range map[string]interface{}{
+		"malformed": "{",
+		"negative offer hours": func() map[string]interface{} {
+			body := newTestGame("soccer", 48*time.Hour, 2, 5)
+			body["promotionOfferHours"] = -1
+			return body
+		}(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			response := h.call(t, testRequest{RouteKey: "POST /games", Requester: "owner@example.com", Body: body}, nil)
+			if response.StatusCode != http.StatusBadRequest {
+				t.Errorf("got %d %s", response.StatusCode, response.Body)
+			}
+		})
+	}
+}
+
+func TestGetGamesByCategory(t *testing.T) {
+	h := newTestHandler(t)
+	later := h.createGame(t, "owner@example.com", newTestGame("soccer", 72*time.Hour, 2, 5))
+	sooner := h.createGame(t, "owner@example.com", newTestGame("soccer", 24*time.Hour, 2, 5))
+	h.createGame(t, "owner@example.com", newTestGame("basketball", 24*time.Hour, 2, 5))
+	var gameList GameList
+	h.mustCall(t, testRequest{
+		RouteKey:        "GET /games",
+		Requester:       "player@example.com",
+		QueryParameters: map[string]string{"category": "soccer", "from": testStart.Format(time.RFC3339)},
+	}, &gameList)
+	if len(gameList.Games) != 2 || gameList.Games[0].GameID != sooner.GameID || gameList.Games[1].GameID != later.GameID {
+		t.Errorf("expected the soccer games soonest first, got %+v", gameList.Games)
+	}
+	response := h.call(t, testRequest{RouteKey: "GET /games", Requester: "player@example.com"}, nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a missing category to be rejected, got %d", response.StatusCode)
+	}
+}
+
+func TestRegisterFillsRosterThenWaitList(t *testing.T) {
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 1, 2))
+	for _, player := range []string{"a@example.com", "b@example.com", "c@example.com", "a@example.com"} {
+		if response := h.register(t, game.GameID, player); response.StatusCode != http.StatusOK {
+			t.Fatalf("registering %s returned %d: %s", player, response.StatusCode, response.Body)
+		}
+	}
+	got := h.getGame(t, game.GameID, "owner@example.com")
+	if !equalStrings(userIDs(got.Roster), []string{"a@example.com", "b@example.com"}) || !equalStrings(userIDs(got.WaitList), []string{"c@example.com"}) {
+		t.Errorf("got roster %v and waitlist %v", userIDs(got.Roster), userIDs(got.WaitList))
+	}
+	if response := h.register(t, "missing", "a@example.com"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("registering for a missing game returned %d", response.StatusCode)
+	}
+}
+
+func TestDropPromotesFromWaitList(t *testing.T) {
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 1, 1))
+	h.register(t, game.GameID, "a@example.com")
+	h.register(t, game.GameID, "b@example.com")
+	h.drop(t, game.GameID, "a@example.com")
+	got := h.getGame(t, game.GameID, "owner@example.com")
+	if !equalStrings(userIDs(got.Roster), []string{"b@example.com"}) || len(got.WaitList) != 0 {
+		t.Errorf("got roster %v and waitlist %v", userIDs(got.Roster), userIDs(got.WaitList))
+	}
+	// dropping a game you're not in changes nothing
+	h.drop(t, game.GameID, "a@example.com")
+	if again := h.getGame(t, game.GameID, "owner@example.com"); again.Version != got.Version {
+		t.Errorf("dropping twice changed the game from version %d to %d", got.Version, again.Version)
+	}
+}
+
+// racingGameStore runs race once, just after the next game is read, as a request slipping in
+// between another request's read and write would
+type racingGameStore struct {
+	GameStore
+	race func()
+}
+
+func (s *racingGameStore) GetGame(ctx context.Context, gameID string) (GameRecord, error) {
+	gameRecord, err := s.GameStore.GetGame(ctx, gameID)
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return gameRecord, err
+}
+
+func TestRegisterRacingCancel(t *testing.T) {
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 1, 2))
+	store := &racingGameStore{GameStore: h.GameStore}
+	h.GameStore = store
+	store.race = func() {
+		h.mustCall(t, testRequest{
+			RouteKey:       "POST /games/{gameID}/cancel",
+			Requester:      "owner@example.com",
+			PathParameters: map[string]string{"gameID": game.GameID},
+		}, nil)
+	}
+	response := h.register(t, game.GameID, "a@example.com")
+	if response.StatusCode != http.StatusConflict || errorCode(t, response) != "game_cancelled" {
+		t.Errorf("registering as the game was cancelled returned %d: %s", response.StatusCode, response.Body)
+	}
+	if got := h.getGame(t, game.GameID, "owner@example.com"); len(got.Roster) != 0 {
+		t.Errorf("cancelled game got roster %v", userIDs(got.Roster))
+	}
+}
+
+func TestDropRacingRegistration(t *testing.T) {
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 1, 1))
+	h.register(t, game.GameID, "a@example.com")
+	h.register(t, game.GameID, "b@example.com")
+	store := &racingGameStore{GameStore: h.GameStore}
+	h.GameStore = store
+	// the waitlist changes hands without changing size
+	store.race = func() {
+		h.drop(t, game.GameID, "b@example.com")
+		if response := h.register(t, game.GameID, "c@example.com"); response.StatusCode != http.StatusOK {
+			t.Fatalf("registering returned %d: %s", response.StatusCode, response.Body)
+		}
+	}
+	h.drop(t, game.GameID, "a@example.com")
+	got := h.getGame(t, game.GameID, "owner@example.com")
+	if !equalStrings(userIDs(got.Roster), []string{"c@example.com"}) || len(got.WaitList) != 0 {
+		t.Errorf("got roster %v and waitlist %v", userIDs(got.Roster), userIDs(got.WaitList))
+	}
+}
+
+func (h *testHandler) pay(t *testing.T, gameID string, player string, paymentMethod string) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	return h.call(t, testRequest{
+		RouteKey:       "POST /games/{gameID}/registration/payment",
+		Requester:      player,
+		PathParameters: map[string]string{"gameID": gameID},
+		Body:           PaymentRequest{PaymentMethod: paymentMethod},
+	}, nil)
+}
+
+// ledger returns the game's ledger entries as its owner sees them
+func (h *testHandler) ledger(t *testing.T, gameID string, owner string) []LedgerEntry {
+	t.Helper()
+	var ledger Ledger
+	h.mustCall(t, testRequest{
+		RouteKey:       "GET /games/{gameID}/payments",
+		Requester:      owner,
+		PathParameters: map[string]string{"gameID": gameID},
+	}, &ledger)
+	return ledger.Entries
+}
+
+// chargeStatus is the status of the player's charge on the game
+func chargeStatus(entries []LedgerEntry, player string) LedgerEntryStatus {
+	for _, entry := range entries {
+		if entry.Kind == LedgerEntryCharge && entry.UserID == player {
+			return entry.Status
+		}
+	}
+	return ""
+}
+
+func TestRefundFollowsPolicyWindows(t *testing.T) {
+	h := newTestHandler(t)
+	body := newTestGame("soccer", 72*time.Hour, 1, 5)
+	body["signupFeeCents"] = 1000
+	body["refundPolicy"] = RefundPolicy{FullRefundHours: 48, PartialRefundPercent: 50, NoRefundHours: 2}
+	game := h.createGame(t, "owner@example.com", body)
+	players := []string{"early@example.com", "middle@example.com", "late@example.com"}
+	for _, player := range players {
+		h.register(t, game.GameID, player)
+		if response := h.pay(t, game.GameID, player, "pm_card_visa"); response.StatusCode != http.StatusOK {
+			t.Fatalf("paying returned %d: %s", response.StatusCode, response.Body)
+		}
+	}
+	// 72, 24 and 1 hours before the start
+	h.drop(t, game.GameID, "early@example.com")
+	h.clock.Advance(48 * time.Hour)
+	h.drop(t, game.GameID, "middle@example.com")
+	h.clock.Advance(23 * time.Hour)
+	h.drop(t, game.GameID, "late@example.com")
+	entries := h.ledger(t, game.GameID, "owner@example.com")
+	for player, want := range map[string]LedgerEntryStatus{
+		"early@example.com":  LedgerEntryRefunded,
+		"middle@example.com": LedgerEntryPartiallyRefunded,
+		"late@example.com":   LedgerEntryForfeited,
+	} {
+		if got := chargeStatus(entries, player); got != want {
+			t.Errorf("%s's charge is %s, expected %s", player, got, want)
+		}
+	}
+	refunded := map[string]int{}
+	for _, entry := range entries {
+		if entry.Kind == LedgerEntryRefund {
+			refunded[entry.UserID] += entry.AmountCents
+		}
+	}
+	if refunded["early@example.com"] != 1000 || refunded["middle@example.com"] != 500 || refunded["late@example.com"] != 0 {
+		t.Errorf("got refunds %v", refunded)
+	}
+}
+
+// removePlayer has the game's owner take player off list
+func (h *testHandler) removePlayer(t *testing.T, gameID string, list PlayerList, player string) Game {
+	t.Helper()
+	entry, ok := h.rosterEntry(t, gameID, player)
+	if list == PlayerListWaitList {
+		game := h.getGame(t, gameID, "owner@example.com")
+		i := indexOfPlayer(game.WaitList, player)
+		entry, ok = RosterEntry{}, i >= 0
+		if ok {
+			entry = game.WaitList[i]
+		}
+	}
+	if !ok {
+		t.Fatalf("%s isn't on the game's %s", player, list)
+	}
+	routeKey := "DELETE /games/{gameID}/roster/{playerID}"
+	if list == PlayerListWaitList {
+		routeKey = "DELETE /games/{gameID}/waitlist/{playerID}"
+	}
+	var game Game
+	h.mustCall(t, testRequest{
+		RouteKey:       routeKey,
+		Requester:      "owner@example.com",
+		PathParameters: map[string]string{"gameID": gameID, "playerID": entry.PlayerID},
+	}, &game)
+	return game
+}
+
+func TestOwnerRemovalSettlesPayments(t *testing.T) {
+	h := newTestHandler(t)
+	body := newTestGame("soccer", 72*time.Hour, 1, 2)
+	body["signupFeeCents"] = 1000
+	body["refundPolicy"] = RefundPolicy{FullRefundHours: 48, PartialRefundPercent: 50, NoRefundHours: 2, RefundWhenSpotFilled: true}
+	game := h.createGame(t, "owner@example.com", body)
+	h.register(t, game.GameID, "paid@example.com")
+	if response := h.pay(t, game.GameID, "paid@example.com", "pm_card_visa"); response.StatusCode != http.StatusOK {
+		t.Fatalf("paying returned %d: %s", response.StatusCode, response.Body)
+	}
+	h.register(t, game.GameID, "processing@example.com")
+	if response := h.pay(t, game.GameID, "processing@example.com", fakeProcessingPaymentMethod); response.StatusCode != http.StatusOK {
+		t.Fatalf("paying returned %d: %s", response.StatusCode, response.Body)
+	}
+	h.register(t, game.GameID, "waiting@example.com")
+	h.register(t, game.GameID, "also-waiting@example.com")
+	h.clock.Advance(48 * time.Hour)
+
+	// within the partial refund window, but the spot goes to the waitlist so it's refunded in full
+	updated := h.removePlayer(t, game.GameID, PlayerListRoster, "paid@example.com")
+	if got := userIDs(updated.Roster); !equalStrings(got, []string{"processing@example.com", "waiting@example.com"}) {
+		t.Fatalf("expected the waitlist promoted, got %v", got)
+	}
+	h.removePlayer(t, game.GameID, PlayerListWaitList, "also-waiting@example.com")
+	h.removePlayer(t, game.GameID, PlayerListRoster, "processing@example.com")
+	entries := h.ledger(t, game.GameID, "owner@example.com")
+	if got := chargeStatus(entries, "paid@example.com"); got != LedgerEntryRefunded {
+		t.Errorf("expected the removed player refunded, got %s: %+v", got, entries)
+	}
+	if got := chargeStatus(entries, "processing@example.com"); got != LedgerEntryExpired {
+		t.Errorf("expected the unsettled charge expired, got %s", got)
+	}
+	if refundsFor(entries) != 1 {
+		t.Errorf("expected one refund, got %+v", entries)
+	}
+}
+
+func TestExpireHoldsPassesOnExpiredOffers(t *testing.T) {
+	h := newTestHandler(t)
+	body := newTestGame("soccer", 48*time.Hour, 1, 1)
+	body["promotionOfferHours"] = 2
+	game := h.createGame(t, "owner@example.com", body)
+	for _, player := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		h.register(t, game.GameID, player)
+	}
+	h.drop(t, game.GameID, "a@example.com")
+	got := h.getGame(t, game.GameID, "owner@example.com")
+	if len(got.Roster) != 1 || got.Roster[0].Status != RegistrationStatusOffered || !got.Roster[0].OfferExpiresAt.Equal(testStart.Add(2*time.Hour)) {
+		t.Fatalf("expected b to be offered the spot for 2 hours, got %+v", got.Roster)
+	}
+	h.clock.Advance(2*time.Hour - time.Second)
+	if err := h.ExpireHolds(context.Background()); err != nil {
+		t.Fatalf("ExpireHolds returned an error: %v", err)
+	}
+	if got := h.getGame(t, game.GameID, "owner@example.com"); !equalStrings(userIDs(got.Roster), []string{"b@example.com"}) {
+		t.Fatalf("offer expired early, roster is %v", userIDs(got.Roster))
+	}
+	h.clock.Advance(time.Second)
+	if err := h.ExpireHolds(context.Background()); err != nil {
+		t.Fatalf("ExpireHolds returned an error: %v", err)
+	}
+	got = h.getGame(t, game.GameID, "owner@example.com")
+	if !equalStrings(userIDs(got.Roster), []string{"c@example.com"}) || len(got.WaitList) != 0 {
+		t.Errorf("got roster %v and waitlist %v", userIDs(got.Roster), userIDs(got.WaitList))
+	}
+	if !got.Roster[0].OfferExpiresAt.Equal(testStart.Add(4 * time.Hour)) {
+		t.Errorf("c's offer should run from when b's expired, got %v", got.Roster[0].OfferExpiresAt)
+	}
+	kinds := h.notifier.kinds("b@example.com")
+	if len(kinds) != 2 || kinds[1] != NotificationKindWaitListOfferExpired {
+		t.Errorf("b got notifications %v", kinds)
+	}
+}
+
+func TestVenueSplitLocksAtCutoff(t *testing.T) {
+	h := newTestHandler(t)
+	body := newTestGame("soccer", 48*time.Hour, 1, 4)
+	body["splitFeeCents"] = 1000
+	body["splitLockHours"] = 24
+	game := h.createGame(t, "owner@example.com", body)
+	h.register(t, game.GameID, "a@example.com")
+	h.register(t, game.GameID, "b@example.com")
+	getSplit := func() VenueSplit {
+		var split VenueSplit
+		h.mustCall(t, testRequest{
+			RouteKey:       "GET /games/{gameID}/split",
+			Requester:      "owner@example.com",
+			PathParameters: map[string]string{"gameID": game.GameID},
+		}, &split)
+		return split
+	}
+	markPaid := func(player string) events.APIGatewayV2HTTPResponse {
+		return h.call(t, testRequest{
+			RouteKey:       "PATCH /games/{gameID}/split/{playerID}",
+			Requester:      "owner@example.com",
+			PathParameters: map[string]string{"gameID": game.GameID, "playerID": h.PlayerIDs.PlayerID(player)},
+			Body:           map[string]bool{"paid": true},
+		}, nil)
+	}
+	h.clock.Advance(24*time.Hour - time.Second)
+	if split := getSplit(); split.Locked || len(split.Shares) != 2 || split.ShareCents != 500 {
+		t.Fatalf("expected an unlocked split between 2 players, got %+v", split)
+	}
+	if response := markPaid("a@example.com"); response.StatusCode != http.StatusConflict || errorCode(t, response) != "split_not_locked" {
+		t.Errorf("marking a share before the lock returned %d: %s", response.StatusCode, response.Body)
+	}
+	h.clock.Advance(time.Second)
+	// registering after the cutoff locks the split as the roster stood first
+	h.register(t, game.GameID, "c@example.com")
+	split := getSplit()
+	if !split.Locked || len(split.Shares) != 2 || !split.LocksAt.Equal(testStart.Add(24*time.Hour)) {
+		t.Fatalf("expected the split locked between a and b, got %+v", split)
+	}
+	if response := markPaid("a@example.com"); response.StatusCode != http.StatusOK {
+		t.Errorf("marking a share after the lock returned %d: %s", response.StatusCode, response.Body)
+	}
+	if response := markPaid("c@example.com"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("c joined after the lock so has no share, got %d: %s", response.StatusCode, response.Body)
+	}
+}
+
+func TestPublicRoutesWithoutAuthorizer(t *testing.T) {
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 2, 5))
+	// API Gateway sends public routes without an authorizer at all
+	for _, event := range []events.APIGatewayV2HTTPRequest{
+		{RouteKey: "GET /games/{gameID}", PathParameters: map[string]string{"gameID": game.GameID}},
+		{RouteKey: "GET /games", QueryStringParameters: map[string]string{"category": "soccer", "from": testStart.Format(time.RFC3339)}},
+	} {
+		response, err := h.handler(context.Background(), event)
+		if err != nil || response.StatusCode != http.StatusOK {
+			t.Fatalf("%s returned %d %v: %s", event.RouteKey, response.StatusCode, err, response.Body)
+		}
+	}
+	if got := h.getGame(t, game.GameID, ""); got.Owner != "" || got.OwnerPlayerID == "" {
+		t.Errorf("anonymous requests should see the owner's player ID only, got %+v", got)
+	}
+	response, err := h.handler(context.Background(), events.APIGatewayV2HTTPRequest{
+		RouteKey:       "POST /games/{gameID}/registrtation",
+		PathParameters: map[string]string{"gameID": game.GameID},
+	})
+	if err != nil || response.StatusCode != http.StatusBadRequest {
+		t.Errorf("registering without a token returned %d %v: %s", response.StatusCode, err, response.Body)
+	}
+}
+
+func TestServeModeMatchesAPIGatewayAuthorization(t *testing.T) {
+	routes := map[string]bool{}
+	for _, route := range apiRoutes {
+		routes[route.RouteKey] = route.Authorized
+	}
+	for _, routeKey := range []string{"GET /games", "GET /games/{gameID}", "POST /auth/signin", "POST /webhooks/payments"} {
+		if routes[routeKey] {
+			t.Errorf("%s is public in API Gateway but authorized in serve mode", routeKey)
+		}
+	}
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 2, 5))
+	server := httptest.NewServer(&HTTPServer{Handler: h.Handler})
+	defer server.Close()
+	response, err := http.Get(server.URL + "/games/" + game.GameID)
+	if err != nil {
+		t.Fatalf("failed to get game: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("GET /games/{gameID} without a token returned %d", response.StatusCode)
+	}
+}
+
+func TestDeleteGameOnlyNotifiesBeforeStart(t *testing.T) {
+	h := newTestHandler(t)
+	upcoming := h.createGame(t, "owner@example.com", newTestGame("soccer", 24*time.Hour, 1, 5))
+	played := h.createGame(t, "owner@example.com", newTestGame("soccer", time.Hour, 1, 5))
+	h.register(t, upcoming.GameID, "a@example.com")
+	h.register(t, played.GameID, "b@example.com")
+	h.clock.Advance(2 * time.Hour)
+	for _, game := range []Game{upcoming, played} {
+		h.mustCall(t, testRequest{
+			RouteKey:       "DELETE /games/{gameID}",
+			Requester:      "owner@example.com",
+			PathParameters: map[string]string{"gameID": game.GameID},
+		}, nil)
+	}
+	if kinds := h.notifier.kinds("a@example.com"); len(kinds) != 1 || kinds[0] != NotificationKindGameCancelled {
+		t.Errorf("expected the upcoming game's player told it was cancelled, got %v", kinds)
+	}
+	if kinds := h.notifier.kinds("b@example.com"); len(kinds) != 0 {
+		t.Errorf("expected no notice for a game that's been played, got %v", kinds)
+	}
+}
+
+func (h *testHandler) updateGame(t *testing.T, gameID string, requester string, body map[string]interface{}) (Game, events.APIGatewayV2HTTPResponse) {
+	t.Helper()
+	var game Game
+	response := h.call(t, testRequest{
+		RouteKey:       "PATCH /games/{gameID}",
+		Requester:      requester,
+		PathParameters: map[string]string{"gameID": gameID},
+		Body:           body,
+	}, &game)
+	return game, response
+}
+
+func TestUpdateGameCapacityMovesPlayersBetweenLists(t *testing.T) {
+	h := newTestHandler(t)
+	body := newTestGame("soccer", 48*time.Hour, 1, 4)
+	body["promotionOfferHours"] = 2
+	game := h.createGame(t, "owner@example.com", body)
+	for _, player := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"} {
+		h.register(t, game.GameID, player)
+	}
+
+	// the latest registrations go back to the front of the waitlist, in order
+	updated, response := h.updateGame(t, game.GameID, "owner@example.com", map[string]interface{}{"teamSize": 2})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("shrinking the game returned %d: %s", response.StatusCode, response.Body)
+	}
+	if !equalStrings(userIDs(updated.Roster), []string{"a@example.com", "b@example.com"}) ||
+		!equalStrings(userIDs(updated.WaitList), []string{"c@example.com", "d@example.com", "e@example.com"}) {
+		t.Fatalf("got roster %v and waitlist %v", userIDs(updated.Roster), userIDs(updated.WaitList))
+	}
+
+	updated, _ = h.updateGame(t, game.GameID, "owner@example.com", map[string]interface{}{"numTeams": 2, "teamSize": 1, "location": "North Field"})
+	if !equalStrings(userIDs(updated.Roster), []string{"a@example.com", "b@example.com"}) || updated.Location != "North Field" {
+		t.Fatalf("expected the roster kept at the same capacity, got %v at %s", userIDs(updated.Roster), updated.Location)
+	}
+	updated, _ = h.updateGame(t, game.GameID, "owner@example.com", map[string]interface{}{"teamSize": 2})
+	if !equalStrings(userIDs(updated.Roster), []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}) {
+		t.Fatalf("expected the waitlist promoted in order, got %v", userIDs(updated.Roster))
+	}
+	if offered := updated.Roster[2]; offered.Status != RegistrationStatusOffered || !offered.OfferExpiresAt.Equal(testStart.Add(2*time.Hour)) {
+		t.Errorf("expected c offered the spot for 2 hours, got %+v", offered)
+	}
+
+	// demoted players lose the offer they held
+	updated, _ = h.updateGame(t, game.GameID, "owner@example.com", map[string]interface{}{"teamSize": 1})
+	if !equalStrings(userIDs(updated.WaitList), []string{"c@example.com", "d@example.com", "e@example.com"}) {
+		t.Fatalf("got waitlist %v", userIDs(updated.WaitList))
+	}
+	if demoted := updated.WaitList[0]; demoted.Status != RegistrationStatusConfirmed || demoted.OfferExpiresAt != nil {
+		t.Errorf("expected c's offer withdrawn, got %+v", demoted)
+	}
+}
+
+func TestUpdateGameRejections(t *testing.T) {
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 1, 4))
+	for _, test := range []struct {
+		name       string
+		requester  string
+		body       map[string]interface{}
+		wantStatus int
+		wantCode   string
+	}{
+		{"not the owner", "a@example.com", map[string]interface{}{"name": "mine"}, http.StatusForbidden, "not_game_owner"},
+		{"stale version", "owner@example.com", map[string]interface{}{"name": "renamed", "version": game.Version + 1}, http.StatusConflict, "concurrent_update"},
+		{"no changes", "owner@example.com", map[string]interface{}{"version": game.Version}, http.StatusBadRequest, ""},
+		{"no teams", "owner@example.com", map[string]interface{}{"numTeams": 0}, http.StatusBadRequest, ""},
+		{"empty location", "owner@example.com", map[string]interface{}{"location": ""}, http.StatusBadRequest, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, response := h.updateGame(t, game.GameID, test.requester, test.body)
+			if response.StatusCode != test.wantStatus || (test.wantCode != "" && errorCode(t, response) != test.wantCode) {
+				t.Errorf("got %d: %s", response.StatusCode, response.Body)
+			}
+		})
+	}
+	if got := h.getGame(t, game.GameID, "owner@example.com"); got.Version != game.Version || got.Name != "soccer game" {
+		t.Errorf("expected the refused updates to leave the game alone, got %+v", got)
+	}
+}
+
+// listGames pages through GET /games limit games at a time and returns every game found
+func (h *testHandler) listGames(t *testing.T, parameters map[string]string, limit int) []Game {
+	t.Helper()
+	query := map[string]string{"limit": strconv.Itoa(limit)}
+	for name, value := range parameters {
+		query[name] = value
+	}
+	games := []Game{}
+	for pages := 0; ; pages++ {
+		if pages == 10 {
+			t.Fatalf("expected paging to end, got %d games", len(games))
+		}
+		var gameList GameList
+		h.mustCall(t, testRequest{RouteKey: "GET /games", Requester: "player@example.com", QueryParameters: query}, &gameList)
+		if len(gameList.Games) > limit {
+			t.Fatalf("asked for %d games, got %d", limit, len(gameList.Games))
+		}
+		games = append(games, gameList.Games...)
+		if gameList.NextCursor == "" {
+			return games
+		}
+		query["cursor"] = gameList.NextCursor
+	}
+}
+
+// gameIDs lists the games' IDs in order
+func gameIDs(games []Game) []string {
+	ids := make([]string, len(games))
+	for i, game := range games {
+		ids[i] = game.GameID
+	}
+	return ids
+}
+
+func TestGetGamesPagesWithCursor(t *testing.T) {
+	h := newTestHandler(t)
+	past := h.createGame(t, "owner@example.com", newTestGame("soccer", -48*time.Hour, 2, 5))
+	tomorrow := []Game{
+		h.createGame(t, "owner@example.com", newTestGame("soccer", 24*time.Hour, 2, 5)),
+		h.createGame(t, "owner@example.com", newTestGame("soccer", 24*time.Hour, 2, 5)),
+	}
+	// games starting together come in ID order
+	if tomorrow[1].GameID < tomorrow[0].GameID {
+		tomorrow[0], tomorrow[1] = tomorrow[1], tomorrow[0]
+	}
+	later := h.createGame(t, "owner@example.com", newTestGame("soccer", 72*time.Hour, 2, 5))
+	nextMonth := h.createGame(t, "owner@example.com", newTestGame("soccer", defaultGamesWindow+time.Hour, 2, 5))
+	h.createGame(t, "owner@example.com", newTestGame("basketball", 24*time.Hour, 2, 5))
+
+	want := []string{tomorrow[0].GameID, tomorrow[1].GameID, later.GameID}
+	for _, limit := range []int{1, 2, 3} {
+		if got := gameIDs(h.listGames(t, map[string]string{"category": "soccer"}, limit)); !equalStrings(got, want) {
+			t.Errorf("paging %d at a time got %v, want the next %v days' games %v", limit, got, defaultGamesWindow, want)
+		}
+	}
+	window := map[string]string{
+		"category": "soccer",
+		"from":     testStart.Add(-72 * time.Hour).Format(time.RFC3339),
+		"to":       testStart.Add(defaultGamesWindow + 2*time.Hour).Format(time.RFC3339),
+	}
+	want = []string{past.GameID, tomorrow[0].GameID, tomorrow[1].GameID, later.GameID, nextMonth.GameID}
+	if got := gameIDs(h.listGames(t, window, 2)); !equalStrings(got, want) {
+		t.Errorf("expected the window's games, past ones included, %v, got %v", want, got)
+	}
+
+	for name, parameters := range map[string]map[string]string{
+		"bad cursor":     {"category": "soccer", "cursor": "not-a-cursor"},
+		"zero limit":     {"category": "soccer", "limit": "0"},
+		"limit too high": {"category": "soccer", "limit": strconv.Itoa(maxGamesPageSize + 1)},
+		"bad from":       {"category": "soccer", "from": "tomorrow"},
+		"backwards":      {"category": "soccer", "from": testStart.Format(time.RFC3339), "to": testStart.Add(-time.Hour).Format(time.RFC3339)},
+	} {
+		response := h.call(t, testRequest{RouteKey: "GET /games", Requester: "player@example.com", QueryParameters: parameters}, nil)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected the query refused, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+}
+
+// myGames returns the IDs of user's games through GET /me/games, paging one game at a time
+func (h *testHandler) myGames(t *testing.T, user string, parameters map[string]string) []string {
+	t.Helper()
+	query := map[string]string{"limit": "1"}
+	for name, value := range parameters {
+		query[name] = value
+	}
+	ids := []string{}
+	for pages := 0; ; pages++ {
+		if pages == 10 {
+			t.Fatalf("expected paging to end, got %v", ids)
+		}
+		var gameList GameList
+		h.mustCall(t, testRequest{RouteKey: "GET /me/games", Requester: user, QueryParameters: query}, &gameList)
+		ids = append(ids, gameIDs(gameList.Games)...)
+		if gameList.NextCursor == "" {
+			return ids
+		}
+		query["cursor"] = gameList.NextCursor
+	}
+}
+
+func TestGetMyGamesFollowsRegistrations(t *testing.T) {
+	for name, newHandler := range map[string]func(t *testing.T) *testHandler{
+		"memory": newTestHandler,
+		"sql":    newSQLTestHandler,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newHandler(t)
+			played := h.createGame(t, "owner@example.com", newTestGame("soccer", -24*time.Hour, 1, 2))
+			tomorrow := h.createGame(t, "owner@example.com", newTestGame("soccer", 24*time.Hour, 1, 1))
+			dropped := h.createGame(t, "owner@example.com", newTestGame("basketball", 48*time.Hour, 1, 1))
+			cancelled := h.createGame(t, "owner@example.com", newTestGame("soccer", 72*time.Hour, 1, 1))
+			for _, game := range []Game{played, tomorrow, dropped, cancelled} {
+				h.register(t, game.GameID, "a@example.com")
+			}
+			h.register(t, tomorrow.GameID, "b@example.com")
+			h.drop(t, dropped.GameID, "a@example.com")
+			h.mustCall(t, testRequest{
+				RouteKey:       "POST /games/{gameID}/cancel",
+				Requester:      "owner@example.com",
+				PathParameters: map[string]string{"gameID": cancelled.GameID},
+			}, nil)
+
+			for _, test := range []struct {
+				name       string
+				user       string
+				parameters map[string]string
+				want       []string
+			}{
+				{"upcoming as a player", "a@example.com", nil, []string{tomorrow.GameID}},
+				{"cancelled included", "a@example.com", map[string]string{"includeCancelled": "true"}, []string{tomorrow.GameID, cancelled.GameID}},
+				{"past games", "a@example.com", map[string]string{"from": testStart.Add(-48 * time.Hour).Format(time.RFC3339)}, []string{played.GameID, tomorrow.GameID}},
+				{"waitlisted", "b@example.com", map[string]string{"role": "waitlist"}, []string{tomorrow.GameID}},
+				{"not yet a player", "b@example.com", map[string]string{"role": "player"}, []string{}},
+				{"owned", "owner@example.com", map[string]string{"role": "owner"}, []string{tomorrow.GameID, dropped.GameID}},
+				{"owns nothing", "a@example.com", map[string]string{"role": "owner"}, []string{}},
+			} {
+				if got := h.myGames(t, test.user, test.parameters); !equalStrings(got, test.want) {
+					t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				}
+			}
+
+			// promotion moves the game from b's waitlist to their roster
+			h.drop(t, tomorrow.GameID, "a@example.com")
+			if got := h.myGames(t, "b@example.com", nil); !equalStrings(got, []string{tomorrow.GameID}) {
+				t.Errorf("expected b playing once promoted, got %v", got)
+			}
+			if got := h.myGames(t, "b@example.com", map[string]string{"role": "waitlist"}); len(got) != 0 {
+				t.Errorf("expected b off the waitlist once promoted, got %v", got)
+			}
+			response := h.call(t, testRequest{RouteKey: "GET /me/games", Requester: "a@example.com", QueryParameters: map[string]string{"role": "referee"}}, nil)
+			if response.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected an unknown role refused, got %d: %s", response.StatusCode, response.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pickupgamesapi/types"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errNoOffer      = types.NewConflictError("no_offer", "you haven't been offered a spot on this game")
+	errOfferExpired = types.NewConflictError("offer_expired", "the offer has expired and passed to the next player")
+)
+
+// ConfirmOffer takes up the spot the requester was offered when promoted from the waitlist.
+// Confirming a spot that's already confirmed changes nothing, and declining is dropping out with
+// DELETE /games/{gameID}/registration. On a game with a signup fee the spot is taken up by paying
+// it instead.
+func (h *Handler) ConfirmOffer(ctx context.Context, gameID string, requester string) (Game, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "ConfirmOffer").Str("gameID", gameID).Str("requester", requester).Logger()
+	logger.Info().Msg("confirming offer")
+	for attempt := 1; ; attempt++ {
+		gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to get game")
+			return Game{}, err
+		}
+		if gameRecord.GameStatus() == GameStatusCancelled {
+			return Game{}, errGameCancelled
+		}
+		i := indexOfPlayer(gameRecord.Roster, requester)
+		if i < 0 {
+			return Game{}, errNoOffer
+		}
+		if gameRecord.Roster[i].Status == RegistrationStatusPendingPayment {
+			return Game{}, errSignupFeeRequired
+		}
+		if gameRecord.Roster[i].Status != RegistrationStatusOffered {
+			return h.presentGame(ctx, requester, gameRecord)
+		}
+		if gameRecord.Roster[i].holdExpired(h.now()) {
+			// the schedule hasn't caught up with it yet, so pass the spot on now
+			if err := h.releaseExpiredHolds(ctx, gameID); err != nil {
+				logger.Error().Err(err).Msg("failed to expire holds")
+			}
+			return Game{}, errOfferExpired
+		}
+		if gameRecord.feeFor(gameRecord.Roster[i]) > 0 && !gameRecord.Roster[i].Paid {
+			return Game{}, errSignupFeeRequired
+		}
+		expectedVersion := gameRecord.Version
+		gameRecord.Roster[i] = gameRecord.Roster[i].withoutHold()
+		updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
+		if errors.Is(err, errConditionFailed) && attempt < maxGameUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to update game")
+			return Game{}, fmt.Errorf("failed to update game: %w", err)
+		}
+		return h.presentGame(ctx, requester, updatedGame)
+	}
+}
+
+// ExpireHolds releases every offered or unpaid spot whose hold has run out. It's meant to run on a
+// schedule, every few minutes, so holds expire on time even when nobody is looking at the game.
+func (h *Handler) ExpireHolds(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("operation", "ExpireHolds").Logger()
+	gameRecords, err := h.GameStore.GetGamesWithExpiredHolds(ctx, h.now().Unix())
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, gameRecord := range gameRecords {
+		if err := h.releaseExpiredHolds(ctx, gameRecord.GameID); err != nil {
+			logger.Error().Err(err).Str("gameID", gameRecord.GameID).Msg("failed to expire holds")
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to expire holds on %d of %d games", failed, len(gameRecords))
+	}
+	return nil
+}
+
+// releaseExpiredHolds takes players whose offers have run out, or who didn't pay in time, off the
+// game and promotes the front of the waitlist into their spots. Once a game has started or been
+// cancelled the spots aren't filled again.
+func (h *Handler) releaseExpiredHolds(ctx context.Context, gameID string) error {
+	for attempt := 1; ; attempt++ {
+		gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+		if errors.Is(err, errGameNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		now := h.now()
+		previousRoster := copyRosterEntries(gameRecord.Roster)
+		roster := []RosterEntry{}
+		expired := []RosterEntry{}
+		for _, entry := range gameRecord.Roster {
+			if entry.holdExpired(now) {
+				expired = append(expired, entry)
+			} else {
+				roster = append(roster, entry)
+			}
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+		if _, err := h.lockSplitIfDue(ctx, gameRecord); err != nil {
+			return err
+		}
+		expectedVersion := gameRecord.Version
+		gameRecord.Roster = roster
+		open := gameRecord.GameStatus() != GameStatusCancelled && gameRecord.StartTime > now.Unix()
+		if open {
+			balancePlayerLists(&gameRecord, now)
+		}
+		updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
+		if errors.Is(err, errConditionFailed) && attempt < maxGameUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update game: %w", err)
+		}
+		for _, entry := range expired {
+			if entry.Status != RegistrationStatusPendingPayment {
+				continue
+			}
+			if err := h.expirePendingCharges(ctx, gameID, entry.UserID); err != nil {
+				log.Ctx(ctx).Error().Err(err).Str("gameID", gameID).Str("userID", entry.UserID).Msg("failed to expire pending charges")
+			}
+		}
+		if open {
+			for _, entry := range expired {
+				h.notifyHoldExpired(ctx, updatedGame, entry)
+			}
+			h.notifyNewHolds(ctx, previousRoster, updatedGame)
+		}
+		return nil
+	}
+}
+
+// notifyNewHolds tells each player promoted into a held spot on the game since previousRoster
+// how long they have to confirm or pay for it. Delivery failures are logged rather than returned
+// as the hold stands either way.
+func (h *Handler) notifyNewHolds(ctx context.Context, previousRoster []RosterEntry, gameRecord GameRecord) {
+	logger := log.Ctx(ctx).With().Str("operation", "notifyNewHolds").Str("gameID", gameRecord.GameID).Logger()
+	for _, entry := range gameRecord.Roster {
+		expiresAt := entry.holdExpiresAt()
+		if expiresAt == nil {
+			continue
+		}
+		if i := indexOfPlayer(previousRoster, entry.UserID); i >= 0 && previousRoster[i].Status == entry.Status {
+			continue
+		}
+		notification := Notification{
+			Kind:      NotificationKindWaitListOffer,
+			Channel:   NotificationChannelEmail,
+			Recipient: entry.UserID,
+			Subject:   "A spot opened up: " + gameRecord.Name,
+			Message: fmt.Sprintf("A spot opened up for you in %s. Confirm it by %s or it will be offered to the next player on the waitlist.",
+				describeGame(gameRecord), expiresAt.UTC().Format(notificationTimeLayout)),
+			Data: map[string]string{
+				"gameId":         gameRecord.GameID,
+				"offerExpiresAt": expiresAt.UTC().Format(time.RFC3339),
+			},
+		}
+		if entry.Status == RegistrationStatusPendingPayment {
+			notification.Kind = NotificationKindPaymentDue
+			notification.Message = fmt.Sprintf("A spot opened up for you in %s. Pay the signup fee by %s or it will go to the next player on the waitlist.",
+				describeGame(gameRecord), expiresAt.UTC().Format(notificationTimeLayout))
+			notification.Data = map[string]string{
+				"gameId":       gameRecord.GameID,
+				"paymentDueAt": expiresAt.UTC().Format(time.RFC3339),
+			}
+		}
+		if err := h.Notifier.Notify(ctx, notification); err != nil {
+			logger.Error().Err(err).Str("recipient", entry.UserID).Msg("failed to send hold notification")
+		}
+	}
+}
+
+// notifyHoldExpired tells a player their hold ran out and they're no longer on the game
+func (h *Handler) notifyHoldExpired(ctx context.Context, gameRecord GameRecord, entry RosterEntry) {
+	notification := Notification{
+		Kind:      NotificationKindWaitListOfferExpired,
+		Channel:   NotificationChannelEmail,
+		Recipient: entry.UserID,
+		Subject:   "Offer expired: " + gameRecord.Name,
+		Message: fmt.Sprintf("Your offer of a spot in %s expired and has passed to the next player. Register again to rejoin the waitlist.",
+			describeGame(gameRecord)),
+		Data: map[string]string{
+			"gameId": gameRecord.GameID,
+		},
+	}
+	if entry.Status == RegistrationStatusPendingPayment {
+		notification.Kind = NotificationKindPaymentExpired
+		notification.Subject = "Spot released: " + gameRecord.Name
+		notification.Message = fmt.Sprintf("The signup fee for %s wasn't paid in time, so your spot was released. Register again to rejoin.",
+			describeGame(gameRecord))
+	}
+	if err := h.Notifier.Notify(ctx, notification); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("gameID", gameRecord.GameID).Str("recipient", entry.UserID).Msg("failed to send hold expiry notification")
+	}
+}
+
+// holdExpiredError is the error for a player acting on a spot whose hold on entry has run out
+func holdExpiredError(entry RosterEntry) error {
+	if entry.Status == RegistrationStatusPendingPayment {
+		return errPaymentHoldExpired
+	}
+	return errOfferExpired
+}
+
+// notificationTimeLayout is how times are written in notification messages
+const notificationTimeLayout = "Mon Jan 2 15:04 MST"
+
+// describeGame names the game, where and when it is for a notification message
+func describeGame(gameRecord GameRecord) string {
+	return fmt.Sprintf("%s at %s on %s", gameRecord.Name, gameRecord.Location,
+		time.Unix(gameRecord.StartTime, 0).UTC().Format(notificationTimeLayout))
+}
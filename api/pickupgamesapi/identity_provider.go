@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"pickupgamesapi/types"
+)
+
+var (
+	errInvalidCredentials  = types.NewUnauthorizedError("invalid_credentials", "incorrect email or password")
+	errUserExists          = types.NewConflictError("user_exists", "user already exists")
+	errUserNotFound        = types.NewNotFoundError("user_not_found", "user not found")
+	errRefreshTokenInvalid = types.NewUnauthorizedError("refresh_token_invalid", "refresh token is invalid, expired or revoked")
+	errInvalidPassword     = types.NewValidationError("invalid_password", "password does not meet the password policy")
+)
+
+// IdentityProvider manages users and the tokens they authenticate with. The handler only sees
+// the claims a provider returns from VerifyToken (or that API Gateway passes through), so any
+// implementation must put the user's email in the ID token's "email" claim.
+type IdentityProvider interface {
+	TokenVerifier
+
+	// CreateUser registers a user without a usable password
+	CreateUser(ctx context.Context, newUserRequest NewUserRequest) (User, error)
+	// GetUser returns a user's attributes or errUserNotFound
+	GetUser(ctx context.Context, email string) (User, error)
+	// UpdateUser sets the user's name and phone number. A changed phone number is no longer
+	// verified.
+	UpdateUser(ctx context.Context, email string, firstName string, lastName string, phoneNumber string) error
+	// MarkVerified records that the user proved ownership of their email or phone number
+	MarkVerified(ctx context.Context, email string, attribute VerificationPurpose) error
+	// SetPassword sets a user's permanent password
+	SetPassword(ctx context.Context, email string, password string) error
+	// Authenticate exchanges an email and password for tokens
+	Authenticate(ctx context.Context, email string, password string) (SignInResponse, error)
+	// Refresh exchanges a refresh token for new access and ID tokens
+	Refresh(ctx context.Context, refreshToken string) (SignInResponse, error)
+	// SignOut revokes every refresh token issued to the user
+	SignOut(ctx context.Context, email string) error
+	// DeleteUser removes the user and revokes their refresh tokens
+	DeleteUser(ctx context.Context, email string) error
+}
+
+// keySetPublisher is implemented by identity providers that sign their own tokens and publish
+// the verification keys from /.well-known/jwks.json
+type keySetPublisher interface {
+	JSONWebKeySet() JSONWebKeySet
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// CognitoIdentityProvider manages users in a Cognito user pool through the admin APIs
+type CognitoIdentityProvider struct {
+	Client     *cognitoidentityprovider.Client
+	UserPoolID string
+	ClientID   string
+
+	tokenVerifier *JWKSTokenVerifier
+}
+
+func NewCognitoIdentityProvider(client *cognitoidentityprovider.Client, region string, userPoolID string, clientID string) *CognitoIdentityProvider {
+	issuer := fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", region, userPoolID)
+	return &CognitoIdentityProvider{
+		Client:        client,
+		UserPoolID:    userPoolID,
+		ClientID:      clientID,
+		tokenVerifier: NewJWKSTokenVerifier(issuer, clientID),
+	}
+}
+
+func (p *CognitoIdentityProvider) CreateUser(ctx context.Context, newUserRequest NewUserRequest) (User, error) {
+	adminCreateUserInput := &cognitoidentityprovider.AdminCreateUserInput{
+		UserPoolId: aws.String(p.UserPoolID),
+		Username:   aws.String(newUserRequest.Email),
+		UserAttributes: []types.AttributeType{
+			{
+				Name:  aws.String("email"),
+				Value: aws.String(newUserRequest.Email),
+			},
+			{
+				Name:  aws.String("phone_number"),
+				Value: aws.String(newUserRequest.PhoneNumber),
+			},
+			{
+				Name:  aws.String("given_name"),
+				Value: aws.String(newUserRequest.FirstName),
+			},
+			{
+				Name:  aws.String("family_name"),
+				Value: aws.String(newUserRequest.LastName),
+			},
+		},
+		MessageAction: types.MessageActionTypeSuppress,
+	}
+	_, err := p.Client.AdminCreateUser(ctx, adminCreateUserInput)
+	if err != nil {
+		var usernameExists *types.UsernameExistsException
+		if errors.As(err, &usernameExists) {
+			return User{}, errUserExists
+		}
+		return User{}, fmt.Errorf("error creating user: %w", upstreamError("Cognito", err))
+	}
+	return User{
+		Email:       newUserRequest.Email,
+		FirstName:   newUserRequest.FirstName,
+		LastName:    newUserRequest.LastName,
+		PhoneNumber: newUserRequest.PhoneNumber,
+	}, nil
+}
+
+func (p *CognitoIdentityProvider) GetUser(ctx context.Context, email string) (User, error) {
+	adminGetUserOutput, err := p.Client.AdminGetUser(ctx, &cognitoidentityprovider.AdminGetUserInput{
+		UserPoolId: aws.String(p.UserPoolID),
+		Username:   aws.String(email),
+	})
+	if err != nil {
+		var userNotFound *types.UserNotFoundException
+		if errors.As(err, &userNotFound) {
+			return User{}, errUserNotFound
+		}
+		return User{}, fmt.Errorf("error getting user: %w", upstreamError("Cognito", err))
+	}
+	attributes := map[string]string{}
+	for _, attribute := range adminGetUserOutput.UserAttributes {
+		attributes[aws.ToString(attribute.Name)] = aws.ToString(attribute.Value)
+	}
+	return User{
+		Email:               attributes["email"],
+		FirstName:           attributes["given_name"],
+		LastName:            attributes["family_name"],
+		PhoneNumber:         attributes["phone_number"],
+		EmailVerified:       attributes["email_verified"] == "true",
+		PhoneNumberVerified: attributes["phone_number_verified"] == "true",
+	}, nil
+}
+
+func (p *CognitoIdentityProvider) UpdateUser(ctx context.Context, email string, firstName string, lastName string, phoneNumber string) error {
+	user, err := p.GetUser(ctx, email)
+	if err != nil {
+		return err
+	}
+	userAttributes := []types.AttributeType{
+		{
+			Name:  aws.String("given_name"),
+			Value: aws.String(firstName),
+		},
+		{
+			Name:  aws.String("family_name"),
+			Value: aws.String(lastName),
+		},
+	}
+	if user.PhoneNumber != phoneNumber {
+		userAttributes = append(userAttributes, types.AttributeType{
+			Name:  aws.String("phone_number"),
+			Value: aws.String(phoneNumber),
+		}, types.AttributeType{
+			Name:  aws.String("phone_number_verified"),
+			Value: aws.String("false"),
+		})
+	}
+	_, err = p.Client.AdminUpdateUserAttributes(ctx, &cognitoidentityprovider.AdminUpdateUserAttributesInput{
+		UserPoolId:     aws.String(p.UserPoolID),
+		Username:       aws.String(email),
+		UserAttributes: userAttributes,
+	})
+	if err != nil {
+		return fmt.Errorf("error updating user: %w", upstreamError("Cognito", err))
+	}
+	return nil
+}
+
+func (p *CognitoIdentityProvider) MarkVerified(ctx context.Context, email string, attribute VerificationPurpose) error {
+	verifiedAttribute := "email_verified"
+	if attribute == VerificationPurposePhoneNumber {
+		verifiedAttribute = "phone_number_verified"
+	}
+	_, err := p.Client.AdminUpdateUserAttributes(ctx, &cognitoidentityprovider.AdminUpdateUserAttributesInput{
+		UserPoolId: aws.String(p.UserPoolID),
+		Username:   aws.String(email),
+		UserAttributes: []types.AttributeType{
+			{
+				Name:  aws.String(verifiedAttribute),
+				Value: aws.String("true"),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error marking user verified: %w", upstreamError("Cognito", err))
+	}
+	return nil
+}
+
+func (p *CognitoIdentityProvider) SetPassword(ctx context.Context, email string, password string) error {
+	adminSetUserPasswordInput := &cognitoidentityprovider.AdminSetUserPasswordInput{
+		UserPoolId: aws.String(p.UserPoolID),
+		Username:   aws.String(email),
+		Password:   aws.String(password),
+		Permanent:  true,
+	}
+	_, err := p.Client.AdminSetUserPassword(ctx, adminSetUserPasswordInput)
+	if err != nil {
+		var invalidPassword *types.InvalidPasswordException
+		if errors.As(err, &invalidPassword) {
+			return errInvalidPassword
+		}
+		var userNotFound *types.UserNotFoundException
+		if errors.As(err, &userNotFound) {
+			return errUserNotFound
+		}
+		return fmt.Errorf("error setting user password: %w", upstreamError("Cognito", err))
+	}
+	return nil
+}
+
+func (p *CognitoIdentityProvider) Authenticate(ctx context.Context, email string, password string) (SignInResponse, error) {
+	return p.initiateAuth(ctx, types.AuthFlowTypeAdminNoSrpAuth, map[string]string{
+		"USERNAME": email,
+		"PASSWORD": password,
+	})
+}
+
+func (p *CognitoIdentityProvider) Refresh(ctx context.Context, refreshToken string) (SignInResponse, error) {
+	signInResponse, err := p.initiateAuth(ctx, types.AuthFlowTypeRefreshTokenAuth, map[string]string{
+		"REFRESH_TOKEN": refreshToken,
+	})
+	if errors.Is(err, errInvalidCredentials) {
+		return SignInResponse{}, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return SignInResponse{}, err
+	}
+	// Cognito doesn't rotate refresh tokens, the original stays valid until it expires
+	if signInResponse.RefreshToken == "" {
+		signInResponse.RefreshToken = refreshToken
+	}
+	return signInResponse, nil
+}
+
+// SignOut invalidates the user's refresh and access tokens. ID tokens can't be revoked in Cognito
+// and stay valid at the API Gateway authorizer until they expire, which is why the handler also
+// refuses tokens issued before the user signed out.
+func (p *CognitoIdentityProvider) SignOut(ctx context.Context, email string) error {
+	adminUserGlobalSignOutInput := &cognitoidentityprovider.AdminUserGlobalSignOutInput{
+		UserPoolId: aws.String(p.UserPoolID),
+		Username:   aws.String(email),
+	}
+	_, err := p.Client.AdminUserGlobalSignOut(ctx, adminUserGlobalSignOutInput)
+	if err != nil {
+		var userNotFound *types.UserNotFoundException
+		if errors.As(err, &userNotFound) {
+			return errUserNotFound
+		}
+		return fmt.Errorf("error signing out user: %w", upstreamError("Cognito", err))
+	}
+	return nil
+}
+
+func (p *CognitoIdentityProvider) DeleteUser(ctx context.Context, email string) error {
+	_, err := p.Client.AdminDeleteUser(ctx, &cognitoidentityprovider.AdminDeleteUserInput{
+		UserPoolId: aws.String(p.UserPoolID),
+		Username:   aws.String(email),
+	})
+	if err != nil {
+		var userNotFound *types.UserNotFoundException
+		if errors.As(err, &userNotFound) {
+			return errUserNotFound
+		}
+		return fmt.Errorf("error deleting user: %w", upstreamError("Cognito", err))
+	}
+	return nil
+}
+
+func (p *CognitoIdentityProvider) initiateAuth(ctx context.Context, authFlow types.AuthFlowType, authParameters map[string]string) (SignInResponse, error) {
+	adminInitiateAuthInput := &cognitoidentityprovider.AdminInitiateAuthInput{
+		UserPoolId:     aws.String(p.UserPoolID),
+		ClientId:       aws.String(p.ClientID),
+		AuthFlow:       authFlow,
+		AuthParameters: authParameters,
+	}
+	adminInitiateAuthOutput, err := p.Client.AdminInitiateAuth(ctx, adminInitiateAuthInput)
+	if err != nil {
+		var notAuthorized *types.NotAuthorizedException
+		var userNotFound *types.UserNotFoundException
+		if errors.As(err, &notAuthorized) || errors.As(err, &userNotFound) {
+			return SignInResponse{}, errInvalidCredentials
+		}
+		return SignInResponse{}, fmt.Errorf("error initiating auth flow: %w", upstreamError("Cognito", err))
+	}
+	authenticationResult := adminInitiateAuthOutput.AuthenticationResult
+	if authenticationResult == nil {
+		// a challenge such as NEW_PASSWORD_REQUIRED was returned instead of tokens
+		return SignInResponse{}, fmt.Errorf("error initiating auth flow: unexpected challenge %s", adminInitiateAuthOutput.ChallengeName)
+	}
+	return SignInResponse{
+		AccessToken:     aws.ToString(authenticationResult.AccessToken),
+		RefreshToken:    aws.ToString(authenticationResult.RefreshToken),
+		IDToken:         aws.ToString(authenticationResult.IdToken),
+		TokenExpiration: time.Now().Add(time.Duration(authenticationResult.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (p *CognitoIdentityProvider) VerifyToken(ctx context.Context, token string) (map[string]string, error) {
+	return p.tokenVerifier.VerifyToken(ctx, token)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	localTokenLifetime        = time.Hour
+	localRefreshTokenLifetime = 30 * 24 * time.Hour
+	// localMinPasswordLength matches the Cognito default password policy's length requirement
+	localMinPasswordLength = 8
+)
+
+// localUser is a user held by the LocalIdentityProvider
+type localUser struct {
+	User
+	Subject      string
+	PasswordHash []byte
+}
+
+// localSession is created on sign in and lasts as long as its refresh token. Tokens carry the
+// session ID in their sid claim so that signing out also revokes tokens already issued.
+type localSession struct {
+	Email        string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// LocalIdentityProvider is a self-contained identity provider for development and tests. Users
+// are kept in memory with bcrypt-hashed passwords, and tokens are RS256 JWTs shaped like
+// Cognito's: ID tokens carry the user's attributes and an aud claim, access tokens a client_id.
+type LocalIdentityProvider struct {
+	Issuer   string
+	Audience string
+	// Clock is the current time tokens are issued and verified at, time.Now when nil
+	Clock func() time.Time
+
+	key   *rsa.PrivateKey
+	keyID string
+
+	mu            sync.Mutex
+	users         map[string]*localUser
+	sessions      map[string]localSession
+	refreshTokens map[string]string // refresh token to session ID
+}
+
+func NewLocalIdentityProvider(issuer string, audience string, key *rsa.PrivateKey) *LocalIdentityProvider {
+	publicKeyBytes := x509.MarshalPKCS1PublicKey(&key.PublicKey)
+	keyIDBytes := sha256.Sum256(publicKeyBytes)
+	return &LocalIdentityProvider{
+		Issuer:        strings.TrimSuffix(issuer, "/"),
+		Audience:      audience,
+		key:           key,
+		keyID:         hex.EncodeToString(keyIDBytes[:8]),
+		users:         map[string]*localUser{},
+		sessions:      map[string]localSession{},
+		refreshTokens: map[string]string{},
+	}
+}
+
+// LoadOrGenerateSigningKey reads a PEM encoded RSA private key from path, or generates a new key
+// when path is empty. Tokens signed with a generated key stop verifying when the process exits.
+func LoadOrGenerateSigningKey(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	key, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key in %s is not an RSA key", path)
+	}
+	return key, nil
+}
+
+// now is the provider's current time
+func (p *LocalIdentityProvider) now() time.Time {
+	if p.Clock != nil {
+		return p.Clock()
+	}
+	return time.Now()
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (p *LocalIdentityProvider) CreateUser(ctx context.Context, newUserRequest NewUserRequest) (User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	email := normalizeEmail(newUserRequest.Email)
+	if _, ok := p.users[email]; ok {
+		return User{}, errUserExists
+	}
+	user := User{
+		Email:       newUserRequest.Email,
+		FirstName:   newUserRequest.FirstName,
+		LastName:    newUserRequest.LastName,
+		PhoneNumber: newUserRequest.PhoneNumber,
+	}
+	p.users[email] = &localUser{
+		User:    user,
+		Subject: uuid.New().String(),
+	}
+	return user, nil
+}
+
+func (p *LocalIdentityProvider) GetUser(ctx context.Context, email string) (User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	user, ok := p.users[normalizeEmail(email)]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return user.User, nil
+}
+
+func (p *LocalIdentityProvider) UpdateUser(ctx context.Context, email string, firstName string, lastName string, phoneNumber string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	user, ok := p.users[normalizeEmail(email)]
+	if !ok {
+		return errUserNotFound
+	}
+	if user.PhoneNumber != phoneNumber {
+		user.PhoneNumberVerified = false
+	}
+	user.FirstName = firstName
+	user.LastName = lastName
+	user.PhoneNumber = phoneNumber
+	return nil
+}
+
+func (p *LocalIdentityProvider) MarkVerified(ctx context.Context, email string, attribute VerificationPurpose) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	user, ok := p.users[normalizeEmail(email)]
+	if !ok {
+		return errUserNotFound
+	}
+	switch attribute {
+	case VerificationPurposeEmail:
+		user.EmailVerified = true
+	case VerificationPurposePhoneNumber:
+		user.PhoneNumberVerified = true
+	}
+	return nil
+}
+
+func (p *LocalIdentityProvider) SetPassword(ctx context.Context, email string, password string) error {
+	if len(password) < localMinPasswordLength {
+		return errInvalidPassword
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	user, ok := p.users[normalizeEmail(email)]
+	if !ok {
+		return errUserNotFound
+	}
+	user.PasswordHash = passwordHash
+	return nil
+}
+
+func (p *LocalIdentityProvider) Authenticate(ctx context.Context, email string, password string) (SignInResponse, error) {
+	p.mu.Lock()
+	user, ok := p.users[normalizeEmail(email)]
+	var passwordHash []byte
+	if ok {
+		passwordHash = user.PasswordHash
+	}
+	p.mu.Unlock()
+	if !ok || passwordHash == nil {
+		return SignInResponse{}, errInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(password)); err != nil {
+		return SignInResponse{}, errInvalidCredentials
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	refreshTokenBytes := make([]byte, 32)
+	if _, err := rand.Read(refreshTokenBytes); err != nil {
+		return SignInResponse{}, fmt.Errorf("error generating refresh token: %w", err)
+	}
+	sessionID := uuid.New().String()
+	session := localSession{
+		Email:        normalizeEmail(email),
+		RefreshToken: base64.RawURLEncoding.EncodeToString(refreshTokenBytes),
+		ExpiresAt:    p.now().Add(localRefreshTokenLifetime),
+	}
+	p.sessions[sessionID] = session
+	p.refreshTokens[session.RefreshToken] = sessionID
+	return p.issueTokens(sessionID, session)
+}
+
+func (p *LocalIdentityProvider) Refresh(ctx context.Context, refreshToken string) (SignInResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessionID, ok := p.refreshTokens[refreshToken]
+	if !ok {
+		return SignInResponse{}, errRefreshTokenInvalid
+	}
+	session := p.sessions[sessionID]
+	if p.now().After(session.ExpiresAt) {
+		p.endSession(sessionID)
+		return SignInResponse{}, errRefreshTokenInvalid
+	}
+	return p.issueTokens(sessionID, session)
+}
+
+func (p *LocalIdentityProvider) SignOut(ctx context.Context, email string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	email = normalizeEmail(email)
+	if _, ok := p.users[email]; !ok {
+		return errUserNotFound
+	}
+	for sessionID, session := range p.sessions {
+		if session.Email == email {
+			p.endSession(sessionID)
+		}
+	}
+	return nil
+}
+
+func (p *LocalIdentityProvider) DeleteUser(ctx context.Context, email string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	email = normalizeEmail(email)
+	if _, ok := p.users[email]; !ok {
+		return errUserNotFound
+	}
+	for sessionID, session := range p.sessions {
+		if session.Email == email {
+			p.endSession(sessionID)
+		}
+	}
+	delete(p.users, email)
+	return nil
+}
+
+// endSession revokes a session and its refresh token. The caller must hold p.mu.
+func (p *LocalIdentityProvider) endSession(sessionID string) {
+	delete(p.refreshTokens, p.sessions[sessionID].RefreshToken)
+	delete(p.sessions, sessionID)
+}
+
+// issueTokens signs new ID and access tokens for a session. The caller must hold p.mu.
+func (p *LocalIdentityProvider) issueTokens(sessionID string, session localSession) (SignInResponse, error) {
+	user, ok := p.users[session.Email]
+	if !ok {
+		return SignInResponse{}, errRefreshTokenInvalid
+	}
+	now := p.now()
+	expiresAt := now.Add(localTokenLifetime)
+	idToken, err := p.sign(jwt.MapClaims{
+		"iss":                   p.Issuer,
+		"sub":                   user.Subject,
+		"sid":                   sessionID,
+		"aud":                   p.Audience,
+		"token_use":             "id",
+		"email":                 user.Email,
+		"given_name":            user.FirstName,
+		"family_name":           user.LastName,
+		"phone_number":          user.PhoneNumber,
+		"email_verified":        user.EmailVerified,
+		"phone_number_verified": user.PhoneNumberVerified,
+		"iat":                   now.Unix(),
+		"exp":                   expiresAt.Unix(),
+		"jti":                   uuid.New().String(),
+	})
+	if err != nil {
+		return SignInResponse{}, err
+	}
+	accessToken, err := p.sign(jwt.MapClaims{
+		"iss":       p.Issuer,
+		"sub":       user.Subject,
+		"sid":       sessionID,
+		"client_id": p.Audience,
+		"token_use": "access",
+		"username":  user.Email,
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+		"jti":       uuid.New().String(),
+	})
+	if err != nil {
+		return SignInResponse{}, err
+	}
+	return SignInResponse{
+		AccessToken:     accessToken,
+		RefreshToken:    session.RefreshToken,
+		IDToken:         idToken,
+		TokenExpiration: expiresAt,
+	}, nil
+}
+
+func (p *LocalIdentityProvider) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.keyID
+	signedToken, err := token.SignedString(p.key)
+	if err != nil {
+		return "", fmt.Errorf("error signing token: %w", err)
+	}
+	return signedToken, nil
+}
+
+func (p *LocalIdentityProvider) VerifyToken(ctx context.Context, token string) (map[string]string, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if kid, _ := t.Header["kid"].(string); kid != p.keyID {
+			return nil, errors.New("unknown key ID")
+		}
+		return &p.key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(p.Issuer), jwt.WithExpirationRequired(), jwt.WithTimeFunc(p.now))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidToken, err.Error())
+	}
+	if !hasAudience(claims, p.Audience) {
+		return nil, fmt.Errorf("%w: token is not intended for this client", errInvalidToken)
+	}
+	sessionID, _ := claims["sid"].(string)
+	p.mu.Lock()
+	_, ok := p.sessions[sessionID]
+	p.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: token has been revoked", errInvalidToken)
+	}
+	return stringClaims(claims), nil
+}
+
+func (p *LocalIdentityProvider) JSONWebKeySet() JSONWebKeySet {
+	return JSONWebKeySet{
+		Keys: []JSONWebKey{NewJSONWebKey(p.keyID, &p.key.PublicKey)},
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignUpAndSignInWithLocalProvider(t *testing.T) {
+	h := newTestHandler(t)
+	newUserRequest := NewUserRequest{
+		FirstName:   "Alex",
+		LastName:    "Player",
+		Email:       "Alex@Example.com",
+		Password:    "Password1!",
+		PhoneNumber: "+15555550100",
+	}
+	var user User
+	h.mustCall(t, testRequest{RouteKey: "POST /auth/signup", Body: newUserRequest}, &user)
+	if user.Email != "Alex@Example.com" || user.FirstName != "Alex" || user.EmailVerified {
+		t.Errorf("got user %+v", user)
+	}
+	if response := h.call(t, testRequest{RouteKey: "POST /auth/signup", Body: newUserRequest}, nil); response.StatusCode != http.StatusConflict || errorCode(t, response) != "user_exists" {
+		t.Errorf("expected a second sign up refused, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	signIn := func(password string) (SignInResponse, int) {
+		var signInResponse SignInResponse
+		response := h.call(t, testRequest{RouteKey: "POST /auth/signin", Body: SignInRequest{Email: "alex@example.com", Password: password}}, &signInResponse)
+		return signInResponse, response.StatusCode
+	}
+	if _, status := signIn("Password2!"); status != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password refused, got %d", status)
+	}
+	tokens, status := signIn("Password1!")
+	if status != http.StatusOK || tokens.IDToken == "" || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("signing in returned %d %+v", status, tokens)
+	}
+	if !tokens.TokenExpiration.Equal(testStart.Add(localTokenLifetime)) {
+		t.Errorf("expected the tokens to expire in %v, got %v", localTokenLifetime, tokens.TokenExpiration)
+	}
+	claims, err := h.identity.VerifyToken(context.Background(), tokens.IDToken)
+	if err != nil {
+		t.Fatalf("failed to verify ID token: %v", err)
+	}
+	if claims["email"] != "Alex@Example.com" || claims["given_name"] != "Alex" || claims["token_use"] != "id" || claims["email_verified"] != "false" {
+		t.Errorf("got claims %v", claims)
+	}
+}
+
+func TestJWKSVerifierAcceptsLocalTokens(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	tokens := h.signIn(t, "a@example.com")
+	server := httptest.NewServer(&HTTPServer{Handler: h.Handler, TokenVerifier: h.identity})
+	defer server.Close()
+	verifier := NewJWKSTokenVerifier(h.identity.Issuer, h.identity.Audience)
+	verifier.JWKSURL = server.URL + "/.well-known/jwks.json"
+
+	for name, token := range map[string]string{"ID": tokens.IDToken, "access": tokens.AccessToken} {
+		claims, err := verifier.VerifyToken(context.Background(), token)
+		if err != nil {
+			t.Fatalf("expected the %s token verified with the published keys, got %v", name, err)
+		}
+		if claims["iss"] != h.identity.Issuer || claims["sid"] == "" {
+			t.Errorf("got %s token claims %v", name, claims)
+		}
+	}
+
+	// another client's tokens are signed with the same key
+	other := NewLocalIdentityProvider(h.identity.Issuer, "other-client", testSigningKey)
+	other.Clock = h.clock.Now
+	if _, err := other.CreateUser(context.Background(), NewUserRequest{Email: "a@example.com"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if err := other.SetPassword(context.Background(), "a@example.com", "Password1!"); err != nil {
+		t.Fatalf("failed to set password: %v", err)
+	}
+	otherTokens, err := other.Authenticate(context.Background(), "a@example.com", "Password1!")
+	if err != nil {
+		t.Fatalf("failed to sign in: %v", err)
+	}
+	if _, err := verifier.VerifyToken(context.Background(), otherTokens.IDToken); !errors.Is(err, errInvalidToken) {
+		t.Errorf("expected another client's token refused, got %v", err)
+	}
+	// our header and signature with the other token's claims
+	parts, otherParts := strings.Split(tokens.IDToken, "."), strings.Split(otherTokens.IDToken, ".")
+	tampered := strings.Join([]string{parts[0], otherParts[1], parts[2]}, ".")
+	if _, err := verifier.VerifyToken(context.Background(), tampered); !errors.Is(err, errInvalidToken) {
+		t.Errorf("expected a tampered token refused, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"pickupgamesapi/types"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minJWKSRefreshInterval limits how often an unknown key ID triggers a JWKS refetch
+const minJWKSRefreshInterval = 5 * time.Minute
+
+var errInvalidToken = types.NewUnauthorizedError("invalid_token", "invalid token")
+
+// TokenVerifier verifies a bearer token and returns its claims in the same string form
+// API Gateway places in Authorizer.JWT.Claims
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, token string) (map[string]string, error)
+}
+
+// JSONWebKey is the subset of an RSA JSON Web Key used to verify RS256 signatures
+type JSONWebKey struct {
+	KeyID     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// JSONWebKeySet is the document served from an issuer's /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKSTokenVerifier verifies RS256 tokens against the key set published by an issuer, applying
+// the same checks as an API Gateway JWT authorizer: signature, issuer, expiry and audience.
+type JWKSTokenVerifier struct {
+	Issuer   string
+	JWKSURL  string
+	Audience string
+
+	httpClient  *http.Client
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	lastFetched time.Time
+}
+
+func NewJWKSTokenVerifier(issuer string, audience string) *JWKSTokenVerifier {
+	return &JWKSTokenVerifier{
+		Issuer:     issuer,
+		JWKSURL:    issuer + "/.well-known/jwks.json",
+		Audience:   audience,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		keys:       map[string]*rsa.PublicKey{},
+	}
+}
+
+func (v *JWKSTokenVerifier) VerifyToken(ctx context.Context, token string) (map[string]string, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(v.Issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidToken, err.Error())
+	}
+	if !hasAudience(claims, v.Audience) {
+		return nil, fmt.Errorf("%w: token is not intended for this client", errInvalidToken)
+	}
+	return stringClaims(claims), nil
+}
+
+// key returns the public key for kid, refetching the key set if kid is unknown
+func (v *JWKSTokenVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.lastFetched) < minJWKSRefreshInterval {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.lastFetched = time.Now()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+func (v *JWKSTokenVerifier) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.JWKSURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build JWKS request: %w", err)
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: unexpected status %d", resp.StatusCode)
+	}
+	var keySet JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range keySet.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		key, err := jwk.RSAPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+// RSAPublicKey decodes the key's modulus and exponent
+func (k JSONWebKey) RSAPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode modulus of key %q: %w", k.KeyID, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode exponent of key %q: %w", k.KeyID, err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// NewJSONWebKey encodes an RSA public key as a JSON Web Key
+func NewJSONWebKey(kid string, key *rsa.PublicKey) JSONWebKey {
+	return JSONWebKey{
+		KeyID:     kid,
+		KeyType:   "RSA",
+		Algorithm: "RS256",
+		Use:       "sig",
+		N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// hasAudience checks aud for ID tokens and client_id for Cognito access tokens. An empty
+// audience accepts any token.
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	if audience == "" {
+		return true
+	}
+	if clientID, ok := claims["client_id"].(string); ok && clientID == audience {
+		return true
+	}
+	aud, err := claims.GetAudience()
+	if err != nil {
+		return false
+	}
+	for _, a := range aud {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// stringClaims flattens claims the way API Gateway does: strings are passed through and
+// everything else is JSON encoded
+func stringClaims(claims jwt.MapClaims) map[string]string {
+	result := make(map[string]string, len(claims))
+	for name, value := range claims {
+		switch value := value.(type) {
+		case string:
+			result[name] = value
+		case float64:
+			result[name] = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			valueBytes, _ := json.Marshal(value)
+			result[name] = string(valueBytes)
+		}
+	}
+	return result
+}
@@ -2,15 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"pickupgamesapi/types"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	valid "github.com/asaskevich/govalidator"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -18,36 +28,226 @@ import (
 )
 
 type GameBase struct {
-	Category       string   `json:"category" dynamodbav:"Category"`
-	DurationMins   int      `json:"durationMins" dynamodbav:"DurationMins"`
-	Location       string   `json:"location" dynamodbav:"Location"`
-	Name           string   `json:"name" dynamodbav:"Name"`
-	NumTeams       int      `json:"numTeams" dynamodbav:"NumTeams"`
-	SignupFeeCents int      `json:"signupFeeCents" dynamodbav:"SignupFeeCents" valid:"-"`
-	SplitFeeCents  int      `json:"splitFeeCents" dynamodbav:"SplitFeeCents" valid:"-"`
-	TeamSize       int      `json:"teamSize" dynamodbav:"TeamSize"`
-	Roster         []string `json:"roster" dynamodbav:"Roster"`
-	WaitList       []string `json:"waitList" dynamodbav:"WaitList"`
+	Category       string        `json:"category" dynamodbav:"Category"`
+	DurationMins   int           `json:"durationMins" dynamodbav:"DurationMins"`
+	Location       string        `json:"location" dynamodbav:"Location"`
+	Name           string        `json:"name" dynamodbav:"Name"`
+	NumTeams       int           `json:"numTeams" dynamodbav:"NumTeams"`
+	SignupFeeCents int           `json:"signupFeeCents" dynamodbav:"SignupFeeCents" valid:"-"`
+	SplitFeeCents  int           `json:"splitFeeCents" dynamodbav:"SplitFeeCents" valid:"-"`
+	TeamSize       int           `json:"teamSize" dynamodbav:"TeamSize"`
+	Roster         []RosterEntry `json:"roster" dynamodbav:"Roster"`
+	WaitList       []RosterEntry `json:"waitList" dynamodbav:"WaitList"`
+	// PromotionOfferHours, when set, has players promoted from the waitlist confirm their spot
+	// within that many hours before it's offered to the next player
+	PromotionOfferHours int `json:"promotionOfferHours" dynamodbav:"PromotionOfferHours" valid:"-"`
+	// SplitLockHours is how long before the start SplitFeeCents stops being reshared as the
+	// roster changes and each player's share is locked in
+	SplitLockHours int `json:"splitLockHours" dynamodbav:"SplitLockHours" valid:"-"`
+	// RefundPolicy decides what players who paid the signup fee get back when they drop out
+	RefundPolicy RefundPolicy `json:"refundPolicy" dynamodbav:"RefundPolicy" valid:"-"`
+	// PriceTiers lower SignupFeeCents for early registrations or while the game fills up
+	PriceTiers []PriceTier `json:"priceTiers,omitempty" dynamodbav:"PriceTiers,omitempty" valid:"-"`
+	// PromoCodes discount registrations that give one, only the owner is shown them
+	PromoCodes []PromoCode `json:"promoCodes,omitempty" dynamodbav:"PromoCodes,omitempty" valid:"-"`
+	// GeoLocation is optional, only games with one can be found by GET /games/nearby
+	GeoLocation *GeoLocation `json:"geoLocation,omitempty" dynamodbav:"GeoLocation,omitempty" valid:"-"`
 }
 
+// GameStatus is where a game is in its lifecycle
+type GameStatus string
+
+const (
+	GameStatusScheduled GameStatus = "scheduled"
+	GameStatusCancelled GameStatus = "cancelled"
+)
+
 // Game represents a game as returned by the API
 type Game struct {
 	GameBase
-	Owner     string    `json:"owner"`
-	GameID    string    `json:"gameId"`
-	StartTime time.Time `json:"startTime"`
+	// Owner is only shown to the owner, everyone else gets OwnerPlayerID
+	Owner              string     `json:"owner,omitempty"`
+	OwnerPlayerID      string     `json:"ownerPlayerId"`
+	GameID             string     `json:"gameId"`
+	StartTime          time.Time  `json:"startTime"`
+	Status             GameStatus `json:"status"`
+	CancellationReason string     `json:"cancellationReason,omitempty"`
+	SeriesID           string     `json:"seriesId,omitempty"`
+	Version            int        `json:"version"`
+	// RosterChanges are only shown to the owner
+	RosterChanges []RosterChange `json:"rosterChanges,omitempty"`
+	// PriceCents is the signup fee for the requester, what they registered at or else what
+	// registering now would cost before any promo code
+	PriceCents int `json:"priceCents"`
+	// PromoRedemptions are only shown to the owner
+	PromoRedemptions []PromoRedemption `json:"promoRedemptions,omitempty"`
 }
 
 type GameList struct {
 	Games []Game `json:"games"`
+	// NextCursor is passed as the cursor parameter to fetch the next page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+const (
+	defaultGamesWindow   = 30 * 24 * time.Hour
+	defaultGamesPageSize = 50
+	maxGamesPageSize     = 100
+)
+
+// timeWindowFromParameters reads the from and to query parameters as RFC 3339 times. The window
+// defaults to the 30 days from now.
+func timeWindowFromParameters(parameters map[string]string, now time.Time) (int64, int64, error) {
+	from := now
+	if parameters["from"] != "" {
+		parsed, err := time.Parse(time.RFC3339, parameters["from"])
+		if err != nil {
+			return 0, 0, types.NewValidationError("", "from must be an RFC 3339 time")
+		}
+		from = parsed
+	}
+	to := from.Add(defaultGamesWindow)
+	if parameters["to"] != "" {
+		parsed, err := time.Parse(time.RFC3339, parameters["to"])
+		if err != nil {
+			return 0, 0, types.NewValidationError("", "to must be an RFC 3339 time")
+		}
+		to = parsed
+	}
+	if to.Before(from) {
+		return 0, 0, types.NewValidationError("", "to must not be before from")
+	}
+	return from.Unix(), to.Unix(), nil
+}
+
+// limitFromParameters reads the limit query parameter
+func limitFromParameters(parameters map[string]string) (int, error) {
+	if parameters["limit"] == "" {
+		return defaultGamesPageSize, nil
+	}
+	limit, err := strconv.Atoi(parameters["limit"])
+	if err != nil || limit < 1 || limit > maxGamesPageSize {
+		return 0, types.NewValidationError("", fmt.Sprintf("limit must be between 1 and %d", maxGamesPageSize))
+	}
+	return limit, nil
+}
+
+// gameQueryFromParameters reads GET /games query parameters
+func gameQueryFromParameters(parameters map[string]string, now time.Time) (GameQuery, error) {
+	query := GameQuery{
+		Category:         parameters["category"],
+		Cursor:           parameters["cursor"],
+		IncludeCancelled: parameters["includeCancelled"] == "true",
+	}
+	if query.Category == "" {
+		return GameQuery{}, &types.InvalidRequestError{Message: "category is required"}
+	}
+	var err error
+	if query.From, query.To, err = timeWindowFromParameters(parameters, now); err != nil {
+		return GameQuery{}, err
+	}
+	if query.Limit, err = limitFromParameters(parameters); err != nil {
+		return GameQuery{}, err
+	}
+	return query, nil
+}
+
+// userGameQueryFromParameters reads GET /me/games query parameters. role defaults to player.
+func userGameQueryFromParameters(user string, parameters map[string]string, now time.Time) (UserGameQuery, error) {
+	query := UserGameQuery{
+		User:             user,
+		Role:             GameRole(parameters["role"]),
+		Cursor:           parameters["cursor"],
+		IncludeCancelled: parameters["includeCancelled"] == "true",
+	}
+	switch query.Role {
+	case "":
+		query.Role = GameRolePlayer
+	case GameRolePlayer, GameRoleWaitList, GameRoleOwner:
+	default:
+		return UserGameQuery{}, types.NewValidationError("", "role must be one of player, waitlist or owner")
+	}
+	var err error
+	if query.From, query.To, err = timeWindowFromParameters(parameters, now); err != nil {
+		return UserGameQuery{}, err
+	}
+	if query.Limit, err = limitFromParameters(parameters); err != nil {
+		return UserGameQuery{}, err
+	}
+	return query, nil
+}
+
+// NearbyGame is a game along with how far it is from the searched point
+type NearbyGame struct {
+	Game
+	DistanceKm float64 `json:"distanceKm"`
+}
+
+type NearbyGameList struct {
+	Games []NearbyGame `json:"games"`
+}
+
+// NearbyGamesRequest is a search for games within RadiusKm of a point
+type NearbyGamesRequest struct {
+	Lat      float64
+	Lng      float64
+	RadiusKm float64
+	Category string
+	From     int64
+	To       int64
+	Limit    int
+}
+
+const (
+	defaultNearbyRadiusKm = 10
+	maxNearbyRadiusKm     = 50
+)
+
+// nearbyGamesRequestFromParameters reads GET /games/nearby query parameters
+func nearbyGamesRequestFromParameters(parameters map[string]string, now time.Time) (NearbyGamesRequest, error) {
+	request := NearbyGamesRequest{
+		RadiusKm: defaultNearbyRadiusKm,
+		Category: parameters["category"],
+	}
+	lat, latErr := strconv.ParseFloat(parameters["lat"], 64)
+	lng, lngErr := strconv.ParseFloat(parameters["lng"], 64)
+	if latErr != nil || lngErr != nil {
+		return NearbyGamesRequest{}, &types.InvalidRequestError{Message: "lat and lng are required"}
+	}
+	geoLocation := GeoLocation{Lat: lat, Lng: lng}
+	if err := geoLocation.Validate(); err != nil {
+		return NearbyGamesRequest{}, err
+	}
+	request.Lat, request.Lng = lat, lng
+	if parameters["radiusKm"] != "" {
+		radiusKm, err := strconv.ParseFloat(parameters["radiusKm"], 64)
+		if err != nil || !(radiusKm > 0 && radiusKm <= maxNearbyRadiusKm) {
+			return NearbyGamesRequest{}, types.NewValidationError("", fmt.Sprintf("radiusKm must be greater than 0 and at most %d", maxNearbyRadiusKm))
+		}
+		request.RadiusKm = radiusKm
+	}
+	var err error
+	if request.From, request.To, err = timeWindowFromParameters(parameters, now); err != nil {
+		return NearbyGamesRequest{}, err
+	}
+	if request.Limit, err = limitFromParameters(parameters); err != nil {
+		return NearbyGamesRequest{}, err
+	}
+	return request, nil
 }
 
 func GameFromGameRecord(gameRecord GameRecord) Game {
 	return Game{
-		GameBase:  gameRecord.GameBase,
-		GameID:    gameRecord.GameID,
-		StartTime: time.Unix(gameRecord.StartTime, 0),
-		Owner:     gameRecord.Owner,
+		GameBase:           gameRecord.GameBase,
+		GameID:             gameRecord.GameID,
+		StartTime:          time.Unix(gameRecord.StartTime, 0),
+		Owner:              gameRecord.Owner,
+		Status:             gameRecord.GameStatus(),
+		Version:            gameRecord.Version,
+		CancellationReason: gameRecord.CancellationReason,
+		SeriesID:           gameRecord.SeriesID,
+		RosterChanges:      append([]RosterChange{}, gameRecord.RosterChanges...),
+		PromoRedemptions:   append([]PromoRedemption{}, gameRecord.PromoRedemptions...),
 	}
 }
 
@@ -55,9 +255,103 @@ func GameFromGameRecord(gameRecord GameRecord) Game {
 type GameRecord struct {
 	GameBase
 
-	GameID    string `dynamodbav:"GameID"`
-	Owner     string `dynamodbav:"Owner"`
-	StartTime int64  `dynamodbav:"StartTime"` // Unix timestamp -- seconds since 1970
+	GameID             string     `dynamodbav:"GameID"`
+	Owner              string     `dynamodbav:"Owner"`
+	StartTime          int64      `dynamodbav:"StartTime"` // Unix timestamp -- seconds since 1970
+	Version            int        `dynamodbav:"Version"`   // incremented on every update, guards ReplaceGame
+	Status             GameStatus `dynamodbav:"Status"`
+	CancellationReason string     `dynamodbav:"CancellationReason"`
+	SeriesID           string     `dynamodbav:"SeriesID,omitempty"` // set on occurrences of a recurring series
+	// GeohashCell is derived from GeoLocation by the stores and keys the GeohashIndex
+	GeohashCell string `dynamodbav:"GeohashCell,omitempty"`
+	// RosterChanges are the owner's changes to the player lists, oldest first
+	RosterChanges []RosterChange `dynamodbav:"RosterChanges,omitempty"`
+	// PromoRedemptions are the promo codes players registered with, oldest first
+	PromoRedemptions []PromoRedemption `dynamodbav:"PromoRedemptions,omitempty"`
+	// HoldIndexKey and NextHoldExpiry are derived from the roster's held spots by the DynamoDB
+	// store and key the HoldExpiryIndex, which only holds games with offers or payments outstanding
+	HoldIndexKey   string `dynamodbav:"HoldIndexKey,omitempty"`
+	NextHoldExpiry int64  `dynamodbav:"NextHoldExpiry,omitempty"`
+}
+
+// recordRosterChange appends change to the record's history, dropping the oldest changes past
+// maxRosterChanges
+func (r *GameRecord) recordRosterChange(change RosterChange) {
+	r.RosterChanges = append(r.RosterChanges, change)
+	if len(r.RosterChanges) > maxRosterChanges {
+		r.RosterChanges = append([]RosterChange{}, r.RosterChanges[len(r.RosterChanges)-maxRosterChanges:]...)
+	}
+}
+
+// indexGeoLocation keeps GeohashCell in step with GeoLocation. Stores call it on every write.
+func (r *GameRecord) indexGeoLocation() {
+	r.GeohashCell = ""
+	if r.GeoLocation != nil {
+		r.GeohashCell = encodeGeohash(r.GeoLocation.Lat, r.GeoLocation.Lng, geohashCellPrecision)
+	}
+}
+
+// maxPromotionOfferHours is the longest a promoted player can be given to confirm their spot
+const maxPromotionOfferHours = 72
+
+// holdIndexKey is the HoldExpiryIndex partition every game with a spot held is kept in
+const holdIndexKey = "pending"
+
+// indexHolds keeps HoldIndexKey and NextHoldExpiry in step with the roster's held spots
+func (r *GameRecord) indexHolds() {
+	r.HoldIndexKey = ""
+	r.NextHoldExpiry = 0
+	for _, entry := range r.Roster {
+		expiresAt := entry.holdExpiresAt()
+		if expiresAt == nil {
+			continue
+		}
+		if r.NextHoldExpiry == 0 || expiresAt.Unix() < r.NextHoldExpiry {
+			r.NextHoldExpiry = expiresAt.Unix()
+		}
+		r.HoldIndexKey = holdIndexKey
+	}
+}
+
+// maxSplitLockHours is the furthest ahead of the start a venue split can be locked
+const maxSplitLockHours = 7 * 24
+
+// splitLocksAt is when the game's venue split is locked in
+func (r GameRecord) splitLocksAt() time.Time {
+	return time.Unix(r.StartTime, 0).UTC().Add(-time.Duration(r.SplitLockHours) * time.Hour)
+}
+
+// holdUntil is when a spot held at now for duration is released, which is no later than the
+// game's start
+func (r GameRecord) holdUntil(now time.Time, duration time.Duration) *time.Time {
+	until := now.UTC().Truncate(time.Second).Add(duration)
+	if startTime := time.Unix(r.StartTime, 0).UTC(); until.After(startTime) {
+		until = startTime
+	}
+	return &until
+}
+
+// promotedEntry is entry moved up from the waitlist at now. Games with PromotionOfferHours only
+// offer the spot, which the player has until the offer expires to confirm, and games with a
+// signup fee hold it until the player pays.
+func (r GameRecord) promotedEntry(entry RosterEntry, now time.Time) RosterEntry {
+	switch {
+	case r.PromotionOfferHours > 0:
+		entry.Status = RegistrationStatusOffered
+		entry.OfferExpiresAt = r.holdUntil(now, time.Duration(r.PromotionOfferHours)*time.Hour)
+	case r.feeFor(entry) > 0 && !entry.Paid:
+		entry.Status = RegistrationStatusPendingPayment
+		entry.PaymentDueAt = r.holdUntil(now, paymentHoldDuration)
+	}
+	return entry
+}
+
+// GameStatus returns the record's status, treating records written before statuses existed as scheduled
+func (r GameRecord) GameStatus() GameStatus {
+	if r.Status == "" {
+		return GameStatusScheduled
+	}
+	return r.Status
 }
 
 // NewGameRequest is the accepted request body for creating a new game
@@ -74,9 +368,138 @@ func (r *NewGameRequest) ValidateRequest(ctx context.Context) error {
 		logger.Err(err).Msg("failed to validate request")
 		return &types.InvalidRequestError{ErrorCodeVal: 400, Message: fmt.Sprintf("Invalid request: %s", err.Error())}
 	}
+	if err := validatePromotionOfferHours(r.PromotionOfferHours); err != nil {
+		return err
+	}
+	if err := validateSplitLockHours(r.SplitLockHours); err != nil {
+		return err
+	}
+	if err := r.RefundPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := validatePricing(r.PriceTiers, r.PromoCodes); err != nil {
+		return err
+	}
+	if r.GeoLocation != nil {
+		return r.GeoLocation.Validate()
+	}
+	return nil
+}
+
+func validatePromotionOfferHours(hours int) error {
+	if hours < 0 || hours > maxPromotionOfferHours {
+		return types.NewValidationError("", fmt.Sprintf("promotionOfferHours must be between 0 and %d", maxPromotionOfferHours))
+	}
 	return nil
 }
 
+func validateSplitLockHours(hours int) error {
+	if hours < 0 || hours > maxSplitLockHours {
+		return types.NewValidationError("", fmt.Sprintf("splitLockHours must be between 0 and %d", maxSplitLockHours))
+	}
+	return nil
+}
+
+// UpdateGameRequest is the accepted request body for editing a game. Only the fields present are
+// changed; players are managed through registration. Version, when given, must match the game's
+// current version so a client can't overwrite changes it hasn't seen.
+type UpdateGameRequest struct {
+	Category       *string    `json:"category"`
+	DurationMins   *int       `json:"durationMins"`
+	Location       *string    `json:"location"`
+	Name           *string    `json:"name"`
+	NumTeams       *int       `json:"numTeams"`
+	SignupFeeCents *int       `json:"signupFeeCents"`
+	SplitFeeCents  *int       `json:"splitFeeCents"`
+	TeamSize       *int       `json:"teamSize"`
+	StartTime      *time.Time `json:"startTime"`
+	// PromotionOfferHours of 0 turns offers off; offers already made still run out as they were
+	PromotionOfferHours *int `json:"promotionOfferHours"`
+	// SplitFeeCents and SplitLockHours can't change once the split is locked
+	SplitLockHours *int `json:"splitLockHours"`
+	// RefundPolicy replaces the whole policy and applies to players who drop out from then on
+	RefundPolicy *RefundPolicy `json:"refundPolicy"`
+	// PriceTiers and PromoCodes replace the whole list. Players keep the price they registered at,
+	// and redemptions of a code still count if it's put back.
+	PriceTiers *[]PriceTier `json:"priceTiers"`
+	PromoCodes *[]PromoCode `json:"promoCodes"`
+	// GeoLocation replaces the game's coordinates, there's no way to remove them
+	GeoLocation *GeoLocation `json:"geoLocation"`
+	Version     *int         `json:"version"`
+}
+
+// empty reports whether the request changes nothing
+func (r *UpdateGameRequest) empty() bool {
+	return r.Category == nil && r.DurationMins == nil && r.Location == nil && r.Name == nil && r.NumTeams == nil &&
+		r.SignupFeeCents == nil && r.SplitFeeCents == nil && r.TeamSize == nil && r.StartTime == nil &&
+		r.PromotionOfferHours == nil && r.SplitLockHours == nil && r.RefundPolicy == nil &&
+		r.PriceTiers == nil && r.PromoCodes == nil && r.GeoLocation == nil
+}
+
+func (r *UpdateGameRequest) ValidateRequest() error {
+	if r.empty() {
+		return types.NewValidationError("", "no changes requested")
+	}
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{{"category", r.Category}, {"location", r.Location}, {"name", r.Name}} {
+		if field.value != nil && *field.value == "" {
+			return types.NewValidationError("", fmt.Sprintf("%s must not be empty", field.name))
+		}
+	}
+	for _, field := range []struct {
+		name    string
+		value   *int
+		minimum int
+	}{{"durationMins", r.DurationMins, 1}, {"numTeams", r.NumTeams, 1}, {"teamSize", r.TeamSize, 1},
+		{"signupFeeCents", r.SignupFeeCents, 0}, {"splitFeeCents", r.SplitFeeCents, 0}} {
+		if field.value != nil && *field.value < field.minimum {
+			return types.NewValidationError("", fmt.Sprintf("%s must be at least %d", field.name, field.minimum))
+		}
+	}
+	if r.StartTime != nil && r.StartTime.IsZero() {
+		return types.NewValidationError("", "startTime must be set")
+	}
+	if r.PromotionOfferHours != nil {
+		if err := validatePromotionOfferHours(*r.PromotionOfferHours); err != nil {
+			return err
+		}
+	}
+	if r.SplitLockHours != nil {
+		if err := validateSplitLockHours(*r.SplitLockHours); err != nil {
+			return err
+		}
+	}
+	if r.RefundPolicy != nil {
+		if err := r.RefundPolicy.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.PriceTiers != nil || r.PromoCodes != nil {
+		var priceTiers []PriceTier
+		var promoCodes []PromoCode
+		if r.PriceTiers != nil {
+			priceTiers = *r.PriceTiers
+		}
+		if r.PromoCodes != nil {
+			promoCodes = *r.PromoCodes
+		}
+		if err := validatePricing(priceTiers, promoCodes); err != nil {
+			return err
+		}
+	}
+	if r.GeoLocation != nil {
+		return r.GeoLocation.Validate()
+	}
+	return nil
+}
+
+// CancelGameRequest is the accepted request body for cancelling a game
+type CancelGameRequest struct {
+	Reason string `json:"reason"`
+}
+
 // NewUserRequest
 type NewUserRequest struct {
 	FirstName   string `json:"firstName"`
@@ -90,8 +513,10 @@ func (r *NewUserRequest) MissingFields() bool {
 	return r.FirstName == "" || r.LastName == "" || r.Email == "" || r.Password == "" || r.PhoneNumber == ""
 }
 
-// ErrorMessage
+// ErrorMessage is the body of every error response. Code is a stable machine-readable value,
+// Message is meant for people.
 type ErrorMessage struct {
+	Code    string `json:"code"`
 	Message string `json:"message"`
 }
 
@@ -100,22 +525,57 @@ func (e *ErrorMessage) String() string {
 	return string(errorStringBytes)
 }
 
-func NewErrorMessage(message string) ErrorMessage {
+func NewErrorMessage(code string, message string) ErrorMessage {
 	return ErrorMessage{
+		Code:    code,
 		Message: message,
 	}
 }
 
+var errRouteNotFound = types.NewNotFoundError("route_not_found", "route not found")
+
 // Hander
 type Handler struct {
-	AWSCognitoClient     *cognitoidentityprovider.Client
-	AWSDynamoDBClient    *dynamodb.Client
-	userPoolID           string
-	clientID             string
-	pickupGamesTableName string
+	IdentityProvider  IdentityProvider
+	GameStore         GameStore
+	SeriesStore       SeriesStore
+	VerificationCodes VerificationCodeStore
+	UserProfiles      UserProfileStore
+	Notifier          Notifier
+	PlayerIDs         PlayerIDs
+	PaymentProvider   PaymentProvider
+	Payments          PaymentLedger
+	// PaymentWebhookSecret signs the payment provider's webhook requests, which are all rejected
+	// when it's empty
+	PaymentWebhookSecret []byte
+	// Clock is the current time for everything the handler does, time.Now when nil
+	Clock func() time.Time
 }
 
-func returnSuccess(responseBody interface{}) (events.APIGatewayV2HTTPResponse, error) {
+// claimsFromEvent returns the verified token claims API Gateway's JWT authorizer passed on, or nil
+// on a public route, which API Gateway sends without an authorizer
+func claimsFromEvent(event events.APIGatewayV2HTTPRequest) map[string]string {
+	authorizer := event.RequestContext.Authorizer
+	if authorizer == nil || authorizer.JWT == nil {
+		return nil
+	}
+	return authorizer.JWT.Claims
+}
+
+// requesterFromEvent is the email of the user who made the request, "" when it's anonymous
+func requesterFromEvent(event events.APIGatewayV2HTTPRequest) string {
+	return claimsFromEvent(event)["email"]
+}
+
+// now is the handler's current time
+func (h *Handler) now() time.Time {
+	if h.Clock != nil {
+		return h.Clock()
+	}
+	return time.Now()
+}
+
+func returnSuccess(ctx context.Context, responseBody interface{}) (events.APIGatewayV2HTTPResponse, error) {
 	if responseBody == nil {
 		return events.APIGatewayV2HTTPResponse{
 			StatusCode: 200,
@@ -123,7 +583,7 @@ func returnSuccess(responseBody interface{}) (events.APIGatewayV2HTTPResponse, e
 	}
 	responseBodyBytes, err := json.Marshal(responseBody)
 	if err != nil {
-		return returnServerError(err)
+		return returnError(ctx, err)
 	}
 	return events.APIGatewayV2HTTPResponse{
 		StatusCode: 200,
@@ -134,45 +594,53 @@ func returnSuccess(responseBody interface{}) (events.APIGatewayV2HTTPResponse, e
 	}, nil
 }
 
-func returnServerError(err error) (events.APIGatewayV2HTTPResponse, error) {
-	errorMessage := NewErrorMessage(err.Error())
-	return events.APIGatewayV2HTTPResponse{
-		StatusCode: 500,
-		Body:       errorMessage.String(),
-	}, nil
-}
-
-func returnNotFound() (events.APIGatewayV2HTTPResponse, error) {
-	return events.APIGatewayV2HTTPResponse{
-		StatusCode: 404,
-	}, nil
-}
-
-func returnClientError(errMessage string) (events.APIGatewayV2HTTPResponse, error) {
-	errorMessage := NewErrorMessage(errMessage)
+// returnError is the one place errors become responses. Errors implementing types.APIError
+// (anywhere in the wrapped chain) set the status code and body; anything else is logged and
+// reported as a 500 without leaking its details.
+func returnError(ctx context.Context, err error) (events.APIGatewayV2HTTPResponse, error) {
+	statusCode := 500
+	errorMessage := NewErrorMessage("internal_error", "Internal server error")
+	var apiErr types.APIError
+	if errors.As(err, &apiErr) {
+		statusCode = apiErr.ErrorCode()
+		errorMessage = NewErrorMessage(apiErr.ErrorType(), apiErr.ErrorMessage())
+	}
+	if statusCode >= 500 {
+		log.Ctx(ctx).Error().Err(err).Int("statusCode", statusCode).Msg("request failed")
+	} else {
+		log.Ctx(ctx).Info().Err(err).Int("statusCode", statusCode).Msg("request rejected")
+	}
 	return events.APIGatewayV2HTTPResponse{
-		StatusCode: 400,
+		StatusCode: statusCode,
 		Body:       errorMessage.String(),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
 	}, nil
 }
 
 func (h *Handler) handler(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	// create context and initialize logger with caller
 	ctx = log.Logger.With().Caller().Logger().WithContext(ctx)
-	log.Ctx(ctx).Debug().Interface("event", event).Msg("received request")
+	log.Ctx(ctx).Debug().Interface("event", loggableEvent(event)).Msg("received request")
+	if claims := claimsFromEvent(event); claims != nil {
+		if err := h.checkTokenNotRevoked(ctx, claims); err != nil {
+			return returnError(ctx, err)
+		}
+	}
 	switch event.RouteKey {
 	case "POST /auth/signup":
 		{
 			requestBody := event.Body
 			newUserRequest := NewUserRequest{}
 			if err := json.Unmarshal([]byte(requestBody), &newUserRequest); err != nil || newUserRequest.MissingFields() {
-				return returnClientError("Invalid request body")
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
 			}
 			newUser, err := h.SignUpUser(ctx, newUserRequest)
 			if err != nil {
-				return returnServerError(err)
+				return returnError(ctx, err)
 			}
-			return returnSuccess(newUser)
+			return returnSuccess(ctx, newUser)
 		}
 	case "POST /auth/signin":
 		{
@@ -180,114 +648,817 @@ func (h *Handler) handler(ctx context.Context, event events.APIGatewayV2HTTPRequ
 			signInRequest := SignInRequest{}
 			if err := json.Unmarshal([]byte(requestBody), &signInRequest); err != nil {
 				log.Error().Err(err).Msg("failed to unmarshal request body")
-				return returnClientError("Invalid request body")
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
 			}
 			signInResponse, err := h.SignInUser(ctx, signInRequest)
 			if err != nil {
-				return returnServerError(err)
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, signInResponse)
+		}
+	case "POST /auth/refresh":
+		{
+			requestBody := event.Body
+			refreshRequest := RefreshRequest{}
+			if err := json.Unmarshal([]byte(requestBody), &refreshRequest); err != nil || refreshRequest.RefreshToken == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			refreshResponse, err := h.RefreshTokens(ctx, refreshRequest)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, refreshResponse)
+		}
+	case "POST /auth/signout":
+		{
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			if err := h.SignOutUser(ctx, requester); err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, nil)
+		}
+	case "POST /auth/forgot-password":
+		{
+			requestBody := event.Body
+			forgotPasswordRequest := ForgotPasswordRequest{}
+			if err := json.Unmarshal([]byte(requestBody), &forgotPasswordRequest); err != nil || forgotPasswordRequest.Email == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := h.ForgotPassword(ctx, forgotPasswordRequest); err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, nil)
+		}
+	case "POST /auth/confirm-forgot-password":
+		{
+			requestBody := event.Body
+			confirmRequest := ConfirmForgotPasswordRequest{}
+			if err := json.Unmarshal([]byte(requestBody), &confirmRequest); err != nil || confirmRequest.MissingFields() {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := h.ConfirmForgotPassword(ctx, confirmRequest); err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, nil)
+		}
+	case "POST /auth/verify":
+		{
+			requestBody := event.Body
+			verifyRequest := VerifyRequest{}
+			if err := json.Unmarshal([]byte(requestBody), &verifyRequest); err != nil || verifyRequest.MissingFields() {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := h.VerifyAttribute(ctx, verifyRequest); err != nil {
+				return returnError(ctx, err)
 			}
-			return returnSuccess(signInResponse)
+			return returnSuccess(ctx, nil)
 		}
 	case "POST /games":
 		{
 			requestBody := event.Body
 			newGameRequest := NewGameRequest{}
-			requester := event.RequestContext.Authorizer.JWT.Claims["email"]
+			requester := requesterFromEvent(event)
 			if err := json.Unmarshal([]byte(requestBody), &newGameRequest); err != nil {
 				log.Error().Err(err).Msg("failed to unmarshal request body")
-				return returnClientError("Invalid request body")
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
 			}
 			if err := newGameRequest.ValidateRequest(ctx); err != nil {
-				return returnClientError(err.Error())
+				return returnError(ctx, err)
 			}
 			newGameRequest.Requester = requester
 			createGameResponse, err := h.CreateGame(ctx, newGameRequest)
 			if err != nil {
-				return returnServerError(err)
+				return returnError(ctx, err)
 			}
-			return returnSuccess(createGameResponse)
+			return returnSuccess(ctx, createGameResponse)
+		}
+	case "GET /games/nearby":
+		{
+			nearbyGamesRequest, err := nearbyGamesRequestFromParameters(event.QueryStringParameters, h.now())
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			requester := requesterFromEvent(event)
+			nearbyGamesResponse, err := h.GetNearbyGames(ctx, nearbyGamesRequest, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, nearbyGamesResponse)
 		}
 	case "GET /games/{gameID}":
 		{
 			gameID := event.PathParameters["gameID"]
-			getGameResponse, err := h.GetGame(ctx, gameID)
+			requester := requesterFromEvent(event)
+			getGameResponse, err := h.GetGame(ctx, gameID, requester)
 			if err != nil {
-				// check if error == game not found
-				if err.Error() == "game not found" {
-					return returnNotFound()
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, getGameResponse)
+		}
+	case "PATCH /games/{gameID}":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			updateGameRequest := UpdateGameRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &updateGameRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := updateGameRequest.ValidateRequest(); err != nil {
+				return returnError(ctx, err)
+			}
+			updateGameResponse, err := h.UpdateGame(ctx, gameID, requester, updateGameRequest)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, updateGameResponse)
+		}
+	case "DELETE /games/{gameID}":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			if err := h.DeleteGame(ctx, gameID, requester); err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, nil)
+		}
+	case "POST /games/{gameID}/cancel":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			cancelGameRequest := CancelGameRequest{}
+			if event.Body != "" {
+				if err := json.Unmarshal([]byte(event.Body), &cancelGameRequest); err != nil {
+					return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
 				}
-				return returnServerError(err)
 			}
-			return returnSuccess(getGameResponse)
+			cancelGameResponse, err := h.CancelGame(ctx, gameID, requester, cancelGameRequest.Reason)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, cancelGameResponse)
 		}
 	case "POST /games/{gameID}/registrtation":
 		{
 			gameID := event.PathParameters["gameID"]
-			requester, ok := event.RequestContext.Authorizer.JWT.Claims["email"]
-			if !ok {
+			requester := requesterFromEvent(event)
+			if requester == "" {
 				// Cognito returns an ID token and an access token, only the ID token contains the email
-				return returnClientError("token provided does not contain email")
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
 			}
-			registerGameResponse, err := h.RegisterForGame(ctx, gameID, requester)
+			displayName := displayNameFromClaims(claimsFromEvent(event))
+			registrationRequest := RegistrationRequest{}
+			if event.Body != "" {
+				if err := json.Unmarshal([]byte(event.Body), &registrationRequest); err != nil {
+					return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+				}
+			}
+			registerGameResponse, err := h.RegisterForGame(ctx, gameID, requester, displayName, registrationRequest.PromoCode)
 			if err != nil {
-				return returnServerError(err)
+				return returnError(ctx, err)
 			}
-			return returnSuccess(registerGameResponse)
+			return returnSuccess(ctx, registerGameResponse)
 		}
 	case "DELETE /games/{gameID}/registration":
 		{
 			gameID := event.PathParameters["gameID"]
-			requester := event.RequestContext.Authorizer.JWT.Claims["email"]
+			requester := requesterFromEvent(event)
 			dropFromGameResponse, err := h.DropFromGame(ctx, gameID, requester)
 			if err != nil {
-				return returnServerError(err)
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, dropFromGameResponse)
+		}
+	case "POST /games/{gameID}/registration/confirm":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			confirmOfferResponse, err := h.ConfirmOffer(ctx, gameID, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, confirmOfferResponse)
+		}
+	case "POST /games/{gameID}/registration/payment":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			paymentRequest := PaymentRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &paymentRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := paymentRequest.ValidateRequest(); err != nil {
+				return returnError(ctx, err)
+			}
+			payForGameResponse, err := h.PayForGame(ctx, gameID, requester, paymentRequest)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, payForGameResponse)
+		}
+	case "GET /games/{gameID}/payments":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			listPaymentsResponse, err := h.ListPayments(ctx, gameID, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, listPaymentsResponse)
+		}
+	case "GET /games/{gameID}/split":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			getVenueSplitResponse, err := h.GetVenueSplit(ctx, gameID, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, getVenueSplitResponse)
+		}
+	case "PATCH /games/{gameID}/split/{playerID}":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			splitShareRequest := SplitShareRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &splitShareRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := splitShareRequest.ValidateRequest(); err != nil {
+				return returnError(ctx, err)
+			}
+			markSplitShareResponse, err := h.MarkSplitShare(ctx, gameID, requester, event.PathParameters["playerID"], splitShareRequest)
+			if err != nil {
+				return returnError(ctx, err)
 			}
-			return returnSuccess(dropFromGameResponse)
+			return returnSuccess(ctx, markSplitShareResponse)
+		}
+	case "POST /games/{gameID}/roster":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			addPlayerRequest := AddPlayerRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &addPlayerRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := addPlayerRequest.ValidateRequest(); err != nil {
+				return returnError(ctx, err)
+			}
+			addPlayerResponse, err := h.AddPlayerToList(ctx, gameID, requester, PlayerListRoster, addPlayerRequest)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, addPlayerResponse)
+		}
+	case "DELETE /games/{gameID}/roster/{playerID}":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			removePlayerResponse, err := h.RemovePlayerFromList(ctx, gameID, requester, PlayerListRoster, event.PathParameters["playerID"])
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, removePlayerResponse)
+		}
+	case "POST /games/{gameID}/waitlist":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			addPlayerRequest := AddPlayerRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &addPlayerRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := addPlayerRequest.ValidateRequest(); err != nil {
+				return returnError(ctx, err)
+			}
+			addPlayerResponse, err := h.AddPlayerToList(ctx, gameID, requester, PlayerListWaitList, addPlayerRequest)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, addPlayerResponse)
+		}
+	case "DELETE /games/{gameID}/waitlist/{playerID}":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			removePlayerResponse, err := h.RemovePlayerFromList(ctx, gameID, requester, PlayerListWaitList, event.PathParameters["playerID"])
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, removePlayerResponse)
+		}
+	case "PUT /games/{gameID}/waitlist":
+		{
+			gameID := event.PathParameters["gameID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			reorderRequest := ReorderWaitListRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &reorderRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			reorderResponse, err := h.ReorderWaitList(ctx, gameID, requester, reorderRequest)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, reorderResponse)
 		}
 	case "GET /games":
 		{
-			category := event.QueryStringParameters["category"]
-			if category == "" {
-				return returnClientError("category is required")
+			gameQuery, err := gameQueryFromParameters(event.QueryStringParameters, h.now())
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			requester := requesterFromEvent(event)
+			getGamesResponse, err := h.GetGames(ctx, gameQuery, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, getGamesResponse)
+		}
+	case "GET /me":
+		{
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			getProfileResponse, err := h.GetUserProfile(ctx, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, getProfileResponse)
+		}
+	case "PATCH /me":
+		{
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			updateProfileRequest := UpdateUserProfileRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &updateProfileRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := updateProfileRequest.ValidateRequest(); err != nil {
+				return returnError(ctx, err)
 			}
-			getGamesResponse, err := h.GetGames(ctx, category)
+			updateProfileResponse, err := h.UpdateUserProfile(ctx, requester, updateProfileRequest)
 			if err != nil {
-				return returnServerError(err)
+				return returnError(ctx, err)
 			}
-			return returnSuccess(getGamesResponse)
+			return returnSuccess(ctx, updateProfileResponse)
+		}
+	case "DELETE /me":
+		{
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			if err := h.DeleteAccount(ctx, requester); err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, nil)
+		}
+	case "GET /me/export":
+		{
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			exportResponse, err := h.ExportAccount(ctx, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, exportResponse)
+		}
+	case "GET /me/games":
+		{
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			userGameQuery, err := userGameQueryFromParameters(requester, event.QueryStringParameters, h.now())
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			getMyGamesResponse, err := h.GetMyGames(ctx, userGameQuery)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, getMyGamesResponse)
+		}
+	case "GET /users/{playerID}":
+		{
+			playerID := event.PathParameters["playerID"]
+			requester := requesterFromEvent(event)
+			getUserResponse, err := h.GetPublicUserProfile(ctx, playerID, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, getUserResponse)
+		}
+	case "POST /series":
+		{
+			newSeriesRequest := NewSeriesRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &newSeriesRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := newSeriesRequest.ValidateRequest(); err != nil {
+				return returnError(ctx, err)
+			}
+			newSeriesRequest.Requester = requesterFromEvent(event)
+			createSeriesResponse, err := h.CreateSeries(ctx, newSeriesRequest)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, createSeriesResponse)
+		}
+	case "GET /series/{seriesID}":
+		{
+			requester := requesterFromEvent(event)
+			getSeriesResponse, err := h.GetSeries(ctx, event.PathParameters["seriesID"], requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, getSeriesResponse)
+		}
+	case "PATCH /series/{seriesID}":
+		{
+			seriesID := event.PathParameters["seriesID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			updateSeriesRequest := UpdateSeriesRequest{}
+			if err := json.Unmarshal([]byte(event.Body), &updateSeriesRequest); err != nil {
+				return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+			}
+			if err := updateSeriesRequest.ValidateRequest(); err != nil {
+				return returnError(ctx, err)
+			}
+			updateSeriesResponse, err := h.UpdateSeries(ctx, seriesID, requester, updateSeriesRequest)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, updateSeriesResponse)
+		}
+	case "POST /series/{seriesID}/subscription":
+		{
+			seriesID := event.PathParameters["seriesID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			displayName := displayNameFromClaims(claimsFromEvent(event))
+			subscribeResponse, err := h.SubscribeToSeries(ctx, seriesID, requester, displayName)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, subscribeResponse)
+		}
+	case "DELETE /series/{seriesID}/subscription":
+		{
+			seriesID := event.PathParameters["seriesID"]
+			requester := requesterFromEvent(event)
+			if requester == "" {
+				return returnError(ctx, &types.InvalidRequestError{Message: "token provided does not contain email"})
+			}
+			unsubscribeResponse, err := h.UnsubscribeFromSeries(ctx, seriesID, requester)
+			if err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, unsubscribeResponse)
+		}
+	case "POST /webhooks/payments":
+		{
+			payload := []byte(event.Body)
+			if event.IsBase64Encoded {
+				decoded, err := base64.StdEncoding.DecodeString(event.Body)
+				if err != nil {
+					return returnError(ctx, &types.InvalidRequestError{Message: "Invalid request body"})
+				}
+				payload = decoded
+			}
+			if err := h.HandlePaymentWebhook(ctx, payload, event.Headers[paymentSignatureHeader]); err != nil {
+				return returnError(ctx, err)
+			}
+			return returnSuccess(ctx, nil)
+		}
+	case "GET /.well-known/jwks.json":
+		{
+			publisher, ok := h.IdentityProvider.(keySetPublisher)
+			if !ok {
+				return returnError(ctx, errRouteNotFound)
+			}
+			return returnSuccess(ctx, publisher.JSONWebKeySet())
 		}
 	default:
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 404,
-		}, nil
+		return returnError(ctx, errRouteNotFound)
+	}
+}
+
+// requireEnv returns the value of an environment variable that must be set
+func requireEnv(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		log.Fatal().Msgf("%s is not set", name)
+	}
+	return value
+}
+
+// configureStores sets up the handler's persistence on the backend named by GAME_STORE,
+// defaulting to DynamoDB
+func configureStores(ctx context.Context, cfg aws.Config, handler *Handler) {
+	switch os.Getenv("GAME_STORE") {
+	case "memory":
+		log.Warn().Msg("using in-memory stores, nothing will be persisted")
+		handler.GameStore = NewMemoryGameStore()
+		handler.SeriesStore = NewMemorySeriesStore()
+		handler.VerificationCodes = NewMemoryVerificationCodeStore()
+		handler.UserProfiles = NewMemoryUserProfileStore()
+		handler.Payments = NewMemoryPaymentLedger()
+	case "sqlite", "postgres":
+		dialect := SQLDialect(os.Getenv("GAME_STORE"))
+		databaseURL := os.Getenv("DATABASE_URL")
+		if databaseURL == "" && dialect == SQLDialectSQLite {
+			databaseURL = "pickupgames.db"
+		}
+		if databaseURL == "" {
+			log.Fatal().Msg("DATABASE_URL is not set")
+		}
+		db, err := OpenSQLDatabase(ctx, dialect, databaseURL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to open database")
+		}
+		handler.GameStore = NewSQLGameStore(db, dialect)
+		handler.SeriesStore = NewSQLSeriesStore(db)
+		handler.VerificationCodes = NewSQLVerificationCodeStore(db)
+		handler.UserProfiles = NewSQLUserProfileStore(db)
+		handler.Payments = NewSQLPaymentLedger(db)
+	case "", "dynamodb":
+		dynamoDBClient := dynamodb.NewFromConfig(cfg)
+		handler.GameStore = NewDynamoDBGameStore(dynamoDBClient, requireEnv("PICKUP_GAMES_TABLE"), requireEnv("GAME_MEMBERSHIPS_TABLE"))
+		handler.SeriesStore = NewDynamoDBSeriesStore(dynamoDBClient, requireEnv("GAME_SERIES_TABLE"))
+		handler.VerificationCodes = NewDynamoDBVerificationCodeStore(dynamoDBClient, requireEnv("VERIFICATION_CODES_TABLE"))
+		handler.UserProfiles = NewDynamoDBUserProfileStore(dynamoDBClient, requireEnv("USER_PROFILES_TABLE"))
+		handler.Payments = NewDynamoDBPaymentLedger(dynamoDBClient, requireEnv("PAYMENT_LEDGER_TABLE"))
+	default:
+		log.Fatal().Str("gameStore", os.Getenv("GAME_STORE")).Msg("unknown GAME_STORE")
+	}
+}
+
+// newNotifier posts notifications to NOTIFIER_WEBHOOK_URL if it's set, sends them through SES and
+// SNS if NOTIFIER_EMAIL_FROM is, and logs them otherwise
+func newNotifier(cfg aws.Config) Notifier {
+	if webhookURL := os.Getenv("NOTIFIER_WEBHOOK_URL"); webhookURL != "" {
+		return NewWebhookNotifier(webhookURL)
+	}
+	if emailFrom := os.Getenv("NOTIFIER_EMAIL_FROM"); emailFrom != "" {
+		return NewAWSNotifier(cfg, emailFrom)
+	}
+	log.Warn().Msg("NOTIFIER_WEBHOOK_URL is not set, notifications will only be logged")
+	return LogNotifier{}
+}
+
+// secretFromEnv is the secret named name, read from the environment variable of that name or,
+// when name_ARN is set instead, from Secrets Manager. Deployments give the ARN so the secret itself
+// never appears in the Lambda's configuration or the stack's template.
+func secretFromEnv(cfg aws.Config, name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
+	secretARN := os.Getenv(name + "_ARN")
+	if secretARN == "" {
+		return ""
+	}
+	value, err := newAWSClient(cfg).getSecretValue(context.Background(), secretARN)
+	if err != nil {
+		log.Fatal().Err(err).Str("secret", name).Msg("Unable to read secret")
+	}
+	return value
+}
+
+// newPlayerIDs keys player IDs with PLAYER_ID_KEY. Every instance has to share the key, so it's
+// required unless the stores are in memory or the identity provider is local, where a key is
+// generated and IDs change whenever the process restarts.
+func newPlayerIDs(cfg aws.Config) PlayerIDs {
+	if key := secretFromEnv(cfg, "PLAYER_ID_KEY"); key != "" {
+		return NewPlayerIDs([]byte(key))
+	}
+	if os.Getenv("GAME_STORE") != "memory" && os.Getenv("IDENTITY_PROVIDER") != "local" {
+		log.Fatal().Msg("PLAYER_ID_KEY is not set")
+	}
+	log.Warn().Msg("PLAYER_ID_KEY is not set, player IDs will change on restart")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal().Err(err).Msg("Unable to generate player ID key")
+	}
+	return NewPlayerIDs(key)
+}
+
+// newIdentityProvider selects the identity provider named by IDENTITY_PROVIDER, defaulting to Cognito
+func newIdentityProvider(cfg aws.Config) IdentityProvider {
+	switch os.Getenv("IDENTITY_PROVIDER") {
+	case "local":
+		issuer := os.Getenv("JWT_ISSUER")
+		if issuer == "" {
+			issuer = "http://localhost:8080"
+		}
+		audience := os.Getenv("CLIENT_ID")
+		if audience == "" {
+			audience = "pickupgames"
+		}
+		key, err := LoadOrGenerateSigningKey(os.Getenv("JWT_SIGNING_KEY_FILE"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to load JWT signing key")
+		}
+		log.Warn().Msg("using local identity provider, users will not be persisted")
+		return NewLocalIdentityProvider(issuer, audience, key)
+	case "", "cognito":
+		userPoolID := requireEnv("USER_POOL_ID")
+		clientID := requireEnv("CLIENT_ID")
+		return NewCognitoIdentityProvider(cognitoidentityprovider.NewFromConfig(cfg), cfg.Region, userPoolID, clientID)
+	default:
+		log.Fatal().Str("identityProvider", os.Getenv("IDENTITY_PROVIDER")).Msg("unknown IDENTITY_PROVIDER")
+	}
+	return nil
 }
 
 func main() {
+	log.Logger = log.Output(newLogWriter())
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		log.Fatal().Err(err).Msg("Unable to load SDK config")
 	}
-	cognitoClient := cognitoidentityprovider.NewFromConfig(cfg)
-	dynamoDBClient := dynamodb.NewFromConfig(cfg)
-	userPoolID := os.Getenv("USER_POOL_ID")
-	if userPoolID == "" {
-		log.Fatal().Msg("USER_POOL_ID is not set")
+	handler := Handler{
+		IdentityProvider:     newIdentityProvider(cfg),
+		Notifier:             newNotifier(cfg),
+		PlayerIDs:            newPlayerIDs(cfg),
+		PaymentProvider:      newPaymentProvider(),
+		PaymentWebhookSecret: newPaymentWebhookSecret(cfg),
 	}
-	clientID := os.Getenv("CLIENT_ID")
-	if clientID == "" {
-		log.Fatal().Msg("CLIENT_ID is not set")
+	configureStores(log.Logger.WithContext(context.Background()), cfg, &handler)
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(&handler, os.Args[2:])
+		return
 	}
-	gamesTable := os.Getenv("PICKUP_GAMES_TABLE")
-	if gamesTable == "" {
-		log.Fatal().Msg("PICKUP_GAMES_TABLE is not set")
+	if len(os.Args) > 1 && (os.Args[1] == "materialize-series" || os.Args[1] == "expire-holds" ||
+		os.Args[1] == "backfill-memberships") {
+		if err := handler.runJob(log.Logger.WithContext(context.Background()), os.Args[1]); err != nil {
+			log.Fatal().Err(err).Msg("job failed")
+		}
+		return
 	}
-	handler := Handler{
-		AWSCognitoClient:     cognitoClient,
-		AWSDynamoDBClient:    dynamoDBClient,
-		userPoolID:           userPoolID,
-		clientID:             clientID,
-		pickupGamesTableName: gamesTable,
+	lambda.Start(handler.invoke)
+}
+
+// ScheduledJob is the input of the EventBridge rules that run background jobs in Lambda
+type ScheduledJob struct {
+	Job string `json:"job"`
+}
+
+// invoke is the Lambda entrypoint. It runs scheduled jobs and hands everything else to handler as
+// an API Gateway request.
+func (h *Handler) invoke(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var scheduledJob ScheduledJob
+	if err := json.Unmarshal(payload, &scheduledJob); err == nil && scheduledJob.Job != "" {
+		return nil, h.runJob(log.Logger.WithContext(ctx), scheduledJob.Job)
+	}
+	var event events.APIGatewayV2HTTPRequest
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API Gateway request: %w", err)
+	}
+	return h.handler(ctx, event)
+}
+
+// runJob runs the background job named job, from a schedule or the command line
+func (h *Handler) runJob(ctx context.Context, job string) error {
+	switch job {
+	case "materialize-series":
+		if err := h.MaterializeAllSeries(ctx); err != nil {
+			return fmt.Errorf("failed to materialize series: %w", err)
+		}
+		return nil
+	case "expire-holds":
+		if err := h.ExpireHolds(ctx); err != nil {
+			return fmt.Errorf("failed to expire holds: %w", err)
+		}
+		return nil
+	case "backfill-memberships":
+		backfiller, ok := h.GameStore.(membershipBackfiller)
+		if !ok {
+			log.Ctx(ctx).Info().Msg("game store has no memberships to backfill")
+			return nil
+		}
+		written, err := backfiller.BackfillMemberships(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to backfill memberships: %w", err)
+		}
+		log.Ctx(ctx).Info().Int("memberships", written).Msg("backfilled memberships")
+		return nil
+	default:
+		return fmt.Errorf("unknown job %q", job)
+	}
+}
+
+// holdExpiryInterval is how often serve looks for expired waitlist offers and payment holds
+const holdExpiryInterval = time.Minute
+
+// serve runs the handler behind a plain net/http server instead of the Lambda runtime
+func serve(handler *Handler, args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	defaultAddr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		defaultAddr = ":" + port
+	}
+	addr := flags.String("addr", defaultAddr, "address to listen on")
+	_ = flags.Parse(args)
+
+	server := &http.Server{
+		Addr: *addr,
+		Handler: &HTTPServer{
+			Handler:       handler,
+			TokenVerifier: handler.IdentityProvider,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if fakePaymentProvider, ok := handler.PaymentProvider.(*FakePaymentProvider); ok && len(handler.PaymentWebhookSecret) > 0 {
+		// the fake provider settles processing charges by calling the server's own webhook
+		webhookHost := *addr
+		if strings.HasPrefix(webhookHost, ":") {
+			webhookHost = "localhost" + webhookHost
+		}
+		fakePaymentProvider.Webhook = &PaymentEventSender{
+			URL:        "http://" + webhookHost + "/webhooks/payments",
+			Secret:     handler.PaymentWebhookSecret,
+			HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// there's no scheduler outside of Lambda, so the server expires holds itself
+	go func() {
+		ticker := time.NewTicker(holdExpiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := handler.ExpireHolds(log.Logger.WithContext(ctx)); err != nil {
+					log.Error().Err(err).Msg("failed to expire holds")
+				}
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("failed to shut down server")
+		}
+	}()
+	log.Info().Str("addr", *addr).Msg("serving API")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal().Err(err).Msg("server failed")
 	}
-	lambda.Start(handler.handler)
 }
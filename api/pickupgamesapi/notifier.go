@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// NotificationChannel is how a notification reaches its recipient
+type NotificationChannel string
+
+const (
+	NotificationChannelEmail NotificationChannel = "email"
+	NotificationChannelSMS   NotificationChannel = "sms"
+)
+
+// NotificationKind lets notifiers pick templates without parsing the message
+type NotificationKind string
+
+const (
+	NotificationKindPasswordReset NotificationKind = "password_reset"
+	NotificationKindVerification  NotificationKind = "verification"
+	NotificationKindGameCancelled NotificationKind = "game_cancelled"
+	// NotificationKindWaitListOffer offers a waitlisted player a spot to confirm before it expires
+	NotificationKindWaitListOffer        NotificationKind = "waitlist_offer"
+	NotificationKindWaitListOfferExpired NotificationKind = "waitlist_offer_expired"
+	// NotificationKindPaymentDue tells a player promoted onto a game with a signup fee to pay before
+	// their spot is released
+	NotificationKindPaymentDue     NotificationKind = "payment_due"
+	NotificationKindPaymentExpired NotificationKind = "payment_expired"
+	// NotificationKindPaymentFailed tells a player the provider failed their charge after it was
+	// made, and how long they have to pay again
+	NotificationKindPaymentFailed NotificationKind = "payment_failed"
+)
+
+// Notification is a message for a single recipient
+type Notification struct {
+	Kind      NotificationKind    `json:"kind"`
+	Channel   NotificationChannel `json:"channel"`
+	Recipient string              `json:"recipient"`
+	Subject   string              `json:"subject"`
+	Message   string              `json:"message"`
+	Data      map[string]string   `json:"data,omitempty"`
+}
+
+// Notifier delivers notifications to players
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// LogNotifier writes notifications to the log instead of delivering them. Verification and
+// password reset codes are masked like every other secret in the log, so flows that need them
+// can't be completed without a NOTIFIER_WEBHOOK_URL.
+type LogNotifier struct{}
+
+func (n LogNotifier) Notify(ctx context.Context, notification Notification) error {
+	data := zerolog.Dict()
+	for key, value := range notification.Data {
+		data.Str(key, value)
+	}
+	log.Ctx(ctx).Info().
+		Str("kind", string(notification.Kind)).
+		Str("channel", string(notification.Channel)).
+		Str("recipient", notification.Recipient).
+		Str("subject", notification.Subject).
+		Str("message", redactSecretData(notification.Message, notification.Data)).
+		Dict("data", data).
+		Msg("notification")
+	return nil
+}
+
+// WebhookNotifier posts each notification as JSON to a URL, such as a mail/SMS relay or a group
+// chat bot
+type WebhookNotifier struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:        url,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	notificationBytes, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(notificationBytes))
+	if err != nil {
+		return fmt.Errorf("failed to build notification request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to send notification: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// AWSNotifier sends emails through SES from EmailFrom, which has to be a verified identity, and
+// text messages through SNS
+type AWSNotifier struct {
+	EmailFrom string
+	client    *awsClient
+}
+
+func NewAWSNotifier(cfg aws.Config, emailFrom string) *AWSNotifier {
+	return &AWSNotifier{
+		EmailFrom: emailFrom,
+		client:    newAWSClient(cfg),
+	}
+}
+
+func (n *AWSNotifier) Notify(ctx context.Context, notification Notification) error {
+	if notification.Channel == NotificationChannelSMS {
+		body := url.Values{
+			"Action":      {"Publish"},
+			"Version":     {"2010-03-31"},
+			"PhoneNumber": {notification.Recipient},
+			"Message":     {notification.Message},
+		}
+		return n.client.call(ctx, awsRequest{
+			Service:        "sns",
+			EndpointPrefix: "sns",
+			Path:           "/",
+			ContentType:    "application/x-www-form-urlencoded",
+			Body:           []byte(body.Encode()),
+		}, nil)
+	}
+	email := map[string]interface{}{
+		"FromEmailAddress": n.EmailFrom,
+		"Destination":      map[string][]string{"ToAddresses": {notification.Recipient}},
+		"Content": map[string]interface{}{
+			"Simple": map[string]interface{}{
+				"Subject": map[string]string{"Data": notification.Subject},
+				"Body":    map[string]interface{}{"Text": map[string]string{"Data": notification.Message}},
+			},
+		},
+	}
+	body, err := json.Marshal(email)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email: %w", err)
+	}
+	return n.client.call(ctx, awsRequest{
+		Service:        "ses",
+		EndpointPrefix: "email",
+		Path:           "/v2/email/outbound-emails",
+		ContentType:    "application/json",
+		Body:           body,
+	}, nil)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pickupgamesapi/types"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// awsRecorder stands in for AWS, keeping the requests it's sent
+type awsRecorder struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func (r *awsRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(body))
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"SecretString":"s3cr3t"}`))
+}
+
+// newTestAWSClient sends every request to recorder, signed with fixed credentials
+func newTestAWSClient(t *testing.T, recorder http.Handler) *awsClient {
+	t.Helper()
+	server := httptest.NewServer(recorder)
+	t.Cleanup(server.Close)
+	client := newAWSClient(aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	client.endpoint = func(endpointPrefix string) string { return server.URL }
+	return client
+}
+
+func TestAWSNotifierSendsEmailThroughSES(t *testing.T) {
+	recorder := &awsRecorder{}
+	notifier := &AWSNotifier{EmailFrom: "games@example.com", client: newTestAWSClient(t, recorder)}
+	err := notifier.Notify(context.Background(), Notification{
+		Channel:   NotificationChannelEmail,
+		Recipient: "a@example.com",
+		Subject:   "Reset your password",
+		Message:   "Your code is 123456",
+	})
+	if err != nil {
+		t.Fatalf("Notify returned an error: %v", err)
+	}
+	if len(recorder.requests) != 1 || recorder.requests[0].URL.Path != "/v2/email/outbound-emails" {
+		t.Fatalf("expected one SendEmail call, got %v", recorder.requests)
+	}
+	if auth := recorder.requests[0].Header.Get("Authorization"); !strings.Contains(auth, "Credential=AKIDTEST/") || !strings.Contains(auth, "/us-east-1/ses/aws4_request") {
+		t.Errorf("expected the request signed for SES, got %q", auth)
+	}
+	var email struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct {
+			Simple struct {
+				Subject struct{ Data string }
+				Body    struct{ Text struct{ Data string } }
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(recorder.bodies[0]), &email); err != nil {
+		t.Fatalf("failed to unmarshal email: %v", err)
+	}
+	if email.FromEmailAddress != "games@example.com" || !equalStrings(email.Destination.ToAddresses, []string{"a@example.com"}) ||
+		email.Content.Simple.Subject.Data != "Reset your password" || email.Content.Simple.Body.Text.Data != "Your code is 123456" {
+		t.Errorf("got %s", recorder.bodies[0])
+	}
+}
+
+func TestAWSNotifierSendsTextsThroughSNS(t *testing.T) {
+	recorder := &awsRecorder{}
+	notifier := &AWSNotifier{EmailFrom: "games@example.com", client: newTestAWSClient(t, recorder)}
+	err := notifier.Notify(context.Background(), Notification{
+		Channel:   NotificationChannelSMS,
+		Recipient: "+15555550100",
+		Message:   "Your code is 123456",
+	})
+	if err != nil {
+		t.Fatalf("Notify returned an error: %v", err)
+	}
+	if len(recorder.requests) != 1 {
+		t.Fatalf("expected one Publish call, got %d", len(recorder.requests))
+	}
+	if auth := recorder.requests[0].Header.Get("Authorization"); !strings.Contains(auth, "/us-east-1/sns/aws4_request") {
+		t.Errorf("expected the request signed for SNS, got %q", auth)
+	}
+	form, err := url.ParseQuery(recorder.bodies[0])
+	if err != nil {
+		t.Fatalf("failed to parse body: %v", err)
+	}
+	if form.Get("Action") != "Publish" || form.Get("PhoneNumber") != "+15555550100" || form.Get("Message") != "Your code is 123456" {
+		t.Errorf("got %s", recorder.bodies[0])
+	}
+}
+
+func TestAWSClientReportsThrottlingAsUnavailable(t *testing.T) {
+	client := newTestAWSClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	notifier := &AWSNotifier{EmailFrom: "games@example.com", client: client}
+	err := notifier.Notify(context.Background(), Notification{Channel: NotificationChannelEmail, Recipient: "a@example.com"})
+	var unavailable *types.UpstreamUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Errorf("expected an upstream unavailable error, got %v", err)
+	}
+}
+
+func TestAWSClientGetsSecretValue(t *testing.T) {
+	recorder := &awsRecorder{}
+	secret, err := newTestAWSClient(t, recorder).getSecretValue(context.Background(), "arn:aws:secretsmanager:us-east-1:123456789012:secret:PlayerIDKey")
+	if err != nil {
+		t.Fatalf("getSecretValue returned an error: %v", err)
+	}
+	if secret != "s3cr3t" {
+		t.Errorf("expected the secret string, got %q", secret)
+	}
+	if len(recorder.requests) != 1 || recorder.requests[0].Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+		t.Fatalf("expected one GetSecretValue call, got %v", recorder.requests)
+	}
+	if auth := recorder.requests[0].Header.Get("Authorization"); !strings.Contains(auth, "/us-east-1/secretsmanager/aws4_request") {
+		t.Errorf("expected the request signed for Secrets Manager, got %q", auth)
+	}
+	if recorder.bodies[0] != `{"SecretId":"arn:aws:secretsmanager:us-east-1:123456789012:secret:PlayerIDKey"}` {
+		t.Errorf("got %s", recorder.bodies[0])
+	}
+}
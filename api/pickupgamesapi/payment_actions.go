@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pickupgamesapi/types"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errNoPaymentDue       = types.NewConflictError("no_payment_due", "you don't owe a signup fee for this game")
+	errPaymentHoldExpired = types.NewConflictError("payment_expired", "your spot was released because the signup fee wasn't paid in time, register again to rejoin")
+	errSignupFeeRequired  = types.NewPaymentRequiredError("payment_required", "pay the signup fee with POST /games/{gameID}/registration/payment to take up your spot")
+	errPaymentProcessing  = types.NewConflictError("payment_processing", "your last payment is still processing, you'll be told when it goes through")
+)
+
+// PaymentRequest pays a game's signup fee. PaymentMethod is the token the payment provider's client
+// SDK gave the player's app for their card.
+type PaymentRequest struct {
+	PaymentMethod string `json:"paymentMethod"`
+}
+
+func (r *PaymentRequest) ValidateRequest() error {
+	if strings.TrimSpace(r.PaymentMethod) == "" {
+		return types.NewValidationError("", "paymentMethod is required")
+	}
+	return nil
+}
+
+// PayForGame charges the requester the game's signup fee and, once the charge succeeds, confirms
+// the spot held for them. A declined charge leaves the spot held until it expires, so the player
+// can try another payment method. A charge the provider is still processing holds the spot for
+// paymentGracePeriod, until the provider's webhook says how it settled.
+func (h *Handler) PayForGame(ctx context.Context, gameID string, requester string, paymentRequest PaymentRequest) (Game, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "PayForGame").Str("gameID", gameID).Str("requester", requester).Logger()
+	logger.Info().Msg("paying signup fee")
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get game")
+		return Game{}, err
+	}
+	if gameRecord.GameStatus() == GameStatusCancelled {
+		return Game{}, errGameCancelled
+	}
+	i := indexOfPlayer(gameRecord.Roster, requester)
+	if i < 0 || gameRecord.feeFor(gameRecord.Roster[i]) <= 0 || gameRecord.Roster[i].Paid {
+		return Game{}, errNoPaymentDue
+	}
+	if gameRecord.Roster[i].PaymentStatus == PaymentIntentProcessing {
+		return Game{}, errPaymentProcessing
+	}
+	if entry := gameRecord.Roster[i]; entry.holdExpired(h.now()) {
+		// the schedule hasn't caught up with it yet, so release the spot now
+		if err := h.releaseExpiredHolds(ctx, gameID); err != nil {
+			logger.Error().Err(err).Msg("failed to expire holds")
+		}
+		return Game{}, holdExpiredError(entry)
+	}
+	now := h.now().UTC().Truncate(time.Second)
+	ledgerEntry := LedgerEntry{
+		GameID:      gameID,
+		EntryID:     uuid.New().String(),
+		UserID:      requester,
+		Kind:        LedgerEntryCharge,
+		AmountCents: gameRecord.feeFor(gameRecord.Roster[i]),
+		Status:      LedgerEntryPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	// the pending entry goes in first so a charge is never made without a record of it
+	if err := h.Payments.PutLedgerEntry(ctx, ledgerEntry); err != nil {
+		logger.Error().Err(err).Msg("failed to record charge")
+		return Game{}, err
+	}
+	intent, err := h.PaymentProvider.CreatePaymentIntent(ctx, PaymentIntentRequest{
+		AmountCents:    ledgerEntry.AmountCents,
+		Customer:       requester,
+		PaymentMethod:  paymentRequest.PaymentMethod,
+		Description:    "Signup fee for " + describeGame(gameRecord),
+		IdempotencyKey: ledgerEntry.EntryID,
+		Metadata: map[string]string{
+			"gameId":  gameID,
+			"entryId": ledgerEntry.EntryID,
+		},
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to create payment intent")
+		return Game{}, fmt.Errorf("failed to create payment intent: %w", err)
+	}
+	ledgerEntry.PaymentIntentID = intent.ID
+	if intent.Status == PaymentIntentRequiresCapture {
+		if intent, err = h.PaymentProvider.CapturePayment(ctx, intent.ID); err != nil {
+			logger.Error().Err(err).Str("paymentIntentID", ledgerEntry.PaymentIntentID).Msg("failed to capture payment")
+			if err := h.updateLedgerEntry(ctx, ledgerEntry, LedgerEntryPending, ""); err != nil {
+				logger.Error().Err(err).Msg("failed to record charge")
+			}
+			return Game{}, fmt.Errorf("failed to capture payment: %w", err)
+		}
+	}
+	switch intent.Status {
+	case PaymentIntentFailed:
+		if err := h.updateLedgerEntry(ctx, ledgerEntry, LedgerEntryFailed, intent.FailureMessage); err != nil {
+			return Game{}, err
+		}
+		message := "your payment was declined"
+		if intent.FailureMessage != "" {
+			message = intent.FailureMessage
+		}
+		return Game{}, types.NewPaymentRequiredError("payment_declined", message)
+	case PaymentIntentSucceeded:
+		if err := h.updateLedgerEntry(ctx, ledgerEntry, LedgerEntrySucceeded, ""); err != nil {
+			return Game{}, err
+		}
+		ledgerEntry.Status = LedgerEntrySucceeded
+		updatedGame, err := h.markPaid(ctx, gameID, ledgerEntry)
+		if err != nil {
+			return Game{}, err
+		}
+		return h.presentGame(ctx, requester, updatedGame)
+	default:
+		// the provider will settle it later and the spot stays held meanwhile
+		if err := h.updateLedgerEntry(ctx, ledgerEntry, LedgerEntryPending, ""); err != nil {
+			return Game{}, err
+		}
+		logger.Info().Str("paymentIntentID", intent.ID).Str("status", string(intent.Status)).Msg("payment is processing")
+		updatedGame, _, err := h.setPaymentStatus(ctx, gameID, requester, PaymentIntentProcessing)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to hold spot for processing payment")
+			return Game{}, err
+		}
+		return h.presentGame(ctx, requester, updatedGame)
+	}
+}
+
+// ListPayments returns the game's ledger. The owner sees every entry and anyone else only their own.
+func (h *Handler) ListPayments(ctx context.Context, gameID string, requester string) (Ledger, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "ListPayments").Str("gameID", gameID).Str("requester", requester).Logger()
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get game")
+		return Ledger{}, err
+	}
+	entries, err := h.Payments.GetLedgerEntries(ctx, gameID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get ledger entries")
+		return Ledger{}, err
+	}
+	if gameRecord.Owner == requester {
+		return Ledger{Entries: entries}, nil
+	}
+	own := []LedgerEntry{}
+	for _, entry := range entries {
+		if entry.UserID == requester {
+			own = append(own, entry)
+		}
+	}
+	return Ledger{Entries: own}, nil
+}
+
+// markPaid confirms the spot of the player charged by ledgerEntry. If they lost it while the
+// charge went through, or another charge got there first, the money is given back.
+func (h *Handler) markPaid(ctx context.Context, gameID string, ledgerEntry LedgerEntry) (GameRecord, error) {
+	for attempt := 1; ; attempt++ {
+		gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+		if errors.Is(err, errGameNotFound) {
+			return GameRecord{}, h.refundUnheldCharge(ctx, ledgerEntry, "game deleted", err)
+		}
+		if err != nil {
+			return GameRecord{}, err
+		}
+		i := indexOfPlayer(gameRecord.Roster, ledgerEntry.UserID)
+		switch {
+		case gameRecord.GameStatus() == GameStatusCancelled:
+			return GameRecord{}, h.refundUnheldCharge(ctx, ledgerEntry, "game cancelled", errGameCancelled)
+		case i < 0:
+			return GameRecord{}, h.refundUnheldCharge(ctx, ledgerEntry, "spot released before the payment went through", errPaymentHoldExpired)
+		case gameRecord.Roster[i].Paid:
+			return gameRecord, h.refundUnheldCharge(ctx, ledgerEntry, "already paid", nil)
+		}
+		expectedVersion := gameRecord.Version
+		gameRecord.Roster[i] = gameRecord.Roster[i].withoutHold()
+		gameRecord.Roster[i].Paid = true
+		updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
+		if errors.Is(err, errConditionFailed) && attempt < maxGameUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return GameRecord{}, fmt.Errorf("failed to update game: %w", err)
+		}
+		return updatedGame, nil
+	}
+}
+
+// refundUnheldCharge gives back the whole of a charge that didn't pay for a spot, returning
+// result once it has
+func (h *Handler) refundUnheldCharge(ctx context.Context, ledgerEntry LedgerEntry, reason string, result error) error {
+	if err := h.refund(ctx, ledgerEntry, RefundDecision{AmountCents: ledgerEntry.AmountCents, Reason: reason}); err != nil {
+		return err
+	}
+	return result
+}
+
+// refundDroppedPlayer settles userID's charges on the game under its refund policy once they've
+// dropped out. Players dropping off the waitlist weren't holding a spot, so they get everything
+// back. spotFilled is whether someone was promoted from the waitlist into their spot.
+func (h *Handler) refundDroppedPlayer(ctx context.Context, gameRecord GameRecord, userID string, fromWaitList bool, spotFilled bool) error {
+	now := h.now()
+	return h.settleCharges(ctx, gameRecord.GameID, userID, func(charge LedgerEntry) RefundDecision {
+		if fromWaitList {
+			return RefundDecision{AmountCents: charge.AmountCents, Reason: "dropped from the waitlist"}
+		}
+		return gameRecord.RefundPolicy.refundForDrop(charge.AmountCents, time.Unix(gameRecord.StartTime, 0), now, spotFilled)
+	})
+}
+
+// refundCancelledGame gives back every charge on the game in full
+func (h *Handler) refundCancelledGame(ctx context.Context, gameRecord GameRecord) error {
+	return h.settleCharges(ctx, gameRecord.GameID, "", func(charge LedgerEntry) RefundDecision {
+		return RefundDecision{AmountCents: charge.AmountCents, Reason: "game cancelled"}
+	})
+}
+
+// settleCharges refunds what decide gives back on each succeeded charge on the game, only userID's
+// when it's set. Each charge is settled once, so a player who rejoins and drops again is only
+// refunded on what they paid the second time.
+func (h *Handler) settleCharges(ctx context.Context, gameID string, userID string, decide func(LedgerEntry) RefundDecision) error {
+	entries, err := h.Payments.GetLedgerEntries(ctx, gameID)
+	if err != nil {
+		return err
+	}
+	for _, charge := range entries {
+		if charge.Kind != LedgerEntryCharge || charge.Status != LedgerEntrySucceeded {
+			continue
+		}
+		if userID != "" && charge.UserID != userID {
+			continue
+		}
+		if err := h.refund(ctx, charge, decide(charge)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refund gives back decision.AmountCents of a succeeded charge, recording the refund alongside it,
+// and marks the charge refunded, partially refunded or forfeited accordingly
+func (h *Handler) refund(ctx context.Context, charge LedgerEntry, decision RefundDecision) error {
+	log.Ctx(ctx).Info().Str("gameID", charge.GameID).Str("entryID", charge.EntryID).Int("amountCents", decision.AmountCents).
+		Str("reason", decision.Reason).Msg("settling charge")
+	status := LedgerEntryRefunded
+	switch {
+	case decision.AmountCents <= 0:
+		status = LedgerEntryForfeited
+	case decision.AmountCents < charge.AmountCents:
+		status = LedgerEntryPartiallyRefunded
+	}
+	if decision.AmountCents > 0 {
+		now := h.now().UTC().Truncate(time.Second)
+		refundEntry := LedgerEntry{
+			GameID:          charge.GameID,
+			EntryID:         uuid.New().String(),
+			UserID:          charge.UserID,
+			Kind:            LedgerEntryRefund,
+			AmountCents:     decision.AmountCents,
+			Status:          LedgerEntryPending,
+			PaymentIntentID: charge.PaymentIntentID,
+			Reason:          decision.Reason,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+		if err := h.Payments.PutLedgerEntry(ctx, refundEntry); err != nil {
+			return fmt.Errorf("failed to record refund: %w", err)
+		}
+		if _, err := h.PaymentProvider.RefundPayment(ctx, charge.PaymentIntentID, decision.AmountCents); err != nil {
+			if err := h.updateLedgerEntry(ctx, refundEntry, LedgerEntryFailed, "the refund could not be made"); err != nil {
+				log.Ctx(ctx).Error().Err(err).Str("entryID", refundEntry.EntryID).Msg("failed to record refund")
+			}
+			return fmt.Errorf("failed to refund payment: %w", err)
+		}
+		if err := h.updateLedgerEntry(ctx, refundEntry, LedgerEntrySucceeded, ""); err != nil {
+			return err
+		}
+	}
+	charge.Reason = decision.Reason
+	return h.updateLedgerEntry(ctx, charge, status, "")
+}
+
+// updateLedgerEntry saves ledgerEntry with a new status
+func (h *Handler) updateLedgerEntry(ctx context.Context, ledgerEntry LedgerEntry, status LedgerEntryStatus, failureMessage string) error {
+	ledgerEntry.Status = status
+	ledgerEntry.FailureMessage = failureMessage
+	ledgerEntry.UpdatedAt = h.now().UTC().Truncate(time.Second)
+	if err := h.Payments.PutLedgerEntry(ctx, ledgerEntry); err != nil {
+		return fmt.Errorf("failed to record charge: %w", err)
+	}
+	return nil
+}
+
+// expirePendingCharges marks the user's charges on the game that never settled as expired, once
+// the spot they were paying for has been released
+func (h *Handler) expirePendingCharges(ctx context.Context, gameID string, userID string) error {
+	entries, err := h.Payments.GetLedgerEntries(ctx, gameID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.UserID != userID || entry.Kind != LedgerEntryCharge || entry.Status != LedgerEntryPending {
+			continue
+		}
+		if err := h.updateLedgerEntry(ctx, entry, LedgerEntryExpired, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
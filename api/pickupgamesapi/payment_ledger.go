@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LedgerEntryKind is what a ledger entry records
+type LedgerEntryKind string
+
+const (
+	// LedgerEntryCharge is a player paying the game's signup fee
+	LedgerEntryCharge LedgerEntryKind = "charge"
+	// LedgerEntrySplitShare is a player's locked share of the game's venue cost, paid to the owner
+	// directly. It's pending until the owner marks it paid, which makes it succeeded.
+	LedgerEntrySplitShare LedgerEntryKind = "split_share"
+	// LedgerEntryRefund is money given back on a charge, which shares the charge's PaymentIntentID
+	LedgerEntryRefund LedgerEntryKind = "refund"
+)
+
+// LedgerEntryStatus is where a ledger entry's money stands
+type LedgerEntryStatus string
+
+const (
+	// LedgerEntryPending has been sent to the payment provider and not yet settled
+	LedgerEntryPending   LedgerEntryStatus = "pending"
+	LedgerEntrySucceeded LedgerEntryStatus = "succeeded"
+	LedgerEntryFailed    LedgerEntryStatus = "failed"
+	// LedgerEntryExpired was still pending when the player's hold on their spot ran out
+	LedgerEntryExpired LedgerEntryStatus = "expired"
+	// LedgerEntryRefunded succeeded and was then given back
+	LedgerEntryRefunded LedgerEntryStatus = "refunded"
+	// LedgerEntryPartiallyRefunded succeeded and some of it was given back under the refund policy
+	LedgerEntryPartiallyRefunded LedgerEntryStatus = "partially_refunded"
+	// LedgerEntryForfeited succeeded and was kept under the refund policy when the player dropped out
+	LedgerEntryForfeited LedgerEntryStatus = "forfeited"
+)
+
+// LedgerEntry records money moving between a player and a game's owner. EntryID doubles as the
+// idempotency key sent to the payment provider.
+type LedgerEntry struct {
+	GameID          string            `json:"gameId" dynamodbav:"GameID"`
+	EntryID         string            `json:"entryId" dynamodbav:"EntryID"`
+	UserID          string            `json:"userId" dynamodbav:"UserID"`
+	Kind            LedgerEntryKind   `json:"kind" dynamodbav:"Kind"`
+	AmountCents     int               `json:"amountCents" dynamodbav:"AmountCents"`
+	Status          LedgerEntryStatus `json:"status" dynamodbav:"Status"`
+	PaymentIntentID string            `json:"paymentIntentId,omitempty" dynamodbav:"PaymentIntentID,omitempty"`
+	FailureMessage  string            `json:"failureMessage,omitempty" dynamodbav:"FailureMessage,omitempty"`
+	// Reason explains how a refund policy settled a charge, and why a refund was given
+	Reason    string    `json:"reason,omitempty" dynamodbav:"Reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"CreatedAt,unixtime"`
+	UpdatedAt time.Time `json:"updatedAt" dynamodbav:"UpdatedAt,unixtime"`
+}
+
+// Ledger is a game's ledger entries, oldest first
+type Ledger struct {
+	Entries []LedgerEntry `json:"entries"`
+}
+
+// PaymentLedger stores each game's ledger entries
+type PaymentLedger interface {
+	// PutLedgerEntry creates the entry or overwrites the one with the same GameID and EntryID
+	PutLedgerEntry(ctx context.Context, entry LedgerEntry) error
+	// GetLedgerEntries returns the game's entries, oldest first
+	GetLedgerEntries(ctx context.Context, gameID string) ([]LedgerEntry, error)
+	// GetLedgerEntriesByUser returns the user's entries across every game, oldest first
+	GetLedgerEntriesByUser(ctx context.Context, userID string) ([]LedgerEntry, error)
+	// RecordWebhookEvent claims a payment provider event for processing, returning false if it was
+	// already claimed
+	RecordWebhookEvent(ctx context.Context, eventID string, receivedAt time.Time) (bool, error)
+	// ForgetWebhookEvent releases the claim on an event that failed to process, so a redelivery of
+	// it is processed again
+	ForgetWebhookEvent(ctx context.Context, eventID string) error
+}
+
+// sortLedgerEntries puts entries oldest first, breaking ties by EntryID so the order is stable
+func sortLedgerEntries(entries []LedgerEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+		}
+		return entries[i].EntryID < entries[j].EntryID
+	})
+}
+
+// MemoryPaymentLedger is an in-process PaymentLedger
+type MemoryPaymentLedger struct {
+	mu            sync.RWMutex
+	entries       map[string]map[string]LedgerEntry
+	webhookEvents map[string]time.Time
+}
+
+func NewMemoryPaymentLedger() *MemoryPaymentLedger {
+	return &MemoryPaymentLedger{
+		entries:       map[string]map[string]LedgerEntry{},
+		webhookEvents: map[string]time.Time{},
+	}
+}
+
+func (l *MemoryPaymentLedger) PutLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.entries[entry.GameID] == nil {
+		l.entries[entry.GameID] = map[string]LedgerEntry{}
+	}
+	l.entries[entry.GameID][entry.EntryID] = entry
+	return nil
+}
+
+func (l *MemoryPaymentLedger) GetLedgerEntries(ctx context.Context, gameID string) ([]LedgerEntry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := make([]LedgerEntry, 0, len(l.entries[gameID]))
+	for _, entry := range l.entries[gameID] {
+		entries = append(entries, entry)
+	}
+	sortLedgerEntries(entries)
+	return entries, nil
+}
+
+func (l *MemoryPaymentLedger) GetLedgerEntriesByUser(ctx context.Context, userID string) ([]LedgerEntry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := []LedgerEntry{}
+	for _, gameEntries := range l.entries {
+		for _, entry := range gameEntries {
+			if entry.UserID == userID {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sortLedgerEntries(entries)
+	return entries, nil
+}
+
+func (l *MemoryPaymentLedger) RecordWebhookEvent(ctx context.Context, eventID string, receivedAt time.Time) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.webhookEvents[eventID]; ok {
+		return false, nil
+	}
+	l.webhookEvents[eventID] = receivedAt
+	return true, nil
+}
+
+func (l *MemoryPaymentLedger) ForgetWebhookEvent(ctx context.Context, eventID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.webhookEvents, eventID)
+	return nil
+}
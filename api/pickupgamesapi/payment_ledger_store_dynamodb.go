@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBPaymentLedger is a PaymentLedger backed by a DynamoDB table keyed on GameID and EntryID.
+// Webhook events share the table, each in a partition of its own.
+type DynamoDBPaymentLedger struct {
+	Client    *dynamodb.Client
+	TableName string
+}
+
+func NewDynamoDBPaymentLedger(client *dynamodb.Client, tableName string) *DynamoDBPaymentLedger {
+	return &DynamoDBPaymentLedger{
+		Client:    client,
+		TableName: tableName,
+	}
+}
+
+func (l *DynamoDBPaymentLedger) PutLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ledger entry: %w", err)
+	}
+	_, err = l.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &l.TableName,
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put ledger entry to DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
+
+// GetLedgerEntries reads the game's whole partition. EntryIDs are random, so the entries are
+// sorted here rather than by the table.
+func (l *DynamoDBPaymentLedger) GetLedgerEntries(ctx context.Context, gameID string) ([]LedgerEntry, error) {
+	return l.queryLedgerEntries(ctx, dynamodb.QueryInput{
+		TableName:              &l.TableName,
+		KeyConditionExpression: aws.String("GameID = :gameID"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":gameID": &ddbtypes.AttributeValueMemberS{Value: gameID},
+		},
+	})
+}
+
+// GetLedgerEntriesByUser reads the user's partition of UserIndex, which webhook events are left
+// out of as they have no UserID
+func (l *DynamoDBPaymentLedger) GetLedgerEntriesByUser(ctx context.Context, userID string) ([]LedgerEntry, error) {
+	return l.queryLedgerEntries(ctx, dynamodb.QueryInput{
+		TableName:              &l.TableName,
+		IndexName:              aws.String("UserIndex"),
+		KeyConditionExpression: aws.String("UserID = :userID"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":userID": &ddbtypes.AttributeValueMemberS{Value: userID},
+		},
+	})
+}
+
+// queryLedgerEntries reads every page of the query and sorts the entries oldest first
+func (l *DynamoDBPaymentLedger) queryLedgerEntries(ctx context.Context, queryInput dynamodb.QueryInput) ([]LedgerEntry, error) {
+	entries := []LedgerEntry{}
+	for {
+		queryOutput, err := l.Client.Query(ctx, &queryInput)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ledger entries from DynamoDB: %w", upstreamError("DynamoDB", err))
+		}
+		var page []LedgerEntry
+		if err := attributevalue.UnmarshalListOfMaps(queryOutput.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ledger entries: %w", err)
+		}
+		entries = append(entries, page...)
+		if len(queryOutput.LastEvaluatedKey) == 0 {
+			break
+		}
+		queryInput.ExclusiveStartKey = queryOutput.LastEvaluatedKey
+	}
+	sortLedgerEntries(entries)
+	return entries, nil
+}
+
+// webhookEventKey is the key of the item recording a webhook event
+func webhookEventKey(eventID string) map[string]ddbtypes.AttributeValue {
+	return map[string]ddbtypes.AttributeValue{
+		"GameID":  &ddbtypes.AttributeValueMemberS{Value: "webhook-event#" + eventID},
+		"EntryID": &ddbtypes.AttributeValueMemberS{Value: "webhook-event"},
+	}
+}
+
+func (l *DynamoDBPaymentLedger) RecordWebhookEvent(ctx context.Context, eventID string, receivedAt time.Time) (bool, error) {
+	item := webhookEventKey(eventID)
+	item["ReceivedAt"] = &ddbtypes.AttributeValueMemberN{Value: strconv.FormatInt(receivedAt.Unix(), 10)}
+	_, err := l.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           &l.TableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(GameID)"),
+	})
+	if err != nil {
+		var conditionalCheckFailed *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailed) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to record webhook event in DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return true, nil
+}
+
+func (l *DynamoDBPaymentLedger) ForgetWebhookEvent(ctx context.Context, eventID string) error {
+	_, err := l.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &l.TableName,
+		Key:       webhookEventKey(eventID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to forget webhook event in DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
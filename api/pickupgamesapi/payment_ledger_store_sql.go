@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SQLPaymentLedger is a PaymentLedger backed by SQLite or Postgres
+type SQLPaymentLedger struct {
+	db *sql.DB
+}
+
+func NewSQLPaymentLedger(db *sql.DB) *SQLPaymentLedger {
+	return &SQLPaymentLedger{
+		db: db,
+	}
+}
+
+func (l *SQLPaymentLedger) PutLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	_, err := l.db.ExecContext(ctx, `INSERT INTO payment_ledger (game_id, entry_id, user_id, kind, amount_cents,
+			status, payment_intent_id, failure_message, reason, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (game_id, entry_id) DO UPDATE SET user_id = excluded.user_id, kind = excluded.kind,
+			amount_cents = excluded.amount_cents, status = excluded.status,
+			payment_intent_id = excluded.payment_intent_id, failure_message = excluded.failure_message,
+			reason = excluded.reason, updated_at = excluded.updated_at`,
+		entry.GameID, entry.EntryID, entry.UserID, string(entry.Kind), entry.AmountCents, string(entry.Status),
+		entry.PaymentIntentID, entry.FailureMessage, entry.Reason, entry.CreatedAt.Unix(), entry.UpdatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to save ledger entry: %w", err)
+	}
+	return nil
+}
+
+func (l *SQLPaymentLedger) GetLedgerEntries(ctx context.Context, gameID string) ([]LedgerEntry, error) {
+	return l.queryLedgerEntries(ctx, `WHERE game_id = $1`, gameID)
+}
+
+func (l *SQLPaymentLedger) GetLedgerEntriesByUser(ctx context.Context, userID string) ([]LedgerEntry, error) {
+	return l.queryLedgerEntries(ctx, `WHERE user_id = $1`, userID)
+}
+
+// queryLedgerEntries loads the entries matched by the WHERE clause, oldest first
+func (l *SQLPaymentLedger) queryLedgerEntries(ctx context.Context, clause string, args ...interface{}) ([]LedgerEntry, error) {
+	rows, err := l.db.QueryContext(ctx, `SELECT game_id, entry_id, user_id, kind, amount_cents, status,
+			payment_intent_id, failure_message, reason, created_at, updated_at
+		FROM payment_ledger `+clause+` ORDER BY created_at, entry_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ledger entries: %w", err)
+	}
+	defer rows.Close()
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var entry LedgerEntry
+		var createdAt, updatedAt int64
+		err := rows.Scan(&entry.GameID, &entry.EntryID, &entry.UserID, &entry.Kind, &entry.AmountCents, &entry.Status,
+			&entry.PaymentIntentID, &entry.FailureMessage, &entry.Reason, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan ledger entry: %w", err)
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0).UTC()
+		entry.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get ledger entries: %w", err)
+	}
+	return entries, nil
+}
+
+func (l *SQLPaymentLedger) RecordWebhookEvent(ctx context.Context, eventID string, receivedAt time.Time) (bool, error) {
+	result, err := l.db.ExecContext(ctx, `INSERT INTO payment_webhook_events (event_id, received_at) VALUES ($1, $2)
+		ON CONFLICT (event_id) DO NOTHING`, eventID, receivedAt.Unix())
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook event: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook event: %w", err)
+	}
+	return inserted == 1, nil
+}
+
+func (l *SQLPaymentLedger) ForgetWebhookEvent(ctx context.Context, eventID string) error {
+	if _, err := l.db.ExecContext(ctx, `DELETE FROM payment_webhook_events WHERE event_id = $1`, eventID); err != nil {
+		return fmt.Errorf("failed to forget webhook event: %w", err)
+	}
+	return nil
+}
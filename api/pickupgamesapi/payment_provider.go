@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// PaymentIntentStatus is where a charge stands with the payment provider
+type PaymentIntentStatus string
+
+const (
+	// PaymentIntentRequiresCapture has been authorized and is waiting to be captured
+	PaymentIntentRequiresCapture PaymentIntentStatus = "requires_capture"
+	// PaymentIntentProcessing will succeed or fail later, and the provider says which asynchronously
+	PaymentIntentProcessing PaymentIntentStatus = "processing"
+	PaymentIntentSucceeded  PaymentIntentStatus = "succeeded"
+	PaymentIntentFailed     PaymentIntentStatus = "failed"
+)
+
+// PaymentIntentRequest asks the provider to authorize a charge to a payment method
+type PaymentIntentRequest struct {
+	AmountCents int
+	// Customer is the UserID of the player paying
+	Customer string
+	// PaymentMethod is the token the provider's client SDK gave the player's app
+	PaymentMethod string
+	Description   string
+	// IdempotencyKey makes a retried request return the intent it already created
+	IdempotencyKey string
+	// Metadata is attached to the intent and sent back in the provider's webhook events about it
+	Metadata map[string]string
+}
+
+// PaymentIntent is a charge as the provider sees it
+type PaymentIntent struct {
+	ID          string
+	AmountCents int
+	Status      PaymentIntentStatus
+	// FailureMessage is the provider's explanation of a failed charge, fit to show the player
+	FailureMessage string
+	Metadata       map[string]string
+}
+
+// PaymentRefund is money returned against a captured intent
+type PaymentRefund struct {
+	ID          string
+	IntentID    string
+	AmountCents int
+}
+
+// PaymentProvider charges players' payment methods. Charges are authorized when the intent is
+// created and only taken once captured.
+type PaymentProvider interface {
+	// CreatePaymentIntent authorizes a charge. A declined payment method gives an intent with
+	// PaymentIntentFailed rather than an error.
+	CreatePaymentIntent(ctx context.Context, intentRequest PaymentIntentRequest) (PaymentIntent, error)
+	// CapturePayment takes the money authorized by the intent
+	CapturePayment(ctx context.Context, intentID string) (PaymentIntent, error)
+	// RefundPayment returns amountCents of a captured intent
+	RefundPayment(ctx context.Context, intentID string, amountCents int) (PaymentRefund, error)
+}
+
+var errPaymentIntentNotFound = errors.New("payment intent not found")
+
+const (
+	// fakeDeclinedPaymentMethod is the payment method FakePaymentProvider declines
+	fakeDeclinedPaymentMethod = "pm_card_declined"
+	// fakeProcessingPaymentMethod and fakeProcessingDeclinedPaymentMethod leave the intent
+	// processing until SettlePayment succeeds or fails it
+	fakeProcessingPaymentMethod         = "pm_card_processing"
+	fakeProcessingDeclinedPaymentMethod = "pm_card_processing_declined"
+)
+
+// fakeSettleDelay is how long FakePaymentProvider leaves an intent processing before settling it
+// when it has a webhook to tell
+const fakeSettleDelay = 5 * time.Second
+
+// FakePaymentProvider approves every payment method except fakeDeclinedPaymentMethod without
+// moving any money. It's meant for tests and local development. With Webhook set, processing
+// intents settle on their own after fakeSettleDelay and the event is sent to it.
+type FakePaymentProvider struct {
+	Webhook *PaymentEventSender
+
+	mu              sync.Mutex
+	intents         map[string]PaymentIntent
+	idempotencyKeys map[string]string
+	refundedCents   map[string]int
+	// declineOnSettle holds the processing intents that will fail when settled
+	declineOnSettle map[string]bool
+}
+
+func NewFakePaymentProvider() *FakePaymentProvider {
+	return &FakePaymentProvider{
+		intents:         map[string]PaymentIntent{},
+		idempotencyKeys: map[string]string{},
+		refundedCents:   map[string]int{},
+		declineOnSettle: map[string]bool{},
+	}
+}
+
+func (p *FakePaymentProvider) CreatePaymentIntent(ctx context.Context, intentRequest PaymentIntentRequest) (PaymentIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if intentID, ok := p.idempotencyKeys[intentRequest.IdempotencyKey]; ok && intentRequest.IdempotencyKey != "" {
+		return p.intents[intentID], nil
+	}
+	intent := PaymentIntent{
+		ID:          "pi_fake_" + uuid.New().String(),
+		AmountCents: intentRequest.AmountCents,
+		Status:      PaymentIntentRequiresCapture,
+		Metadata:    intentRequest.Metadata,
+	}
+	switch intentRequest.PaymentMethod {
+	case fakeDeclinedPaymentMethod:
+		intent.Status = PaymentIntentFailed
+		intent.FailureMessage = "Your card was declined."
+	case fakeProcessingPaymentMethod, fakeProcessingDeclinedPaymentMethod:
+		intent.Status = PaymentIntentProcessing
+		p.declineOnSettle[intent.ID] = intentRequest.PaymentMethod == fakeProcessingDeclinedPaymentMethod
+		if p.Webhook != nil {
+			intentID := intent.ID
+			time.AfterFunc(fakeSettleDelay, func() {
+				p.settleAndNotify(intentID)
+			})
+		}
+	}
+	p.intents[intent.ID] = intent
+	p.idempotencyKeys[intentRequest.IdempotencyKey] = intent.ID
+	return intent, nil
+}
+
+// SettlePayment succeeds or fails a processing intent, as its payment method dictates, and returns
+// the event the provider would send about it
+func (p *FakePaymentProvider) SettlePayment(intentID string) (PaymentEvent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return PaymentEvent{}, errPaymentIntentNotFound
+	}
+	if intent.Status != PaymentIntentProcessing {
+		return PaymentEvent{}, fmt.Errorf("payment intent %s isn't processing", intentID)
+	}
+	event := PaymentEvent{
+		ID:      "evt_fake_" + uuid.New().String(),
+		Type:    PaymentEventSucceeded,
+		Created: time.Now().Unix(),
+	}
+	intent.Status = PaymentIntentSucceeded
+	if p.declineOnSettle[intentID] {
+		intent.Status = PaymentIntentFailed
+		intent.FailureMessage = "Your bank declined the payment."
+		event.Type = PaymentEventFailed
+	}
+	delete(p.declineOnSettle, intentID)
+	p.intents[intentID] = intent
+	event.Data = PaymentEventData{
+		PaymentIntentID: intent.ID,
+		AmountCents:     intent.AmountCents,
+		FailureMessage:  intent.FailureMessage,
+		Metadata:        intent.Metadata,
+	}
+	return event, nil
+}
+
+// settleAndNotify settles the intent and sends the event to the provider's webhook
+func (p *FakePaymentProvider) settleAndNotify(intentID string) {
+	event, err := p.SettlePayment(intentID)
+	if err != nil {
+		log.Error().Err(err).Str("paymentIntentID", intentID).Msg("failed to settle fake payment")
+		return
+	}
+	if err := p.Webhook.Send(context.Background(), event); err != nil {
+		log.Error().Err(err).Str("eventID", event.ID).Msg("failed to send fake payment event")
+	}
+}
+
+func (p *FakePaymentProvider) CapturePayment(ctx context.Context, intentID string) (PaymentIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return PaymentIntent{}, errPaymentIntentNotFound
+	}
+	if intent.Status != PaymentIntentRequiresCapture {
+		return PaymentIntent{}, fmt.Errorf("payment intent %s can't be captured from %s", intentID, intent.Status)
+	}
+	intent.Status = PaymentIntentSucceeded
+	p.intents[intentID] = intent
+	return intent, nil
+}
+
+func (p *FakePaymentProvider) RefundPayment(ctx context.Context, intentID string, amountCents int) (PaymentRefund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return PaymentRefund{}, errPaymentIntentNotFound
+	}
+	if intent.Status != PaymentIntentSucceeded {
+		return PaymentRefund{}, fmt.Errorf("payment intent %s hasn't been captured", intentID)
+	}
+	if amountCents <= 0 || p.refundedCents[intentID]+amountCents > intent.AmountCents {
+		return PaymentRefund{}, fmt.Errorf("refund of %d cents exceeds what's left of payment intent %s", amountCents, intentID)
+	}
+	p.refundedCents[intentID] += amountCents
+	return PaymentRefund{ID: "re_fake_" + uuid.New().String(), IntentID: intentID, AmountCents: amountCents}, nil
+}
+
+// newPaymentProvider selects the payment provider named by PAYMENT_PROVIDER. Only the fake
+// provider exists so far, so signup fees are recorded but never actually collected. A deployment
+// has to ask for it by name, only local runs get it by default.
+func newPaymentProvider() PaymentProvider {
+	switch os.Getenv("PAYMENT_PROVIDER") {
+	case "":
+		if os.Getenv("GAME_STORE") != "memory" && os.Getenv("IDENTITY_PROVIDER") != "local" {
+			log.Fatal().Msg("PAYMENT_PROVIDER is not set")
+		}
+		fallthrough
+	case "fake":
+		log.Warn().Msg("using fake payment provider, signup fees will not be collected")
+		return NewFakePaymentProvider()
+	default:
+		log.Fatal().Str("paymentProvider", os.Getenv("PAYMENT_PROVIDER")).Msg("unknown PAYMENT_PROVIDER")
+	}
+	return nil
+}
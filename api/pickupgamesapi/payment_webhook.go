@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"pickupgamesapi/types"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/rs/zerolog/log"
+)
+
+// paymentSignatureHeader carries the signature on a payment provider's webhook request, as
+// "t=<unix time>,v1=<hex HMAC-SHA256 of the time, a dot and the body>". There can be more than one
+// v1 while the provider rotates secrets.
+const paymentSignatureHeader = "payment-signature"
+
+// paymentSignatureTolerance is how far a webhook's signing time can be from now, so a captured
+// request can't be replayed later
+const paymentSignatureTolerance = 5 * time.Minute
+
+var errInvalidPaymentSignature = types.NewUnauthorizedError("invalid_signature", "the webhook signature is missing or invalid")
+
+// PaymentEventType is what a payment provider's webhook event reports
+type PaymentEventType string
+
+const (
+	PaymentEventSucceeded PaymentEventType = "payment_intent.succeeded"
+	PaymentEventFailed    PaymentEventType = "payment_intent.payment_failed"
+)
+
+// PaymentEvent is a payment provider telling us how a charge settled. Providers deliver events at
+// least once, so the same ID can arrive more than once.
+type PaymentEvent struct {
+	ID      string           `json:"id"`
+	Type    PaymentEventType `json:"type"`
+	Created int64            `json:"created"`
+	Data    PaymentEventData `json:"data"`
+}
+
+type PaymentEventData struct {
+	PaymentIntentID string `json:"paymentIntentId"`
+	AmountCents     int    `json:"amountCents"`
+	FailureMessage  string `json:"failureMessage,omitempty"`
+	// Metadata is what was attached to the intent, gameId and entryId for signup fees
+	Metadata map[string]string `json:"metadata"`
+}
+
+// signPaymentEvent signs payload as the provider would at timestamp, giving the header value
+func signPaymentEvent(secret []byte, timestamp time.Time, payload []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", timestamp.Unix(), paymentSignature(secret, timestamp.Unix(), payload))
+}
+
+func paymentSignature(secret []byte, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPaymentSignature checks that header signs payload with secret within
+// paymentSignatureTolerance of now
+func verifyPaymentSignature(secret []byte, header string, payload []byte, now time.Time) error {
+	if len(secret) == 0 {
+		return errInvalidPaymentSignature
+	}
+	var timestamp int64
+	signatures := []string{}
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errInvalidPaymentSignature
+			}
+			timestamp = parsed
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == 0 || len(signatures) == 0 {
+		return errInvalidPaymentSignature
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-paymentSignatureTolerance)) || signedAt.After(now.Add(paymentSignatureTolerance)) {
+		return errInvalidPaymentSignature
+	}
+	expected := []byte(paymentSignature(secret, timestamp, payload))
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), expected) {
+			return nil
+		}
+	}
+	return errInvalidPaymentSignature
+}
+
+// HandlePaymentWebhook verifies and applies an event from the payment provider. Each event is
+// applied once, a redelivery of one already applied is acknowledged and ignored. An error tells
+// the provider to deliver the event again later.
+func (h *Handler) HandlePaymentWebhook(ctx context.Context, payload []byte, signatureHeader string) error {
+	logger := log.Ctx(ctx).With().Str("operation", "HandlePaymentWebhook").Logger()
+	if err := verifyPaymentSignature(h.PaymentWebhookSecret, signatureHeader, payload, h.now()); err != nil {
+		logger.Warn().Msg("rejected payment webhook with an invalid signature")
+		return err
+	}
+	var event PaymentEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.ID == "" {
+		return types.NewValidationError("", "invalid payment event")
+	}
+	logger = logger.With().Str("eventID", event.ID).Str("type", string(event.Type)).Logger()
+	first, err := h.Payments.RecordWebhookEvent(ctx, event.ID, h.now().UTC().Truncate(time.Second))
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to record payment event")
+		return err
+	}
+	if !first {
+		logger.Info().Msg("ignoring payment event already received")
+		return nil
+	}
+	if err := h.applyPaymentEvent(log.Ctx(ctx).With().Str("eventID", event.ID).Logger().WithContext(ctx), event); err != nil {
+		logger.Error().Err(err).Msg("failed to apply payment event")
+		if err := h.Payments.ForgetWebhookEvent(ctx, event.ID); err != nil {
+			logger.Error().Err(err).Msg("failed to forget payment event")
+		}
+		return err
+	}
+	return nil
+}
+
+// applyPaymentEvent settles the signup fee charge the event is about. A charge that succeeds
+// confirms the player's spot, or is refunded if they've lost it, and a redelivery confirms a spot
+// an earlier delivery recorded the charge for but failed to. A charge that fails leaves the spot
+// held for paymentGracePeriod so the player can pay again.
+func (h *Handler) applyPaymentEvent(ctx context.Context, event PaymentEvent) error {
+	logger := log.Ctx(ctx).With().Str("paymentIntentID", event.Data.PaymentIntentID).Logger()
+	gameID, entryID := event.Data.Metadata["gameId"], event.Data.Metadata["entryId"]
+	if event.Type != PaymentEventSucceeded && event.Type != PaymentEventFailed {
+		logger.Info().Msg("ignoring payment event of an unhandled type")
+		return nil
+	}
+	if gameID == "" || entryID == "" {
+		logger.Info().Msg("ignoring payment event for a charge that isn't a signup fee")
+		return nil
+	}
+	entries, err := h.Payments.GetLedgerEntries(ctx, gameID)
+	if err != nil {
+		return err
+	}
+	var charge LedgerEntry
+	for _, entry := range entries {
+		if entry.EntryID == entryID && entry.Kind == LedgerEntryCharge {
+			charge = entry
+		}
+	}
+	if charge.EntryID == "" || (charge.PaymentIntentID != "" && charge.PaymentIntentID != event.Data.PaymentIntentID) {
+		logger.Warn().Str("gameID", gameID).Str("entryID", entryID).Msg("ignoring payment event for an unknown charge")
+		return nil
+	}
+	// the intent isn't recorded if the charge was interrupted right after it was created
+	charge.PaymentIntentID = event.Data.PaymentIntentID
+	switch event.Type {
+	case PaymentEventSucceeded:
+		switch charge.Status {
+		case LedgerEntryPending, LedgerEntryExpired:
+			if err := h.updateLedgerEntry(ctx, charge, LedgerEntrySucceeded, ""); err != nil {
+				return err
+			}
+			charge.Status = LedgerEntrySucceeded
+		case LedgerEntrySucceeded:
+			// a delivery that failed after recording the charge may not have confirmed the spot
+			paid, err := h.chargeApplied(ctx, charge)
+			if err != nil || paid {
+				return err
+			}
+		default:
+			return nil
+		}
+		_, err := h.markPaid(ctx, gameID, charge)
+		if errors.Is(err, errPaymentHoldExpired) || errors.Is(err, errGameCancelled) || errors.Is(err, errGameNotFound) {
+			// the charge was refunded in full
+			return nil
+		}
+		return err
+	default:
+		if charge.Status != LedgerEntryPending {
+			return nil
+		}
+		if err := h.updateLedgerEntry(ctx, charge, LedgerEntryFailed, event.Data.FailureMessage); err != nil {
+			return err
+		}
+		gameRecord, held, err := h.setPaymentStatus(ctx, gameID, charge.UserID, PaymentIntentFailed)
+		if errors.Is(err, errGameNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if held {
+			h.notifyPaymentFailed(ctx, gameRecord, charge.UserID, event.Data.FailureMessage)
+		}
+		return nil
+	}
+}
+
+// chargeApplied is whether the player charged has been marked paid on the game. Any charge of
+// theirs that succeeded after they were paid was refunded, so the one that paid is this one.
+func (h *Handler) chargeApplied(ctx context.Context, charge LedgerEntry) (bool, error) {
+	gameRecord, err := h.GameStore.GetGame(ctx, charge.GameID)
+	if errors.Is(err, errGameNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	i := indexOfPlayer(gameRecord.Roster, charge.UserID)
+	return i >= 0 && gameRecord.Roster[i].Paid, nil
+}
+
+// setPaymentStatus records where the player's charge stands on their unpaid roster entry and
+// holds their spot for paymentGracePeriod, returning whether they were still holding one
+func (h *Handler) setPaymentStatus(ctx context.Context, gameID string, userID string, status PaymentIntentStatus) (GameRecord, bool, error) {
+	for attempt := 1; ; attempt++ {
+		gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+		if err != nil {
+			return GameRecord{}, false, err
+		}
+		i := indexOfPlayer(gameRecord.Roster, userID)
+		if i < 0 || gameRecord.Roster[i].Paid || gameRecord.Roster[i].holdExpiresAt() == nil || gameRecord.GameStatus() == GameStatusCancelled {
+			return gameRecord, false, nil
+		}
+		expectedVersion := gameRecord.Version
+		gameRecord.Roster[i] = gameRecord.Roster[i].withPaymentStatus(status, h.now(), time.Unix(gameRecord.StartTime, 0))
+		updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
+		if errors.Is(err, errConditionFailed) && attempt < maxGameUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return GameRecord{}, false, fmt.Errorf("failed to update game: %w", err)
+		}
+		return updatedGame, true, nil
+	}
+}
+
+// notifyPaymentFailed tells a player their charge failed and how long they have to pay again
+func (h *Handler) notifyPaymentFailed(ctx context.Context, gameRecord GameRecord, userID string, failureMessage string) {
+	i := indexOfPlayer(gameRecord.Roster, userID)
+	if i < 0 || gameRecord.Roster[i].holdExpiresAt() == nil {
+		return
+	}
+	dueAt := gameRecord.Roster[i].holdExpiresAt().UTC()
+	if failureMessage == "" {
+		failureMessage = "Your payment was declined."
+	}
+	notification := Notification{
+		Kind:      NotificationKindPaymentFailed,
+		Channel:   NotificationChannelEmail,
+		Recipient: userID,
+		Subject:   "Payment failed: " + gameRecord.Name,
+		Message: fmt.Sprintf("Your payment of the signup fee for %s failed: %s Pay again by %s or your spot will be released.",
+			describeGame(gameRecord), failureMessage, dueAt.Format(notificationTimeLayout)),
+		Data: map[string]string{
+			"gameId":       gameRecord.GameID,
+			"paymentDueAt": dueAt.Format(time.RFC3339),
+		},
+	}
+	if err := h.Notifier.Notify(ctx, notification); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("gameID", gameRecord.GameID).Str("recipient", userID).Msg("failed to send payment failure notification")
+	}
+}
+
+// newPaymentWebhookSecret reads the payment provider's webhook signing secret from
+// PAYMENT_WEBHOOK_SECRET, or the Secrets Manager secret PAYMENT_WEBHOOK_SECRET_ARN names
+func newPaymentWebhookSecret(cfg aws.Config) []byte {
+	secret := secretFromEnv(cfg, "PAYMENT_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Warn().Msg("PAYMENT_WEBHOOK_SECRET is not set, payment webhooks will be rejected")
+	}
+	return []byte(secret)
+}
+
+// PaymentEventSender is a stand-in for a payment provider's webhook delivery, signing events with
+// Secret and posting them to URL. FakePaymentProvider uses it to settle processing charges.
+type PaymentEventSender struct {
+	URL        string
+	Secret     []byte
+	HTTPClient *http.Client
+}
+
+func (s *PaymentEventSender) Send(ctx context.Context, event PaymentEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payment event: %w", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(paymentSignatureHeader, signPaymentEvent(s.Secret, time.Now(), payload))
+	response, err := s.HTTPClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send payment event: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("payment webhook returned %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// failingGameStore fails the next failReplace game replacements, as a store that's briefly
+// unavailable would
+type failingGameStore struct {
+	GameStore
+	failReplace int
+}
+
+func (s *failingGameStore) ReplaceGame(ctx context.Context, gameRecord GameRecord, expectedVersion int) (GameRecord, error) {
+	if s.failReplace > 0 {
+		s.failReplace--
+		return GameRecord{}, errors.New("store unavailable")
+	}
+	return s.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
+}
+
+// deliverPaymentEvent posts the event to the payment webhook with signature as its header
+func (h *testHandler) deliverPaymentEvent(t *testing.T, payload []byte, signature string) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	return h.call(t, testRequest{
+		RouteKey: "POST /webhooks/payments",
+		Headers:  map[string]string{paymentSignatureHeader: signature},
+		Body:     string(payload),
+	}, nil)
+}
+
+// deliverSigned posts the event signed with the handler's secret at the clock's current time
+func (h *testHandler) deliverSigned(t *testing.T, event PaymentEvent) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	payload := marshalPaymentEvent(t, event)
+	return h.deliverPaymentEvent(t, payload, signPaymentEvent(h.PaymentWebhookSecret, h.clock.Now(), payload))
+}
+
+func marshalPaymentEvent(t *testing.T, event PaymentEvent) []byte {
+	t.Helper()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to marshal payment event: %v", err)
+	}
+	return payload
+}
+
+// processingPayment registers player for a game with a signup fee and pays with paymentMethod,
+// which leaves the charge processing, returning the game and the event that settles it
+func (h *testHandler) processingPayment(t *testing.T, player string, paymentMethod string) (Game, PaymentEvent) {
+	t.Helper()
+	body := newTestGame("soccer", 72*time.Hour, 1, 5)
+	body["signupFeeCents"] = 1000
+	game := h.createGame(t, "owner@example.com", body)
+	h.register(t, game.GameID, player)
+	if response := h.pay(t, game.GameID, player, paymentMethod); response.StatusCode != http.StatusOK {
+		t.Fatalf("paying returned %d: %s", response.StatusCode, response.Body)
+	}
+	entries := h.ledger(t, game.GameID, "owner@example.com")
+	if len(entries) != 1 || entries[0].PaymentIntentID == "" {
+		t.Fatalf("expected one charge, got %+v", entries)
+	}
+	event, err := h.payments.SettlePayment(entries[0].PaymentIntentID)
+	if err != nil {
+		t.Fatalf("failed to settle payment: %v", err)
+	}
+	return game, event
+}
+
+// rosterEntry returns the player's entry on the game's roster
+func (h *testHandler) rosterEntry(t *testing.T, gameID string, player string) (RosterEntry, bool) {
+	t.Helper()
+	game := h.getGame(t, gameID, "owner@example.com")
+	if i := indexOfPlayer(game.Roster, player); i >= 0 {
+		return game.Roster[i], true
+	}
+	return RosterEntry{}, false
+}
+
+// refundsFor is how many refunds the ledger holds
+func refundsFor(entries []LedgerEntry) int {
+	refunds := 0
+	for _, entry := range entries {
+		if entry.Kind == LedgerEntryRefund {
+			refunds++
+		}
+	}
+	return refunds
+}
+
+func TestPaymentWebhookRejectsBadSignatures(t *testing.T) {
+	h := newTestHandler(t)
+	game, event := h.processingPayment(t, "a@example.com", fakeProcessingPaymentMethod)
+	payload := marshalPaymentEvent(t, event)
+	tampered := marshalPaymentEvent(t, PaymentEvent{ID: event.ID, Type: event.Type, Data: PaymentEventData{
+		PaymentIntentID: event.Data.PaymentIntentID,
+		AmountCents:     1,
+		Metadata:        event.Data.Metadata,
+	}})
+	now := h.clock.Now()
+	for name, delivery := range map[string]struct {
+		payload   []byte
+		signature string
+	}{
+		"missing":         {payload, ""},
+		"malformed":       {payload, "v1=abc"},
+		"wrong secret":    {payload, signPaymentEvent([]byte("whsec_other"), now, payload)},
+		"tampered body":   {tampered, signPaymentEvent(h.PaymentWebhookSecret, now, payload)},
+		"stale":           {payload, signPaymentEvent(h.PaymentWebhookSecret, now.Add(-paymentSignatureTolerance-time.Second), payload)},
+		"from the future": {payload, signPaymentEvent(h.PaymentWebhookSecret, now.Add(paymentSignatureTolerance+time.Second), payload)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			response := h.deliverPaymentEvent(t, delivery.payload, delivery.signature)
+			if response.StatusCode != http.StatusUnauthorized || errorCode(t, response) != "invalid_signature" {
+				t.Errorf("got %d: %s", response.StatusCode, response.Body)
+			}
+		})
+	}
+	if entry, _ := h.rosterEntry(t, game.GameID, "a@example.com"); entry.Paid {
+		t.Fatalf("a rejected event marked the player paid")
+	}
+	// the signature is still good at the edge of the tolerance, and a rejected delivery doesn't
+	// stop the real one being applied
+	h.clock.Advance(paymentSignatureTolerance)
+	if response := h.deliverPaymentEvent(t, payload, signPaymentEvent(h.PaymentWebhookSecret, now, payload)); response.StatusCode != http.StatusOK {
+		t.Fatalf("delivering the signed event returned %d: %s", response.StatusCode, response.Body)
+	}
+	if entry, _ := h.rosterEntry(t, game.GameID, "a@example.com"); !entry.Paid {
+		t.Errorf("expected the player paid, got %+v", entry)
+	}
+}
+
+func TestPaymentWebhookAppliesRedeliveriesOnce(t *testing.T) {
+	h := newTestHandler(t)
+	game, event := h.processingPayment(t, "a@example.com", fakeProcessingPaymentMethod)
+	for delivery := 1; delivery <= 3; delivery++ {
+		if response := h.deliverSigned(t, event); response.StatusCode != http.StatusOK {
+			t.Fatalf("delivery %d returned %d: %s", delivery, response.StatusCode, response.Body)
+		}
+	}
+	entry, _ := h.rosterEntry(t, game.GameID, "a@example.com")
+	if !entry.Paid || entry.Status != RegistrationStatusConfirmed || entry.PaymentDueAt != nil {
+		t.Errorf("expected a confirmed, paid spot, got %+v", entry)
+	}
+	entries := h.ledger(t, game.GameID, "owner@example.com")
+	if chargeStatus(entries, "a@example.com") != LedgerEntrySucceeded || refundsFor(entries) != 0 {
+		t.Errorf("expected one succeeded charge and no refunds, got %+v", entries)
+	}
+}
+
+func TestPaymentWebhookFailureHoldsSpotForGracePeriod(t *testing.T) {
+	h := newTestHandler(t)
+	game, event := h.processingPayment(t, "a@example.com", fakeProcessingDeclinedPaymentMethod)
+	if event.Type != PaymentEventFailed {
+		t.Fatalf("expected a failed payment event, got %s", event.Type)
+	}
+	h.clock.Advance(time.Hour)
+	if response := h.deliverSigned(t, event); response.StatusCode != http.StatusOK {
+		t.Fatalf("delivering the event returned %d: %s", response.StatusCode, response.Body)
+	}
+	entry, ok := h.rosterEntry(t, game.GameID, "a@example.com")
+	dueAt := testStart.Add(time.Hour + paymentGracePeriod)
+	if !ok || entry.Paid || entry.PaymentStatus != PaymentIntentFailed || entry.PaymentDueAt == nil || !entry.PaymentDueAt.Equal(dueAt) {
+		t.Fatalf("expected the spot held until %v, got %+v", dueAt, entry)
+	}
+	if chargeStatus(h.ledger(t, game.GameID, "owner@example.com"), "a@example.com") != LedgerEntryFailed {
+		t.Errorf("expected the charge failed")
+	}
+	if kinds := h.notifier.kinds("a@example.com"); len(kinds) != 1 || kinds[0] != NotificationKindPaymentFailed {
+		t.Errorf("got notifications %v", kinds)
+	}
+	h.clock.Advance(paymentGracePeriod - time.Second)
+	if err := h.ExpireHolds(context.Background()); err != nil {
+		t.Fatalf("ExpireHolds returned an error: %v", err)
+	}
+	if _, ok := h.rosterEntry(t, game.GameID, "a@example.com"); !ok {
+		t.Fatalf("spot released before the grace period ran out")
+	}
+	h.clock.Advance(time.Second)
+	if err := h.ExpireHolds(context.Background()); err != nil {
+		t.Fatalf("ExpireHolds returned an error: %v", err)
+	}
+	if _, ok := h.rosterEntry(t, game.GameID, "a@example.com"); ok {
+		t.Errorf("spot still held after the grace period")
+	}
+	if kinds := h.notifier.kinds("a@example.com"); len(kinds) != 2 || kinds[1] != NotificationKindPaymentExpired {
+		t.Errorf("got notifications %v", kinds)
+	}
+}
+
+func TestPaymentWebhookRedeliveryConfirmsSpotAfterPartialFailure(t *testing.T) {
+	h := newTestHandler(t)
+	game, event := h.processingPayment(t, "a@example.com", fakeProcessingPaymentMethod)
+	h.GameStore = &failingGameStore{GameStore: h.GameStore, failReplace: 1}
+	if response := h.deliverSigned(t, event); response.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the provider to be told to redeliver, got %d: %s", response.StatusCode, response.Body)
+	}
+	if chargeStatus(h.ledger(t, game.GameID, "owner@example.com"), "a@example.com") != LedgerEntrySucceeded {
+		t.Fatalf("expected the charge recorded before the spot was confirmed")
+	}
+	if entry, _ := h.rosterEntry(t, game.GameID, "a@example.com"); entry.Paid {
+		t.Fatalf("the failed delivery marked the player paid")
+	}
+	for delivery := 1; delivery <= 2; delivery++ {
+		if response := h.deliverSigned(t, event); response.StatusCode != http.StatusOK {
+			t.Fatalf("redelivery %d returned %d: %s", delivery, response.StatusCode, response.Body)
+		}
+	}
+	if entry, _ := h.rosterEntry(t, game.GameID, "a@example.com"); !entry.Paid || entry.Status != RegistrationStatusConfirmed {
+		t.Errorf("expected the redelivery to confirm the spot, got %+v", entry)
+	}
+	entries := h.ledger(t, game.GameID, "owner@example.com")
+	if chargeStatus(entries, "a@example.com") != LedgerEntrySucceeded || refundsFor(entries) != 0 {
+		t.Errorf("expected the charge kept and nothing refunded, got %+v", entries)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"pickupgamesapi/types"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	maxPriceTiers = 5
+	maxPromoCodes = 20
+	// maxPriceTierHours is the furthest ahead of the start an early registration price can reach
+	maxPriceTierHours = 30 * 24
+)
+
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+var (
+	// errInvalidPromoCode doesn't say whether the code exists, so codes can't be guessed
+	errInvalidPromoCode   = types.NewValidationError("invalid_promo_code", "promo code isn't valid for this game")
+	errPromoCodeExpired   = types.NewConflictError("promo_code_expired", "promo code has expired")
+	errPromoCodeUsedUp    = types.NewConflictError("promo_code_used_up", "promo code has been used as many times as it can be")
+	errPromoCodeReused    = types.NewConflictError("promo_code_limit_reached", "you've used this promo code as many times as you can")
+	errNoSignupFeeToCut   = types.NewConflictError("no_signup_fee", "this game has no signup fee to discount")
+	errDuplicatePromoCode = types.NewValidationError("", "promo codes must be unique")
+)
+
+// PriceTier is a lower signup fee for players registering early or while the game is filling up.
+// It applies to a registration at least MinHoursBeforeStart before the start and while fewer than
+// MaxPlayers are on the roster, either condition left out when it's 0.
+type PriceTier struct {
+	Name                string `json:"name,omitempty" dynamodbav:"Name,omitempty"`
+	PriceCents          int    `json:"priceCents" dynamodbav:"PriceCents"`
+	MinHoursBeforeStart int    `json:"minHoursBeforeStart,omitempty" dynamodbav:"MinHoursBeforeStart,omitempty"`
+	MaxPlayers          int    `json:"maxPlayers,omitempty" dynamodbav:"MaxPlayers,omitempty"`
+}
+
+// appliesTo reports whether the tier covers a registration untilStart before the start with
+// rosterSize players already on the roster
+func (t PriceTier) appliesTo(untilStart time.Duration, rosterSize int) bool {
+	if t.MinHoursBeforeStart > 0 && untilStart < time.Duration(t.MinHoursBeforeStart)*time.Hour {
+		return false
+	}
+	return t.MaxPlayers == 0 || rosterSize < t.MaxPlayers
+}
+
+// PromoCode takes PercentOff or AmountOffCents off the price of a registration. MaxUses caps
+// redemptions across all players and MaxUsesPerUser each player's, unlimited when 0. Uses is
+// filled in for the owner from the game's redemptions.
+type PromoCode struct {
+	Code           string     `json:"code" dynamodbav:"Code"`
+	PercentOff     int        `json:"percentOff,omitempty" dynamodbav:"PercentOff,omitempty"`
+	AmountOffCents int        `json:"amountOffCents,omitempty" dynamodbav:"AmountOffCents,omitempty"`
+	MaxUses        int        `json:"maxUses,omitempty" dynamodbav:"MaxUses,omitempty"`
+	MaxUsesPerUser int        `json:"maxUsesPerUser,omitempty" dynamodbav:"MaxUsesPerUser,omitempty"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty" dynamodbav:"ExpiresAt,omitempty,unixtime"`
+	Uses           int        `json:"uses" dynamodbav:"-"`
+}
+
+// discount is what the code takes off priceCents, never more than the price
+func (c PromoCode) discount(priceCents int) int {
+	discount := c.AmountOffCents
+	if c.PercentOff > 0 {
+		discount = priceCents * c.PercentOff / 100
+	}
+	if discount > priceCents {
+		return priceCents
+	}
+	return discount
+}
+
+// PromoRedemption records a player using a promo code to register. Redemptions count towards the
+// code's limits even if the player later drops out. Only the owner is shown them.
+type PromoRedemption struct {
+	Code          string    `json:"code" dynamodbav:"Code"`
+	UserID        string    `json:"userId" dynamodbav:"UserID"`
+	DiscountCents int       `json:"discountCents" dynamodbav:"DiscountCents"`
+	RedeemedAt    time.Time `json:"redeemedAt" dynamodbav:"RedeemedAt,unixtime"`
+}
+
+// RegistrationRequest is the optional request body for registering for a game
+type RegistrationRequest struct {
+	PromoCode string `json:"promoCode"`
+}
+
+// validatePricing checks a game's price tiers and promo codes, upper-casing the codes in place
+func validatePricing(priceTiers []PriceTier, promoCodes []PromoCode) error {
+	if len(priceTiers) > maxPriceTiers {
+		return types.NewValidationError("", fmt.Sprintf("a game can have at most %d price tiers", maxPriceTiers))
+	}
+	for _, tier := range priceTiers {
+		switch {
+		case tier.PriceCents < 0:
+			return types.NewValidationError("", "priceTiers.priceCents must be at least 0")
+		case tier.MinHoursBeforeStart < 0 || tier.MinHoursBeforeStart > maxPriceTierHours:
+			return types.NewValidationError("", fmt.Sprintf("priceTiers.minHoursBeforeStart must be between 0 and %d", maxPriceTierHours))
+		case tier.MaxPlayers < 0:
+			return types.NewValidationError("", "priceTiers.maxPlayers must be at least 0")
+		case tier.MinHoursBeforeStart == 0 && tier.MaxPlayers == 0:
+			return types.NewValidationError("", "priceTiers need minHoursBeforeStart or maxPlayers")
+		}
+	}
+	if len(promoCodes) > maxPromoCodes {
+		return types.NewValidationError("", fmt.Sprintf("a game can have at most %d promo codes", maxPromoCodes))
+	}
+	seen := map[string]bool{}
+	for i := range promoCodes {
+		code := &promoCodes[i]
+		code.Code = strings.ToUpper(strings.TrimSpace(code.Code))
+		code.Uses = 0
+		switch {
+		case !promoCodePattern.MatchString(code.Code):
+			return types.NewValidationError("", "promoCodes.code must be 3 to 32 letters, digits, dashes or underscores")
+		case seen[code.Code]:
+			return errDuplicatePromoCode
+		case (code.PercentOff > 0) == (code.AmountOffCents > 0):
+			return types.NewValidationError("", "promoCodes need one of percentOff or amountOffCents")
+		case code.PercentOff < 0 || code.PercentOff > 100:
+			return types.NewValidationError("", "promoCodes.percentOff must be between 1 and 100")
+		case code.AmountOffCents < 0:
+			return types.NewValidationError("", "promoCodes.amountOffCents must be at least 1")
+		case code.MaxUses < 0 || code.MaxUsesPerUser < 0:
+			return types.NewValidationError("", "promoCodes.maxUses and maxUsesPerUser must be at least 0")
+		}
+		seen[code.Code] = true
+	}
+	return nil
+}
+
+// currentPriceCents is what a player registering at now pays before any promo code, the lowest of
+// the signup fee and the price tiers that apply
+func (r GameRecord) currentPriceCents(now time.Time) int {
+	price := r.SignupFeeCents
+	untilStart := time.Unix(r.StartTime, 0).Sub(now)
+	for _, tier := range r.PriceTiers {
+		if tier.PriceCents < price && tier.appliesTo(untilStart, len(r.Roster)) {
+			price = tier.PriceCents
+		}
+	}
+	return price
+}
+
+// feeFor is the signup fee the player on entry owes, the price they registered at or, for players
+// without one, the game's signup fee
+func (r GameRecord) feeFor(entry RosterEntry) int {
+	if entry.PriceCents != nil {
+		return *entry.PriceCents
+	}
+	return r.SignupFeeCents
+}
+
+// redeemPromoCode applies the game's promo code to userID's registration at priceCents, returning
+// the discounted price and the redemption to record
+func (r GameRecord) redeemPromoCode(code string, userID string, priceCents int, now time.Time) (int, PromoRedemption, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for _, promoCode := range r.PromoCodes {
+		if promoCode.Code != code {
+			continue
+		}
+		if promoCode.ExpiresAt != nil && !now.Before(*promoCode.ExpiresAt) {
+			return 0, PromoRedemption{}, errPromoCodeExpired
+		}
+		if priceCents <= 0 {
+			return 0, PromoRedemption{}, errNoSignupFeeToCut
+		}
+		uses, userUses := 0, 0
+		for _, redemption := range r.PromoRedemptions {
+			if redemption.Code != code {
+				continue
+			}
+			uses++
+			if redemption.UserID == userID {
+				userUses++
+			}
+		}
+		if promoCode.MaxUses > 0 && uses >= promoCode.MaxUses {
+			return 0, PromoRedemption{}, errPromoCodeUsedUp
+		}
+		if promoCode.MaxUsesPerUser > 0 && userUses >= promoCode.MaxUsesPerUser {
+			return 0, PromoRedemption{}, errPromoCodeReused
+		}
+		discount := promoCode.discount(priceCents)
+		return priceCents - discount, PromoRedemption{
+			Code:          code,
+			UserID:        userID,
+			DiscountCents: discount,
+			RedeemedAt:    now.UTC().Truncate(time.Second),
+		}, nil
+	}
+	return 0, PromoRedemption{}, errInvalidPromoCode
+}
+
+// promoCodeUses returns the game's promo codes with how many times each has been redeemed
+func (r GameRecord) promoCodeUses() []PromoCode {
+	promoCodes := make([]PromoCode, len(r.PromoCodes))
+	for i, promoCode := range r.PromoCodes {
+		promoCode.Uses = 0
+		for _, redemption := range r.PromoRedemptions {
+			if redemption.Code == promoCode.Code {
+				promoCode.Uses++
+			}
+		}
+		promoCodes[i] = promoCode
+	}
+	return promoCodes
+}
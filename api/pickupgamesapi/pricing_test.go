@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCurrentPriceCents(t *testing.T) {
+	gameRecord := GameRecord{
+		GameBase: GameBase{
+			SignupFeeCents: 1000,
+			PriceTiers: []PriceTier{
+				{Name: "early bird", PriceCents: 700, MinHoursBeforeStart: 48},
+				{Name: "first in", PriceCents: 500, MaxPlayers: 2},
+				// a tier can't raise the price
+				{Name: "late", PriceCents: 1500, MaxPlayers: 10},
+			},
+		},
+		StartTime: testStart.Add(7 * 24 * time.Hour).Unix(),
+	}
+	startTime := time.Unix(gameRecord.StartTime, 0)
+	for _, test := range []struct {
+		name       string
+		untilStart time.Duration
+		rosterSize int
+		want       int
+	}{
+		{"both tiers apply", 72 * time.Hour, 0, 500},
+		{"early once the first spots are gone", 72 * time.Hour, 2, 700},
+		{"early right at the cutoff", 48 * time.Hour, 2, 700},
+		{"first in after the early cutoff", 24 * time.Hour, 1, 500},
+		{"full price once neither applies", 24 * time.Hour, 2, 1000},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			gameRecord.Roster = make([]RosterEntry, test.rosterSize)
+			if got := gameRecord.currentPriceCents(startTime.Add(-test.untilStart)); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedeemPromoCode(t *testing.T) {
+	expiresAt := testStart.Add(time.Hour)
+	gameRecord := GameRecord{
+		GameBase: GameBase{
+			SignupFeeCents: 1000,
+			PromoCodes: []PromoCode{
+				{Code: "HALF", PercentOff: 50},
+				{Code: "THIRD", PercentOff: 33},
+				{Code: "TENOFF", AmountOffCents: 1000},
+				{Code: "SOON", PercentOff: 10, ExpiresAt: &expiresAt},
+				{Code: "LIMITED", PercentOff: 10, MaxUses: 2},
+				{Code: "ONCE", PercentOff: 10, MaxUsesPerUser: 1},
+			},
+		},
+		PromoRedemptions: []PromoRedemption{
+			{Code: "LIMITED", UserID: "b@example.com"},
+			{Code: "LIMITED", UserID: "c@example.com"},
+			{Code: "ONCE", UserID: "a@example.com"},
+		},
+	}
+	for _, test := range []struct {
+		name       string
+		code       string
+		user       string
+		priceCents int
+		now        time.Time
+		want       int
+		wantErr    error
+	}{
+		{name: "codes are case insensitive", code: " half ", priceCents: 1000, want: 500},
+		{name: "percentages round the discount down", code: "THIRD", priceCents: 1001, want: 671},
+		{name: "discounts stop at the price", code: "TENOFF", priceCents: 500, want: 0},
+		{name: "applies to the tier price", code: "HALF", priceCents: 700, want: 350},
+		{name: "before expiry", code: "SOON", priceCents: 1000, now: expiresAt.Add(-time.Second), want: 900},
+		{name: "expired", code: "SOON", priceCents: 1000, now: expiresAt, wantErr: errPromoCodeExpired},
+		{name: "used up", code: "LIMITED", priceCents: 1000, wantErr: errPromoCodeUsedUp},
+		{name: "used by the player", code: "ONCE", user: "a@example.com", priceCents: 1000, wantErr: errPromoCodeReused},
+		{name: "used by someone else", code: "ONCE", user: "b@example.com", priceCents: 1000, want: 900},
+		{name: "unknown", code: "NOPE", priceCents: 1000, wantErr: errInvalidPromoCode},
+		{name: "nothing to discount", code: "HALF", priceCents: 0, wantErr: errNoSignupFeeToCut},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			user, now := test.user, test.now
+			if user == "" {
+				user = "d@example.com"
+			}
+			if now.IsZero() {
+				now = testStart
+			}
+			got, redemption, err := gameRecord.redeemPromoCode(test.code, user, test.priceCents, now)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("expected error %v, got %v", test.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+			if redemption.UserID != user || redemption.DiscountCents != test.priceCents-test.want || !redemption.RedeemedAt.Equal(now) {
+				t.Errorf("got redemption %+v", redemption)
+			}
+		})
+	}
+}
+
+func TestValidatePricing(t *testing.T) {
+	tooManyTiers := make([]PriceTier, maxPriceTiers+1)
+	for i := range tooManyTiers {
+		tooManyTiers[i] = PriceTier{PriceCents: 500, MaxPlayers: i + 1}
+	}
+	for _, test := range []struct {
+		name       string
+		priceTiers []PriceTier
+		promoCodes []PromoCode
+		wantErr    bool
+	}{
+		{name: "none"},
+		{
+			name:       "valid",
+			priceTiers: []PriceTier{{PriceCents: 0, MaxPlayers: 1}, {PriceCents: 500, MinHoursBeforeStart: maxPriceTierHours}},
+			promoCodes: []PromoCode{{Code: "half", PercentOff: 100}, {Code: "ten-off_1", AmountOffCents: 1000, MaxUses: 5, MaxUsesPerUser: 1}},
+		},
+		{name: "too many tiers", priceTiers: tooManyTiers, wantErr: true},
+		{name: "negative tier price", priceTiers: []PriceTier{{PriceCents: -1, MaxPlayers: 1}}, wantErr: true},
+		{name: "tier without a condition", priceTiers: []PriceTier{{PriceCents: 500}}, wantErr: true},
+		{name: "tier too far ahead", priceTiers: []PriceTier{{PriceCents: 500, MinHoursBeforeStart: maxPriceTierHours + 1}}, wantErr: true},
+		{name: "negative max players", priceTiers: []PriceTier{{PriceCents: 500, MaxPlayers: -1, MinHoursBeforeStart: 1}}, wantErr: true},
+		{name: "code too short", promoCodes: []PromoCode{{Code: "AB", PercentOff: 10}}, wantErr: true},
+		{name: "code with spaces inside", promoCodes: []PromoCode{{Code: "TEN OFF", PercentOff: 10}}, wantErr: true},
+		{name: "duplicate codes", promoCodes: []PromoCode{{Code: "half", PercentOff: 50}, {Code: "HALF", PercentOff: 50}}, wantErr: true},
+		{name: "no discount", promoCodes: []PromoCode{{Code: "NOTHING"}}, wantErr: true},
+		{name: "two discounts", promoCodes: []PromoCode{{Code: "BOTH", PercentOff: 10, AmountOffCents: 100}}, wantErr: true},
+		{name: "over 100 percent", promoCodes: []PromoCode{{Code: "FREE", PercentOff: 101}}, wantErr: true},
+		{name: "negative max uses", promoCodes: []PromoCode{{Code: "HALF", PercentOff: 50, MaxUses: -1}}, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validatePricing(test.priceTiers, test.promoCodes); (err != nil) != test.wantErr {
+				t.Errorf("expected an error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+	promoCodes := []PromoCode{{Code: " ten-off ", AmountOffCents: 1000, Uses: 3}}
+	if err := validatePricing(nil, promoCodes); err != nil || promoCodes[0].Code != "TEN-OFF" || promoCodes[0].Uses != 0 {
+		t.Errorf("expected the code upper-cased and its uses cleared, got %+v %v", promoCodes[0], err)
+	}
+}
+
+func TestGamePriceFollowsTiers(t *testing.T) {
+	h := newTestHandler(t)
+	body := newTestGame("soccer", 72*time.Hour, 1, 5)
+	body["signupFeeCents"] = 1000
+	body["priceTiers"] = []PriceTier{{Name: "first in", PriceCents: 500, MaxPlayers: 1}}
+	game := h.createGame(t, "owner@example.com", body)
+	if price := h.getGame(t, game.GameID, "a@example.com").PriceCents; price != 500 {
+		t.Fatalf("expected the first spot priced at 500, got %d", price)
+	}
+	h.register(t, game.GameID, "a@example.com")
+	if price := h.getGame(t, game.GameID, "a@example.com").PriceCents; price != 500 {
+		t.Errorf("expected a@example.com shown what they registered at, got %d", price)
+	}
+	if price := h.getGame(t, game.GameID, "b@example.com").PriceCents; price != 1000 {
+		t.Errorf("expected the next spot at full price, got %d", price)
+	}
+	if price := h.getGame(t, game.GameID, "").PriceCents; price != 1000 {
+		t.Errorf("expected anonymous requests shown the current price, got %d", price)
+	}
+}
+
+func TestRegisterWithPromoCode(t *testing.T) {
+	h := newTestHandler(t)
+	body := newTestGame("soccer", 72*time.Hour, 1, 5)
+	body["signupFeeCents"] = 1000
+	body["promoCodes"] = []map[string]interface{}{{"code": "half", "percentOff": 50, "maxUsesPerUser": 1}}
+	game := h.createGame(t, "owner@example.com", body)
+	registerWithCode := func(player string, code string) (int, string) {
+		response := h.call(t, testRequest{
+			RouteKey:       "POST /games/{gameID}/registrtation",
+			Requester:      player,
+			PathParameters: map[string]string{"gameID": game.GameID},
+			Body:           RegistrationRequest{PromoCode: code},
+		}, nil)
+		if response.StatusCode == http.StatusOK {
+			return response.StatusCode, ""
+		}
+		return response.StatusCode, errorCode(t, response)
+	}
+
+	if status, code := registerWithCode("a@example.com", "Half"); status != http.StatusOK {
+		t.Fatalf("registering with the promo code returned %d %s", status, code)
+	}
+	if price := h.getGame(t, game.GameID, "a@example.com").PriceCents; price != 500 {
+		t.Errorf("expected the discounted price, got %d", price)
+	}
+	if response := h.pay(t, game.GameID, "a@example.com", "pm_card_visa"); response.StatusCode != http.StatusOK {
+		t.Fatalf("paying returned %d: %s", response.StatusCode, response.Body)
+	}
+	if entries := h.ledger(t, game.GameID, "owner@example.com"); len(entries) != 1 || entries[0].AmountCents != 500 {
+		t.Errorf("expected a 500 charge, got %+v", entries)
+	}
+	owned := h.getGame(t, game.GameID, "owner@example.com")
+	if len(owned.PromoRedemptions) != 1 || owned.PromoRedemptions[0].Code != "HALF" || owned.PromoRedemptions[0].DiscountCents != 500 {
+		t.Errorf("expected the owner shown the redemption, got %+v", owned.PromoRedemptions)
+	}
+	if len(owned.PromoCodes) != 1 || owned.PromoCodes[0].Uses != 1 {
+		t.Errorf("expected the owner shown the code's uses, got %+v", owned.PromoCodes)
+	}
+	if seen := h.getGame(t, game.GameID, "b@example.com"); len(seen.PromoCodes) != 0 || len(seen.PromoRedemptions) != 0 {
+		t.Errorf("expected players not shown promo codes, got %+v %+v", seen.PromoCodes, seen.PromoRedemptions)
+	}
+
+	if status, code := registerWithCode("b@example.com", "NOPE"); status != http.StatusBadRequest || code != "invalid_promo_code" {
+		t.Errorf("expected an unknown code refused, got %d %s", status, code)
+	}
+	if _, found := h.rosterEntry(t, game.GameID, "b@example.com"); found {
+		t.Errorf("expected no registration with a refused code")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// PlayerIDs derives the opaque IDs that stand in for emails outside a game owner's view. An ID is
+// an HMAC of the email, so it's stable without being stored but can't be found by hashing guesses.
+type PlayerIDs struct {
+	key []byte
+}
+
+func NewPlayerIDs(key []byte) PlayerIDs {
+	return PlayerIDs{key: key}
+}
+
+func (p PlayerIDs) PlayerID(userID string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(normalizeEmail(userID)))
+	return "p_" + hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// indexOf returns the position of the entry with playerID in entries, or -1 if it isn't there
+func (p PlayerIDs) indexOf(entries []RosterEntry, playerID string) int {
+	for i, entry := range entries {
+		if p.PlayerID(entry.UserID) == playerID {
+			return i
+		}
+	}
+	return -1
+}
+
+// hiddenPlayers returns the users, of those given, who hide from public rosters
+func (h *Handler) hiddenPlayers(ctx context.Context, userIDs map[string]bool) (map[string]bool, error) {
+	hidden := map[string]bool{}
+	if len(userIDs) == 0 {
+		return hidden, nil
+	}
+	ids := make([]string, 0, len(userIDs))
+	for userID := range userIDs {
+		ids = append(ids, userID)
+	}
+	profiles, err := h.UserProfiles.GetUserProfiles(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for userID, profile := range profiles {
+		if profile.HideFromRosters {
+			hidden[userID] = true
+		}
+	}
+	return hidden, nil
+}
+
+// presentGames converts game records for the requester. A game's owner sees its players as
+// stored. Everyone else sees display names and player IDs in place of emails, and players who hide
+// from rosters only as a placeholder. Requesters always see their own entries.
+func (h *Handler) presentGames(ctx context.Context, requester string, gameRecords []GameRecord) ([]Game, error) {
+	userIDs := map[string]bool{}
+	for _, gameRecord := range gameRecords {
+		if gameRecord.Owner == requester {
+			continue
+		}
+		for _, players := range [][]RosterEntry{gameRecord.Roster, gameRecord.WaitList} {
+			for _, player := range players {
+				userIDs[player.UserID] = true
+			}
+		}
+	}
+	hidden, err := h.hiddenPlayers(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	games := make([]Game, 0, len(gameRecords))
+	for _, gameRecord := range gameRecords {
+		game := GameFromGameRecord(gameRecord)
+		game.OwnerPlayerID = h.PlayerIDs.PlayerID(gameRecord.Owner)
+		ownerView := gameRecord.Owner == requester
+		game.PriceCents = gameRecord.currentPriceCents(h.now())
+		for _, players := range [][]RosterEntry{gameRecord.Roster, gameRecord.WaitList} {
+			if i := indexOfPlayer(players, requester); i >= 0 {
+				game.PriceCents = gameRecord.feeFor(players[i])
+			}
+		}
+		if ownerView {
+			game.PromoCodes = gameRecord.promoCodeUses()
+		} else {
+			game.Owner = ""
+			game.RosterChanges = nil
+			game.PromoCodes = nil
+			game.PromoRedemptions = nil
+		}
+		game.Roster = h.presentRosterEntries(gameRecord.Roster, requester, ownerView, hidden)
+		game.WaitList = h.presentRosterEntries(gameRecord.WaitList, requester, ownerView, hidden)
+		games = append(games, game)
+	}
+	return games, nil
+}
+
+func (h *Handler) presentGame(ctx context.Context, requester string, gameRecord GameRecord) (Game, error) {
+	games, err := h.presentGames(ctx, requester, []GameRecord{gameRecord})
+	if err != nil {
+		return Game{}, err
+	}
+	return games[0], nil
+}
+
+func (h *Handler) presentRosterEntries(entries []RosterEntry, requester string, ownerView bool, hidden map[string]bool) []RosterEntry {
+	presented := make([]RosterEntry, 0, len(entries))
+	for _, entry := range entries {
+		entry.PlayerID = h.PlayerIDs.PlayerID(entry.UserID)
+		switch {
+		case ownerView || entry.UserID == requester:
+		case hidden[entry.UserID]:
+			entry = RosterEntry{Status: entry.Status, Hidden: true}
+		default:
+			entry.UserID = ""
+			entry.PaymentStatus = ""
+			entry.PriceCents = nil
+			entry.PromoCode = ""
+			if entry.GuestOf != "" {
+				entry.GuestOf = h.PlayerIDs.PlayerID(entry.GuestOf)
+			}
+		}
+		presented = append(presented, entry)
+	}
+	return presented
+}
+
+// presentSeries converts a series record for the requester. Only the owner sees subscribers'
+// emails; everyone else sees the player IDs of subscribers who don't hide from rosters.
+func (h *Handler) presentSeries(ctx context.Context, requester string, seriesRecord SeriesRecord) (Series, error) {
+	series := SeriesFromSeriesRecord(seriesRecord)
+	series.OwnerPlayerID = h.PlayerIDs.PlayerID(seriesRecord.Owner)
+	if seriesRecord.Owner == requester {
+		return series, nil
+	}
+	series.Owner = ""
+	series.PromoCodes = nil
+	userIDs := map[string]bool{}
+	for _, subscriber := range seriesRecord.Subscribers {
+		userIDs[subscriber] = true
+	}
+	hidden, err := h.hiddenPlayers(ctx, userIDs)
+	if err != nil {
+		return Series{}, err
+	}
+	series.Subscribers = []string{}
+	for _, subscriber := range seriesRecord.Subscribers {
+		if !hidden[subscriber] || subscriber == requester {
+			series.Subscribers = append(series.Subscribers, h.PlayerIDs.PlayerID(subscriber))
+		}
+	}
+	return series, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const redactedValue = "[REDACTED]"
+
+// defaultRedactedFields are always masked. Codes are verification and password reset codes,
+// which are as good as a password until they expire.
+var defaultRedactedFields = []string{
+	"password", "newPassword", "authorization", "cookie", "cookies", "accessToken", "idToken", "refreshToken",
+	"token", "code",
+}
+
+// piiRedactedFields are masked along with any email address or phone number when personal data is
+// redacted too
+var piiRedactedFields = []string{"email", "phoneNumber"}
+
+var (
+	// bearer tokens and JWTs are masked wherever they turn up, whatever the field is called
+	bearerTokenPattern       = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`)
+	jwtPattern               = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	emailPattern             = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	phoneNumberInTextPattern = regexp.MustCompile(`\+[1-9][0-9]{6,14}\b`)
+)
+
+// RedactingWriter masks secrets in zerolog's JSON output before passing it on. The values of
+// sensitive fields are replaced at any depth, including inside strings holding JSON such as a
+// request's body, and bearer tokens are masked in any string. Field names are matched ignoring
+// case, dashes and underscores, so "Authorization" and "new_password" are caught too.
+type RedactingWriter struct {
+	Out io.Writer
+	// RedactPII also masks emails and phone numbers
+	RedactPII bool
+
+	fields map[string]bool
+}
+
+func NewRedactingWriter(out io.Writer, fields []string, redactPII bool) *RedactingWriter {
+	w := &RedactingWriter{
+		Out:       out,
+		RedactPII: redactPII,
+		fields:    map[string]bool{},
+	}
+	for _, field := range fields {
+		w.fields[normalizeFieldName(field)] = true
+	}
+	if redactPII {
+		for _, field := range piiRedactedFields {
+			w.fields[normalizeFieldName(field)] = true
+		}
+	}
+	return w
+}
+
+func normalizeFieldName(field string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(field)))
+}
+
+func (w *RedactingWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	if err := w.redactValue(dec, &buf, false); err != nil {
+		// zerolog only writes JSON objects, but whatever this is it still mustn't leak tokens
+		buf.Reset()
+		buf.WriteString(w.redactString(strings.TrimRight(string(p), "\n")))
+	}
+	buf.WriteByte('\n')
+	if _, err := w.Out.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactValue copies the next JSON value from dec to buf, masking it if redact is set, keeping
+// the order of object fields
+func (w *RedactingWriter) redactValue(dec *json.Decoder, buf *bytes.Buffer, redact bool) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch value := token.(type) {
+	case json.Delim:
+		closing := json.Delim('}')
+		if value == '[' {
+			closing = ']'
+		}
+		buf.WriteRune(rune(value))
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fieldRedacted := redact
+			if value == '{' {
+				keyToken, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key, ok := keyToken.(string)
+				if !ok {
+					return errors.New("object key is not a string")
+				}
+				writeJSONString(buf, key)
+				buf.WriteByte(':')
+				fieldRedacted = redact || w.fields[normalizeFieldName(key)]
+			}
+			if err := w.redactValue(dec, buf, fieldRedacted); err != nil {
+				return err
+			}
+		}
+		if token, err := dec.Token(); err != nil || token != closing {
+			return errors.New("unterminated JSON value")
+		}
+		buf.WriteRune(rune(closing))
+	case nil:
+		buf.WriteString("null")
+	case string:
+		if redact {
+			writeJSONString(buf, redactedValue)
+		} else {
+			writeJSONString(buf, w.redactString(value))
+		}
+	default:
+		if redact {
+			writeJSONString(buf, redactedValue)
+		} else {
+			valueBytes, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			buf.Write(valueBytes)
+		}
+	}
+	return nil
+}
+
+// redactString masks a string value that isn't itself sensitive, which may still hold JSON or
+// carry a token
+func (w *RedactingWriter) redactString(value string) string {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var buf bytes.Buffer
+		dec := json.NewDecoder(strings.NewReader(trimmed))
+		dec.UseNumber()
+		if err := w.redactValue(dec, &buf, false); err == nil && !dec.More() {
+			return buf.String()
+		}
+	}
+	value = bearerTokenPattern.ReplaceAllString(value, "Bearer "+redactedValue)
+	value = jwtPattern.ReplaceAllString(value, redactedValue)
+	if w.RedactPII {
+		value = emailPattern.ReplaceAllString(value, redactedValue)
+		value = phoneNumberInTextPattern.ReplaceAllString(value, redactedValue)
+	}
+	return value
+}
+
+func writeJSONString(buf *bytes.Buffer, value string) {
+	valueBytes, _ := json.Marshal(value)
+	buf.Write(valueBytes)
+}
+
+// loggableEvent decodes a base64 encoded request body so the RedactingWriter can see the fields
+// inside it. A body that isn't JSON once decoded can't be redacted field by field, so it's masked
+// whole.
+func loggableEvent(event events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPRequest {
+	if !event.IsBase64Encoded {
+		return event
+	}
+	body, err := base64.StdEncoding.DecodeString(event.Body)
+	if err != nil || !json.Valid(body) {
+		event.Body = redactedValue
+	} else {
+		event.Body = string(body)
+	}
+	event.IsBase64Encoded = false
+	return event
+}
+
+// redactSecretData masks the values of data's sensitive fields wherever they're repeated in text,
+// such as a verification code written into a notification's message
+func redactSecretData(text string, data map[string]string) string {
+	for _, field := range defaultRedactedFields {
+		for key, value := range data {
+			if value != "" && normalizeFieldName(key) == normalizeFieldName(field) {
+				text = strings.ReplaceAll(text, value, redactedValue)
+			}
+		}
+	}
+	return text
+}
+
+// newLogWriter is where logs go: stderr, as zerolog's default, through a RedactingWriter.
+// LOG_REDACT_FIELDS adds comma separated field names to mask and LOG_REDACT_PII=true masks emails
+// and phone numbers too.
+func newLogWriter() io.Writer {
+	fields := append([]string{}, defaultRedactedFields...)
+	for _, field := range strings.Split(os.Getenv("LOG_REDACT_FIELDS"), ",") {
+		if strings.TrimSpace(field) != "" {
+			fields = append(fields, field)
+		}
+	}
+	return NewRedactingWriter(os.Stderr, fields, os.Getenv("LOG_REDACT_PII") == "true")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"pickupgamesapi/types"
+	"time"
+)
+
+// maxRefundPolicyHours is the furthest ahead of the start a refund policy can draw a line
+const maxRefundPolicyHours = 30 * 24
+
+// RefundPolicy decides how much of the signup fee a player who drops out gets back. Dropping at
+// least FullRefundHours before the start refunds everything, dropping within NoRefundHours of it
+// refunds nothing, and in between PartialRefundPercent is refunded. The zero policy refunds in
+// full right up to the start. Cancelled games are always refunded in full.
+type RefundPolicy struct {
+	FullRefundHours      int `json:"fullRefundHours" dynamodbav:"FullRefundHours"`
+	PartialRefundPercent int `json:"partialRefundPercent" dynamodbav:"PartialRefundPercent"`
+	NoRefundHours        int `json:"noRefundHours" dynamodbav:"NoRefundHours"`
+	// RefundWhenSpotFilled refunds in full, whenever they drop, a player whose spot goes to someone
+	// promoted from the waitlist
+	RefundWhenSpotFilled bool `json:"refundWhenSpotFilled" dynamodbav:"RefundWhenSpotFilled"`
+}
+
+func (p RefundPolicy) Validate() error {
+	for _, field := range []struct {
+		name  string
+		value int
+	}{{"fullRefundHours", p.FullRefundHours}, {"noRefundHours", p.NoRefundHours}} {
+		if field.value < 0 || field.value > maxRefundPolicyHours {
+			return types.NewValidationError("", fmt.Sprintf("refundPolicy.%s must be between 0 and %d", field.name, maxRefundPolicyHours))
+		}
+	}
+	if p.NoRefundHours > p.FullRefundHours {
+		return types.NewValidationError("", "refundPolicy.noRefundHours must not be more than fullRefundHours")
+	}
+	if p.PartialRefundPercent < 0 || p.PartialRefundPercent > 100 {
+		return types.NewValidationError("", "refundPolicy.partialRefundPercent must be between 0 and 100")
+	}
+	return nil
+}
+
+// RefundDecision is what a refund policy gives back on a charge, and why
+type RefundDecision struct {
+	AmountCents int
+	Reason      string
+}
+
+// refundForDrop applies the policy to a player who paid amountCents dropping out at now from a game
+// starting at startTime. spotFilled is whether someone was promoted from the waitlist into their
+// spot. Partial refunds round down to the cent.
+func (p RefundPolicy) refundForDrop(amountCents int, startTime time.Time, now time.Time, spotFilled bool) RefundDecision {
+	if spotFilled && p.RefundWhenSpotFilled {
+		return RefundDecision{AmountCents: amountCents, Reason: "spot taken by a player from the waitlist"}
+	}
+	untilStart := startTime.Sub(now)
+	switch {
+	case untilStart <= 0:
+		return RefundDecision{AmountCents: 0, Reason: "dropped after the start"}
+	case untilStart >= time.Duration(p.FullRefundHours)*time.Hour:
+		return RefundDecision{AmountCents: amountCents, Reason: fmt.Sprintf("dropped at least %d hours before the start", p.FullRefundHours)}
+	case untilStart < time.Duration(p.NoRefundHours)*time.Hour:
+		return RefundDecision{AmountCents: 0, Reason: fmt.Sprintf("dropped within %d hours of the start", p.NoRefundHours)}
+	}
+	return RefundDecision{
+		AmountCents: amountCents * p.PartialRefundPercent / 100,
+		Reason:      fmt.Sprintf("dropped within %d hours of the start, %d%% refunded", p.FullRefundHours, p.PartialRefundPercent),
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// RegistrationStatus is where a player's place on a game stands
+type RegistrationStatus string
+
+const (
+	RegistrationStatusConfirmed RegistrationStatus = "confirmed"
+	// RegistrationStatusOffered holds a roster spot for a player promoted from the waitlist until
+	// they confirm it or the offer expires
+	RegistrationStatusOffered RegistrationStatus = "offered"
+	// RegistrationStatusPendingPayment holds a roster spot until the signup fee is paid or
+	// PaymentDueAt passes
+	RegistrationStatusPendingPayment RegistrationStatus = "pending_payment"
+)
+
+// paymentHoldDuration is how long a spot on a game with a signup fee is held for payment
+const paymentHoldDuration = 30 * time.Minute
+
+// paymentGracePeriod is how long an unpaid spot is held, at least, once the provider reports the
+// player's charge is processing or has failed. The player is taken off the roster when it runs out.
+const paymentGracePeriod = 24 * time.Hour
+
+// RosterEntry is a player on a game's roster or waitlist. Games used to hold bare emails, which
+// still decode as an entry with only UserID set.
+type RosterEntry struct {
+	// UserID is the player's email, which is how accounts are identified everywhere else. Only
+	// the game's owner and the player themselves are shown it.
+	UserID string `json:"userId,omitempty" dynamodbav:"UserID"`
+	// PlayerID and Hidden are filled in when a game is presented, see presentGames
+	PlayerID    string `json:"playerId,omitempty" dynamodbav:"-"`
+	Hidden      bool   `json:"hidden,omitempty" dynamodbav:"-"`
+	DisplayName string `json:"displayName" dynamodbav:"DisplayName"`
+	// JoinedAt is nil for entries recorded before join times were kept
+	JoinedAt *time.Time         `json:"joinedAt,omitempty" dynamodbav:"JoinedAt,omitempty,unixtime"`
+	Status   RegistrationStatus `json:"status" dynamodbav:"Status"`
+	// OfferExpiresAt is when an offered spot passes to the next player on the waitlist
+	OfferExpiresAt *time.Time `json:"offerExpiresAt,omitempty" dynamodbav:"OfferExpiresAt,omitempty,unixtime"`
+	// PaymentDueAt is when an unpaid spot is released
+	PaymentDueAt *time.Time `json:"paymentDueAt,omitempty" dynamodbav:"PaymentDueAt,omitempty,unixtime"`
+	Paid         bool       `json:"paid" dynamodbav:"Paid"`
+	// PaymentStatus is where the player's latest charge stands while their spot is unpaid, set when
+	// the provider reports it processing or failed. Only the owner and the player are shown it.
+	PaymentStatus PaymentIntentStatus `json:"paymentStatus,omitempty" dynamodbav:"PaymentStatus,omitempty"`
+	// PriceCents is the signup fee the player registered at, with any tier and promo code applied.
+	// It's nil for players who joined without paying a price, who owe the game's SignupFeeCents.
+	PriceCents *int `json:"priceCents,omitempty" dynamodbav:"PriceCents,omitempty"`
+	// PromoCode is the code the player registered with
+	PromoCode string `json:"promoCode,omitempty" dynamodbav:"PromoCode,omitempty"`
+	// GuestOf is the UserID of the player who brought this guest
+	GuestOf string `json:"guestOf,omitempty" dynamodbav:"GuestOf,omitempty"`
+}
+
+// RosterAction is a kind of change an owner makes to a game's players
+type RosterAction string
+
+const (
+	RosterActionAdd     RosterAction = "add"
+	RosterActionRemove  RosterAction = "remove"
+	RosterActionMove    RosterAction = "move"
+	RosterActionReorder RosterAction = "reorder"
+	RosterActionUpdate  RosterAction = "update"
+)
+
+// maxRosterChanges is how many roster changes a game keeps, older ones are dropped
+const maxRosterChanges = 100
+
+// RosterChange records a change an owner made to a game's roster or waitlist. Only the owner is
+// shown a game's changes.
+type RosterChange struct {
+	Action RosterAction `json:"action" dynamodbav:"Action"`
+	// Actor is the UserID of whoever made the change
+	Actor string `json:"actor" dynamodbav:"Actor"`
+	// Player is the UserID of the player affected, empty when the waitlist is reordered
+	Player string     `json:"player,omitempty" dynamodbav:"Player,omitempty"`
+	From   PlayerList `json:"from,omitempty" dynamodbav:"From,omitempty"`
+	To     PlayerList `json:"to,omitempty" dynamodbav:"To,omitempty"`
+	At     time.Time  `json:"at" dynamodbav:"At,unixtime"`
+}
+
+// newRosterEntry is a confirmed, unpaid entry for a player joining now
+func newRosterEntry(userID string, displayName string, joinedAt time.Time) RosterEntry {
+	joinedAt = joinedAt.UTC().Truncate(time.Second)
+	return RosterEntry{
+		UserID:      userID,
+		DisplayName: displayName,
+		JoinedAt:    &joinedAt,
+		Status:      RegistrationStatusConfirmed,
+	}
+}
+
+// holdExpiresAt is when an offered or unpaid spot is released, nil for any other entry
+func (e RosterEntry) holdExpiresAt() *time.Time {
+	switch e.Status {
+	case RegistrationStatusOffered:
+		return e.OfferExpiresAt
+	case RegistrationStatusPendingPayment:
+		return e.PaymentDueAt
+	}
+	return nil
+}
+
+// holdExpired reports whether the entry's spot was held until a time that has passed by now
+func (e RosterEntry) holdExpired(now time.Time) bool {
+	expiresAt := e.holdExpiresAt()
+	return expiresAt != nil && !now.Before(*expiresAt)
+}
+
+// withoutHold returns the entry as a plain confirmed registration, for a player who has taken up
+// their spot or been moved back to the waitlist
+func (e RosterEntry) withoutHold() RosterEntry {
+	if e.Status == RegistrationStatusOffered || e.Status == RegistrationStatusPendingPayment {
+		e.Status = RegistrationStatusConfirmed
+	}
+	e.OfferExpiresAt = nil
+	e.PaymentDueAt = nil
+	e.PaymentStatus = ""
+	return e
+}
+
+// withPaymentStatus returns the unpaid entry with its charge's status, its hold extended to at
+// least paymentGracePeriod from now but never past the game's start
+func (e RosterEntry) withPaymentStatus(status PaymentIntentStatus, now time.Time, startTime time.Time) RosterEntry {
+	e.PaymentStatus = status
+	graceEndsAt := now.Add(paymentGracePeriod).UTC().Truncate(time.Second)
+	if graceEndsAt.After(startTime) {
+		graceEndsAt = startTime.UTC()
+	}
+	switch {
+	case e.Status == RegistrationStatusOffered && e.OfferExpiresAt != nil && e.OfferExpiresAt.Before(graceEndsAt):
+		e.OfferExpiresAt = &graceEndsAt
+	case e.Status == RegistrationStatusPendingPayment && e.PaymentDueAt != nil && e.PaymentDueAt.Before(graceEndsAt):
+		e.PaymentDueAt = &graceEndsAt
+	}
+	return e
+}
+
+// legacyRosterEntry is the entry for a player stored as a bare email
+func legacyRosterEntry(userID string) RosterEntry {
+	return RosterEntry{UserID: userID, Status: RegistrationStatusConfirmed}
+}
+
+// rosterEntry has RosterEntry's fields without its decoding methods
+type rosterEntry RosterEntry
+
+func (e *RosterEntry) UnmarshalJSON(data []byte) error {
+	var userID string
+	if err := json.Unmarshal(data, &userID); err == nil {
+		*e = legacyRosterEntry(userID)
+		return nil
+	}
+	if err := json.Unmarshal(data, (*rosterEntry)(e)); err != nil {
+		return err
+	}
+	if e.Status == "" {
+		e.Status = RegistrationStatusConfirmed
+	}
+	return nil
+}
+
+func (e *RosterEntry) UnmarshalDynamoDBAttributeValue(av ddbtypes.AttributeValue) error {
+	if userID, ok := av.(*ddbtypes.AttributeValueMemberS); ok {
+		*e = legacyRosterEntry(userID.Value)
+		return nil
+	}
+	if err := attributevalue.Unmarshal(av, (*rosterEntry)(e)); err != nil {
+		return err
+	}
+	if e.Status == "" {
+		e.Status = RegistrationStatusConfirmed
+	}
+	return nil
+}
+
+// indexOfPlayer returns the position of userID's entry in entries, or -1 if they aren't there
+func indexOfPlayer(entries []RosterEntry, userID string) int {
+	for i, entry := range entries {
+		if entry.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyRosterEntries returns a copy of entries that shares nothing with the original
+func copyRosterEntries(entries []RosterEntry) []RosterEntry {
+	copied := make([]RosterEntry, len(entries))
+	for i, entry := range entries {
+		if entry.JoinedAt != nil {
+			joinedAt := *entry.JoinedAt
+			entry.JoinedAt = &joinedAt
+		}
+		if entry.OfferExpiresAt != nil {
+			offerExpiresAt := *entry.OfferExpiresAt
+			entry.OfferExpiresAt = &offerExpiresAt
+		}
+		if entry.PaymentDueAt != nil {
+			paymentDueAt := *entry.PaymentDueAt
+			entry.PaymentDueAt = &paymentDueAt
+		}
+		if entry.PriceCents != nil {
+			priceCents := *entry.PriceCents
+			entry.PriceCents = &priceCents
+		}
+		copied[i] = entry
+	}
+	return copied
+}
+
+// displayNameFromClaims builds a display name from the ID token's name claims
+func displayNameFromClaims(claims map[string]string) string {
+	return displayName(claims["given_name"], claims["family_name"])
+}
+
+func displayName(firstName string, lastName string) string {
+	return strings.TrimSpace(firstName + " " + lastName)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"pickupgamesapi/types"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errPlayerNotFound = types.NewNotFoundError("player_not_found", "player is not on the game")
+	errRosterFull     = types.NewConflictError("roster_full", "roster is full, move a player to the waitlist first")
+)
+
+// AddPlayerRequest puts a player on a list. UserID adds someone by email, PlayerID picks a player
+// already on the game; either way a player on the other list is moved. Position is where on the
+// list they go, which defaults to the end. Paid marks whether they've paid.
+type AddPlayerRequest struct {
+	UserID      string `json:"userId"`
+	PlayerID    string `json:"playerId"`
+	DisplayName string `json:"displayName"`
+	Paid        *bool  `json:"paid"`
+	Position    *int   `json:"position"`
+}
+
+func (r *AddPlayerRequest) ValidateRequest() error {
+	if (r.UserID == "") == (r.PlayerID == "") {
+		return &types.InvalidRequestError{Message: "exactly one of userId and playerId is required"}
+	}
+	if r.Position != nil && *r.Position < 0 {
+		return types.NewValidationError("", "position cannot be negative")
+	}
+	return nil
+}
+
+// ReorderWaitListRequest lists every player on the waitlist by player ID in their new order
+type ReorderWaitListRequest struct {
+	PlayerIDs []string `json:"playerIds"`
+}
+
+// AddPlayerToList puts a player on the roster or waitlist for the game's owner. A player moved
+// off the roster is replaced from the front of the waitlist, as when they drop out themselves.
+func (h *Handler) AddPlayerToList(ctx context.Context, gameID string, requester string, list PlayerList, addRequest AddPlayerRequest) (Game, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "AddPlayerToList").Str("gameID", gameID).Str("list", string(list)).Logger()
+	logger.Info().Interface("addRequest", addRequest).Msg("adding player to list")
+	return h.changeRoster(ctx, gameID, requester, func(gameRecord *GameRecord) (*RosterChange, error) {
+		entry, from, index, err := h.takePlayer(ctx, gameRecord, addRequest)
+		if err != nil {
+			return nil, err
+		}
+		change := &RosterChange{Action: RosterActionMove, Player: entry.UserID, From: from, To: list}
+		position := addRequest.Position
+		switch {
+		case from == "":
+			change.Action = RosterActionAdd
+		case from == list && (position == nil || *position == index):
+			// staying put, so only paid can change
+			if addRequest.Paid == nil || *addRequest.Paid == entry.Paid {
+				return nil, nil
+			}
+			change.Action = RosterActionUpdate
+			position = &index
+		}
+		if addRequest.Paid != nil {
+			entry.Paid = *addRequest.Paid
+		}
+		if list == PlayerListWaitList {
+			entry = entry.withoutHold()
+		}
+		switch list {
+		case PlayerListRoster:
+			if len(gameRecord.Roster) >= gameRecord.NumTeams*gameRecord.TeamSize {
+				return nil, errRosterFull
+			}
+			gameRecord.Roster = insertRosterEntry(gameRecord.Roster, entry, position)
+		case PlayerListWaitList:
+			gameRecord.WaitList = insertRosterEntry(gameRecord.WaitList, entry, position)
+		}
+		balancePlayerLists(gameRecord, h.now())
+		return change, nil
+	})
+}
+
+// RemovePlayerFromList takes a player off the game for its owner, promoting from the waitlist when
+// they were on the roster. What they paid is settled under the refund policy as if they'd dropped
+// out, and charges still being processed are expired.
+func (h *Handler) RemovePlayerFromList(ctx context.Context, gameID string, requester string, list PlayerList, playerID string) (Game, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "RemovePlayerFromList").Str("gameID", gameID).Str("list", string(list)).Logger()
+	logger.Info().Str("playerID", playerID).Msg("removing player from list")
+	var removed RosterEntry
+	var removedFrom GameRecord
+	spotFilled := false
+	game, err := h.changeRoster(ctx, gameID, requester, func(gameRecord *GameRecord) (*RosterChange, error) {
+		players := &gameRecord.Roster
+		if list == PlayerListWaitList {
+			players = &gameRecord.WaitList
+		}
+		i := h.PlayerIDs.indexOf(*players, playerID)
+		if i < 0 {
+			return nil, errPlayerNotFound
+		}
+		removed = (*players)[i]
+		*players = append(append([]RosterEntry{}, (*players)[:i]...), (*players)[i+1:]...)
+		waiting := len(gameRecord.WaitList)
+		balancePlayerLists(gameRecord, h.now())
+		spotFilled = len(gameRecord.WaitList) < waiting
+		removedFrom = *gameRecord
+		return &RosterChange{Action: RosterActionRemove, Player: removed.UserID, From: list}, nil
+	})
+	if err != nil {
+		return Game{}, err
+	}
+	// the player is off the game either way, so money that fails to settle is left for the owner
+	if err := h.expirePendingCharges(ctx, gameID, removed.UserID); err != nil {
+		logger.Error().Err(err).Msg("failed to expire pending charges")
+	}
+	if err := h.refundDroppedPlayer(ctx, removedFrom, removed.UserID, list == PlayerListWaitList, spotFilled); err != nil {
+		logger.Error().Err(err).Msg("failed to refund removed player")
+	}
+	return game, nil
+}
+
+// ReorderWaitList puts the game's waitlist in the order the owner gives
+func (h *Handler) ReorderWaitList(ctx context.Context, gameID string, requester string, reorderRequest ReorderWaitListRequest) (Game, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "ReorderWaitList").Str("gameID", gameID).Logger()
+	logger.Info().Strs("playerIDs", reorderRequest.PlayerIDs).Msg("reordering waitlist")
+	return h.changeRoster(ctx, gameID, requester, func(gameRecord *GameRecord) (*RosterChange, error) {
+		if len(reorderRequest.PlayerIDs) != len(gameRecord.WaitList) {
+			return nil, types.NewValidationError("invalid_waitlist_order", "playerIds must list every player on the waitlist once")
+		}
+		if len(gameRecord.WaitList) == 0 {
+			return nil, nil
+		}
+		waitList := make([]RosterEntry, 0, len(gameRecord.WaitList))
+		remaining := append([]RosterEntry{}, gameRecord.WaitList...)
+		for _, playerID := range reorderRequest.PlayerIDs {
+			i := h.PlayerIDs.indexOf(remaining, playerID)
+			if i < 0 {
+				return nil, types.NewValidationError("invalid_waitlist_order", "playerIds must list every player on the waitlist once")
+			}
+			waitList = append(waitList, remaining[i])
+			remaining = append(remaining[:i], remaining[i+1:]...)
+		}
+		gameRecord.WaitList = waitList
+		return &RosterChange{Action: RosterActionReorder, To: PlayerListWaitList}, nil
+	})
+}
+
+// changeRoster applies an owner's change to the game and records it. The write is conditional on
+// the game's version, so a change based on lists someone else has since altered fails with
+// errConditionFailed rather than being applied to players the owner hasn't seen. A nil change
+// means there was nothing to do.
+func (h *Handler) changeRoster(ctx context.Context, gameID string, requester string, change func(*GameRecord) (*RosterChange, error)) (Game, error) {
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+	if err != nil {
+		return Game{}, err
+	}
+	if gameRecord.Owner != requester {
+		return Game{}, errNotGameOwner
+	}
+	if gameRecord.GameStatus() == GameStatusCancelled {
+		return Game{}, errGameCancelled
+	}
+	if _, err := h.lockSplitIfDue(ctx, gameRecord); err != nil {
+		return Game{}, err
+	}
+	expectedVersion := gameRecord.Version
+	original := copyGameRecord(gameRecord)
+	rosterChange, err := change(&gameRecord)
+	if err != nil {
+		return Game{}, err
+	}
+	if rosterChange == nil {
+		return h.presentGame(ctx, requester, original)
+	}
+	rosterChange.Actor = requester
+	rosterChange.At = h.now().UTC().Truncate(time.Second)
+	gameRecord.recordRosterChange(*rosterChange)
+	updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
+	if err != nil {
+		return Game{}, fmt.Errorf("failed to update game: %w", err)
+	}
+	h.notifyNewHolds(ctx, original.Roster, updatedGame)
+	return h.presentGame(ctx, requester, updatedGame)
+}
+
+// takePlayer finds the requested player and takes them off the list they're on, returning the
+// list and their position on it, or builds a new entry for someone not on the game
+func (h *Handler) takePlayer(ctx context.Context, gameRecord *GameRecord, addRequest AddPlayerRequest) (RosterEntry, PlayerList, int, error) {
+	for _, list := range []PlayerList{PlayerListRoster, PlayerListWaitList} {
+		players := &gameRecord.Roster
+		if list == PlayerListWaitList {
+			players = &gameRecord.WaitList
+		}
+		i := indexOfPlayer(*players, strings.TrimSpace(addRequest.UserID))
+		if addRequest.PlayerID != "" {
+			i = h.PlayerIDs.indexOf(*players, addRequest.PlayerID)
+		}
+		if i >= 0 {
+			entry := (*players)[i]
+			*players = append(append([]RosterEntry{}, (*players)[:i]...), (*players)[i+1:]...)
+			return entry, list, i, nil
+		}
+	}
+	if addRequest.PlayerID != "" {
+		return RosterEntry{}, "", -1, errPlayerNotFound
+	}
+	displayName := addRequest.DisplayName
+	if displayName == "" {
+		profileRecord, err := h.UserProfiles.GetUserProfile(ctx, strings.TrimSpace(addRequest.UserID))
+		if err == nil {
+			displayName = profileRecord.displayName()
+		}
+	}
+	return newRosterEntry(strings.TrimSpace(addRequest.UserID), displayName, h.now()), "", -1, nil
+}
+
+// insertRosterEntry returns players with entry inserted at position, or appended if position is
+// nil or past the end
+func insertRosterEntry(players []RosterEntry, entry RosterEntry, position *int) []RosterEntry {
+	if position == nil || *position >= len(players) {
+		return append(players, entry)
+	}
+	inserted := append([]RosterEntry{}, players[:*position]...)
+	inserted = append(inserted, entry)
+	return append(inserted, players[*position:]...)
+}
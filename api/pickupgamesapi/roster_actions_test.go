@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// changeList has requester make a change to the game's list through routeKey, with the player ID
+// in the path when it's set
+func (h *testHandler) changeList(t *testing.T, routeKey string, gameID string, requester string, playerID string, body interface{}) (Game, events.APIGatewayV2HTTPResponse) {
+	t.Helper()
+	pathParameters := map[string]string{"gameID": gameID}
+	if playerID != "" {
+		pathParameters["playerID"] = playerID
+	}
+	var game Game
+	response := h.call(t, testRequest{RouteKey: routeKey, Requester: requester, PathParameters: pathParameters, Body: body}, &game)
+	return game, response
+}
+
+func TestOwnerAddsMovesAndReordersPlayers(t *testing.T) {
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 1, 2))
+	for _, player := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"} {
+		h.register(t, game.GameID, player)
+	}
+	paid := true
+	mustChange := func(routeKey string, playerID string, body interface{}) Game {
+		t.Helper()
+		updated, response := h.changeList(t, routeKey, game.GameID, "owner@example.com", playerID, body)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("%s returned %d: %s", routeKey, response.StatusCode, response.Body)
+		}
+		return updated
+	}
+
+	// someone who paid cash goes to the front of the waitlist
+	first := 0
+	updated := mustChange("POST /games/{gameID}/waitlist", "", AddPlayerRequest{UserID: "e@example.com", DisplayName: "E", Paid: &paid, Position: &first})
+	if !equalStrings(userIDs(updated.WaitList), []string{"e@example.com", "c@example.com", "d@example.com"}) || !updated.WaitList[0].Paid {
+		t.Fatalf("expected e paid at the front of the waitlist, got %+v", updated.WaitList)
+	}
+	// moving a off the roster promotes the front of the waitlist
+	second := 1
+	updated = mustChange("POST /games/{gameID}/waitlist", "", AddPlayerRequest{PlayerID: h.PlayerIDs.PlayerID("a@example.com"), Position: &second})
+	if !equalStrings(userIDs(updated.Roster), []string{"b@example.com", "e@example.com"}) ||
+		!equalStrings(userIDs(updated.WaitList), []string{"a@example.com", "c@example.com", "d@example.com"}) {
+		t.Fatalf("got roster %v and waitlist %v", userIDs(updated.Roster), userIDs(updated.WaitList))
+	}
+	updated = mustChange("PUT /games/{gameID}/waitlist", "", ReorderWaitListRequest{PlayerIDs: []string{
+		h.PlayerIDs.PlayerID("d@example.com"), h.PlayerIDs.PlayerID("a@example.com"), h.PlayerIDs.PlayerID("c@example.com"),
+	}})
+	if !equalStrings(userIDs(updated.WaitList), []string{"d@example.com", "a@example.com", "c@example.com"}) {
+		t.Fatalf("expected the waitlist reordered, got %v", userIDs(updated.WaitList))
+	}
+	updated = mustChange("DELETE /games/{gameID}/roster/{playerID}", h.PlayerIDs.PlayerID("b@example.com"), nil)
+	if !equalStrings(userIDs(updated.Roster), []string{"e@example.com", "d@example.com"}) {
+		t.Fatalf("expected d promoted in b's place, got %v", userIDs(updated.Roster))
+	}
+
+	// every change is recorded with who made it
+	var actions []string
+	for _, change := range updated.RosterChanges {
+		actions = append(actions, string(change.Action)+" "+change.Player)
+		if change.Actor != "owner@example.com" || !change.At.Equal(testStart) {
+			t.Errorf("expected the change made by the owner now, got %+v", change)
+		}
+	}
+	want := []string{"add e@example.com", "move a@example.com", "reorder ", "remove b@example.com"}
+	if !equalStrings(actions, want) {
+		t.Errorf("expected changes %v, got %v", want, actions)
+	}
+	if seen := h.getGame(t, game.GameID, "c@example.com"); len(seen.RosterChanges) != 0 {
+		t.Errorf("expected players not shown the roster changes, got %+v", seen.RosterChanges)
+	}
+}
+
+func TestOwnerRosterChangeRejections(t *testing.T) {
+	h := newTestHandler(t)
+	game := h.createGame(t, "owner@example.com", newTestGame("soccer", 48*time.Hour, 1, 1))
+	h.register(t, game.GameID, "a@example.com")
+	h.register(t, game.GameID, "b@example.com")
+	h.register(t, game.GameID, "c@example.com")
+	for _, test := range []struct {
+		name      string
+		routeKey  string
+		requester string
+		playerID  string
+		body      interface{}
+		wantCode  string
+	}{
+		{"not the owner", "POST /games/{gameID}/roster", "a@example.com", "", AddPlayerRequest{UserID: "d@example.com"}, "not_game_owner"},
+		{"full roster", "POST /games/{gameID}/roster", "owner@example.com", "", AddPlayerRequest{UserID: "d@example.com"}, "roster_full"},
+		{"unknown player", "DELETE /games/{gameID}/roster/{playerID}", "owner@example.com", h.PlayerIDs.PlayerID("b@example.com"), nil, "player_not_found"},
+		{"unknown player ID", "POST /games/{gameID}/waitlist", "owner@example.com", "", AddPlayerRequest{PlayerID: "missing"}, "player_not_found"},
+		{"player left out", "PUT /games/{gameID}/waitlist", "owner@example.com", "", ReorderWaitListRequest{PlayerIDs: []string{h.PlayerIDs.PlayerID("b@example.com")}}, "invalid_waitlist_order"},
+		{"player listed twice", "PUT /games/{gameID}/waitlist", "owner@example.com", "", ReorderWaitListRequest{PlayerIDs: []string{
+			h.PlayerIDs.PlayerID("b@example.com"), h.PlayerIDs.PlayerID("b@example.com"),
+		}}, "invalid_waitlist_order"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, response := h.changeList(t, test.routeKey, game.GameID, test.requester, test.playerID, test.body)
+			if response.StatusCode == http.StatusOK || errorCode(t, response) != test.wantCode {
+				t.Errorf("expected %s, got %d: %s", test.wantCode, response.StatusCode, response.Body)
+			}
+		})
+	}
+	got := h.getGame(t, game.GameID, "owner@example.com")
+	if got.Version != game.Version+3 || len(got.RosterChanges) != 0 {
+		t.Errorf("expected the refused changes to leave the game alone, got version %d and changes %+v", got.Version, got.RosterChanges)
+	}
+
+	// changes based on lists that have since changed are refused rather than applied
+	store := &racingGameStore{GameStore: h.GameStore}
+	h.GameStore = store
+	store.race = func() { h.drop(t, game.GameID, "a@example.com") }
+	_, response := h.changeList(t, "PUT /games/{gameID}/waitlist", game.GameID, "owner@example.com", "", ReorderWaitListRequest{PlayerIDs: []string{
+		h.PlayerIDs.PlayerID("c@example.com"), h.PlayerIDs.PlayerID("b@example.com"),
+	}})
+	if response.StatusCode != http.StatusConflict || errorCode(t, response) != "concurrent_update" {
+		t.Errorf("expected a reorder racing a drop refused, got %d: %s", response.StatusCode, response.Body)
+	}
+	if got := h.getGame(t, game.GameID, "owner@example.com"); !equalStrings(userIDs(got.Roster), []string{"b@example.com"}) || !equalStrings(userIDs(got.WaitList), []string{"c@example.com"}) {
+		t.Errorf("expected only the drop applied, got roster %v and waitlist %v", userIDs(got.Roster), userIDs(got.WaitList))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestRosterEntryDecodesLegacyJSON(t *testing.T) {
+	var gameBase GameBase
+	body := `{"roster":["a@x.com",{"userId":"b@x.com","displayName":"B","status":"pending_payment","paid":false},{"userId":"c@x.com"}],"waitList":["d@x.com"]}`
+	if err := json.Unmarshal([]byte(body), &gameBase); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if !equalStrings(userIDs(gameBase.Roster), []string{"a@x.com", "b@x.com", "c@x.com"}) || !equalStrings(userIDs(gameBase.WaitList), []string{"d@x.com"}) {
+		t.Fatalf("got roster %v and waitlist %v", userIDs(gameBase.Roster), userIDs(gameBase.WaitList))
+	}
+	if gameBase.Roster[0] != legacyRosterEntry("a@x.com") || gameBase.WaitList[0] != legacyRosterEntry("d@x.com") {
+		t.Errorf("expected bare emails decoded as confirmed entries, got %+v and %+v", gameBase.Roster[0], gameBase.WaitList[0])
+	}
+	if gameBase.Roster[1].Status != RegistrationStatusPendingPayment || gameBase.Roster[1].DisplayName != "B" {
+		t.Errorf("expected the entry's fields kept, got %+v", gameBase.Roster[1])
+	}
+	if gameBase.Roster[2].Status != RegistrationStatusConfirmed {
+		t.Errorf("expected an entry without a status confirmed, got %+v", gameBase.Roster[2])
+	}
+}
+
+func TestRosterEntryDecodesLegacyDynamoDBItem(t *testing.T) {
+	joinedAt := testStart.UTC()
+	entry, err := attributevalue.Marshal(RosterEntry{
+		UserID:      "b@x.com",
+		DisplayName: "B",
+		JoinedAt:    &joinedAt,
+		Status:      RegistrationStatusConfirmed,
+		Paid:        true,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal entry: %v", err)
+	}
+	item := map[string]ddbtypes.AttributeValue{
+		"GameID": &ddbtypes.AttributeValueMemberS{Value: "game-1"},
+		"Roster": &ddbtypes.AttributeValueMemberL{Value: []ddbtypes.AttributeValue{
+			&ddbtypes.AttributeValueMemberS{Value: "a@x.com"},
+			entry,
+			// entries written before registrations had a status
+			&ddbtypes.AttributeValueMemberM{Value: map[string]ddbtypes.AttributeValue{
+				"UserID": &ddbtypes.AttributeValueMemberS{Value: "e@x.com"},
+			}},
+		}},
+		"WaitList": &ddbtypes.AttributeValueMemberL{Value: []ddbtypes.AttributeValue{
+			&ddbtypes.AttributeValueMemberS{Value: "c@x.com"},
+			&ddbtypes.AttributeValueMemberS{Value: "d@x.com"},
+		}},
+	}
+	var gameRecord GameRecord
+	if err := attributevalue.UnmarshalMap(item, &gameRecord); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if !equalStrings(userIDs(gameRecord.Roster), []string{"a@x.com", "b@x.com", "e@x.com"}) || !equalStrings(userIDs(gameRecord.WaitList), []string{"c@x.com", "d@x.com"}) {
+		t.Fatalf("got roster %v and waitlist %v", userIDs(gameRecord.Roster), userIDs(gameRecord.WaitList))
+	}
+	if gameRecord.Roster[0] != legacyRosterEntry("a@x.com") || gameRecord.WaitList[1] != legacyRosterEntry("d@x.com") {
+		t.Errorf("expected bare emails decoded as confirmed entries, got %+v and %+v", gameRecord.Roster[0], gameRecord.WaitList[1])
+	}
+	decoded := gameRecord.Roster[1]
+	if decoded.DisplayName != "B" || !decoded.Paid || decoded.JoinedAt == nil || !decoded.JoinedAt.Equal(joinedAt.Truncate(time.Second)) {
+		t.Errorf("expected the entry's fields kept, got %+v", decoded)
+	}
+	if gameRecord.Roster[2].Status != RegistrationStatusConfirmed {
+		t.Errorf("expected an entry without a status confirmed, got %+v", gameRecord.Roster[2])
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"pickupgamesapi/types"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	_ "time/tzdata" // series time zones must resolve on hosts without a zoneinfo database, like Lambda
+
+	"github.com/google/uuid"
+)
+
+const (
+	// seriesMaterializationHorizon is how far ahead a series' games are created
+	seriesMaterializationHorizon = 8 * 7 * 24 * time.Hour
+	seriesDateLayout             = "2006-01-02"
+)
+
+var (
+	errSeriesNotFound        = types.NewNotFoundError("series_not_found", "series not found")
+	errSeriesConditionFailed = types.NewConflictError("concurrent_update", "series was modified by another request, please retry")
+)
+
+// RecurrenceFrequency is how often a series repeats
+type RecurrenceFrequency string
+
+const (
+	RecurrenceWeekly   RecurrenceFrequency = "weekly"
+	RecurrenceBiweekly RecurrenceFrequency = "biweekly"
+)
+
+// intervalDays returns the number of days between occurrences, or 0 for an unknown frequency
+func (f RecurrenceFrequency) intervalDays() int {
+	switch f {
+	case RecurrenceWeekly:
+		return 7
+	case RecurrenceBiweekly:
+		return 14
+	}
+	return 0
+}
+
+// SeriesRecord represents a recurring game series in storage. GameBase is the template copied
+// onto every occurrence; its Roster and WaitList are unused as Subscribers are registered instead.
+type SeriesRecord struct {
+	GameBase
+
+	SeriesID  string              `dynamodbav:"SeriesID"`
+	Owner     string              `dynamodbav:"Owner"`
+	StartTime int64               `dynamodbav:"StartTime"` // first occurrence, Unix timestamp
+	TimeZone  string              `dynamodbav:"TimeZone"`  // IANA name, occurrences keep their local time across DST
+	Frequency RecurrenceFrequency `dynamodbav:"Frequency"`
+	Until     int64               `dynamodbav:"Until"` // last possible start time, 0 for none
+	Count     int                 `dynamodbav:"Count"` // number of occurrences including skipped ones, 0 for no limit
+	// SkippedDates are local dates (YYYY-MM-DD) with no game
+	SkippedDates []string `dynamodbav:"SkippedDates"`
+	Subscribers  []string `dynamodbav:"Subscribers"`
+	// MaterializedThrough is the start time up to which occurrences have been created as games
+	MaterializedThrough int64 `dynamodbav:"MaterializedThrough"`
+	Version             int   `dynamodbav:"Version"`
+}
+
+// Series represents a series as returned by the API
+type Series struct {
+	GameBase
+	SeriesID            string              `json:"seriesId"`
+	Owner               string              `json:"owner,omitempty"`
+	OwnerPlayerID       string              `json:"ownerPlayerId"`
+	StartTime           time.Time           `json:"startTime"`
+	TimeZone            string              `json:"timeZone"`
+	Frequency           RecurrenceFrequency `json:"frequency"`
+	Until               *time.Time          `json:"until,omitempty"`
+	Count               int                 `json:"count,omitempty"`
+	SkippedDates        []string            `json:"skippedDates"`
+	Subscribers         []string            `json:"subscribers"`
+	MaterializedThrough time.Time           `json:"materializedThrough"`
+	Version             int                 `json:"version"`
+}
+
+func SeriesFromSeriesRecord(seriesRecord SeriesRecord) Series {
+	series := Series{
+		GameBase:            seriesRecord.GameBase,
+		SeriesID:            seriesRecord.SeriesID,
+		Owner:               seriesRecord.Owner,
+		StartTime:           time.Unix(seriesRecord.StartTime, 0),
+		TimeZone:            seriesRecord.TimeZone,
+		Frequency:           seriesRecord.Frequency,
+		Count:               seriesRecord.Count,
+		SkippedDates:        append([]string{}, seriesRecord.SkippedDates...),
+		Subscribers:         append([]string{}, seriesRecord.Subscribers...),
+		MaterializedThrough: time.Unix(seriesRecord.MaterializedThrough, 0),
+		Version:             seriesRecord.Version,
+	}
+	series.Roster = []RosterEntry{}
+	series.WaitList = []RosterEntry{}
+	if seriesRecord.Until != 0 {
+		until := time.Unix(seriesRecord.Until, 0)
+		series.Until = &until
+	}
+	return series
+}
+
+// NewSeriesRequest is the accepted request body for creating a series. Until and Count both end
+// the series, whichever comes first; at least one is required.
+type NewSeriesRequest struct {
+	GameBase
+	Requester    string              `json:"-"`
+	StartTime    time.Time           `json:"startTime"`
+	TimeZone     string              `json:"timeZone"`
+	Frequency    RecurrenceFrequency `json:"frequency"`
+	Until        *time.Time          `json:"until"`
+	Count        int                 `json:"count"`
+	SkippedDates []string            `json:"skippedDates"`
+}
+
+func (r *NewSeriesRequest) ValidateRequest() error {
+	if r.Category == "" || r.Name == "" || r.Location == "" {
+		return types.NewValidationError("", "category, name and location are required")
+	}
+	if r.DurationMins <= 0 || r.NumTeams <= 0 || r.TeamSize <= 0 {
+		return types.NewValidationError("", "durationMins, numTeams and teamSize must be greater than zero")
+	}
+	if r.SignupFeeCents < 0 || r.SplitFeeCents < 0 {
+		return types.NewValidationError("", "fees must not be negative")
+	}
+	if err := validatePromotionOfferHours(r.PromotionOfferHours); err != nil {
+		return err
+	}
+	if err := validateSplitLockHours(r.SplitLockHours); err != nil {
+		return err
+	}
+	if err := r.RefundPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := validatePricing(r.PriceTiers, r.PromoCodes); err != nil {
+		return err
+	}
+	if r.GeoLocation != nil {
+		if err := r.GeoLocation.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.StartTime.IsZero() {
+		return types.NewValidationError("", "startTime is required")
+	}
+	if r.Frequency.intervalDays() == 0 {
+		return types.NewValidationError("", fmt.Sprintf("frequency must be %q or %q", RecurrenceWeekly, RecurrenceBiweekly))
+	}
+	if _, err := time.LoadLocation(r.TimeZone); err != nil {
+		return types.NewValidationError("", fmt.Sprintf("unknown timeZone %q", r.TimeZone))
+	}
+	if r.Until == nil && r.Count <= 0 {
+		return types.NewValidationError("", "until or a positive count is required")
+	}
+	if r.Count < 0 {
+		return types.NewValidationError("", "count must not be negative")
+	}
+	if r.Until != nil && r.Until.Before(r.StartTime) {
+		return types.NewValidationError("", "until must not be before startTime")
+	}
+	return validateSkippedDates(r.SkippedDates)
+}
+
+// UpdateSeriesRequest is the accepted request body for editing a series. Game fields are applied
+// to the template and to every future occurrence; a new startTime moves every future occurrence
+// by the same amount. Occurrences on newly skipped dates are cancelled, while removing a skipped
+// date only affects occurrences that haven't been created yet.
+type UpdateSeriesRequest struct {
+	UpdateGameRequest
+	SkippedDates *[]string `json:"skippedDates"`
+}
+
+func (r *UpdateSeriesRequest) ValidateRequest() error {
+	if r.SkippedDates != nil {
+		if err := validateSkippedDates(*r.SkippedDates); err != nil {
+			return err
+		}
+		if r.UpdateGameRequest.empty() {
+			return nil
+		}
+	}
+	return r.UpdateGameRequest.ValidateRequest()
+}
+
+func validateSkippedDates(dates []string) error {
+	for _, date := range dates {
+		if _, err := time.Parse(seriesDateLayout, date); err != nil {
+			return types.NewValidationError("", fmt.Sprintf("skipped date %q is not in YYYY-MM-DD format", date))
+		}
+	}
+	return nil
+}
+
+// SeriesStore persists series records. A missing series is reported as errSeriesNotFound and a
+// failed version check as errSeriesConditionFailed.
+type SeriesStore interface {
+	// PutSeries saves a new series record
+	PutSeries(ctx context.Context, seriesRecord SeriesRecord) error
+	// GetSeries returns the series record with the given ID
+	GetSeries(ctx context.Context, seriesID string) (SeriesRecord, error)
+	// ListSeries returns every series record
+	ListSeries(ctx context.Context) ([]SeriesRecord, error)
+	// ReplaceSeries overwrites the record, provided the stored record is still at expectedVersion,
+	// and returns it with its version incremented
+	ReplaceSeries(ctx context.Context, seriesRecord SeriesRecord, expectedVersion int) (SeriesRecord, error)
+}
+
+// seriesOccurrence is one scheduled game of a series. Index counts from the first occurrence and
+// is stable when the series is edited, so it's used to derive the occurrence's game ID.
+type seriesOccurrence struct {
+	Index     int
+	StartTime int64
+	Date      string
+}
+
+func (r SeriesRecord) location() *time.Location {
+	location, err := time.LoadLocation(r.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+func (r SeriesRecord) skipped(date string) bool {
+	for _, skippedDate := range r.SkippedDates {
+		if skippedDate == date {
+			return true
+		}
+	}
+	return false
+}
+
+// occurrences returns the series' occurrences starting after `after` and no later than through
+// (Unix seconds), leaving out skipped dates
+func (r SeriesRecord) occurrences(after int64, through int64) []seriesOccurrence {
+	intervalDays := r.Frequency.intervalDays()
+	if intervalDays == 0 {
+		return nil
+	}
+	first := time.Unix(r.StartTime, 0).In(r.location())
+	occurrences := []seriesOccurrence{}
+	for i := 0; r.Count == 0 || i < r.Count; i++ {
+		startTime := first.AddDate(0, 0, i*intervalDays)
+		if startTime.Unix() > through || (r.Until != 0 && startTime.Unix() > r.Until) {
+			break
+		}
+		date := startTime.Format(seriesDateLayout)
+		if startTime.Unix() <= after || r.skipped(date) {
+			continue
+		}
+		occurrences = append(occurrences, seriesOccurrence{Index: i, StartTime: startTime.Unix(), Date: date})
+	}
+	return occurrences
+}
+
+// ended reports whether every occurrence has already been materialized
+func (r SeriesRecord) ended() bool {
+	if r.Until != 0 && r.MaterializedThrough >= r.Until {
+		return true
+	}
+	if r.Count > 0 {
+		last := time.Unix(r.StartTime, 0).In(r.location()).AddDate(0, 0, (r.Count-1)*r.Frequency.intervalDays())
+		return r.MaterializedThrough >= last.Unix()
+	}
+	return false
+}
+
+// occurrenceGame builds the game for an occurrence, registering subscribers in order as if they
+// joined at materializedAt. Subscribers pay like any other player: each is priced as they join and,
+// on a game with a fee, their spot on the roster is held until they pay. They aren't there to pay
+// when the game is materialized, so the hold lasts paymentGracePeriod rather than paymentHoldDuration.
+func (r SeriesRecord) occurrenceGame(occurrence seriesOccurrence, materializedAt time.Time) GameRecord {
+	gameRecord := GameRecord{
+		GameBase:  r.GameBase,
+		GameID:    occurrenceGameID(r.SeriesID, occurrence.Index),
+		Owner:     r.Owner,
+		StartTime: occurrence.StartTime,
+		Status:    GameStatusScheduled,
+		SeriesID:  r.SeriesID,
+	}
+	capacity := r.NumTeams * r.TeamSize
+	gameRecord.Roster = []RosterEntry{}
+	gameRecord.WaitList = []RosterEntry{}
+	for _, subscriber := range r.Subscribers {
+		entry := newRosterEntry(subscriber, "", materializedAt)
+		if gameRecord.SignupFeeCents > 0 {
+			priceCents := gameRecord.currentPriceCents(materializedAt)
+			entry.PriceCents = &priceCents
+		}
+		if len(gameRecord.Roster) < capacity {
+			if gameRecord.feeFor(entry) > 0 {
+				entry.Status = RegistrationStatusPendingPayment
+				entry.PaymentDueAt = gameRecord.holdUntil(materializedAt, paymentGracePeriod)
+			}
+			gameRecord.Roster = append(gameRecord.Roster, entry)
+		} else {
+			gameRecord.WaitList = append(gameRecord.WaitList, entry)
+		}
+	}
+	return gameRecord
+}
+
+// occurrenceGameID derives a stable game ID so materializing an occurrence twice is detected by
+// the store rather than creating a duplicate game
+func occurrenceGameID(seriesID string, index int) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("series:"+seriesID+"#"+strconv.Itoa(index))).String()
+}
+
+// MemorySeriesStore is an in-process SeriesStore
+type MemorySeriesStore struct {
+	mu     sync.RWMutex
+	series map[string]SeriesRecord
+}
+
+func NewMemorySeriesStore() *MemorySeriesStore {
+	return &MemorySeriesStore{
+		series: map[string]SeriesRecord{},
+	}
+}
+
+// copySeriesRecord returns a copy of seriesRecord that shares no slices with the original
+func copySeriesRecord(seriesRecord SeriesRecord) SeriesRecord {
+	seriesRecord.SkippedDates = append([]string{}, seriesRecord.SkippedDates...)
+	seriesRecord.Subscribers = append([]string{}, seriesRecord.Subscribers...)
+	return seriesRecord
+}
+
+func (s *MemorySeriesStore) PutSeries(ctx context.Context, seriesRecord SeriesRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series[seriesRecord.SeriesID] = copySeriesRecord(seriesRecord)
+	return nil
+}
+
+func (s *MemorySeriesStore) GetSeries(ctx context.Context, seriesID string) (SeriesRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seriesRecord, ok := s.series[seriesID]
+	if !ok {
+		return SeriesRecord{}, errSeriesNotFound
+	}
+	return copySeriesRecord(seriesRecord), nil
+}
+
+func (s *MemorySeriesStore) ListSeries(ctx context.Context) ([]SeriesRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seriesRecords := make([]SeriesRecord, 0, len(s.series))
+	for _, seriesRecord := range s.series {
+		seriesRecords = append(seriesRecords, copySeriesRecord(seriesRecord))
+	}
+	sort.Slice(seriesRecords, func(i, j int) bool {
+		return seriesRecords[i].SeriesID < seriesRecords[j].SeriesID
+	})
+	return seriesRecords, nil
+}
+
+func (s *MemorySeriesStore) ReplaceSeries(ctx context.Context, seriesRecord SeriesRecord, expectedVersion int) (SeriesRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	storedRecord, ok := s.series[seriesRecord.SeriesID]
+	if !ok {
+		return SeriesRecord{}, errSeriesNotFound
+	}
+	if storedRecord.Version != expectedVersion {
+		return SeriesRecord{}, errSeriesConditionFailed
+	}
+	seriesRecord = copySeriesRecord(seriesRecord)
+	seriesRecord.Version = expectedVersion + 1
+	s.series[seriesRecord.SeriesID] = seriesRecord
+	return copySeriesRecord(seriesRecord), nil
+}
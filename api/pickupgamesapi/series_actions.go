@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pickupgamesapi/types"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const maxOccurrenceUpdateAttempts = 3
+
+var errNotSeriesOwner = types.NewForbiddenError("not_series_owner", "only the series' owner can do that")
+
+func (h *Handler) CreateSeries(ctx context.Context, newSeriesRequest NewSeriesRequest) (Series, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "CreateSeries").Logger()
+	logger.Info().Interface("newSeriesRequest", newSeriesRequest).Msg("creating series")
+	seriesRecord := SeriesRecord{
+		GameBase:     newSeriesRequest.GameBase,
+		SeriesID:     uuid.New().String(),
+		Owner:        newSeriesRequest.Requester,
+		StartTime:    newSeriesRequest.StartTime.Unix(),
+		TimeZone:     newSeriesRequest.TimeZone,
+		Frequency:    newSeriesRequest.Frequency,
+		Count:        newSeriesRequest.Count,
+		SkippedDates: append([]string{}, newSeriesRequest.SkippedDates...),
+		Subscribers:  []string{},
+	}
+	seriesRecord.Roster = []RosterEntry{}
+	seriesRecord.WaitList = []RosterEntry{}
+	if seriesRecord.TimeZone == "" {
+		seriesRecord.TimeZone = "UTC"
+	}
+	if newSeriesRequest.Until != nil {
+		seriesRecord.Until = newSeriesRequest.Until.Unix()
+	}
+	if err := h.SeriesStore.PutSeries(ctx, seriesRecord); err != nil {
+		return Series{}, err
+	}
+	materializedSeries, err := h.materializeSeries(ctx, seriesRecord)
+	if err != nil {
+		// the series exists, the next materialization run will create its games
+		logger.Error().Err(err).Str("seriesID", seriesRecord.SeriesID).Msg("failed to materialize series")
+		return h.presentSeries(ctx, newSeriesRequest.Requester, seriesRecord)
+	}
+	return h.presentSeries(ctx, newSeriesRequest.Requester, materializedSeries)
+}
+
+func (h *Handler) GetSeries(ctx context.Context, seriesID string, requester string) (Series, error) {
+	log := log.Ctx(ctx).With().Str("operation", "GetSeries").Logger()
+	log.Info().Str("seriesID", seriesID).Msg("getting series")
+	seriesRecord, err := h.SeriesStore.GetSeries(ctx, seriesID)
+	if err != nil {
+		return Series{}, err
+	}
+	return h.presentSeries(ctx, requester, seriesRecord)
+}
+
+// UpdateSeries changes the series' template and rule, then brings every future occurrence in line
+// with it. Occurrences that have already been cancelled are left alone.
+func (h *Handler) UpdateSeries(ctx context.Context, seriesID string, requester string, updateSeriesRequest UpdateSeriesRequest) (Series, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "UpdateSeries").Str("seriesID", seriesID).Str("requester", requester).Logger()
+	logger.Info().Interface("updateSeriesRequest", updateSeriesRequest).Msg("updating series")
+	seriesRecord, err := h.SeriesStore.GetSeries(ctx, seriesID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get series")
+		return Series{}, err
+	}
+	if seriesRecord.Owner != requester {
+		return Series{}, errNotSeriesOwner
+	}
+	if updateSeriesRequest.Version != nil && *updateSeriesRequest.Version != seriesRecord.Version {
+		return Series{}, errSeriesConditionFailed
+	}
+	expectedVersion := seriesRecord.Version
+	// a new start time moves the whole rule, including what's already been materialized
+	var shift int64
+	if updateSeriesRequest.StartTime != nil {
+		shift = updateSeriesRequest.StartTime.Unix() - seriesRecord.StartTime
+		seriesRecord.MaterializedThrough += shift
+		if seriesRecord.Until != 0 {
+			seriesRecord.Until += shift
+		}
+	}
+	template := GameRecord{GameBase: seriesRecord.GameBase, StartTime: seriesRecord.StartTime}
+	applyGameUpdate(&template, updateSeriesRequest.UpdateGameRequest, h.now())
+	seriesRecord.GameBase = template.GameBase
+	seriesRecord.StartTime = template.StartTime
+	if updateSeriesRequest.SkippedDates != nil {
+		seriesRecord.SkippedDates = append([]string{}, *updateSeriesRequest.SkippedDates...)
+	}
+	updatedSeries, err := h.SeriesStore.ReplaceSeries(ctx, seriesRecord, expectedVersion)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to update series")
+		return Series{}, fmt.Errorf("failed to update series: %w", err)
+	}
+
+	gameRecords, err := h.GameStore.GetGamesBySeries(ctx, seriesID, h.now().Unix())
+	if err != nil {
+		return Series{}, err
+	}
+	location := updatedSeries.location()
+	for _, gameRecord := range gameRecords {
+		if gameRecord.GameStatus() == GameStatusCancelled {
+			continue
+		}
+		date := time.Unix(gameRecord.StartTime+shift, 0).In(location).Format(seriesDateLayout)
+		if updatedSeries.skipped(date) {
+			if _, err := h.CancelGame(ctx, gameRecord.GameID, updatedSeries.Owner, "skipped date"); err != nil {
+				return Series{}, err
+			}
+			continue
+		}
+		if updateSeriesRequest.UpdateGameRequest.empty() {
+			continue
+		}
+		gameUpdate := updateSeriesRequest.UpdateGameRequest
+		gameUpdate.Version = nil
+		if err := h.updateOccurrence(ctx, gameRecord.GameID, gameUpdate, shift); err != nil {
+			return Series{}, err
+		}
+	}
+
+	materializedSeries, err := h.materializeSeries(ctx, updatedSeries)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to materialize series")
+		return h.presentSeries(ctx, requester, updatedSeries)
+	}
+	return h.presentSeries(ctx, requester, materializedSeries)
+}
+
+// updateOccurrence applies a series edit to one of its games, moving its start time by shift
+// seconds. Concurrent registrations are retried rather than failing the whole series update.
+func (h *Handler) updateOccurrence(ctx context.Context, gameID string, gameUpdate UpdateGameRequest, shift int64) error {
+	for attempt := 1; ; attempt++ {
+		gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+		if err != nil {
+			return err
+		}
+		lockedShares, err := h.lockSplitIfDue(ctx, gameRecord)
+		if err != nil {
+			return err
+		}
+		update := gameUpdate
+		if lockedShares != nil {
+			// the shares owed are already fixed
+			update.SplitFeeCents = nil
+			update.SplitLockHours = nil
+		}
+		if shift != 0 {
+			startTime := time.Unix(gameRecord.StartTime+shift, 0)
+			update.StartTime = &startTime
+		} else {
+			update.StartTime = nil
+		}
+		expectedVersion := gameRecord.Version
+		previousRoster := copyRosterEntries(gameRecord.Roster)
+		applyGameUpdate(&gameRecord, update, h.now())
+		updatedGame, err := h.GameStore.ReplaceGame(ctx, gameRecord, expectedVersion)
+		if errors.Is(err, errConditionFailed) && attempt < maxOccurrenceUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update game: %w", err)
+		}
+		h.notifyNewHolds(ctx, previousRoster, updatedGame)
+		return nil
+	}
+}
+
+// SubscribeToSeries registers requester for every future occurrence, including ones materialized later
+func (h *Handler) SubscribeToSeries(ctx context.Context, seriesID string, requester string, displayName string) (Series, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "SubscribeToSeries").Str("seriesID", seriesID).Str("requester", requester).Logger()
+	logger.Info().Msg("subscribing to series")
+	seriesRecord, err := h.SeriesStore.GetSeries(ctx, seriesID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get series")
+		return Series{}, err
+	}
+	if !containsPlayer(seriesRecord.Subscribers, requester) {
+		expectedVersion := seriesRecord.Version
+		seriesRecord.Subscribers = append(seriesRecord.Subscribers, requester)
+		seriesRecord, err = h.SeriesStore.ReplaceSeries(ctx, seriesRecord, expectedVersion)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to update series")
+			return Series{}, fmt.Errorf("failed to update series: %w", err)
+		}
+	}
+	// registering again is harmless, so a retried subscription fills in any games missed the first time
+	gameRecords, err := h.GameStore.GetGamesBySeries(ctx, seriesID, h.now().Unix())
+	if err != nil {
+		return Series{}, err
+	}
+	for _, gameRecord := range gameRecords {
+		if gameRecord.GameStatus() == GameStatusCancelled {
+			continue
+		}
+		if _, err := h.RegisterForGame(ctx, gameRecord.GameID, requester, displayName, ""); err != nil {
+			return Series{}, err
+		}
+	}
+	return h.presentSeries(ctx, requester, seriesRecord)
+}
+
+// UnsubscribeFromSeries stops automatic registration and drops requester from future occurrences
+func (h *Handler) UnsubscribeFromSeries(ctx context.Context, seriesID string, requester string) (Series, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "UnsubscribeFromSeries").Str("seriesID", seriesID).Str("requester", requester).Logger()
+	logger.Info().Msg("unsubscribing from series")
+	seriesRecord, err := h.SeriesStore.GetSeries(ctx, seriesID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get series")
+		return Series{}, err
+	}
+	if containsPlayer(seriesRecord.Subscribers, requester) {
+		expectedVersion := seriesRecord.Version
+		subscribers := []string{}
+		for _, subscriber := range seriesRecord.Subscribers {
+			if subscriber != requester {
+				subscribers = append(subscribers, subscriber)
+			}
+		}
+		seriesRecord.Subscribers = subscribers
+		seriesRecord, err = h.SeriesStore.ReplaceSeries(ctx, seriesRecord, expectedVersion)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to update series")
+			return Series{}, fmt.Errorf("failed to update series: %w", err)
+		}
+	}
+	gameRecords, err := h.GameStore.GetGamesBySeries(ctx, seriesID, h.now().Unix())
+	if err != nil {
+		return Series{}, err
+	}
+	for _, gameRecord := range gameRecords {
+		if gameRecord.GameStatus() == GameStatusCancelled {
+			continue
+		}
+		if _, err := h.DropFromGame(ctx, gameRecord.GameID, requester); err != nil {
+			return Series{}, err
+		}
+	}
+	return h.presentSeries(ctx, requester, seriesRecord)
+}
+
+// MaterializeAllSeries creates the games of every series up to the materialization horizon. It's
+// meant to run on a schedule, at least weekly, so open ended series keep their games ahead.
+func (h *Handler) MaterializeAllSeries(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("operation", "MaterializeAllSeries").Logger()
+	seriesRecords, err := h.SeriesStore.ListSeries(ctx)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, seriesRecord := range seriesRecords {
+		if seriesRecord.ended() {
+			continue
+		}
+		if _, err := h.materializeSeries(ctx, seriesRecord); err != nil {
+			logger.Error().Err(err).Str("seriesID", seriesRecord.SeriesID).Msg("failed to materialize series")
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to materialize %d of %d series", failed, len(seriesRecords))
+	}
+	return nil
+}
+
+// materializeSeries creates games for the occurrences between the last materialization and the
+// horizon. Occurrence game IDs are stable, so racing another materialization can't duplicate games.
+func (h *Handler) materializeSeries(ctx context.Context, seriesRecord SeriesRecord) (SeriesRecord, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "materializeSeries").Str("seriesID", seriesRecord.SeriesID).Logger()
+	for attempt := 1; ; attempt++ {
+		now := h.now()
+		through := now.Add(seriesMaterializationHorizon).Unix()
+		if through <= seriesRecord.MaterializedThrough {
+			return seriesRecord, nil
+		}
+		after := seriesRecord.MaterializedThrough
+		if after < now.Unix() {
+			after = now.Unix()
+		}
+		for _, occurrence := range seriesRecord.occurrences(after, through) {
+			gameRecord := seriesRecord.occurrenceGame(occurrence, now)
+			err := h.GameStore.PutGame(ctx, gameRecord)
+			if errors.Is(err, errGameExists) {
+				continue
+			}
+			if err != nil {
+				return seriesRecord, err
+			}
+			logger.Info().Str("date", occurrence.Date).Msg("created occurrence")
+			// subscribers with a fee to pay are told their spot is held
+			h.notifyNewHolds(ctx, nil, gameRecord)
+		}
+		expectedVersion := seriesRecord.Version
+		seriesRecord.MaterializedThrough = through
+		updatedSeries, err := h.SeriesStore.ReplaceSeries(ctx, seriesRecord, expectedVersion)
+		if errors.Is(err, errSeriesConditionFailed) && attempt < maxOccurrenceUpdateAttempts {
+			if seriesRecord, err = h.SeriesStore.GetSeries(ctx, seriesRecord.SeriesID); err != nil {
+				return SeriesRecord{}, err
+			}
+			continue
+		}
+		return updatedSeries, err
+	}
+}
+
+func containsPlayer(players []string, player string) bool {
+	for _, p := range players {
+		if p == player {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBSeriesStore is a SeriesStore backed by a DynamoDB table keyed on SeriesID
+type DynamoDBSeriesStore struct {
+	Client    *dynamodb.Client
+	TableName string
+}
+
+func NewDynamoDBSeriesStore(client *dynamodb.Client, tableName string) *DynamoDBSeriesStore {
+	return &DynamoDBSeriesStore{
+		Client:    client,
+		TableName: tableName,
+	}
+}
+
+func (s *DynamoDBSeriesStore) PutSeries(ctx context.Context, seriesRecord SeriesRecord) error {
+	item, err := attributevalue.MarshalMap(seriesRecord)
+	if err != nil {
+		return fmt.Errorf("failed to marshal series to attribute value: %w", err)
+	}
+	_, err = s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.TableName,
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put series to DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
+
+func (s *DynamoDBSeriesStore) GetSeries(ctx context.Context, seriesID string) (SeriesRecord, error) {
+	getItemOutput, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &s.TableName,
+		Key:       map[string]ddbtypes.AttributeValue{"SeriesID": &ddbtypes.AttributeValueMemberS{Value: seriesID}},
+	})
+	if err != nil {
+		return SeriesRecord{}, fmt.Errorf("failed to get series from DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	if getItemOutput.Item == nil {
+		return SeriesRecord{}, errSeriesNotFound
+	}
+	var seriesRecord SeriesRecord
+	if err := attributevalue.UnmarshalMap(getItemOutput.Item, &seriesRecord); err != nil {
+		return SeriesRecord{}, fmt.Errorf("failed to unmarshal series record: %w", err)
+	}
+	return seriesRecord, nil
+}
+
+func (s *DynamoDBSeriesStore) ListSeries(ctx context.Context) ([]SeriesRecord, error) {
+	seriesRecords := []SeriesRecord{}
+	paginator := dynamodb.NewScanPaginator(s.Client, &dynamodb.ScanInput{TableName: &s.TableName})
+	for paginator.HasMorePages() {
+		scanOutput, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan series from DynamoDB: %w", upstreamError("DynamoDB", err))
+		}
+		for _, item := range scanOutput.Items {
+			var seriesRecord SeriesRecord
+			if err := attributevalue.UnmarshalMap(item, &seriesRecord); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal series record: %w", err)
+			}
+			seriesRecords = append(seriesRecords, seriesRecord)
+		}
+	}
+	return seriesRecords, nil
+}
+
+func (s *DynamoDBSeriesStore) ReplaceSeries(ctx context.Context, seriesRecord SeriesRecord, expectedVersion int) (SeriesRecord, error) {
+	seriesRecord.Version = expectedVersion + 1
+	item, err := attributevalue.MarshalMap(seriesRecord)
+	if err != nil {
+		return SeriesRecord{}, fmt.Errorf("failed to marshal series to attribute value: %w", err)
+	}
+	_, err = s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           &s.TableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(SeriesID) AND Version = :expectedVersion"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":expectedVersion": &ddbtypes.AttributeValueMemberN{Value: fmt.Sprintf("%d", expectedVersion)},
+		},
+	})
+	if err != nil {
+		var conditionalCheckFailed *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailed) {
+			return SeriesRecord{}, errSeriesConditionFailed
+		}
+		return SeriesRecord{}, fmt.Errorf("failed to put series to DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return seriesRecord, nil
+}
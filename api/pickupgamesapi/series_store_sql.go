@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SQLSeriesStore is a SeriesStore backed by SQLite or Postgres
+type SQLSeriesStore struct {
+	db *sql.DB
+}
+
+func NewSQLSeriesStore(db *sql.DB) *SQLSeriesStore {
+	return &SQLSeriesStore{
+		db: db,
+	}
+}
+
+const sqlSeriesColumns = `series_id, owner, category, name, location, start_time, duration_mins, num_teams, team_size,
+	signup_fee_cents, split_fee_cents, time_zone, frequency, until_time, occurrence_count, skipped_dates, subscribers,
+	materialized_through, version, geo_lat, geo_lng, geo_address, promotion_offer_hours,
+	split_lock_hours, refund_full_hours, refund_partial_percent, refund_none_hours, refund_when_spot_filled,
+	price_tiers, promo_codes`
+
+func scanSeries(row sqlScanner) (SeriesRecord, error) {
+	var seriesRecord SeriesRecord
+	var skippedDates, subscribers, priceTiers, promoCodes string
+	var geoLocation sqlGeoLocation
+	err := row.Scan(&seriesRecord.SeriesID, &seriesRecord.Owner, &seriesRecord.Category, &seriesRecord.Name,
+		&seriesRecord.Location, &seriesRecord.StartTime, &seriesRecord.DurationMins, &seriesRecord.NumTeams,
+		&seriesRecord.TeamSize, &seriesRecord.SignupFeeCents, &seriesRecord.SplitFeeCents, &seriesRecord.TimeZone,
+		&seriesRecord.Frequency, &seriesRecord.Until, &seriesRecord.Count, &skippedDates, &subscribers,
+		&seriesRecord.MaterializedThrough, &seriesRecord.Version, &geoLocation.Lat, &geoLocation.Lng, &geoLocation.Address,
+		&seriesRecord.PromotionOfferHours, &seriesRecord.SplitLockHours, &seriesRecord.RefundPolicy.FullRefundHours,
+		&seriesRecord.RefundPolicy.PartialRefundPercent, &seriesRecord.RefundPolicy.NoRefundHours,
+		&seriesRecord.RefundPolicy.RefundWhenSpotFilled, &priceTiers, &promoCodes)
+	if err != nil {
+		return SeriesRecord{}, err
+	}
+	if err := scanPricingColumns(&seriesRecord.GameBase, priceTiers, promoCodes); err != nil {
+		return SeriesRecord{}, err
+	}
+	if err := json.Unmarshal([]byte(skippedDates), &seriesRecord.SkippedDates); err != nil {
+		return SeriesRecord{}, fmt.Errorf("failed to unmarshal skipped dates: %w", err)
+	}
+	if err := json.Unmarshal([]byte(subscribers), &seriesRecord.Subscribers); err != nil {
+		return SeriesRecord{}, fmt.Errorf("failed to unmarshal subscribers: %w", err)
+	}
+	seriesRecord.Roster = []RosterEntry{}
+	seriesRecord.WaitList = []RosterEntry{}
+	seriesRecord.GeoLocation = geoLocation.GeoLocation()
+	return seriesRecord, nil
+}
+
+// seriesLists encodes the series' list columns
+func seriesLists(seriesRecord SeriesRecord) (string, string, error) {
+	skippedDates, err := json.Marshal(append([]string{}, seriesRecord.SkippedDates...))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal skipped dates: %w", err)
+	}
+	subscribers, err := json.Marshal(append([]string{}, seriesRecord.Subscribers...))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal subscribers: %w", err)
+	}
+	return string(skippedDates), string(subscribers), nil
+}
+
+func (s *SQLSeriesStore) PutSeries(ctx context.Context, seriesRecord SeriesRecord) error {
+	skippedDates, subscribers, err := seriesLists(seriesRecord)
+	if err != nil {
+		return err
+	}
+	priceTiers, promoCodes, err := pricingColumns(seriesRecord.GameBase)
+	if err != nil {
+		return err
+	}
+	geoLat, geoLng, geoAddress := geoLocationColumns(seriesRecord.GeoLocation)
+	_, err = s.db.ExecContext(ctx, `INSERT INTO game_series (`+sqlSeriesColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24,
+			$25, $26, $27, $28, $29, $30)`,
+		seriesRecord.SeriesID, seriesRecord.Owner, seriesRecord.Category, seriesRecord.Name, seriesRecord.Location,
+		seriesRecord.StartTime, seriesRecord.DurationMins, seriesRecord.NumTeams, seriesRecord.TeamSize,
+		seriesRecord.SignupFeeCents, seriesRecord.SplitFeeCents, seriesRecord.TimeZone, seriesRecord.Frequency,
+		seriesRecord.Until, seriesRecord.Count, skippedDates, subscribers, seriesRecord.MaterializedThrough,
+		seriesRecord.Version, geoLat, geoLng, geoAddress, seriesRecord.PromotionOfferHours, seriesRecord.SplitLockHours,
+		seriesRecord.RefundPolicy.FullRefundHours, seriesRecord.RefundPolicy.PartialRefundPercent,
+		seriesRecord.RefundPolicy.NoRefundHours, seriesRecord.RefundPolicy.RefundWhenSpotFilled, priceTiers, promoCodes)
+	if err != nil {
+		return fmt.Errorf("failed to insert series: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLSeriesStore) GetSeries(ctx context.Context, seriesID string) (SeriesRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+sqlSeriesColumns+` FROM game_series WHERE series_id = $1`, seriesID)
+	seriesRecord, err := scanSeries(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SeriesRecord{}, errSeriesNotFound
+	}
+	if err != nil {
+		return SeriesRecord{}, fmt.Errorf("failed to get series: %w", err)
+	}
+	return seriesRecord, nil
+}
+
+func (s *SQLSeriesStore) ListSeries(ctx context.Context) ([]SeriesRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqlSeriesColumns+` FROM game_series ORDER BY series_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list series: %w", err)
+	}
+	defer rows.Close()
+	seriesRecords := []SeriesRecord{}
+	for rows.Next() {
+		seriesRecord, err := scanSeries(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan series: %w", err)
+		}
+		seriesRecords = append(seriesRecords, seriesRecord)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list series: %w", err)
+	}
+	return seriesRecords, nil
+}
+
+func (s *SQLSeriesStore) ReplaceSeries(ctx context.Context, seriesRecord SeriesRecord, expectedVersion int) (SeriesRecord, error) {
+	skippedDates, subscribers, err := seriesLists(seriesRecord)
+	if err != nil {
+		return SeriesRecord{}, err
+	}
+	priceTiers, promoCodes, err := pricingColumns(seriesRecord.GameBase)
+	if err != nil {
+		return SeriesRecord{}, err
+	}
+	geoLat, geoLng, geoAddress := geoLocationColumns(seriesRecord.GeoLocation)
+	result, err := s.db.ExecContext(ctx, `UPDATE game_series SET owner = $2, category = $3, name = $4, location = $5,
+		start_time = $6, duration_mins = $7, num_teams = $8, team_size = $9, signup_fee_cents = $10,
+		split_fee_cents = $11, time_zone = $12, frequency = $13, until_time = $14, occurrence_count = $15,
+		skipped_dates = $16, subscribers = $17, materialized_through = $18, version = $19,
+		geo_lat = $21, geo_lng = $22, geo_address = $23, promotion_offer_hours = $24,
+		split_lock_hours = $25, refund_full_hours = $26, refund_partial_percent = $27, refund_none_hours = $28,
+		refund_when_spot_filled = $29, price_tiers = $30, promo_codes = $31
+		WHERE series_id = $1 AND version = $20`,
+		seriesRecord.SeriesID, seriesRecord.Owner, seriesRecord.Category, seriesRecord.Name, seriesRecord.Location,
+		seriesRecord.StartTime, seriesRecord.DurationMins, seriesRecord.NumTeams, seriesRecord.TeamSize,
+		seriesRecord.SignupFeeCents, seriesRecord.SplitFeeCents, seriesRecord.TimeZone, seriesRecord.Frequency,
+		seriesRecord.Until, seriesRecord.Count, skippedDates, subscribers, seriesRecord.MaterializedThrough,
+		expectedVersion+1, expectedVersion, geoLat, geoLng, geoAddress, seriesRecord.PromotionOfferHours,
+		seriesRecord.SplitLockHours, seriesRecord.RefundPolicy.FullRefundHours, seriesRecord.RefundPolicy.PartialRefundPercent,
+		seriesRecord.RefundPolicy.NoRefundHours, seriesRecord.RefundPolicy.RefundWhenSpotFilled, priceTiers, promoCodes)
+	if err != nil {
+		return SeriesRecord{}, fmt.Errorf("failed to update series: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return SeriesRecord{}, fmt.Errorf("failed to update series: %w", err)
+	}
+	if updated == 0 {
+		// tell a missing series apart from a stale version
+		if _, err := s.GetSeries(ctx, seriesRecord.SeriesID); err != nil {
+			return SeriesRecord{}, err
+		}
+		return SeriesRecord{}, errSeriesConditionFailed
+	}
+	seriesRecord.Version = expectedVersion + 1
+	return seriesRecord, nil
+}
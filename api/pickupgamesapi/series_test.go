@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestSeries is the body of a weekly UTC series of soccer games, the first starting startsIn
+// after the test clock's start
+func newTestSeries(startsIn time.Duration, count int) map[string]interface{} {
+	body := newTestGame("soccer", startsIn, 1, 2)
+	body["timeZone"] = "UTC"
+	body["frequency"] = RecurrenceWeekly
+	if count > 0 {
+		body["count"] = count
+	}
+	return body
+}
+
+func (h *testHandler) createSeries(t *testing.T, owner string, body map[string]interface{}) Series {
+	t.Helper()
+	var series Series
+	h.mustCall(t, testRequest{RouteKey: "POST /series", Requester: owner, Body: body}, &series)
+	return series
+}
+
+// seriesGames returns every game of the series, ordered by start time
+func (h *testHandler) seriesGames(t *testing.T, seriesID string) []GameRecord {
+	t.Helper()
+	gameRecords, err := h.GameStore.GetGamesBySeries(context.Background(), seriesID, 0)
+	if err != nil {
+		t.Fatalf("failed to get series games: %v", err)
+	}
+	return gameRecords
+}
+
+func TestSeriesOccurrences(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load time zone: %v", err)
+	}
+	local := func(value string) int64 {
+		localTime, err := time.ParseInLocation("2006-01-02 15:04", value, newYork)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", value, err)
+		}
+		return localTime.Unix()
+	}
+	// the first occurrence is the week before clocks go forward on March 10th
+	series := func(frequency RecurrenceFrequency, count int, until int64, skippedDates ...string) SeriesRecord {
+		return SeriesRecord{
+			StartTime:    local("2030-03-03 18:00"),
+			TimeZone:     "America/New_York",
+			Frequency:    frequency,
+			Count:        count,
+			Until:        until,
+			SkippedDates: skippedDates,
+		}
+	}
+	for _, test := range []struct {
+		name    string
+		series  SeriesRecord
+		after   int64
+		through int64
+		want    []string
+	}{
+		{
+			name:   "keeps the local time across DST",
+			series: series(RecurrenceWeekly, 3, 0),
+			want:   []string{"0 2030-03-03 18:00 EST", "1 2030-03-10 18:00 EDT", "2 2030-03-17 18:00 EDT"},
+		},
+		{
+			name:   "until ends the series before count",
+			series: series(RecurrenceWeekly, 5, local("2030-03-17 18:00")),
+			want:   []string{"0 2030-03-03 18:00 EST", "1 2030-03-10 18:00 EDT", "2 2030-03-17 18:00 EDT"},
+		},
+		{
+			name:   "count ends the series before until",
+			series: series(RecurrenceWeekly, 2, local("2030-12-31 00:00")),
+			want:   []string{"0 2030-03-03 18:00 EST", "1 2030-03-10 18:00 EDT"},
+		},
+		{
+			name:   "skipped dates count toward count",
+			series: series(RecurrenceWeekly, 3, 0, "2030-03-10"),
+			want:   []string{"0 2030-03-03 18:00 EST", "2 2030-03-17 18:00 EDT"},
+		},
+		{
+			name:   "biweekly",
+			series: series(RecurrenceBiweekly, 3, 0),
+			want:   []string{"0 2030-03-03 18:00 EST", "1 2030-03-17 18:00 EDT", "2 2030-03-31 18:00 EDT"},
+		},
+		{
+			name:    "only occurrences after after and through through",
+			series:  series(RecurrenceWeekly, 0, local("2030-12-31 00:00")),
+			after:   local("2030-03-03 18:00"),
+			through: local("2030-03-17 18:00"),
+			want:    []string{"1 2030-03-10 18:00 EDT", "2 2030-03-17 18:00 EDT"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			through := test.through
+			if through == 0 {
+				through = local("2031-01-01 00:00")
+			}
+			got := []string{}
+			for _, occurrence := range test.series.occurrences(test.after, through) {
+				startTime := time.Unix(occurrence.StartTime, 0).In(newYork)
+				if occurrence.Date != startTime.Format(seriesDateLayout) {
+					t.Errorf("occurrence %d is dated %s but starts %v", occurrence.Index, occurrence.Date, startTime)
+				}
+				got = append(got, fmt.Sprintf("%d %s", occurrence.Index, startTime.Format("2006-01-02 15:04 MST")))
+			}
+			if !equalStrings(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMaterializeSeriesIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t)
+	series := h.createSeries(t, "owner@example.com", newTestSeries(24*time.Hour, 3))
+	gameRecords := h.seriesGames(t, series.SeriesID)
+	if len(gameRecords) != 3 {
+		t.Fatalf("expected 3 games, got %d", len(gameRecords))
+	}
+	for i, gameRecord := range gameRecords {
+		if gameRecord.GameID != occurrenceGameID(series.SeriesID, i) {
+			t.Errorf("expected occurrence %d to have ID %s, got %s", i, occurrenceGameID(series.SeriesID, i), gameRecord.GameID)
+		}
+	}
+	h.register(t, gameRecords[0].GameID, "a@example.com")
+
+	// a materialization that raced this one created the games but never recorded it
+	seriesRecord, err := h.SeriesStore.GetSeries(ctx, series.SeriesID)
+	if err != nil {
+		t.Fatalf("failed to get series: %v", err)
+	}
+	seriesRecord.MaterializedThrough = 0
+	if seriesRecord, err = h.SeriesStore.ReplaceSeries(ctx, seriesRecord, seriesRecord.Version); err != nil {
+		t.Fatalf("failed to reset series: %v", err)
+	}
+	if _, err := h.materializeSeries(ctx, seriesRecord); err != nil {
+		t.Fatalf("materializing again returned an error: %v", err)
+	}
+	gameRecords = h.seriesGames(t, series.SeriesID)
+	if len(gameRecords) != 3 {
+		t.Fatalf("expected the same 3 games, got %d", len(gameRecords))
+	}
+	if !equalStrings(userIDs(gameRecords[0].Roster), []string{"a@example.com"}) {
+		t.Errorf("expected the existing game left alone, got roster %v", userIDs(gameRecords[0].Roster))
+	}
+}
+
+func TestUpdateSeriesShiftsFutureOccurrences(t *testing.T) {
+	h := newTestHandler(t)
+	series := h.createSeries(t, "owner@example.com", newTestSeries(24*time.Hour, 3))
+	before := h.seriesGames(t, series.SeriesID)
+	// the first game has been played
+	h.clock.Advance(48 * time.Hour)
+
+	startTime := series.StartTime.Add(time.Hour)
+	h.mustCall(t, testRequest{
+		RouteKey:       "PATCH /series/{seriesID}",
+		Requester:      "owner@example.com",
+		PathParameters: map[string]string{"seriesID": series.SeriesID},
+		Body:           map[string]interface{}{"startTime": startTime.Format(time.RFC3339), "name": "Evening soccer"},
+	}, nil)
+	after := h.seriesGames(t, series.SeriesID)
+	if len(after) != 3 {
+		t.Fatalf("expected 3 games, got %d", len(after))
+	}
+	if after[0].StartTime != before[0].StartTime || after[0].Name != before[0].Name {
+		t.Errorf("expected the played game left alone, got %+v", after[0])
+	}
+	for i := 1; i < 3; i++ {
+		if after[i].StartTime != before[i].StartTime+3600 || after[i].Name != "Evening soccer" {
+			t.Errorf("expected occurrence %d an hour later and renamed, got %d %q", i, after[i].StartTime-before[i].StartTime, after[i].Name)
+		}
+	}
+
+	skippedDate := time.Unix(after[2].StartTime, 0).UTC().Format(seriesDateLayout)
+	h.mustCall(t, testRequest{
+		RouteKey:       "PATCH /series/{seriesID}",
+		Requester:      "owner@example.com",
+		PathParameters: map[string]string{"seriesID": series.SeriesID},
+		Body:           map[string]interface{}{"skippedDates": []string{skippedDate}},
+	}, nil)
+	after = h.seriesGames(t, series.SeriesID)
+	if after[1].GameStatus() != GameStatusScheduled || after[2].GameStatus() != GameStatusCancelled {
+		t.Errorf("expected only the game on the skipped date cancelled, got %s and %s", after[1].GameStatus(), after[2].GameStatus())
+	}
+}
+
+func TestSubscribersAreRegisteredForMaterializedGames(t *testing.T) {
+	h := newTestHandler(t)
+	body := newTestSeries(24*time.Hour, 0)
+	body["until"] = testStart.Add(20 * 7 * 24 * time.Hour).Format(time.RFC3339)
+	series := h.createSeries(t, "owner@example.com", body)
+	materialized := len(h.seriesGames(t, series.SeriesID))
+	if materialized == 0 {
+		t.Fatalf("expected games materialized up to the horizon")
+	}
+
+	response := h.call(t, testRequest{
+		RouteKey:       "POST /series/{seriesID}/subscription",
+		Requester:      "a@example.com",
+		PathParameters: map[string]string{"seriesID": series.SeriesID},
+	}, nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("subscribing returned %d: %s", response.StatusCode, response.Body)
+	}
+	// four weeks on, the scheduled run materializes four more games
+	h.clock.Advance(28 * 24 * time.Hour)
+	if err := h.MaterializeAllSeries(context.Background()); err != nil {
+		t.Fatalf("materializing returned an error: %v", err)
+	}
+	gameRecords := h.seriesGames(t, series.SeriesID)
+	if len(gameRecords) != materialized+4 {
+		t.Fatalf("expected %d games, got %d", materialized+4, len(gameRecords))
+	}
+	for _, gameRecord := range gameRecords {
+		roster := gameRecord.Roster
+		if len(roster) != 1 || roster[0].UserID != "a@example.com" || roster[0].Status != RegistrationStatusConfirmed {
+			t.Errorf("expected the subscriber registered for the game on %s, got %+v", time.Unix(gameRecord.StartTime, 0).UTC(), roster)
+		}
+	}
+}
+
+func TestOccurrenceGameHoldsSubscriberSpotsUntilPaid(t *testing.T) {
+	seriesRecord := SeriesRecord{
+		GameBase: GameBase{
+			NumTeams:       1,
+			TeamSize:       2,
+			SignupFeeCents: 1000,
+			PriceTiers:     []PriceTier{{Name: "first in", PriceCents: 500, MaxPlayers: 1}},
+		},
+		SeriesID:    "s1",
+		Owner:       "owner@example.com",
+		Subscribers: []string{"a@example.com", "b@example.com", "c@example.com"},
+	}
+	occurrence := seriesOccurrence{Index: 3, StartTime: testStart.Add(7 * 24 * time.Hour).Unix()}
+	gameRecord := seriesRecord.occurrenceGame(occurrence, testStart)
+
+	if got := userIDs(gameRecord.Roster); !equalStrings(got, []string{"a@example.com", "b@example.com"}) {
+		t.Fatalf("expected the first two subscribers on the roster, got %v", got)
+	}
+	dueAt := testStart.Add(paymentGracePeriod)
+	for i, priceCents := range []int{500, 1000} {
+		entry := gameRecord.Roster[i]
+		if entry.Status != RegistrationStatusPendingPayment || entry.PaymentDueAt == nil || !entry.PaymentDueAt.Equal(dueAt) {
+			t.Errorf("expected %s's spot held until %v, got %+v", entry.UserID, dueAt, entry)
+		}
+		if entry.PriceCents == nil || *entry.PriceCents != priceCents {
+			t.Errorf("expected %s priced at %d, got %v", entry.UserID, priceCents, entry.PriceCents)
+		}
+	}
+	if waiting := gameRecord.WaitList; len(waiting) != 1 || waiting[0].Status != RegistrationStatusConfirmed || waiting[0].PaymentDueAt != nil {
+		t.Errorf("expected c@example.com waiting without a hold, got %+v", waiting)
+	}
+
+	gameRecord.indexHolds()
+	if gameRecord.HoldIndexKey != holdIndexKey || gameRecord.NextHoldExpiry != dueAt.Unix() {
+		t.Errorf("expected the holds indexed, got %q %d", gameRecord.HoldIndexKey, gameRecord.NextHoldExpiry)
+	}
+}
+
+func TestOccurrenceGameConfirmsSubscribersWithoutFee(t *testing.T) {
+	seriesRecord := SeriesRecord{
+		GameBase:    GameBase{NumTeams: 1, TeamSize: 2},
+		SeriesID:    "s1",
+		Subscribers: []string{"a@example.com"},
+	}
+	occurrence := seriesOccurrence{StartTime: testStart.Add(24 * time.Hour).Unix()}
+	gameRecord := seriesRecord.occurrenceGame(occurrence, testStart)
+	if len(gameRecord.Roster) != 1 || gameRecord.Roster[0].Status != RegistrationStatusConfirmed || gameRecord.Roster[0].PriceCents != nil {
+		t.Errorf("expected a confirmed spot, got %+v", gameRecord.Roster)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// maxRequestBodyBytes matches the API Gateway HTTP API payload limit
+const maxRequestBodyBytes = 10 << 20
+
+var errRequestTooLarge = errors.New("request body too large")
+
+// apiRoute is a route served by the handler. Authorized routes sit behind the JWT authorizer in
+// API Gateway and require a bearer token in serve mode.
+type apiRoute struct {
+	RouteKey   string
+	Authorized bool
+}
+
+// apiRoutes must be kept in sync with the route keys in Handler.handler and the API Gateway routes
+var apiRoutes = []apiRoute{
+	{RouteKey: "POST /auth/signup"},
+	{RouteKey: "POST /auth/signin"},
+	{RouteKey: "POST /auth/refresh"},
+	{RouteKey: "POST /auth/signout", Authorized: true},
+	{RouteKey: "POST /auth/forgot-password"},
+	{RouteKey: "POST /auth/confirm-forgot-password"},
+	{RouteKey: "POST /auth/verify"},
+	{RouteKey: "POST /games", Authorized: true},
+	{RouteKey: "GET /games"},
+	// literal segments must come before path parameters at the same position, as in API Gateway
+	{RouteKey: "GET /games/nearby", Authorized: true},
+	{RouteKey: "GET /games/{gameID}"},
+	{RouteKey: "PATCH /games/{gameID}", Authorized: true},
+	{RouteKey: "DELETE /games/{gameID}", Authorized: true},
+	{RouteKey: "POST /games/{gameID}/cancel", Authorized: true},
+	{RouteKey: "POST /games/{gameID}/registrtation", Authorized: true},
+	{RouteKey: "DELETE /games/{gameID}/registration", Authorized: true},
+	{RouteKey: "POST /games/{gameID}/registration/confirm", Authorized: true},
+	{RouteKey: "POST /games/{gameID}/registration/payment", Authorized: true},
+	{RouteKey: "GET /games/{gameID}/payments", Authorized: true},
+	{RouteKey: "GET /games/{gameID}/split", Authorized: true},
+	{RouteKey: "PATCH /games/{gameID}/split/{playerID}", Authorized: true},
+	{RouteKey: "POST /games/{gameID}/roster", Authorized: true},
+	{RouteKey: "DELETE /games/{gameID}/roster/{playerID}", Authorized: true},
+	{RouteKey: "POST /games/{gameID}/waitlist", Authorized: true},
+	{RouteKey: "PUT /games/{gameID}/waitlist", Authorized: true},
+	{RouteKey: "DELETE /games/{gameID}/waitlist/{playerID}", Authorized: true},
+	{RouteKey: "GET /me", Authorized: true},
+	{RouteKey: "PATCH /me", Authorized: true},
+	{RouteKey: "DELETE /me", Authorized: true},
+	{RouteKey: "GET /me/export", Authorized: true},
+	{RouteKey: "GET /me/games", Authorized: true},
+	{RouteKey: "GET /users/{playerID}", Authorized: true},
+	{RouteKey: "POST /series", Authorized: true},
+	{RouteKey: "GET /series/{seriesID}", Authorized: true},
+	{RouteKey: "PATCH /series/{seriesID}", Authorized: true},
+	{RouteKey: "POST /series/{seriesID}/subscription", Authorized: true},
+	{RouteKey: "DELETE /series/{seriesID}/subscription", Authorized: true},
+	// payment provider webhooks are authenticated by their signature instead of a token
+	{RouteKey: "POST /webhooks/payments"},
+	{RouteKey: "GET /.well-known/jwks.json"},
+}
+
+// matchRoute finds the route for method and path and extracts its path parameters
+func matchRoute(method string, path string) (apiRoute, map[string]string, bool) {
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, route := range apiRoutes {
+		routeMethod, routePath, _ := strings.Cut(route.RouteKey, " ")
+		if routeMethod != method {
+			continue
+		}
+		routeSegments := strings.Split(strings.Trim(routePath, "/"), "/")
+		if len(routeSegments) != len(pathSegments) {
+			continue
+		}
+		pathParameters := map[string]string{}
+		matched := true
+		for i, routeSegment := range routeSegments {
+			if strings.HasPrefix(routeSegment, "{") && strings.HasSuffix(routeSegment, "}") {
+				pathParameters[strings.Trim(routeSegment, "{}")] = pathSegments[i]
+				continue
+			}
+			if routeSegment != pathSegments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route, pathParameters, true
+		}
+	}
+	return apiRoute{}, nil, false
+}
+
+// HTTPServer exposes the handler over net/http by translating each request into the
+// APIGatewayV2HTTPRequest that API Gateway would have sent to the Lambda
+type HTTPServer struct {
+	Handler       *Handler
+	TokenVerifier TokenVerifier
+}
+
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := log.With().Str("method", r.Method).Str("path", r.URL.Path).Logger()
+	route, pathParameters, ok := matchRoute(r.Method, r.URL.Path)
+	if !ok {
+		writeAPIGatewayResponse(w, events.APIGatewayV2HTTPResponse{StatusCode: http.StatusNotFound})
+		return
+	}
+	var claims map[string]string
+	if route.Authorized {
+		token, ok := bearerToken(r)
+		if !ok {
+			writeAPIGatewayResponse(w, unauthorizedResponse())
+			return
+		}
+		verifiedClaims, err := s.TokenVerifier.VerifyToken(r.Context(), token)
+		if err != nil {
+			logger.Info().Err(err).Msg("rejected bearer token")
+			writeAPIGatewayResponse(w, unauthorizedResponse())
+			return
+		}
+		claims = verifiedClaims
+	}
+	event, err := newAPIGatewayRequest(r, route.RouteKey, pathParameters, claims)
+	if errors.Is(err, errRequestTooLarge) {
+		writeAPIGatewayResponse(w, events.APIGatewayV2HTTPResponse{StatusCode: http.StatusRequestEntityTooLarge})
+		return
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to read request")
+		writeAPIGatewayResponse(w, events.APIGatewayV2HTTPResponse{StatusCode: http.StatusBadRequest})
+		return
+	}
+	response, err := s.Handler.handler(r.Context(), event)
+	if err != nil {
+		// the Lambda runtime turns a handler error into a 500 at API Gateway
+		logger.Error().Err(err).Msg("handler returned an error")
+		writeAPIGatewayResponse(w, events.APIGatewayV2HTTPResponse{StatusCode: http.StatusInternalServerError})
+		return
+	}
+	writeAPIGatewayResponse(w, response)
+}
+
+// newAPIGatewayRequest builds the payload format 2.0 event for r. Like API Gateway it only carries
+// an authorizer on authorized routes, which pass claims.
+func newAPIGatewayRequest(r *http.Request, routeKey string, pathParameters map[string]string, claims map[string]string) (events.APIGatewayV2HTTPRequest, error) {
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodyBytes+1))
+	if err != nil {
+		return events.APIGatewayV2HTTPRequest{}, err
+	}
+	if len(bodyBytes) > maxRequestBodyBytes {
+		return events.APIGatewayV2HTTPRequest{}, errRequestTooLarge
+	}
+	body := string(bodyBytes)
+	isBase64Encoded := false
+	if !utf8.Valid(bodyBytes) {
+		body = base64.StdEncoding.EncodeToString(bodyBytes)
+		isBase64Encoded = true
+	}
+	// API Gateway lowercases header names and joins repeated headers and query parameters with commas
+	headers := map[string]string{}
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	var queryStringParameters map[string]string
+	if query := r.URL.Query(); len(query) > 0 {
+		queryStringParameters = map[string]string{}
+		for name, values := range query {
+			queryStringParameters[name] = strings.Join(values, ",")
+		}
+	}
+	var cookies []string
+	for _, cookie := range r.Cookies() {
+		cookies = append(cookies, cookie.String())
+	}
+	var authorizer *events.APIGatewayV2HTTPRequestContextAuthorizerDescription
+	if claims != nil {
+		authorizer = &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+			JWT: &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+				Claims: claims,
+			},
+		}
+	}
+	now := time.Now()
+	return events.APIGatewayV2HTTPRequest{
+		Version:               "2.0",
+		RouteKey:              routeKey,
+		RawPath:               r.URL.Path,
+		RawQueryString:        r.URL.RawQuery,
+		Cookies:               cookies,
+		Headers:               headers,
+		QueryStringParameters: queryStringParameters,
+		PathParameters:        pathParameters,
+		Body:                  body,
+		IsBase64Encoded:       isBase64Encoded,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RouteKey:   routeKey,
+			Stage:      "$default",
+			RequestID:  uuid.New().String(),
+			DomainName: r.Host,
+			Time:       now.UTC().Format("02/Jan/2006:15:04:05 -0700"),
+			TimeEpoch:  now.UnixMilli(),
+			Authorizer: authorizer,
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Protocol:  r.Proto,
+				SourceIP:  r.RemoteAddr,
+				UserAgent: r.UserAgent(),
+			},
+		},
+	}, nil
+}
+
+func writeAPIGatewayResponse(w http.ResponseWriter, response events.APIGatewayV2HTTPResponse) {
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	for name, values := range response.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	for _, cookie := range response.Cookies {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+	body := []byte(response.Body)
+	if response.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(response.Body)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to decode base64 response body")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body = decoded
+	}
+	if response.StatusCode == 0 {
+		response.StatusCode = http.StatusOK
+	}
+	w.WriteHeader(response.StatusCode)
+	_, _ = w.Write(body)
+}
+
+// unauthorizedResponse mirrors the response API Gateway's JWT authorizer returns
+func unauthorizedResponse() events.APIGatewayV2HTTPResponse {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusUnauthorized,
+		Body:       `{"message":"Unauthorized"}`,
+		Headers: map[string]string{
+			"Content-Type":     "application/json",
+			"WWW-Authenticate": "Bearer",
+		},
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"pickupgamesapi/types"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errNoVenueSplit       = types.NewNotFoundError("no_venue_split", "game has no venue cost to split")
+	errSplitNotLocked     = types.NewConflictError("split_not_locked", "shares can only be marked paid once the split is locked")
+	errSplitLocked        = types.NewConflictError("split_locked", "the venue split is locked and can no longer change")
+	errSplitShareNotFound = types.NewNotFoundError("split_share_not_found", "player has no share of the venue split")
+)
+
+// VenueSplit is a game's SplitFeeCents shared evenly across its roster. Until LocksAt the shares
+// follow the roster; after it they're fixed as amounts owed that the owner marks paid as the money
+// comes in.
+type VenueSplit struct {
+	TotalCents int `json:"totalCents"`
+	// ShareCents is what each player owes, the total divided evenly and rounded up to the cent
+	ShareCents int `json:"shareCents"`
+	// CollectedCents is the shares added up, which can be a few cents over TotalCents but never under
+	CollectedCents int          `json:"collectedCents"`
+	LocksAt        time.Time    `json:"locksAt"`
+	Locked         bool         `json:"locked"`
+	Shares         []SplitShare `json:"shares"`
+}
+
+// SplitShare is one player's part of a venue split. UserID is only shown to the game's owner and
+// the player themselves.
+type SplitShare struct {
+	UserID      string     `json:"userId,omitempty"`
+	PlayerID    string     `json:"playerId"`
+	AmountCents int        `json:"amountCents"`
+	Paid        bool       `json:"paid"`
+	PaidAt      *time.Time `json:"paidAt,omitempty"`
+}
+
+// SplitShareRequest marks a player's share of the venue split paid or unpaid
+type SplitShareRequest struct {
+	Paid *bool `json:"paid"`
+}
+
+func (r *SplitShareRequest) ValidateRequest() error {
+	if r.Paid == nil {
+		return types.NewValidationError("", "paid is required")
+	}
+	return nil
+}
+
+// splitShareCents divides totalCents between players, rounding up so the shares never add up to
+// less than the total
+func splitShareCents(totalCents int, players int) int {
+	if players == 0 {
+		return 0
+	}
+	return (totalCents + players - 1) / players
+}
+
+// GetVenueSplit returns the game's venue split as it stands, locking it in if it's due
+func (h *Handler) GetVenueSplit(ctx context.Context, gameID string, requester string) (VenueSplit, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "GetVenueSplit").Str("gameID", gameID).Str("requester", requester).Logger()
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get game")
+		return VenueSplit{}, err
+	}
+	if gameRecord.SplitFeeCents <= 0 {
+		return VenueSplit{}, errNoVenueSplit
+	}
+	lockedShares, err := h.lockSplitIfDue(ctx, gameRecord)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to lock venue split")
+		return VenueSplit{}, err
+	}
+	return h.presentVenueSplit(requester, gameRecord, lockedShares), nil
+}
+
+// MarkSplitShare records whether a player has paid their locked share, for the game's owner
+func (h *Handler) MarkSplitShare(ctx context.Context, gameID string, requester string, playerID string, shareRequest SplitShareRequest) (VenueSplit, error) {
+	logger := log.Ctx(ctx).With().Str("operation", "MarkSplitShare").Str("gameID", gameID).Str("requester", requester).Logger()
+	logger.Info().Str("playerID", playerID).Bool("paid", *shareRequest.Paid).Msg("marking split share")
+	gameRecord, err := h.GameStore.GetGame(ctx, gameID)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get game")
+		return VenueSplit{}, err
+	}
+	if gameRecord.Owner != requester {
+		return VenueSplit{}, errNotGameOwner
+	}
+	if gameRecord.SplitFeeCents <= 0 {
+		return VenueSplit{}, errNoVenueSplit
+	}
+	lockedShares, err := h.lockSplitIfDue(ctx, gameRecord)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to lock venue split")
+		return VenueSplit{}, err
+	}
+	if lockedShares == nil {
+		return VenueSplit{}, errSplitNotLocked
+	}
+	for i, share := range lockedShares {
+		if h.PlayerIDs.PlayerID(share.UserID) != playerID {
+			continue
+		}
+		status := LedgerEntryPending
+		if *shareRequest.Paid {
+			status = LedgerEntrySucceeded
+		}
+		if share.Status != status {
+			if err := h.updateLedgerEntry(ctx, share, status, ""); err != nil {
+				logger.Error().Err(err).Msg("failed to record split share")
+				return VenueSplit{}, err
+			}
+			lockedShares[i].Status = status
+			lockedShares[i].UpdatedAt = h.now().UTC().Truncate(time.Second)
+		}
+		return h.presentVenueSplit(requester, gameRecord, lockedShares), nil
+	}
+	return VenueSplit{}, errSplitShareNotFound
+}
+
+// lockSplitIfDue returns the game's locked shares, recording one for each player on the roster if
+// the lock is due and that hasn't happened yet. It's nil while the split still follows the roster.
+// Anything changing the roster calls it first, so a split locked late is still the roster as it
+// stood at the cutoff.
+func (h *Handler) lockSplitIfDue(ctx context.Context, gameRecord GameRecord) ([]LedgerEntry, error) {
+	if gameRecord.SplitFeeCents <= 0 || gameRecord.GameStatus() == GameStatusCancelled {
+		return nil, nil
+	}
+	now := h.now().UTC().Truncate(time.Second)
+	if now.Before(gameRecord.splitLocksAt()) {
+		return nil, nil
+	}
+	entries, err := h.Payments.GetLedgerEntries(ctx, gameRecord.GameID)
+	if err != nil {
+		return nil, err
+	}
+	shares := []LedgerEntry{}
+	for _, entry := range entries {
+		if entry.Kind == LedgerEntrySplitShare {
+			shares = append(shares, entry)
+		}
+	}
+	if len(shares) > 0 {
+		return shares, nil
+	}
+	if len(gameRecord.Roster) == 0 {
+		// nobody to share it between yet
+		return nil, nil
+	}
+	log.Ctx(ctx).Info().Str("gameID", gameRecord.GameID).Int("players", len(gameRecord.Roster)).Msg("locking venue split")
+	shareCents := splitShareCents(gameRecord.SplitFeeCents, len(gameRecord.Roster))
+	for _, player := range gameRecord.Roster {
+		share := LedgerEntry{
+			GameID: gameRecord.GameID,
+			// one share per player, so a lock that's retried overwrites rather than duplicates
+			EntryID:     "split-" + h.PlayerIDs.PlayerID(player.UserID),
+			UserID:      player.UserID,
+			Kind:        LedgerEntrySplitShare,
+			AmountCents: shareCents,
+			Status:      LedgerEntryPending,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if err := h.Payments.PutLedgerEntry(ctx, share); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// presentVenueSplit builds the split from the locked shares if there are any, otherwise from the
+// game's current roster
+func (h *Handler) presentVenueSplit(requester string, gameRecord GameRecord, lockedShares []LedgerEntry) VenueSplit {
+	split := VenueSplit{
+		TotalCents: gameRecord.SplitFeeCents,
+		LocksAt:    gameRecord.splitLocksAt(),
+		Locked:     lockedShares != nil,
+		Shares:     []SplitShare{},
+	}
+	if lockedShares != nil {
+		for _, entry := range lockedShares {
+			share := SplitShare{UserID: entry.UserID, AmountCents: entry.AmountCents}
+			if entry.Status == LedgerEntrySucceeded {
+				paidAt := entry.UpdatedAt
+				share.Paid = true
+				share.PaidAt = &paidAt
+			}
+			split.Shares = append(split.Shares, share)
+		}
+	} else {
+		shareCents := splitShareCents(gameRecord.SplitFeeCents, len(gameRecord.Roster))
+		for _, player := range gameRecord.Roster {
+			split.Shares = append(split.Shares, SplitShare{UserID: player.UserID, AmountCents: shareCents})
+		}
+	}
+	for i := range split.Shares {
+		split.CollectedCents += split.Shares[i].AmountCents
+		split.ShareCents = split.Shares[i].AmountCents
+		split.Shares[i].PlayerID = h.PlayerIDs.PlayerID(split.Shares[i].UserID)
+		if requester != gameRecord.Owner && requester != split.Shares[i].UserID {
+			split.Shares[i].UserID = ""
+		}
+	}
+	return split
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// SQLDialect identifies the database behind the SQL stores
+type SQLDialect string
+
+const (
+	SQLDialectSQLite   SQLDialect = "sqlite"
+	SQLDialectPostgres SQLDialect = "postgres"
+)
+
+// sqlQueryer is satisfied by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlScanner is satisfied by both *sql.Row and *sql.Rows
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// OpenSQLDatabase opens the database, migrating it to the latest schema. dialect doubles as the
+// database/sql driver name.
+func OpenSQLDatabase(ctx context.Context, dialect SQLDialect, dataSourceName string) (*sql.DB, error) {
+	db, err := sql.Open(string(dialect), dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", dialect, err)
+	}
+	if dialect == SQLDialectSQLite {
+		// SQLite allows a single writer, serializing through one connection avoids SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+		if _, err := db.ExecContext(ctx, `PRAGMA foreign_keys = ON`); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
+		}
+	}
+	if err := migrateSQL(ctx, db, sqlMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// withSQLTx runs fn in a transaction, committing if it returns nil
+func withSQLTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sqlMigration is one versioned schema change. Migrations are applied in order and each version
+// is recorded in schema_migrations so it only runs once. Statements must work on both SQLite and
+// Postgres; never edit a migration that has shipped, add a new one instead.
+type sqlMigration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+var sqlMigrations = []sqlMigration{
+	{
+		Version:     1,
+		Description: "create games and game players",
+		Statements: []string{
+			`CREATE TABLE games (
+				game_id          TEXT PRIMARY KEY,
+				owner            TEXT NOT NULL,
+				category         TEXT NOT NULL,
+				name             TEXT NOT NULL,
+				location         TEXT NOT NULL,
+				start_time       BIGINT NOT NULL,
+				duration_mins    INTEGER NOT NULL,
+				num_teams        INTEGER NOT NULL,
+				team_size        INTEGER NOT NULL,
+				signup_fee_cents INTEGER NOT NULL,
+				split_fee_cents  INTEGER NOT NULL
+			)`,
+			// equivalent of the DynamoDB SortedCategoryIndex
+			`CREATE INDEX games_category_start_time ON games (category, start_time)`,
+			`CREATE TABLE game_players (
+				game_id  TEXT NOT NULL REFERENCES games (game_id) ON DELETE CASCADE,
+				list     TEXT NOT NULL,
+				position INTEGER NOT NULL,
+				player   TEXT NOT NULL,
+				PRIMARY KEY (game_id, list, position)
+			)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "create verification codes",
+		Statements: []string{
+			`CREATE TABLE verification_codes (
+				email      TEXT NOT NULL,
+				purpose    TEXT NOT NULL,
+				code_hash  TEXT NOT NULL,
+				expires_at BIGINT NOT NULL,
+				attempts   INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (email, purpose)
+			)`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "add game version",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "add game status",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN status TEXT NOT NULL DEFAULT 'scheduled'`,
+			`ALTER TABLE games ADD COLUMN cancellation_reason TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "create game series",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN series_id TEXT NOT NULL DEFAULT ''`,
+			// equivalent of the DynamoDB SeriesIndex
+			`CREATE INDEX games_series_start_time ON games (series_id, start_time)`,
+			// skipped_dates and subscribers are JSON arrays, they're small and only ever read with the series
+			`CREATE TABLE game_series (
+				series_id            TEXT PRIMARY KEY,
+				owner                TEXT NOT NULL,
+				category             TEXT NOT NULL,
+				name                 TEXT NOT NULL,
+				location             TEXT NOT NULL,
+				start_time           BIGINT NOT NULL,
+				duration_mins        INTEGER NOT NULL,
+				num_teams            INTEGER NOT NULL,
+				team_size            INTEGER NOT NULL,
+				signup_fee_cents     INTEGER NOT NULL,
+				split_fee_cents      INTEGER NOT NULL,
+				time_zone            TEXT NOT NULL,
+				frequency            TEXT NOT NULL,
+				until_time           BIGINT NOT NULL,
+				occurrence_count     INTEGER NOT NULL,
+				skipped_dates        TEXT NOT NULL,
+				subscribers          TEXT NOT NULL,
+				materialized_through BIGINT NOT NULL,
+				version              INTEGER NOT NULL
+			)`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "add game coordinates",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN geo_lat DOUBLE PRECISION`,
+			`ALTER TABLE games ADD COLUMN geo_lng DOUBLE PRECISION`,
+			`ALTER TABLE games ADD COLUMN geo_address TEXT`,
+			`ALTER TABLE games ADD COLUMN geohash_cell TEXT NOT NULL DEFAULT ''`,
+			// equivalent of the DynamoDB GeohashIndex
+			`CREATE INDEX games_geohash_cell_start_time ON games (geohash_cell, start_time)`,
+			`ALTER TABLE game_series ADD COLUMN geo_lat DOUBLE PRECISION`,
+			`ALTER TABLE game_series ADD COLUMN geo_lng DOUBLE PRECISION`,
+			`ALTER TABLE game_series ADD COLUMN geo_address TEXT`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "index games by owner and player",
+		Statements: []string{
+			// equivalents of the DynamoDB OwnerIndex and game memberships table
+			`CREATE INDEX games_owner_start_time ON games (owner, start_time)`,
+			`CREATE INDEX game_players_player ON game_players (player, list)`,
+		},
+	},
+	{
+		Version:     8,
+		Description: "add roster entry details",
+		Statements: []string{
+			// existing players are confirmed with no join time, matching bare emails in DynamoDB
+			`ALTER TABLE game_players ADD COLUMN display_name TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE game_players ADD COLUMN joined_at BIGINT`,
+			`ALTER TABLE game_players ADD COLUMN status TEXT NOT NULL DEFAULT 'confirmed'`,
+			`ALTER TABLE game_players ADD COLUMN paid BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE game_players ADD COLUMN guest_of TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version:     9,
+		Description: "create user profiles",
+		Statements: []string{
+			`CREATE TABLE user_profiles (
+				user_id           TEXT PRIMARY KEY,
+				hide_from_rosters BOOLEAN NOT NULL DEFAULT FALSE
+			)`,
+		},
+	},
+	{
+		Version:     10,
+		Description: "add user details and preferences",
+		Statements: []string{
+			`ALTER TABLE user_profiles ADD COLUMN player_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE user_profiles ADD COLUMN first_name TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE user_profiles ADD COLUMN last_name TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE user_profiles ADD COLUMN phone_number TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE user_profiles ADD COLUMN favorite_categories TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE user_profiles ADD COLUMN home_lat DOUBLE PRECISION`,
+			`ALTER TABLE user_profiles ADD COLUMN home_lng DOUBLE PRECISION`,
+			`ALTER TABLE user_profiles ADD COLUMN home_address TEXT`,
+			`ALTER TABLE user_profiles ADD COLUMN skill_level TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE user_profiles ADD COLUMN muted_channels TEXT NOT NULL DEFAULT '[]'`,
+			`CREATE INDEX user_profiles_player_id ON user_profiles (player_id)`,
+		},
+	},
+	{
+		Version:     11,
+		Description: "add roster change history",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN roster_changes TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		Version:     12,
+		Description: "add waitlist promotion offers",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN promotion_offer_hours INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE game_series ADD COLUMN promotion_offer_hours INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE game_players ADD COLUMN offer_expires_at BIGINT`,
+			`CREATE INDEX game_players_offer_expiry ON game_players (status, offer_expires_at)`,
+		},
+	},
+	{
+		Version:     13,
+		Description: "add signup fee payments",
+		Statements: []string{
+			`ALTER TABLE game_players ADD COLUMN payment_due_at BIGINT`,
+			`CREATE INDEX game_players_payment_due ON game_players (status, payment_due_at)`,
+			`CREATE TABLE payment_ledger (
+				game_id           TEXT NOT NULL,
+				entry_id          TEXT NOT NULL,
+				user_id           TEXT NOT NULL,
+				kind              TEXT NOT NULL,
+				amount_cents      INTEGER NOT NULL,
+				status            TEXT NOT NULL,
+				payment_intent_id TEXT NOT NULL DEFAULT '',
+				failure_message   TEXT NOT NULL DEFAULT '',
+				created_at        BIGINT NOT NULL,
+				updated_at        BIGINT NOT NULL,
+				PRIMARY KEY (game_id, entry_id)
+			)`,
+		},
+	},
+	{
+		Version:     14,
+		Description: "add venue split lock",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN split_lock_hours INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE game_series ADD COLUMN split_lock_hours INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		Version:     15,
+		Description: "add refund policies",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN refund_full_hours INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE games ADD COLUMN refund_partial_percent INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE games ADD COLUMN refund_none_hours INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE games ADD COLUMN refund_when_spot_filled BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE game_series ADD COLUMN refund_full_hours INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE game_series ADD COLUMN refund_partial_percent INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE game_series ADD COLUMN refund_none_hours INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE game_series ADD COLUMN refund_when_spot_filled BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE payment_ledger ADD COLUMN reason TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version:     16,
+		Description: "add payment webhook events",
+		Statements: []string{
+			`ALTER TABLE game_players ADD COLUMN payment_status TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE payment_webhook_events (
+				event_id    TEXT PRIMARY KEY,
+				received_at BIGINT NOT NULL
+			)`,
+		},
+	},
+	{
+		Version:     17,
+		Description: "add price tiers and promo codes",
+		Statements: []string{
+			`ALTER TABLE games ADD COLUMN price_tiers TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE games ADD COLUMN promo_codes TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE games ADD COLUMN promo_redemptions TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE game_series ADD COLUMN price_tiers TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE game_series ADD COLUMN promo_codes TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE game_players ADD COLUMN price_cents INTEGER`,
+			`ALTER TABLE game_players ADD COLUMN promo_code TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version:     18,
+		Description: "index ledger entries by user",
+		Statements: []string{
+			`CREATE INDEX payment_ledger_user_id ON payment_ledger (user_id, created_at)`,
+		},
+	},
+	{
+		Version:     19,
+		Description: "count verification code sends",
+		Statements: []string{
+			`ALTER TABLE verification_codes ADD COLUMN sends INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		Version:     20,
+		Description: "record when users signed out",
+		Statements: []string{
+			`ALTER TABLE user_profiles ADD COLUMN signed_out_at BIGINT NOT NULL DEFAULT 0`,
+		},
+	},
+}
+
+// migrateSQL applies any migrations newer than the database's current version
+func migrateSQL(ctx context.Context, db *sql.DB, migrations []sqlMigration) error {
+	logger := log.Ctx(ctx).With().Str("operation", "migrateSQL").Logger()
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var currentVersion int
+	err = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&currentVersion)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	for _, migration := range migrations {
+		if migration.Version <= currentVersion {
+			continue
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", migration.Version, err)
+		}
+		for _, statement := range migration.Statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("failed to apply migration %d (%s): %w", migration.Version, migration.Description, err)
+			}
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, migration.Version, time.Now().Unix())
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", migration.Version, err)
+		}
+		logger.Info().Int("version", migration.Version).Str("description", migration.Description).Msg("applied migration")
+	}
+	return nil
+}
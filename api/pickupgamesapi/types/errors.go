@@ -2,11 +2,15 @@ package types
 
 import "fmt"
 
+// APIError is an error the handler can turn into an HTTP response. ErrorCode is the HTTP status,
+// ErrorType a stable machine-readable code for clients to switch on and ErrorMessage the
+// human-readable explanation.
 type APIError interface {
 	error
 
 	ErrorCode() int
 	ErrorMessage() string
+	ErrorType() string
 }
 
 type InvalidRequestError struct {
@@ -32,3 +36,209 @@ func (e *InvalidRequestError) ErrorMessage() string {
 	}
 	return e.Message
 }
+
+func (e *InvalidRequestError) ErrorType() string {
+	return "invalid_request"
+}
+
+// ValidationError is returned when a request is well formed but its values are not acceptable
+type ValidationError struct {
+	Type    string
+	Message string
+}
+
+func NewValidationError(errorType string, message string) *ValidationError {
+	return &ValidationError{Type: errorType, Message: message}
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func (e *ValidationError) ErrorCode() int {
+	return 400
+}
+
+func (e *ValidationError) ErrorMessage() string {
+	return e.Message
+}
+
+func (e *ValidationError) ErrorType() string {
+	if e.Type == "" {
+		return "validation_failed"
+	}
+	return e.Type
+}
+
+// UnauthorizedError is returned when the caller's credentials are missing, wrong or revoked
+type UnauthorizedError struct {
+	Type    string
+	Message string
+}
+
+func NewUnauthorizedError(errorType string, message string) *UnauthorizedError {
+	return &UnauthorizedError{Type: errorType, Message: message}
+}
+
+func (e *UnauthorizedError) Error() string {
+	return e.Message
+}
+
+func (e *UnauthorizedError) ErrorCode() int {
+	return 401
+}
+
+func (e *UnauthorizedError) ErrorMessage() string {
+	return e.Message
+}
+
+func (e *UnauthorizedError) ErrorType() string {
+	if e.Type == "" {
+		return "unauthorized"
+	}
+	return e.Type
+}
+
+// PaymentRequiredError is returned when the action needs a payment that hasn't been made or was declined
+type PaymentRequiredError struct {
+	Type    string
+	Message string
+}
+
+func NewPaymentRequiredError(errorType string, message string) *PaymentRequiredError {
+	return &PaymentRequiredError{Type: errorType, Message: message}
+}
+
+func (e *PaymentRequiredError) Error() string {
+	return e.Message
+}
+
+func (e *PaymentRequiredError) ErrorCode() int {
+	return 402
+}
+
+func (e *PaymentRequiredError) ErrorMessage() string {
+	return e.Message
+}
+
+func (e *PaymentRequiredError) ErrorType() string {
+	if e.Type == "" {
+		return "payment_required"
+	}
+	return e.Type
+}
+
+// ForbiddenError is returned when the caller is known but may not perform the action
+type ForbiddenError struct {
+	Type    string
+	Message string
+}
+
+func NewForbiddenError(errorType string, message string) *ForbiddenError {
+	return &ForbiddenError{Type: errorType, Message: message}
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Message
+}
+
+func (e *ForbiddenError) ErrorCode() int {
+	return 403
+}
+
+func (e *ForbiddenError) ErrorMessage() string {
+	return e.Message
+}
+
+func (e *ForbiddenError) ErrorType() string {
+	if e.Type == "" {
+		return "forbidden"
+	}
+	return e.Type
+}
+
+// NotFoundError is returned when the requested resource does not exist
+type NotFoundError struct {
+	Type    string
+	Message string
+}
+
+func NewNotFoundError(errorType string, message string) *NotFoundError {
+	return &NotFoundError{Type: errorType, Message: message}
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+func (e *NotFoundError) ErrorCode() int {
+	return 404
+}
+
+func (e *NotFoundError) ErrorMessage() string {
+	return e.Message
+}
+
+func (e *NotFoundError) ErrorType() string {
+	if e.Type == "" {
+		return "not_found"
+	}
+	return e.Type
+}
+
+// ConflictError is returned when the request conflicts with the resource's current state, such
+// as a concurrent update winning a conditional write
+type ConflictError struct {
+	Type    string
+	Message string
+}
+
+func NewConflictError(errorType string, message string) *ConflictError {
+	return &ConflictError{Type: errorType, Message: message}
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+func (e *ConflictError) ErrorCode() int {
+	return 409
+}
+
+func (e *ConflictError) ErrorMessage() string {
+	return e.Message
+}
+
+func (e *ConflictError) ErrorType() string {
+	if e.Type == "" {
+		return "conflict"
+	}
+	return e.Type
+}
+
+// UpstreamUnavailableError wraps a failure of a service the API depends on that is worth retrying,
+// such as throttling or a timeout
+type UpstreamUnavailableError struct {
+	Service string
+	Err     error
+}
+
+func (e *UpstreamUnavailableError) Error() string {
+	return fmt.Sprintf("%s is unavailable: %s", e.Service, e.Err.Error())
+}
+
+func (e *UpstreamUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UpstreamUnavailableError) ErrorCode() int {
+	return 503
+}
+
+func (e *UpstreamUnavailableError) ErrorMessage() string {
+	return "Service temporarily unavailable, please try again"
+}
+
+func (e *UpstreamUnavailableError) ErrorType() string {
+	return "upstream_unavailable"
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pickupgamesapi/types"
+	"regexp"
+	"sync"
+)
+
+var errUserProfileNotFound = errors.New("user profile not found")
+
+// phoneNumberPattern matches E.164 numbers, the format Cognito requires
+var phoneNumberPattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// SkillLevel is how players rate themselves, so organizers can balance teams
+type SkillLevel string
+
+const (
+	SkillLevelBeginner     SkillLevel = "beginner"
+	SkillLevelIntermediate SkillLevel = "intermediate"
+	SkillLevelAdvanced     SkillLevel = "advanced"
+)
+
+func (l SkillLevel) Valid() bool {
+	switch l {
+	case "", SkillLevelBeginner, SkillLevelIntermediate, SkillLevelAdvanced:
+		return true
+	}
+	return false
+}
+
+const maxFavoriteCategories = 10
+
+// UserProfileRecord is a user's row in the users table. It's written on sign up; users who signed
+// up before it existed get one the first time they read or change their profile.
+type UserProfileRecord struct {
+	UserID string `dynamodbav:"UserID"` // the user's email
+	// PlayerID is stored so GET /users/{id} can find the user, see PlayerIDs
+	PlayerID           string       `dynamodbav:"PlayerID"`
+	FirstName          string       `dynamodbav:"FirstName"`
+	LastName           string       `dynamodbav:"LastName"`
+	PhoneNumber        string       `dynamodbav:"PhoneNumber"`
+	HideFromRosters    bool         `dynamodbav:"HideFromRosters"`
+	FavoriteCategories []string     `dynamodbav:"FavoriteCategories"`
+	HomeLocation       *GeoLocation `dynamodbav:"HomeLocation,omitempty"`
+	SkillLevel         SkillLevel   `dynamodbav:"SkillLevel"`
+	// MutedChannels are the notification channels the user opted out of, so every channel is on
+	// for users who never changed their settings
+	MutedChannels []NotificationChannel `dynamodbav:"MutedChannels"`
+	// SignedOutAt is when the user last signed out everywhere, as a Unix timestamp. Tokens issued
+	// before it are refused, see Handler.checkTokenNotRevoked.
+	SignedOutAt int64 `dynamodbav:"SignedOutAt"`
+}
+
+func (r UserProfileRecord) displayName() string {
+	return displayName(r.FirstName, r.LastName)
+}
+
+func (r UserProfileRecord) channelMuted(channel NotificationChannel) bool {
+	for _, muted := range r.MutedChannels {
+		if muted == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// NotificationSettings says which channels a user accepts notifications on
+type NotificationSettings struct {
+	Email bool `json:"email"`
+	SMS   bool `json:"sms"`
+}
+
+// UserProfile is the requester's own profile as returned by the API
+type UserProfile struct {
+	UserID      string `json:"userId"`
+	PlayerID    string `json:"playerId"`
+	FirstName   string `json:"firstName"`
+	LastName    string `json:"lastName"`
+	PhoneNumber string `json:"phoneNumber"`
+	// HideFromRosters leaves the user anonymous on rosters shown to anyone but the game's owner
+	HideFromRosters    bool                 `json:"hideFromRosters"`
+	FavoriteCategories []string             `json:"favoriteCategories"`
+	HomeLocation       *GeoLocation         `json:"homeLocation,omitempty"`
+	SkillLevel         SkillLevel           `json:"skillLevel,omitempty"`
+	Notifications      NotificationSettings `json:"notifications"`
+}
+
+// PublicUserProfile is the part of a profile anyone can see with the user's player ID
+type PublicUserProfile struct {
+	PlayerID           string     `json:"playerId"`
+	DisplayName        string     `json:"displayName"`
+	FavoriteCategories []string   `json:"favoriteCategories"`
+	SkillLevel         SkillLevel `json:"skillLevel,omitempty"`
+}
+
+// UpdateUserProfileRequest changes the fields that are set. An empty homeLocation object clears
+// the home location.
+type UpdateUserProfileRequest struct {
+	FirstName          *string               `json:"firstName"`
+	LastName           *string               `json:"lastName"`
+	PhoneNumber        *string               `json:"phoneNumber"`
+	HideFromRosters    *bool                 `json:"hideFromRosters"`
+	FavoriteCategories *[]string             `json:"favoriteCategories"`
+	HomeLocation       *GeoLocation          `json:"homeLocation"`
+	SkillLevel         *SkillLevel           `json:"skillLevel"`
+	Notifications      *NotificationSettings `json:"notifications"`
+}
+
+func (r *UpdateUserProfileRequest) ValidateRequest() error {
+	if r.FirstName != nil && *r.FirstName == "" {
+		return &types.InvalidRequestError{Message: "firstName cannot be empty"}
+	}
+	if r.LastName != nil && *r.LastName == "" {
+		return &types.InvalidRequestError{Message: "lastName cannot be empty"}
+	}
+	if r.PhoneNumber != nil && !phoneNumberPattern.MatchString(*r.PhoneNumber) {
+		return types.NewValidationError("invalid_phone_number", "phoneNumber must be in E.164 format, such as +15555550100")
+	}
+	if r.FavoriteCategories != nil {
+		if len(*r.FavoriteCategories) > maxFavoriteCategories {
+			return types.NewValidationError("", fmt.Sprintf("favoriteCategories can have at most %d entries", maxFavoriteCategories))
+		}
+		for _, category := range *r.FavoriteCategories {
+			if category == "" {
+				return types.NewValidationError("", "favoriteCategories cannot contain empty categories")
+			}
+		}
+	}
+	if r.HomeLocation != nil && *r.HomeLocation != (GeoLocation{}) {
+		if err := r.HomeLocation.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.SkillLevel != nil && !r.SkillLevel.Valid() {
+		return types.NewValidationError("invalid_skill_level", "skillLevel must be beginner, intermediate or advanced")
+	}
+	return nil
+}
+
+// UserProfileStore persists user profiles, keyed on the user's email
+type UserProfileStore interface {
+	// GetUserProfile returns the user's profile or errUserProfileNotFound
+	GetUserProfile(ctx context.Context, userID string) (UserProfileRecord, error)
+	// GetUserProfileByPlayerID returns the profile with the player ID or errUserProfileNotFound
+	GetUserProfileByPlayerID(ctx context.Context, playerID string) (UserProfileRecord, error)
+	// GetUserProfiles returns the profiles that exist for userIDs, keyed on user ID
+	GetUserProfiles(ctx context.Context, userIDs []string) (map[string]UserProfileRecord, error)
+	// PutUserProfile saves the profile, replacing any existing one
+	PutUserProfile(ctx context.Context, profile UserProfileRecord) error
+	// DeleteUserProfile removes the user's profile, if they have one
+	DeleteUserProfile(ctx context.Context, userID string) error
+}
+
+// MemoryUserProfileStore is an in-process UserProfileStore
+type MemoryUserProfileStore struct {
+	mu       sync.RWMutex
+	profiles map[string]UserProfileRecord
+}
+
+func NewMemoryUserProfileStore() *MemoryUserProfileStore {
+	return &MemoryUserProfileStore{
+		profiles: map[string]UserProfileRecord{},
+	}
+}
+
+// copyUserProfileRecord returns a copy of profile that shares nothing with the original
+func copyUserProfileRecord(profile UserProfileRecord) UserProfileRecord {
+	profile.FavoriteCategories = append([]string{}, profile.FavoriteCategories...)
+	profile.MutedChannels = append([]NotificationChannel{}, profile.MutedChannels...)
+	if profile.HomeLocation != nil {
+		homeLocation := *profile.HomeLocation
+		profile.HomeLocation = &homeLocation
+	}
+	return profile
+}
+
+func (s *MemoryUserProfileStore) GetUserProfile(ctx context.Context, userID string) (UserProfileRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	profile, ok := s.profiles[userID]
+	if !ok {
+		return UserProfileRecord{}, errUserProfileNotFound
+	}
+	return copyUserProfileRecord(profile), nil
+}
+
+func (s *MemoryUserProfileStore) GetUserProfileByPlayerID(ctx context.Context, playerID string) (UserProfileRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, profile := range s.profiles {
+		if profile.PlayerID == playerID {
+			return copyUserProfileRecord(profile), nil
+		}
+	}
+	return UserProfileRecord{}, errUserProfileNotFound
+}
+
+func (s *MemoryUserProfileStore) GetUserProfiles(ctx context.Context, userIDs []string) (map[string]UserProfileRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	profiles := map[string]UserProfileRecord{}
+	for _, userID := range userIDs {
+		if profile, ok := s.profiles[userID]; ok {
+			profiles[userID] = copyUserProfileRecord(profile)
+		}
+	}
+	return profiles, nil
+}
+
+func (s *MemoryUserProfileStore) PutUserProfile(ctx context.Context, profile UserProfileRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles[profile.UserID] = copyUserProfileRecord(profile)
+	return nil
+}
+
+func (s *MemoryUserProfileStore) DeleteUserProfile(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.profiles, userID)
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+// GetUserProfile returns the requester's profile
+func (h *Handler) GetUserProfile(ctx context.Context, requester string) (UserProfile, error) {
+	log := log.Ctx(ctx).With().Str("operation", "GetUserProfile").Logger()
+	log.Info().Msg("getting user profile")
+	profileRecord, err := h.getUserProfileRecord(ctx, requester)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	return userProfileFromRecord(profileRecord), nil
+}
+
+func (h *Handler) UpdateUserProfile(ctx context.Context, requester string, updateRequest UpdateUserProfileRequest) (UserProfile, error) {
+	log := log.Ctx(ctx).With().Str("operation", "UpdateUserProfile").Logger()
+	log.Info().Interface("updateRequest", updateRequest).Msg("updating user profile")
+	profileRecord, err := h.getUserProfileRecord(ctx, requester)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	// names and the phone number also live with the identity provider, which puts them in ID
+	// tokens and sends verification codes to the phone
+	identityChanged := false
+	for _, field := range []struct {
+		value  *string
+		stored *string
+	}{
+		{updateRequest.FirstName, &profileRecord.FirstName},
+		{updateRequest.LastName, &profileRecord.LastName},
+		{updateRequest.PhoneNumber, &profileRecord.PhoneNumber},
+	} {
+		if field.value != nil && *field.value != *field.stored {
+			*field.stored = *field.value
+			identityChanged = true
+		}
+	}
+	if updateRequest.HideFromRosters != nil {
+		profileRecord.HideFromRosters = *updateRequest.HideFromRosters
+	}
+	if updateRequest.FavoriteCategories != nil {
+		profileRecord.FavoriteCategories = *updateRequest.FavoriteCategories
+	}
+	if updateRequest.HomeLocation != nil {
+		profileRecord.HomeLocation = updateRequest.HomeLocation
+		if *updateRequest.HomeLocation == (GeoLocation{}) {
+			profileRecord.HomeLocation = nil
+		}
+	}
+	if updateRequest.SkillLevel != nil {
+		profileRecord.SkillLevel = *updateRequest.SkillLevel
+	}
+	if updateRequest.Notifications != nil {
+		profileRecord.MutedChannels = []NotificationChannel{}
+		if !updateRequest.Notifications.Email {
+			profileRecord.MutedChannels = append(profileRecord.MutedChannels, NotificationChannelEmail)
+		}
+		if !updateRequest.Notifications.SMS {
+			profileRecord.MutedChannels = append(profileRecord.MutedChannels, NotificationChannelSMS)
+		}
+	}
+	if identityChanged {
+		err := h.IdentityProvider.UpdateUser(ctx, requester, profileRecord.FirstName, profileRecord.LastName, profileRecord.PhoneNumber)
+		if err != nil {
+			return UserProfile{}, err
+		}
+		log.Debug().Msg("updated user with identity provider")
+	}
+	if err := h.UserProfiles.PutUserProfile(ctx, profileRecord); err != nil {
+		return UserProfile{}, err
+	}
+	return userProfileFromRecord(profileRecord), nil
+}
+
+// GetPublicUserProfile looks a user up by player ID. Users who hide from rosters can only find
+// themselves, anyone else looking is told they don't exist.
+func (h *Handler) GetPublicUserProfile(ctx context.Context, playerID string, requester string) (PublicUserProfile, error) {
+	log := log.Ctx(ctx).With().Str("operation", "GetPublicUserProfile").Str("playerID", playerID).Logger()
+	log.Info().Msg("getting public user profile")
+	profileRecord, err := h.UserProfiles.GetUserProfileByPlayerID(ctx, playerID)
+	if errors.Is(err, errUserProfileNotFound) {
+		return PublicUserProfile{}, errUserNotFound
+	}
+	if err != nil {
+		return PublicUserProfile{}, err
+	}
+	if profileRecord.HideFromRosters && profileRecord.UserID != requester {
+		return PublicUserProfile{}, errUserNotFound
+	}
+	return PublicUserProfile{
+		PlayerID:           profileRecord.PlayerID,
+		DisplayName:        profileRecord.displayName(),
+		FavoriteCategories: append([]string{}, profileRecord.FavoriteCategories...),
+		SkillLevel:         profileRecord.SkillLevel,
+	}, nil
+}
+
+// newUserProfileRecord is the profile of a user who has never changed their settings
+func (h *Handler) newUserProfileRecord(user User) UserProfileRecord {
+	return UserProfileRecord{
+		UserID:      user.Email,
+		PlayerID:    h.PlayerIDs.PlayerID(user.Email),
+		FirstName:   user.FirstName,
+		LastName:    user.LastName,
+		PhoneNumber: user.PhoneNumber,
+	}
+}
+
+// getUserProfileRecord returns the user's stored profile. Users who signed up before profiles
+// held their details get them copied from the identity provider, and saved so that GET
+// /users/{id} can find them by player ID.
+func (h *Handler) getUserProfileRecord(ctx context.Context, userID string) (UserProfileRecord, error) {
+	profileRecord, err := h.UserProfiles.GetUserProfile(ctx, userID)
+	if err != nil && !errors.Is(err, errUserProfileNotFound) {
+		return UserProfileRecord{}, err
+	}
+	if err == nil && profileRecord.PlayerID != "" {
+		return profileRecord, nil
+	}
+	user, err := h.IdentityProvider.GetUser(ctx, userID)
+	if err != nil {
+		return UserProfileRecord{}, err
+	}
+	backfilled := h.newUserProfileRecord(user)
+	backfilled.UserID = userID
+	backfilled.HideFromRosters = profileRecord.HideFromRosters
+	backfilled.SignedOutAt = profileRecord.SignedOutAt
+	if err := h.UserProfiles.PutUserProfile(ctx, backfilled); err != nil {
+		return UserProfileRecord{}, err
+	}
+	log.Ctx(ctx).Info().Msg("backfilled user profile from identity provider")
+	return backfilled, nil
+}
+
+func userProfileFromRecord(profileRecord UserProfileRecord) UserProfile {
+	return UserProfile{
+		UserID:             profileRecord.UserID,
+		PlayerID:           profileRecord.PlayerID,
+		FirstName:          profileRecord.FirstName,
+		LastName:           profileRecord.LastName,
+		PhoneNumber:        profileRecord.PhoneNumber,
+		HideFromRosters:    profileRecord.HideFromRosters,
+		FavoriteCategories: append([]string{}, profileRecord.FavoriteCategories...),
+		HomeLocation:       profileRecord.HomeLocation,
+		SkillLevel:         profileRecord.SkillLevel,
+		Notifications: NotificationSettings{
+			Email: !profileRecord.channelMuted(NotificationChannelEmail),
+			SMS:   !profileRecord.channelMuted(NotificationChannelSMS),
+		},
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchGetKeys is the most keys DynamoDB accepts in one BatchGetItem request
+const maxBatchGetKeys = 100
+
+// DynamoDBUserProfileStore is a UserProfileStore backed by a DynamoDB table keyed on UserID
+type DynamoDBUserProfileStore struct {
+	Client    *dynamodb.Client
+	TableName string
+}
+
+func NewDynamoDBUserProfileStore(client *dynamodb.Client, tableName string) *DynamoDBUserProfileStore {
+	return &DynamoDBUserProfileStore{
+		Client:    client,
+		TableName: tableName,
+	}
+}
+
+func (s *DynamoDBUserProfileStore) GetUserProfile(ctx context.Context, userID string) (UserProfileRecord, error) {
+	getItemOutput, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &s.TableName,
+		Key:       map[string]ddbtypes.AttributeValue{"UserID": &ddbtypes.AttributeValueMemberS{Value: userID}},
+	})
+	if err != nil {
+		return UserProfileRecord{}, fmt.Errorf("failed to get user profile from DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	if getItemOutput.Item == nil {
+		return UserProfileRecord{}, errUserProfileNotFound
+	}
+	var profile UserProfileRecord
+	if err := attributevalue.UnmarshalMap(getItemOutput.Item, &profile); err != nil {
+		return UserProfileRecord{}, fmt.Errorf("failed to unmarshal user profile: %w", err)
+	}
+	return profile, nil
+}
+
+// GetUserProfileByPlayerID queries PlayerIDIndex, a GSI on PlayerID
+func (s *DynamoDBUserProfileStore) GetUserProfileByPlayerID(ctx context.Context, playerID string) (UserProfileRecord, error) {
+	queryOutput, err := s.Client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              &s.TableName,
+		IndexName:              aws.String("PlayerIDIndex"),
+		KeyConditionExpression: aws.String("PlayerID = :playerID"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":playerID": &ddbtypes.AttributeValueMemberS{Value: playerID},
+		},
+		Limit: aws.Int32(1),
+	})
+	if err != nil {
+		return UserProfileRecord{}, fmt.Errorf("failed to get user profile from DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	if len(queryOutput.Items) == 0 {
+		return UserProfileRecord{}, errUserProfileNotFound
+	}
+	var profile UserProfileRecord
+	if err := attributevalue.UnmarshalMap(queryOutput.Items[0], &profile); err != nil {
+		return UserProfileRecord{}, fmt.Errorf("failed to unmarshal user profile: %w", err)
+	}
+	return profile, nil
+}
+
+func (s *DynamoDBUserProfileStore) GetUserProfiles(ctx context.Context, userIDs []string) (map[string]UserProfileRecord, error) {
+	profiles := map[string]UserProfileRecord{}
+	for start := 0; start < len(userIDs); start += maxBatchGetKeys {
+		end := start + maxBatchGetKeys
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+		keys := make([]map[string]ddbtypes.AttributeValue, 0, end-start)
+		for _, userID := range userIDs[start:end] {
+			keys = append(keys, map[string]ddbtypes.AttributeValue{"UserID": &ddbtypes.AttributeValueMemberS{Value: userID}})
+		}
+		requestItems := map[string]ddbtypes.KeysAndAttributes{s.TableName: {Keys: keys}}
+		for len(requestItems) > 0 {
+			batchGetItemOutput, err := s.Client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: requestItems})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get user profiles from DynamoDB: %w", upstreamError("DynamoDB", err))
+			}
+			for _, item := range batchGetItemOutput.Responses[s.TableName] {
+				var profile UserProfileRecord
+				if err := attributevalue.UnmarshalMap(item, &profile); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal user profile: %w", err)
+				}
+				profiles[profile.UserID] = profile
+			}
+			requestItems = batchGetItemOutput.UnprocessedKeys
+		}
+	}
+	return profiles, nil
+}
+
+func (s *DynamoDBUserProfileStore) PutUserProfile(ctx context.Context, profile UserProfileRecord) error {
+	item, err := attributevalue.MarshalMap(profile)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user profile: %w", err)
+	}
+	_, err = s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.TableName,
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put user profile to DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
+
+func (s *DynamoDBUserProfileStore) DeleteUserProfile(ctx context.Context, userID string) error {
+	_, err := s.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &s.TableName,
+		Key:       map[string]ddbtypes.AttributeValue{"UserID": &ddbtypes.AttributeValueMemberS{Value: userID}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user profile from DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQLUserProfileStore is a UserProfileStore backed by SQLite or Postgres
+type SQLUserProfileStore struct {
+	db *sql.DB
+}
+
+func NewSQLUserProfileStore(db *sql.DB) *SQLUserProfileStore {
+	return &SQLUserProfileStore{
+		db: db,
+	}
+}
+
+const sqlUserProfileColumns = `user_id, player_id, first_name, last_name, phone_number, hide_from_rosters,
+	favorite_categories, home_lat, home_lng, home_address, skill_level, muted_channels, signed_out_at`
+
+func scanUserProfile(row sqlScanner) (UserProfileRecord, error) {
+	var profile UserProfileRecord
+	var favoriteCategories, mutedChannels string
+	var homeLocation sqlGeoLocation
+	err := row.Scan(&profile.UserID, &profile.PlayerID, &profile.FirstName, &profile.LastName, &profile.PhoneNumber,
+		&profile.HideFromRosters, &favoriteCategories, &homeLocation.Lat, &homeLocation.Lng, &homeLocation.Address,
+		&profile.SkillLevel, &mutedChannels, &profile.SignedOutAt)
+	if err != nil {
+		return UserProfileRecord{}, err
+	}
+	if err := json.Unmarshal([]byte(favoriteCategories), &profile.FavoriteCategories); err != nil {
+		return UserProfileRecord{}, fmt.Errorf("failed to unmarshal favorite categories: %w", err)
+	}
+	if err := json.Unmarshal([]byte(mutedChannels), &profile.MutedChannels); err != nil {
+		return UserProfileRecord{}, fmt.Errorf("failed to unmarshal muted channels: %w", err)
+	}
+	profile.HomeLocation = homeLocation.GeoLocation()
+	return profile, nil
+}
+
+func (s *SQLUserProfileStore) getUserProfile(ctx context.Context, column string, value string) (UserProfileRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+sqlUserProfileColumns+` FROM user_profiles WHERE `+column+` = $1`, value)
+	profile, err := scanUserProfile(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserProfileRecord{}, errUserProfileNotFound
+	}
+	if err != nil {
+		return UserProfileRecord{}, fmt.Errorf("failed to get user profile: %w", err)
+	}
+	return profile, nil
+}
+
+func (s *SQLUserProfileStore) GetUserProfile(ctx context.Context, userID string) (UserProfileRecord, error) {
+	return s.getUserProfile(ctx, "user_id", userID)
+}
+
+func (s *SQLUserProfileStore) GetUserProfileByPlayerID(ctx context.Context, playerID string) (UserProfileRecord, error) {
+	return s.getUserProfile(ctx, "player_id", playerID)
+}
+
+func (s *SQLUserProfileStore) GetUserProfiles(ctx context.Context, userIDs []string) (map[string]UserProfileRecord, error) {
+	profiles := map[string]UserProfileRecord{}
+	if len(userIDs) == 0 {
+		return profiles, nil
+	}
+	args := make([]interface{}, len(userIDs))
+	placeholders := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		args[i] = userID
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqlUserProfileColumns+` FROM user_profiles
+		WHERE user_id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user profiles: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		profile, err := scanUserProfile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user profile: %w", err)
+		}
+		profiles[profile.UserID] = profile
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get user profiles: %w", err)
+	}
+	return profiles, nil
+}
+
+func (s *SQLUserProfileStore) PutUserProfile(ctx context.Context, profile UserProfileRecord) error {
+	favoriteCategories, err := json.Marshal(append([]string{}, profile.FavoriteCategories...))
+	if err != nil {
+		return fmt.Errorf("failed to marshal favorite categories: %w", err)
+	}
+	mutedChannels, err := json.Marshal(append([]NotificationChannel{}, profile.MutedChannels...))
+	if err != nil {
+		return fmt.Errorf("failed to marshal muted channels: %w", err)
+	}
+	homeLat, homeLng, homeAddress := geoLocationColumns(profile.HomeLocation)
+	_, err = s.db.ExecContext(ctx, `INSERT INTO user_profiles (`+sqlUserProfileColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (user_id) DO UPDATE SET player_id = excluded.player_id, first_name = excluded.first_name,
+			last_name = excluded.last_name, phone_number = excluded.phone_number,
+			hide_from_rosters = excluded.hide_from_rosters, favorite_categories = excluded.favorite_categories,
+			home_lat = excluded.home_lat, home_lng = excluded.home_lng, home_address = excluded.home_address,
+			skill_level = excluded.skill_level, muted_channels = excluded.muted_channels,
+			signed_out_at = excluded.signed_out_at`,
+		profile.UserID, profile.PlayerID, profile.FirstName, profile.LastName, profile.PhoneNumber,
+		profile.HideFromRosters, string(favoriteCategories), homeLat, homeLng, homeAddress, profile.SkillLevel,
+		string(mutedChannels), profile.SignedOutAt)
+	if err != nil {
+		return fmt.Errorf("failed to save user profile: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLUserProfileStore) DeleteUserProfile(ctx context.Context, userID string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM user_profiles WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete user profile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func (h *testHandler) getProfile(t *testing.T, requester string) UserProfile {
+	t.Helper()
+	var profile UserProfile
+	h.mustCall(t, testRequest{RouteKey: "GET /me", Requester: requester}, &profile)
+	return profile
+}
+
+func (h *testHandler) updateProfile(t *testing.T, requester string, body map[string]interface{}) (UserProfile, events.APIGatewayV2HTTPResponse) {
+	t.Helper()
+	var profile UserProfile
+	response := h.call(t, testRequest{RouteKey: "PATCH /me", Requester: requester, Body: body}, &profile)
+	return profile, response
+}
+
+func TestUpdateUserProfile(t *testing.T) {
+	for name, newHandler := range map[string]func(t *testing.T) *testHandler{
+		"memory": newTestHandler,
+		"sql":    newSQLTestHandler,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newHandler(t)
+			// users created straight with the identity provider have no stored profile yet
+			h.createUser(t, "a@example.com")
+			profile := h.getProfile(t, "a@example.com")
+			if profile.FirstName != "Test" || profile.PhoneNumber != "+15555550100" || profile.PlayerID != h.PlayerIDs.PlayerID("a@example.com") {
+				t.Errorf("expected the profile filled in from the identity provider, got %+v", profile)
+			}
+			if !profile.Notifications.Email || !profile.Notifications.SMS || len(profile.FavoriteCategories) != 0 {
+				t.Errorf("expected the default settings, got %+v", profile)
+			}
+
+			if err := h.identity.MarkVerified(context.Background(), "a@example.com", VerificationPurposePhoneNumber); err != nil {
+				t.Fatalf("failed to verify phone number: %v", err)
+			}
+			updated, response := h.updateProfile(t, "a@example.com", map[string]interface{}{
+				"firstName":          "Alex",
+				"phoneNumber":        "+15555550199",
+				"favoriteCategories": []string{"soccer", "ultimate"},
+				"homeLocation":       GeoLocation{Lat: 52.52, Lng: 13.405, Address: "Berlin"},
+				"skillLevel":         SkillLevelAdvanced,
+				"notifications":      NotificationSettings{Email: true},
+			})
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("updating the profile returned %d: %s", response.StatusCode, response.Body)
+			}
+			if updated.FirstName != "Alex" || updated.PhoneNumber != "+15555550199" {
+				t.Errorf("expected the updated profile returned, got %+v", updated)
+			}
+			if got := h.getProfile(t, "a@example.com"); got.FirstName != "Alex" || got.LastName != "Player" || got.SkillLevel != SkillLevelAdvanced ||
+				!equalStrings(got.FavoriteCategories, []string{"soccer", "ultimate"}) || got.HomeLocation == nil || got.HomeLocation.Address != "Berlin" ||
+				!got.Notifications.Email || got.Notifications.SMS {
+				t.Errorf("expected the changes stored, got %+v", got)
+			}
+			user, err := h.identity.GetUser(context.Background(), "a@example.com")
+			if err != nil {
+				t.Fatalf("failed to get user: %v", err)
+			}
+			if user.FirstName != "Alex" || user.PhoneNumber != "+15555550199" || user.PhoneNumberVerified {
+				t.Errorf("expected the identity provider updated and the new number unverified, got %+v", user)
+			}
+
+			if updated, _ := h.updateProfile(t, "a@example.com", map[string]interface{}{"homeLocation": map[string]interface{}{}}); updated.HomeLocation != nil || updated.FirstName != "Alex" {
+				t.Errorf("expected an empty home location to clear only it, got %+v", updated)
+			}
+			for name, body := range map[string]map[string]interface{}{
+				"empty first name":   {"firstName": ""},
+				"local phone":        {"phoneNumber": "555-0100"},
+				"unknown skill":      {"skillLevel": "pro"},
+				"empty category":     {"favoriteCategories": []string{""}},
+				"off the map":        {"homeLocation": GeoLocation{Lat: 91, Lng: 0}},
+				"too many favorites": {"favoriteCategories": make([]string, maxFavoriteCategories+1)},
+			} {
+				if _, response := h.updateProfile(t, "a@example.com", body); response.StatusCode != http.StatusBadRequest {
+					t.Errorf("%s: expected the update refused, got %d: %s", name, response.StatusCode, response.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestGetPublicUserProfile(t *testing.T) {
+	h := newTestHandler(t)
+	h.createUser(t, "a@example.com")
+	h.updateProfile(t, "a@example.com", map[string]interface{}{"favoriteCategories": []string{"soccer"}, "skillLevel": SkillLevelBeginner})
+	getPublic := func(requester string, playerID string) (PublicUserProfile, events.APIGatewayV2HTTPResponse) {
+		var profile PublicUserProfile
+		response := h.call(t, testRequest{
+			RouteKey:       "GET /users/{playerID}",
+			Requester:      requester,
+			PathParameters: map[string]string{"playerID": playerID},
+		}, &profile)
+		return profile, response
+	}
+	playerID := h.PlayerIDs.PlayerID("a@example.com")
+
+	for _, requester := range []string{"b@example.com", ""} {
+		profile, response := getPublic(requester, playerID)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("getting the profile as %q returned %d: %s", requester, response.StatusCode, response.Body)
+		}
+		if profile.DisplayName != "Test Player" || profile.SkillLevel != SkillLevelBeginner || !equalStrings(profile.FavoriteCategories, []string{"soccer"}) {
+			t.Errorf("got %+v", profile)
+		}
+		if strings.Contains(response.Body, "a@example.com") || strings.Contains(response.Body, "+15555550100") {
+			t.Errorf("expected no contact details in the public profile, got %s", response.Body)
+		}
+	}
+	if _, response := getPublic("b@example.com", "missing"); response.StatusCode != http.StatusNotFound || errorCode(t, response) != "user_not_found" {
+		t.Errorf("expected an unknown player ID not found, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	h.updateProfile(t, "a@example.com", map[string]interface{}{"hideFromRosters": true})
+	if _, response := getPublic("b@example.com", playerID); response.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a hidden user not found by others, got %d: %s", response.StatusCode, response.Body)
+	}
+	if _, response := getPublic("a@example.com", playerID); response.StatusCode != http.StatusOK {
+		t.Errorf("expected a hidden user to find themselves, got %d: %s", response.StatusCode, response.Body)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"pickupgamesapi/types"
+	"sync"
+	"time"
+)
+
+const (
+	maxVerificationAttempts = 5
+	maxVerificationSends    = 5
+	passwordResetCodeTTL    = 15 * time.Minute
+	attributeCodeTTL        = 24 * time.Hour
+)
+
+var (
+	errVerificationCodeNotFound = errors.New("verification code not found")
+	errVerificationCodeInvalid  = types.NewValidationError("verification_code_invalid", "verification code is invalid or has expired")
+)
+
+// VerificationPurpose is what a verification code unlocks
+type VerificationPurpose string
+
+const (
+	VerificationPurposePasswordReset VerificationPurpose = "password_reset"
+	VerificationPurposeEmail         VerificationPurpose = "email"
+	VerificationPurposePhoneNumber   VerificationPurpose = "phone_number"
+)
+
+// VerificationCode is an outstanding code for one email and purpose. Only a hash of the code is
+// stored; a new code for the same email and purpose replaces the old one. Attempts and Sends carry
+// over to a code issued before the one it replaces expires, so asking for a new code never earns
+// more guesses.
+type VerificationCode struct {
+	Email     string              `dynamodbav:"Email"`
+	Purpose   VerificationPurpose `dynamodbav:"Purpose"`
+	CodeHash  string              `dynamodbav:"CodeHash"`
+	ExpiresAt int64               `dynamodbav:"ExpiresAt"` // Unix timestamp, also the DynamoDB TTL attribute
+	Attempts  int                 `dynamodbav:"Attempts"`
+	Sends     int                 `dynamodbav:"Sends"`
+}
+
+// reissue is code replacing previous, the outstanding code for the same email and purpose. It
+// returns false when previous is locked, out of attempts or sends, and no new code should be sent
+// until it expires.
+func (c VerificationCode) reissue(previous VerificationCode, now time.Time) (VerificationCode, bool) {
+	if now.Unix() <= previous.ExpiresAt {
+		if previous.Attempts >= maxVerificationAttempts || previous.Sends >= maxVerificationSends {
+			return VerificationCode{}, false
+		}
+		c.Attempts = previous.Attempts
+		c.Sends = previous.Sends
+	}
+	c.Sends++
+	return c, true
+}
+
+// VerificationCodeStore persists outstanding verification codes
+type VerificationCodeStore interface {
+	// PutVerificationCode saves code, replacing any outstanding code for the same email and purpose
+	PutVerificationCode(ctx context.Context, code VerificationCode) error
+	// GetVerificationCode returns the outstanding code or errVerificationCodeNotFound
+	GetVerificationCode(ctx context.Context, email string, purpose VerificationPurpose) (VerificationCode, error)
+	// RecordFailedAttempt increments the code's attempt count
+	RecordFailedAttempt(ctx context.Context, email string, purpose VerificationPurpose) error
+	// DeleteVerificationCode removes the outstanding code, if any
+	DeleteVerificationCode(ctx context.Context, email string, purpose VerificationPurpose) error
+}
+
+// newVerificationCode generates a six digit code, returning it along with the record to store
+func newVerificationCode(email string, purpose VerificationPurpose, ttl time.Duration, now time.Time) (string, VerificationCode, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", VerificationCode{}, fmt.Errorf("failed to generate verification code: %w", err)
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	return code, VerificationCode{
+		Email:     normalizeEmail(email),
+		Purpose:   purpose,
+		CodeHash:  hashVerificationCode(email, purpose, code),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}, nil
+}
+
+// hashVerificationCode binds the code to its email and purpose so a code can't be replayed elsewhere
+func hashVerificationCode(email string, purpose VerificationPurpose, code string) string {
+	sum := sha256.Sum256([]byte(normalizeEmail(email) + "|" + string(purpose) + "|" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkVerificationCode consumes the outstanding code if it matches and hasn't expired by now,
+// counting failed attempts towards maxVerificationAttempts. A code that's run out of attempts is
+// kept until it expires, so the count can't be reset by asking for another.
+func checkVerificationCode(ctx context.Context, store VerificationCodeStore, email string, purpose VerificationPurpose, code string, now time.Time) error {
+	email = normalizeEmail(email)
+	storedCode, err := store.GetVerificationCode(ctx, email, purpose)
+	if errors.Is(err, errVerificationCodeNotFound) {
+		return errVerificationCodeInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if now.Unix() > storedCode.ExpiresAt {
+		if err := store.DeleteVerificationCode(ctx, email, purpose); err != nil {
+			return err
+		}
+		return errVerificationCodeInvalid
+	}
+	if storedCode.Attempts >= maxVerificationAttempts {
+		return errVerificationCodeInvalid
+	}
+	codeHash := hashVerificationCode(email, purpose, code)
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(storedCode.CodeHash)) != 1 {
+		if err := store.RecordFailedAttempt(ctx, email, purpose); err != nil {
+			return err
+		}
+		return errVerificationCodeInvalid
+	}
+	return store.DeleteVerificationCode(ctx, email, purpose)
+}
+
+// MemoryVerificationCodeStore is an in-process VerificationCodeStore
+type MemoryVerificationCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]VerificationCode
+}
+
+func NewMemoryVerificationCodeStore() *MemoryVerificationCodeStore {
+	return &MemoryVerificationCodeStore{
+		codes: map[string]VerificationCode{},
+	}
+}
+
+func verificationCodeKey(email string, purpose VerificationPurpose) string {
+	return normalizeEmail(email) + "#" + string(purpose)
+}
+
+func (s *MemoryVerificationCodeStore) PutVerificationCode(ctx context.Context, code VerificationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[verificationCodeKey(code.Email, code.Purpose)] = code
+	return nil
+}
+
+func (s *MemoryVerificationCodeStore) GetVerificationCode(ctx context.Context, email string, purpose VerificationPurpose) (VerificationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.codes[verificationCodeKey(email, purpose)]
+	if !ok {
+		return VerificationCode{}, errVerificationCodeNotFound
+	}
+	return code, nil
+}
+
+func (s *MemoryVerificationCodeStore) RecordFailedAttempt(ctx context.Context, email string, purpose VerificationPurpose) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := verificationCodeKey(email, purpose)
+	if code, ok := s.codes[key]; ok {
+		code.Attempts++
+		s.codes[key] = code
+	}
+	return nil
+}
+
+func (s *MemoryVerificationCodeStore) DeleteVerificationCode(ctx context.Context, email string, purpose VerificationPurpose) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.codes, verificationCodeKey(email, purpose))
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBVerificationCodeStore is a VerificationCodeStore backed by a DynamoDB table keyed on
+// CodeKey (email#purpose). ExpiresAt should be configured as the table's TTL attribute.
+type DynamoDBVerificationCodeStore struct {
+	Client    *dynamodb.Client
+	TableName string
+}
+
+func NewDynamoDBVerificationCodeStore(client *dynamodb.Client, tableName string) *DynamoDBVerificationCodeStore {
+	return &DynamoDBVerificationCodeStore{
+		Client:    client,
+		TableName: tableName,
+	}
+}
+
+func verificationCodeItemKey(email string, purpose VerificationPurpose) map[string]ddbtypes.AttributeValue {
+	return map[string]ddbtypes.AttributeValue{
+		"CodeKey": &ddbtypes.AttributeValueMemberS{Value: verificationCodeKey(email, purpose)},
+	}
+}
+
+func (s *DynamoDBVerificationCodeStore) PutVerificationCode(ctx context.Context, code VerificationCode) error {
+	item, err := attributevalue.MarshalMap(code)
+	if err != nil {
+		return fmt.Errorf("failed to marshal verification code: %w", err)
+	}
+	item["CodeKey"] = verificationCodeItemKey(code.Email, code.Purpose)["CodeKey"]
+	_, err = s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.TableName,
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put verification code to DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
+
+func (s *DynamoDBVerificationCodeStore) GetVerificationCode(ctx context.Context, email string, purpose VerificationPurpose) (VerificationCode, error) {
+	getItemOutput, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &s.TableName,
+		Key:            verificationCodeItemKey(email, purpose),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return VerificationCode{}, fmt.Errorf("failed to get verification code from DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	if getItemOutput.Item == nil {
+		return VerificationCode{}, errVerificationCodeNotFound
+	}
+	var code VerificationCode
+	if err := attributevalue.UnmarshalMap(getItemOutput.Item, &code); err != nil {
+		return VerificationCode{}, fmt.Errorf("failed to unmarshal verification code: %w", err)
+	}
+	return code, nil
+}
+
+func (s *DynamoDBVerificationCodeStore) RecordFailedAttempt(ctx context.Context, email string, purpose VerificationPurpose) error {
+	_, err := s.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &s.TableName,
+		Key:                 verificationCodeItemKey(email, purpose),
+		UpdateExpression:    aws.String("ADD Attempts :one"),
+		ConditionExpression: aws.String("attribute_exists(CodeKey)"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":one": &ddbtypes.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	if err != nil {
+		var conditionalCheckFailed *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailed) {
+			// the code was consumed or replaced concurrently
+			return nil
+		}
+		return fmt.Errorf("failed to update verification code in DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
+
+func (s *DynamoDBVerificationCodeStore) DeleteVerificationCode(ctx context.Context, email string, purpose VerificationPurpose) error {
+	_, err := s.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &s.TableName,
+		Key:       verificationCodeItemKey(email, purpose),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete verification code from DynamoDB: %w", upstreamError("DynamoDB", err))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SQLVerificationCodeStore is a VerificationCodeStore backed by SQLite or Postgres
+type SQLVerificationCodeStore struct {
+	db *sql.DB
+}
+
+func NewSQLVerificationCodeStore(db *sql.DB) *SQLVerificationCodeStore {
+	return &SQLVerificationCodeStore{
+		db: db,
+	}
+}
+
+func (s *SQLVerificationCodeStore) PutVerificationCode(ctx context.Context, code VerificationCode) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO verification_codes (email, purpose, code_hash, expires_at, attempts, sends)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (email, purpose) DO UPDATE SET code_hash = excluded.code_hash, expires_at = excluded.expires_at,
+			attempts = excluded.attempts, sends = excluded.sends`,
+		normalizeEmail(code.Email), code.Purpose, code.CodeHash, code.ExpiresAt, code.Attempts, code.Sends)
+	if err != nil {
+		return fmt.Errorf("failed to save verification code: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLVerificationCodeStore) GetVerificationCode(ctx context.Context, email string, purpose VerificationPurpose) (VerificationCode, error) {
+	var code VerificationCode
+	err := s.db.QueryRowContext(ctx, `SELECT email, purpose, code_hash, expires_at, attempts, sends FROM verification_codes
+		WHERE email = $1 AND purpose = $2`, normalizeEmail(email), purpose).
+		Scan(&code.Email, &code.Purpose, &code.CodeHash, &code.ExpiresAt, &code.Attempts, &code.Sends)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VerificationCode{}, errVerificationCodeNotFound
+	}
+	if err != nil {
+		return VerificationCode{}, fmt.Errorf("failed to get verification code: %w", err)
+	}
+	return code, nil
+}
+
+func (s *SQLVerificationCodeStore) RecordFailedAttempt(ctx context.Context, email string, purpose VerificationPurpose) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE verification_codes SET attempts = attempts + 1 WHERE email = $1 AND purpose = $2`,
+		normalizeEmail(email), purpose)
+	if err != nil {
+		return fmt.Errorf("failed to update verification code: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLVerificationCodeStore) DeleteVerificationCode(ctx context.Context, email string, purpose VerificationPurpose) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM verification_codes WHERE email = $1 AND purpose = $2`, normalizeEmail(email), purpose)
+	if err != nil {
+		return fmt.Errorf("failed to delete verification code: %w", err)
+	}
+	return nil
+}
@@ -4,9 +4,16 @@ import * as cdk from 'aws-cdk-lib';
 import { PickupApiStack } from '../lib/pickup-api-stack';
 
 const app = new cdk.App();
+// the address players get verification codes and game notices from, given with
+// `cdk deploy -c notificationEmailFrom=...`
+const notificationEmailFrom = app.node.tryGetContext('notificationEmailFrom');
+if (!notificationEmailFrom) {
+  throw new Error('set the notificationEmailFrom context value to the address notifications are sent from');
+}
 new PickupApiStack(app, 'PickupApiStack', {
   // provide the bucket name to which built artifacts are uploaded --bucket created outside of the stack previously
   pickupGamesDeploymentBucketName: "pickupgames-api-artifacts",
+  notificationEmailFrom: notificationEmailFrom,
   /* If you don't specify 'env', this stack will be environment-agnostic.
    * Account/Region-dependent features and context lookups will not work,
    * but a single synthesized template can be deployed anywhere. */
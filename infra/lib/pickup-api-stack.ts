@@ -9,9 +9,16 @@ import * as apigateway from "aws-cdk-lib/aws-apigatewayv2";
 import * as apigatewayintegrations from "aws-cdk-lib/aws-apigatewayv2-integrations";
 import * as apigwauth from "aws-cdk-lib/aws-apigatewayv2-authorizers";
 import * as s3 from "aws-cdk-lib/aws-s3";
+import * as events from "aws-cdk-lib/aws-events";
+import * as targets from "aws-cdk-lib/aws-events-targets";
+import * as secretsmanager from "aws-cdk-lib/aws-secretsmanager";
+import * as iam from "aws-cdk-lib/aws-iam";
+import * as ses from "aws-cdk-lib/aws-ses";
 
 export interface PickupApiStackProps extends cdk.StackProps {
   readonly pickupGamesDeploymentBucketName: string;
+  // the address verification codes and game notices are emailed from, verified with SES by the stack
+  readonly notificationEmailFrom: string;
 }
 
 export class PickupApiStack extends cdk.Stack {
@@ -48,6 +55,79 @@ export class PickupApiStack extends cdk.Stack {
       partitionKey: { name: "Category", type: dynamodb.AttributeType.STRING },
       sortKey: { name: "StartTime", type: dynamodb.AttributeType.NUMBER },
     });
+    // occurrences of a recurring series
+    pickupGamesTable.addGlobalSecondaryIndex({
+      indexName: "SeriesIndex",
+      partitionKey: { name: "SeriesID", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "StartTime", type: dynamodb.AttributeType.NUMBER },
+    });
+    const gameSeriesTable = new dynamodb.Table(this, "GameSeries", {
+      partitionKey: { name: "SeriesID", type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+    // games near a location, by the geohash cell they're in
+    pickupGamesTable.addGlobalSecondaryIndex({
+      indexName: "GeohashIndex",
+      partitionKey: { name: "GeohashCell", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "StartTime", type: dynamodb.AttributeType.NUMBER },
+    });
+    // games a user owns
+    pickupGamesTable.addGlobalSecondaryIndex({
+      indexName: "OwnerIndex",
+      partitionKey: { name: "Owner", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "StartTime", type: dynamodb.AttributeType.NUMBER },
+    });
+    // the roster or waitlist each player is on for each game, kept in step with the games table
+    const gameMembershipsTable = new dynamodb.Table(this, "GameMemberships", {
+      partitionKey: { name: "Player", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "GameID", type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+    gameMembershipsTable.addGlobalSecondaryIndex({
+      indexName: "PlayerStartTimeIndex",
+      partitionKey: { name: "Player", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "StartTime", type: dynamodb.AttributeType.NUMBER },
+    });
+    const userProfilesTable = new dynamodb.Table(this, "UserProfiles", {
+      partitionKey: { name: "UserID", type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+    // public profiles are looked up by player ID rather than email
+    userProfilesTable.addGlobalSecondaryIndex({
+      indexName: "PlayerIDIndex",
+      partitionKey: { name: "PlayerID", type: dynamodb.AttributeType.STRING },
+    });
+    // games with a waitlist offer or payment hold that runs out, soonest first
+    pickupGamesTable.addGlobalSecondaryIndex({
+      indexName: "HoldExpiryIndex",
+      partitionKey: { name: "HoldIndexKey", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "NextHoldExpiry", type: dynamodb.AttributeType.NUMBER },
+    });
+    // charges and refunds for each game, along with the payment webhook events received
+    const paymentLedgerTable = new dynamodb.Table(this, "PaymentLedger", {
+      partitionKey: { name: "GameID", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "EntryID", type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+    // a user's payments across every game, for account export and deletion
+    paymentLedgerTable.addGlobalSecondaryIndex({
+      indexName: "UserIndex",
+      partitionKey: { name: "UserID", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "CreatedAt", type: dynamodb.AttributeType.NUMBER },
+    });
+    // password reset and verification codes, keyed on email#purpose and removed by TTL once they expire
+    const verificationCodesTable = new dynamodb.Table(this, "VerificationCodes", {
+      partitionKey: { name: "CodeKey", type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      timeToLiveAttribute: "ExpiresAt",
+    });
+    // player IDs are derived from this key, so every Lambda instance has to share it
+    const playerIDKey = new secretsmanager.Secret(this, "PlayerIDKey", {
+      generateSecretString: { passwordLength: 64, excludePunctuation: true },
+    });
+    // the payment provider's webhook signing secret, to be set to the provider's value after the
+    // first deploy. The Lambda reads it when an instance starts, so new instances pick up changes.
+    const paymentWebhookSecret = new secretsmanager.Secret(this, "PaymentWebhookSecret");
     // TODO: Better to have the artifacts uploaded and pulled from the bucket, but that requires a bit more work and I'd rather dedicate the time to more important features
     // Go Lambda responsible for all auth actions
     const gameAuthLambda = new lambda.Function(this, "GameAuthLambda", {
@@ -56,12 +136,50 @@ export class PickupApiStack extends cdk.Stack {
       code: lambda.Code.fromAsset("../lambda/out/bin/pickupgamesapi.zip"),
       environment: {
         PICKUP_GAMES_TABLE: pickupGamesTable.tableName,
+        GAME_MEMBERSHIPS_TABLE: gameMembershipsTable.tableName,
+        GAME_SERIES_TABLE: gameSeriesTable.tableName,
+        VERIFICATION_CODES_TABLE: verificationCodesTable.tableName,
+        USER_PROFILES_TABLE: userProfilesTable.tableName,
+        PAYMENT_LEDGER_TABLE: paymentLedgerTable.tableName,
+        // no real provider exists yet, signup fees are recorded without moving any money
+        PAYMENT_PROVIDER: "fake",
+        // emails go out through SES and texts through SNS
+        NOTIFIER_EMAIL_FROM: props.notificationEmailFrom,
+        // the secrets are read from Secrets Manager rather than kept in the Lambda's configuration
+        PAYMENT_WEBHOOK_SECRET_ARN: paymentWebhookSecret.secretArn,
+        PLAYER_ID_KEY_ARN: playerIDKey.secretArn,
         USER_POOL_ID: userPool.userPoolId,
         CLIENT_ID: userPoolClient.userPoolClientId,
       },
-      timeout: cdk.Duration.seconds(4),
+      // long enough for the scheduled jobs, API Gateway still gives up on requests after 30 seconds
+      timeout: cdk.Duration.seconds(30),
     });
     pickupGamesTable.grantReadWriteData(gameAuthLambda);
+    gameMembershipsTable.grantReadWriteData(gameAuthLambda);
+    gameSeriesTable.grantReadWriteData(gameAuthLambda);
+    verificationCodesTable.grantReadWriteData(gameAuthLambda);
+    userProfilesTable.grantReadWriteData(gameAuthLambda);
+    paymentLedgerTable.grantReadWriteData(gameAuthLambda);
+    playerIDKey.grantRead(gameAuthLambda);
+    paymentWebhookSecret.grantRead(gameAuthLambda);
+    // SES only sends from the address once its owner follows the link in the email it's sent, and
+    // only to verified addresses until the account is moved out of the SES sandbox
+    new ses.EmailIdentity(this, "NotificationEmailIdentity", {
+      identity: ses.Identity.email(props.notificationEmailFrom),
+    });
+    gameAuthLambda.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: ["ses:SendEmail"],
+        resources: [this.formatArn({ service: "ses", resource: "identity", resourceName: "*" })],
+      })
+    );
+    // texts are published straight to phone numbers, which have no ARN to scope this to
+    gameAuthLambda.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: ["sns:Publish"],
+        resources: ["*"],
+      })
+    );
 
     // create API Gateway integration
     const pickupGamesAuthLambdaIntegration =
@@ -90,6 +208,28 @@ export class PickupApiStack extends cdk.Stack {
       userPoolAuthorizer
     );
     userPool.grant(gameAuthLambda, "cognito-idp:Admin*");
+    // offers and payment holds have to run out on time even when no requests arrive
+    this.scheduleJob(gameAuthLambda, "expire-holds", events.Schedule.rate(cdk.Duration.minutes(1)));
+    // open ended series keep their games eight weeks ahead
+    this.scheduleJob(gameAuthLambda, "materialize-series", events.Schedule.rate(cdk.Duration.days(1)));
+    // memberships are written on a best-effort basis, so any a failed write left out are repaired daily
+    this.scheduleJob(gameAuthLambda, "backfill-memberships", events.Schedule.rate(cdk.Duration.days(1)));
+  }
+
+  // helper function to run one of the Lambda's background jobs on a schedule
+  scheduleJob(handler: lambda.Function, job: string, schedule: events.Schedule) {
+    const ruleID = job
+      .split("-")
+      .map((word) => word.charAt(0).toUpperCase() + word.slice(1))
+      .join("");
+    new events.Rule(this, `${ruleID}Schedule`, {
+      schedule: schedule,
+      targets: [
+        new targets.LambdaFunction(handler, {
+          event: events.RuleTargetInput.fromObject({ job: job }),
+        }),
+      ],
+    });
   }
 
   // helper function to convert string to HttpMethod